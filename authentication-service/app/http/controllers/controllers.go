@@ -1,24 +1,39 @@
 package controllers
 
 import (
+	"context"
 	"database/sql"
 	"errors"
+	"math"
+	"net"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
+	"github.com/bstaijen/mariadb-for-microservices/authentication-service/app/lockout"
 	"github.com/bstaijen/mariadb-for-microservices/authentication-service/app/models"
+	"github.com/bstaijen/mariadb-for-microservices/authentication-service/app/twofactor"
 	"github.com/bstaijen/mariadb-for-microservices/authentication-service/config"
 	"github.com/bstaijen/mariadb-for-microservices/authentication-service/database"
+	"github.com/bstaijen/mariadb-for-microservices/shared/apierror"
+	"github.com/bstaijen/mariadb-for-microservices/shared/ipc"
+	"github.com/bstaijen/mariadb-for-microservices/shared/jwks"
+	sharedModels "github.com/bstaijen/mariadb-for-microservices/shared/models"
+	"github.com/bstaijen/mariadb-for-microservices/shared/session"
 	"github.com/bstaijen/mariadb-for-microservices/shared/util"
+	"github.com/bstaijen/mariadb-for-microservices/shared/util/middleware"
 
-	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/gorilla/mux"
 	"github.com/urfave/negroni"
 	"golang.org/x/crypto/bcrypt"
 )
 
-// LoginHandler validates the user and returns a JWT token
-func LoginHandler(connection *sql.DB, cnf config.Config) negroni.HandlerFunc {
+// LoginHandler validates the user and returns a JWT access token and a refresh token. The failed logins of every
+// account and IP address are counted, after too many of them the login has to wait or is locked.
+func LoginHandler(connection *sql.DB, cnf config.Config, keys *jwks.Set) negroni.HandlerFunc {
+	store := session.NewStore(connection, cnf.RefreshTokenLifetime)
+	guard := loginGuard(connection, cnf)
 	return negroni.HandlerFunc(func(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
 		type Login struct {
 			Username string `json:"username"`
@@ -38,51 +53,685 @@ func LoginHandler(connection *sql.DB, cnf config.Config) negroni.HandlerFunc {
 			return
 		}
 
-		// authenticate the username password combination
-		usr, err := authenticate(connection, login.Username, login.Password)
+		// Refuse the attempt while the account or the address has to wait
+		account := strings.ToLower(login.Username)
+		address := clientAddress(r)
+		if !attemptLogin(w, r, guard, account, address) {
+			return
+		}
+
+		// authenticate the username password combination, a wrong password stays counted as a failure
+		usr, err := authenticate(r.Context(), connection, login.Username, login.Password)
+		if err != nil {
+			if err != ErrInvalidCredentials {
+				releaseLogin(r, guard, account, address)
+			}
+			util.SendError(w, err)
+			return
+		}
+
+		user := *usr
+		user.Password = "" // trick to prevent password from leaking to client
+
+		// With two-factor authentication the password only earns a challenge, see TwoFactorLoginHandler. The failures
+		// of the account are kept until the code is right, so the password can't reset the guessing of codes.
+		twoFactor, err := db.GetTwoFactor(r.Context(), connection, user.ID)
+		if err != nil {
+			releaseLogin(r, guard, account, address)
+			util.SendError(w, err)
+			return
+		}
+		if twoFactor.Enabled {
+			releaseLogin(r, guard, account, address)
+			sendChallenge(w, r, connection, keys, user.ID)
+			return
+		}
+		if err := guard.Succeed(r.Context(), account, address); err != nil {
+			util.SendError(w, err)
+			return
+		}
+
+		refreshToken, err := store.Issue(r.Context(), user.ID)
+		if err != nil {
+			util.SendError(w, err)
+			return
+		}
+		sendTokens(w, r, connection, cnf, keys, user, refreshToken)
+	})
+}
+
+// TwoFactorLoginHandler completes the login of a user with two-factor authentication. It exchanges the challenge
+// token from LoginHandler and a TOTP code or a recovery code for a JWT access token and a refresh token. A wrong code
+// is a failed login of the account, like a wrong password.
+func TwoFactorLoginHandler(connection *sql.DB, cnf config.Config, keys *jwks.Set) negroni.HandlerFunc {
+	store := session.NewStore(connection, cnf.RefreshTokenLifetime)
+	guard := loginGuard(connection, cnf)
+	return negroni.HandlerFunc(func(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+		type TwoFactorLogin struct {
+			ChallengeToken string `json:"challenge_token"`
+			Code           string `json:"code"`
+		}
+		login := &TwoFactorLogin{}
+
+		err := util.RequestToJSON(r, login)
+		if err != nil {
+			util.SendBadRequest(w, errors.New("Bad json"))
+			return
+		}
+		if len(login.ChallengeToken) < 1 || len(login.Code) < 1 {
+			util.SendBadRequest(w, errors.New("Please provide challenge_token and code in the body"))
+			return
+		}
+
+		challenge, err := twofactor.ParseChallenge(r.Context(), keys, login.ChallengeToken)
+		if err != nil {
+			util.Log(r.Context()).Infof("Rejected challenge: %v", err)
+			util.SendError(w, ErrInvalidChallenge)
+			return
+		}
+		userID := challenge.UserID
+
+		// Every code counts, so a challenge is used up after a few wrong ones
+		ok, err := db.AttemptTwoFactorChallenge(r.Context(), connection, challenge.ID, userID, twofactor.ChallengeAttempts)
+		if err != nil {
+			util.SendError(w, err)
+			return
+		}
+		if !ok {
+			util.SendError(w, ErrInvalidChallenge)
+			return
+		}
+		user, err := db.GetUserByID(r.Context(), connection, userID)
+		if err != nil {
+			util.SendError(w, err)
+			return
+		}
+
+		account := strings.ToLower(user.Username)
+		address := clientAddress(r)
+		if !attemptLogin(w, r, guard, account, address) {
+			return
+		}
+		twoFactor, err := db.GetTwoFactor(r.Context(), connection, userID)
+		if err != nil {
+			releaseLogin(r, guard, account, address)
+			util.SendError(w, err)
+			return
+		}
+		if !twoFactor.Enabled {
+			releaseLogin(r, guard, account, address)
+			util.SendError(w, ErrInvalidChallenge)
+			return
+		}
+		if err := verifyCode(r.Context(), connection, twoFactor, login.Code); err != nil {
+			if err != ErrInvalidCode {
+				releaseLogin(r, guard, account, address)
+			}
+			util.SendError(w, err)
+			return
+		}
+		// A concurrent login with the same challenge loses here
+		used, err := db.UseTwoFactorChallenge(r.Context(), connection, challenge.ID)
+		if err != nil {
+			releaseLogin(r, guard, account, address)
+			util.SendError(w, err)
+			return
+		}
+		if !used {
+			releaseLogin(r, guard, account, address)
+			util.SendError(w, ErrInvalidChallenge)
+			return
+		}
+		if err := guard.Succeed(r.Context(), account, address); err != nil {
+			util.SendError(w, err)
+			return
+		}
+
+		refreshToken, err := store.Issue(r.Context(), user.ID)
+		if err != nil {
+			util.SendError(w, err)
+			return
+		}
+		sendTokens(w, r, connection, cnf, keys, user, refreshToken)
+	})
+}
+
+// EnrollTwoFactorHandler starts the two-factor authentication of the user of the request. It returns a new TOTP
+// secret and its otpauth:// URI for the authenticator app. The secret is only used after ConfirmTwoFactorHandler.
+func EnrollTwoFactorHandler(connection *sql.DB, cnf config.Config) negroni.HandlerFunc {
+	return negroni.HandlerFunc(func(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+		principal, _ := middleware.UserFromContext(r.Context())
+		user, err := db.GetUserByID(r.Context(), connection, principal.ID)
+		if err != nil {
+			util.SendError(w, err)
+			return
+		}
+
+		secret, uri, err := twofactor.NewSecret(cnf.TOTPIssuer, user.Username)
+		if err != nil {
+			util.SendError(w, err)
+			return
+		}
+		if err := db.SaveTwoFactorSecret(r.Context(), connection, user.ID, secret); err != nil {
+			util.SendError(w, err)
+			return
+		}
+
+		type Enrollment struct {
+			Secret string `json:"secret"`
+			URI    string `json:"uri"`
+		}
+		util.SendOK(w, &Enrollment{Secret: secret, URI: uri})
+	})
+}
+
+// ConfirmTwoFactorHandler enables the two-factor authentication of the user of the request with a code of the
+// authenticator app, which proves that the app was set up. It returns the recovery codes, which are only shown once.
+func ConfirmTwoFactorHandler(connection *sql.DB) negroni.HandlerFunc {
+	return negroni.HandlerFunc(func(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+		code, ok := readCode(w, r)
+		if !ok {
+			return
+		}
+
+		principal, _ := middleware.UserFromContext(r.Context())
+		twoFactor, err := db.GetTwoFactor(r.Context(), connection, principal.ID)
+		if err != nil {
+			util.SendError(w, err)
+			return
+		}
+		if twoFactor.Enabled {
+			util.SendError(w, db.ErrTwoFactorEnabled)
+			return
+		}
+		if twoFactor.Secret == "" {
+			util.SendError(w, ErrTwoFactorNotEnrolled)
+			return
+		}
+
+		step, ok := twofactor.Validate(twoFactor.Secret, code, time.Now(), twoFactor.LastStep)
+		if !ok {
+			util.SendError(w, ErrInvalidCode)
+			return
+		}
+		codes, hashes, err := twofactor.NewRecoveryCodes()
+		if err != nil {
+			util.SendError(w, err)
+			return
+		}
+		if err := db.EnableTwoFactor(r.Context(), connection, principal.ID, step, hashes); err != nil {
+			util.SendError(w, err)
+			return
+		}
+
+		type RecoveryCodes struct {
+			RecoveryCodes []string `json:"recovery_codes"`
+		}
+		util.SendOK(w, &RecoveryCodes{RecoveryCodes: codes})
+	})
+}
+
+// DisableTwoFactorHandler disables the two-factor authentication of the user of the request. It asks for a TOTP code
+// or a recovery code, so a stolen access token alone can't disable it.
+func DisableTwoFactorHandler(connection *sql.DB) negroni.HandlerFunc {
+	return negroni.HandlerFunc(func(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+		code, ok := readCode(w, r)
+		if !ok {
+			return
+		}
+
+		principal, _ := middleware.UserFromContext(r.Context())
+		twoFactor, err := db.GetTwoFactor(r.Context(), connection, principal.ID)
+		if err != nil {
+			util.SendError(w, err)
+			return
+		}
+		if !twoFactor.Enabled {
+			util.SendError(w, ErrTwoFactorNotEnrolled)
+			return
+		}
+		if err := verifyCode(r.Context(), connection, twoFactor, code); err != nil {
+			util.SendError(w, err)
+			return
+		}
+		if err := db.DeleteTwoFactor(r.Context(), connection, principal.ID); err != nil {
+			util.SendError(w, err)
+			return
+		}
+		util.SendOKMessage(w, "Two-factor authentication disabled")
+	})
+}
+
+// readCode reads the code from the body of r. It sends a bad request and returns false when there is none.
+func readCode(w http.ResponseWriter, r *http.Request) (string, bool) {
+	type Code struct {
+		Code string `json:"code"`
+	}
+	code := &Code{}
+
+	if err := util.RequestToJSON(r, code); err != nil {
+		util.SendBadRequest(w, errors.New("Bad json"))
+		return "", false
+	}
+	if len(code.Code) < 1 {
+		util.SendBadRequest(w, errors.New("Please provide code in the body"))
+		return "", false
+	}
+	return code.Code, true
+}
+
+// verifyCode checks code, a TOTP code or a recovery code, of the user of twoFactor and marks it as used.
+func verifyCode(ctx context.Context, connection *sql.DB, twoFactor models.TwoFactor, code string) error {
+	if twofactor.IsRecoveryCode(code) {
+		ok, err := db.UseRecoveryCode(ctx, connection, twoFactor.UserID, twofactor.HashRecoveryCode(code))
 		if err != nil {
+			return err
+		}
+		if !ok {
+			return ErrInvalidCode
+		}
+		return nil
+	}
+
+	step, ok := twofactor.Validate(twoFactor.Secret, code, time.Now(), twoFactor.LastStep)
+	if !ok {
+		return ErrInvalidCode
+	}
+	// A concurrent login with the same code loses here
+	ok, err := db.UseTwoFactorStep(ctx, connection, twoFactor.UserID, step)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrInvalidCode
+	}
+	return nil
+}
+
+// loginGuard returns the guard of the logins with the lockout policies of cnf.
+func loginGuard(connection *sql.DB, cnf config.Config) *lockout.Guard {
+	return lockout.NewGuard(db.LoginFailures(connection),
+		lockout.Policy{MaxFailures: cnf.LoginMaxFailures, Duration: cnf.LoginLockout},
+		lockout.Policy{MaxFailures: cnf.LoginMaxFailuresIP, Duration: cnf.LoginLockout},
+	)
+}
+
+// attemptLogin counts a login to account from address with guard. It sends ErrLoginLocked and returns false when the
+// account or the address has to wait.
+func attemptLogin(w http.ResponseWriter, r *http.Request, guard *lockout.Guard, account string, address string) bool {
+	retryAfter, err := guard.Attempt(r.Context(), account, address)
+	if err != nil {
+		util.SendError(w, err)
+		return false
+	}
+	if retryAfter > 0 {
+		util.Log(r.Context()).Warnf("Login of %v from %v refused for %v", account, address, retryAfter)
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+		util.SendError(w, ErrLoginLocked)
+		return false
+	}
+	return true
+}
+
+// releaseLogin takes back the failure counted by attemptLogin for a login which didn't fail.
+func releaseLogin(r *http.Request, guard *lockout.Guard, account string, address string) {
+	if err := guard.Release(r.Context(), account, address); err != nil {
+		util.Log(r.Context()).Errorf("Can not release a login: %v", err)
+	}
+}
+
+// sendChallenge stores and sends a challenge token for the user with userID, signed with the signing key of keys.
+func sendChallenge(w http.ResponseWriter, r *http.Request, connection *sql.DB, keys *jwks.Set, userID int) {
+	token, challenge, err := twofactor.NewChallenge(keys.SigningKey(), userID)
+	if err != nil {
+		util.SendError(w, err)
+		return
+	}
+	if err := db.CreateTwoFactorChallenge(r.Context(), connection, challenge.ID, userID, challenge.ExpiresAt); err != nil {
+		util.SendError(w, err)
+		return
+	}
+	util.SendOK(w, &models.Challenge{
+		TwoFactorRequired: true,
+		ChallengeToken:    token,
+		ExpiresOn:         strconv.FormatInt(challenge.ExpiresAt.Unix(), 10),
+	})
+}
+
+// RefreshHandler exchanges a refresh token for a new access token and a new refresh token. The refresh token in the
+// request can't be used again.
+func RefreshHandler(connection *sql.DB, cnf config.Config, keys *jwks.Set) negroni.HandlerFunc {
+	store := session.NewStore(connection, cnf.RefreshTokenLifetime)
+	return negroni.HandlerFunc(func(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+		type Refresh struct {
+			RefreshToken string `json:"refresh_token"`
+		}
+		refresh := &Refresh{}
+
+		err := util.RequestToJSON(r, refresh)
+		if err != nil {
+			util.SendBadRequest(w, errors.New("Bad json"))
+			return
+		}
+		if len(refresh.RefreshToken) < 1 {
+			util.SendBadRequest(w, errors.New("Please provide refresh_token in the body"))
+			return
+		}
+
+		refreshToken, err := store.Rotate(r.Context(), refresh.RefreshToken)
+		if err == session.ErrRefreshTokenReused {
+			util.Log(r.Context()).Warn("Refresh token reused, revoked its session")
+		}
+		if err != nil {
+			util.SendError(w, err)
+			return
+		}
+
+		user, err := db.GetUserByID(r.Context(), connection, refreshToken.UserID)
+		if err == db.ErrUserNotFound {
+			util.SendError(w, session.ErrInvalidRefreshToken)
+			return
+		}
+		if err != nil {
+			util.SendError(w, err)
+			return
+		}
+		sendTokens(w, r, connection, cnf, keys, user, refreshToken)
+	})
+}
+
+// LogoutHandler revokes the access token of the request and, when the body contains its refresh_token, the session
+// the refresh token belongs to.
+func LogoutHandler(connection *sql.DB, cnf config.Config) negroni.HandlerFunc {
+	store := session.NewStore(connection, cnf.RefreshTokenLifetime)
+	return negroni.HandlerFunc(func(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+		type Logout struct {
+			RefreshToken string `json:"refresh_token"`
+		}
+		logout := &Logout{}
+
+		// The body is optional, a client which lost its refresh token can still revoke its access token.
+		if r.ContentLength != 0 {
+			if err := util.RequestToJSON(r, logout); err != nil {
+				util.SendBadRequest(w, errors.New("Bad json"))
+				return
+			}
+		}
+
+		user, _ := middleware.UserFromContext(r.Context())
+		if err := db.RevokeToken(r.Context(), connection, user.ID, user.TokenID, user.ExpiresAt); err != nil {
+			util.SendError(w, err)
+			return
+		}
+		if len(logout.RefreshToken) > 0 {
+			if err := store.Revoke(r.Context(), user.ID, logout.RefreshToken); err != nil {
+				util.SendError(w, err)
+				return
+			}
+		}
+		util.SendOKMessage(w, "Logged out")
+	})
+}
+
+// LogoutAllHandler logs the user of the request out everywhere: every access token issued before is revoked and
+// every session is ended.
+func LogoutAllHandler(connection *sql.DB, cnf config.Config) negroni.HandlerFunc {
+	store := session.NewStore(connection, cnf.RefreshTokenLifetime)
+	return negroni.HandlerFunc(func(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+		user, _ := middleware.UserFromContext(r.Context())
+		if err := revokeSessions(r.Context(), connection, store, user.ID); err != nil {
+			util.SendError(w, err)
+			return
+		}
+		util.SendOKMessage(w, "Logged out everywhere")
+	})
+}
+
+// IPCRevokeSessions is a handler which logs users out everywhere for the profile service, e.g. after their password
+// was changed. The request expects a json object in the following format: {"requests":[{"user_id":1}]}.
+func IPCRevokeSessions(connection *sql.DB, cnf config.Config) negroni.HandlerFunc {
+	store := session.NewStore(connection, cnf.RefreshTokenLifetime)
+	return negroni.HandlerFunc(func(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+		requests := make([]*sharedModels.RevokeSessionsRequest, 0)
+		if err := ipc.ReadRequests(r, &requests); err != nil {
 			util.SendBadRequest(w, err)
 			return
 		}
 
-		// create JWT object with claims
-		expiration := time.Now().Add(time.Hour * 24 * 31).Unix()
-		token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-			"sub": usr.ID,
-			"iat": time.Now().Unix(),
-			"exp": expiration,
-		})
+		revoked := make([]*sharedModels.RevokeSessionsResponse, 0, len(requests))
+		for _, request := range requests {
+			if err := revokeSessions(r.Context(), connection, store, request.UserID); err != nil {
+				util.SendError(w, err)
+				return
+			}
+			revoked = append(revoked, &sharedModels.RevokeSessionsResponse{UserID: request.UserID})
+		}
+		ipc.SendResults(w, revoked)
+	})
+}
+
+// revokeSessions revokes every access token issued before to the user with userID and ends every session.
+func revokeSessions(ctx context.Context, connection *sql.DB, store *session.Store, userID int) error {
+	if err := db.IncrementTokenVersion(ctx, connection, userID); err != nil {
+		return err
+	}
+	return store.RevokeUser(ctx, userID)
+}
 
-		// Load secret key from config and generate a signed token
-		secretKey := cnf.SecretKey
-		tokenString, err := token.SignedString([]byte(secretKey))
+// IPCTokenStatus is a handler which tells the other services whether access tokens were revoked. The request
+// expects a json object in the following format: {"requests":[{"user_id":1,"jti":"..."}]}.
+func IPCTokenStatus(connection *sql.DB) negroni.HandlerFunc {
+	return negroni.HandlerFunc(func(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+		requests := make([]*sharedModels.TokenStatusRequest, 0)
+		if err := ipc.ReadRequests(r, &requests); err != nil {
+			util.SendBadRequest(w, err)
+			return
+		}
+
+		statuses := make([]*sharedModels.TokenStatusResponse, 0, len(requests))
+		for _, request := range requests {
+			status, err := db.GetTokenStatus(r.Context(), connection, request.UserID, request.TokenID)
+			if err != nil {
+				util.SendError(w, err)
+				return
+			}
+			statuses = append(statuses, &sharedModels.TokenStatusResponse{
+				UserID:  request.UserID,
+				TokenID: request.TokenID,
+				Revoked: status.Revoked,
+				Version: status.Version,
+			})
+		}
+		ipc.SendResults(w, statuses)
+	})
+}
+
+// Revocations returns the revocations with which the routes of the service check the access tokens. The service owns
+// the revocations, so they are looked up without a cache.
+func Revocations(connection *sql.DB) middleware.Revocations {
+	return middleware.RevocationLookup(func(ctx context.Context, userID int, tokenID string) (middleware.TokenStatus, error) {
+		return db.GetTokenStatus(ctx, connection, userID, tokenID)
+	})
+}
+
+// ListAccessTokensHandler returns the personal access tokens of the user of the request with the moment they were
+// last used. The tokens themselves are not stored, so they aren't part of the answer.
+func ListAccessTokensHandler(connection *sql.DB) negroni.HandlerFunc {
+	return negroni.HandlerFunc(func(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+		user, _ := middleware.UserFromContext(r.Context())
+		tokens, err := db.GetAccessTokens(r.Context(), connection, user.ID)
 		if err != nil {
 			util.SendError(w, err)
 			return
 		}
+		util.SendOK(w, tokens)
+	})
+}
 
-		// Retrieve the user from the database
-		databaseUser, _ := db.GetUserByUsername(connection, login.Username)
-		databaseUser.Password = "" // trick to prevent password from leaking to client
+// CreateAccessTokenHandler creates a personal access token for the user of the request. The request expects a json
+// object in the following format: {"name":"upload bot","scopes":["photos:write"]}. The answer is the only time the
+// token is shown.
+func CreateAccessTokenHandler(connection *sql.DB) negroni.HandlerFunc {
+	return negroni.HandlerFunc(func(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+		create := &models.AccessTokenCreate{}
+		if err := util.RequestToJSON(r, create); err != nil {
+			util.SendBadRequest(w, errors.New("Bad json"))
+			return
+		}
+		if err := create.Validate(); err != nil {
+			util.SendError(w, err)
+			return
+		}
+
+		tokenString, err := middleware.NewAccessToken()
+		if err != nil {
+			util.SendError(w, err)
+			return
+		}
+		user, _ := middleware.UserFromContext(r.Context())
+		id, err := db.CreateAccessToken(r.Context(), connection, user.ID, create.Name, create.Scopes, middleware.HashAccessToken(tokenString))
+		if err != nil {
+			util.SendError(w, err)
+			return
+		}
 
-		// Send the token and user back
-		data := &models.Token{
+		util.SendOK(w, &models.AccessToken{
+			ID:        id,
+			Name:      create.Name,
+			Scopes:    create.Scopes,
+			CreatedAt: time.Now().UTC(),
 			Token:     tokenString,
-			ExpiresOn: strconv.Itoa(int(expiration)),
-			User:      databaseUser,
+		})
+	})
+}
+
+// DeleteAccessTokenHandler revokes the personal access token of the user of the request with the id of the route.
+// The other services cache the tokens, so it can be used for up to middleware.DefaultRevocationTTL afterwards.
+func DeleteAccessTokenHandler(connection *sql.DB) negroni.HandlerFunc {
+	return negroni.HandlerFunc(func(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+		id, err := strconv.Atoi(mux.Vars(r)["id"])
+		if err != nil {
+			util.SendBadRequest(w, err)
+			return
+		}
+
+		user, _ := middleware.UserFromContext(r.Context())
+		deleted, err := db.DeleteAccessToken(r.Context(), connection, user.ID, id)
+		if err != nil {
+			util.SendError(w, err)
+			return
 		}
-		util.SendOK(w, data)
+		if !deleted {
+			util.SendError(w, ErrAccessTokenNotFound)
+			return
+		}
+		util.SendOKMessage(w, "Token revoked")
 	})
 }
 
+// IPCAccessTokens is a handler which looks up personal access tokens for the other services and records that they
+// were used. It only answers for the tokens which exist. The request expects a json object in the following format:
+// {"requests":[{"token_hash":"..."}]}.
+func IPCAccessTokens(connection *sql.DB) negroni.HandlerFunc {
+	return negroni.HandlerFunc(func(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+		requests := make([]*sharedModels.AccessTokenRequest, 0)
+		if err := ipc.ReadRequests(r, &requests); err != nil {
+			util.SendBadRequest(w, err)
+			return
+		}
+
+		tokens := make([]*sharedModels.AccessTokenResponse, 0, len(requests))
+		for _, request := range requests {
+			principal, err := db.UseAccessToken(r.Context(), connection, request.TokenHash)
+			if err != nil {
+				util.SendError(w, err)
+				return
+			}
+			if principal == nil {
+				continue
+			}
+			tokens = append(tokens, &sharedModels.AccessTokenResponse{
+				TokenHash:     request.TokenHash,
+				UserID:        principal.ID,
+				Scopes:        principal.Scopes,
+				EmailVerified: principal.EmailVerified,
+			})
+		}
+		ipc.SendResults(w, tokens)
+	})
+}
+
+// sendTokens sends a new access token for user together with refreshToken.
+func sendTokens(w http.ResponseWriter, r *http.Request, connection *sql.DB, cnf config.Config, keys *jwks.Set, user models.User, refreshToken *session.RefreshToken) {
+	tokenString, expiresAt, err := newAccessToken(r.Context(), connection, cnf, keys, user.ID)
+	if err != nil {
+		util.SendError(w, err)
+		return
+	}
+
+	data := &models.Token{
+		Token:            tokenString,
+		ExpiresOn:        strconv.FormatInt(expiresAt.Unix(), 10),
+		RefreshToken:     refreshToken.Token,
+		RefreshExpiresOn: strconv.FormatInt(refreshToken.ExpiresAt.Unix(), 10),
+		User:             user,
+	}
+	util.SendOK(w, data)
+}
+
+// newAccessToken returns an access token for the user with userID, signed with the signing key of keys. The token
+// carries the current token version of the user and whether the user verified their email address.
+func newAccessToken(ctx context.Context, connection *sql.DB, cnf config.Config, keys *jwks.Set, userID int) (string, time.Time, error) {
+	version, emailVerified, err := db.GetTokenClaims(ctx, connection, userID)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	return middleware.NewToken(keys.SigningKey(), userID, version, emailVerified, cnf.AccessTokenLifetime)
+}
+
+// dummyHash is compared with the password of an unknown user, so the answer takes as long as for a known user and
+// doesn't tell which usernames exist. Its cost is the cost of the hashes of the profile service.
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("not the password of anyone"), 10)
+
 // authenticate user by checking username and password in database
-func authenticate(connection *sql.DB, username string, password string) (*models.User, error) {
-	databaseUser, _ := db.GetUserByUsername(connection, username)
+func authenticate(ctx context.Context, connection *sql.DB, username string, password string) (*models.User, error) {
+	databaseUser, err := db.GetUserByUsername(ctx, connection, username)
+	if err == db.ErrUserNotFound {
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		return &models.User{}, ErrInvalidCredentials
+	}
+	if err != nil {
+		return &models.User{}, err
+	}
 	if bcrypt.CompareHashAndPassword([]byte(databaseUser.Password), []byte(password)) == nil {
 		return &databaseUser, nil
 	}
 	return &models.User{}, ErrInvalidCredentials
 }
 
+// clientAddress returns the IP address of the client of r.
+func clientAddress(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
 // ErrInvalidCredentials error
-var ErrInvalidCredentials = errors.New("Invalid credentials")
+var ErrInvalidCredentials = apierror.New(apierror.Unauthenticated, "Invalid credentials")
+
+// ErrLoginLocked error if the account or the address of a login failed too often and has to wait
+var ErrLoginLocked = apierror.New(apierror.TooManyRequests, "Too many failed logins, try again later")
+
+// ErrInvalidChallenge error if the challenge token of a two-factor login is invalid, expired or used up
+var ErrInvalidChallenge = apierror.New(apierror.Unauthenticated, "Invalid challenge token")
+
+// ErrInvalidCode error if a two-factor code is wrong or was used before
+var ErrInvalidCode = apierror.New(apierror.Unauthenticated, "Invalid two-factor code")
+
+// ErrAccessTokenNotFound is sent when the user has no personal access token with the id of the request.
+var ErrAccessTokenNotFound = apierror.New(apierror.NotFound, "Token does not exist")
+
+// ErrTwoFactorNotEnrolled error if the user has no two-factor authentication to confirm or disable
+var ErrTwoFactorNotEnrolled = apierror.New(apierror.Conflict, "Two-factor authentication is not enrolled")
@@ -3,6 +3,8 @@ package controllers
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"testing"
@@ -34,13 +36,12 @@ func TestLoginHandlerWithoutUsername(t *testing.T) {
 
 	// Mock config
 	cnf := config.Config{}
-	cnf.SecretKey = "ABC"
 
-	handler := LoginHandler(db, cnf)
+	handler := LoginHandler(db, cnf, nil)
 	handler(res, req, nil)
 
 	actual := res.Body.String()
-	expected := "{\"message\":\"Please provide username and password in the body\"}"
+	expected := "{\"type\":\"about:blank\",\"title\":\"Bad Request\",\"status\":400,\"detail\":\"Please provide username and password in the body\",\"code\":\"invalid_argument\"}"
 	if expected != actual {
 		t.Fatalf("Expected %s got %s", expected, actual)
 	}
@@ -68,14 +69,92 @@ func TestLoginHandlerWithoutPassword(t *testing.T) {
 
 	// Mock config
 	cnf := config.Config{}
-	cnf.SecretKey = "ABC"
 
-	handler := LoginHandler(db, cnf)
+	handler := LoginHandler(db, cnf, nil)
 	handler(res, req, nil)
 
 	actual := res.Body.String()
-	expected := "{\"message\":\"Please provide username and password in the body\"}"
+	expected := "{\"type\":\"about:blank\",\"title\":\"Bad Request\",\"status\":400,\"detail\":\"Please provide username and password in the body\",\"code\":\"invalid_argument\"}"
 	if expected != actual {
 		t.Fatalf("Expected %s got %s", expected, actual)
 	}
 }
+
+func TestLoginHandlerInvalidCredentials(t *testing.T) {
+	user := &models.User{Username: "user", Password: "wrong"}
+
+	json, _ := json.Marshal(user)
+
+	req, err := http.NewRequest("POST", "http://localhost/users", bytes.NewBuffer(json))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res := httptest.NewRecorder()
+
+	// Mock database
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	expectLoginAllowed(mock, "user")
+	mock.ExpectQuery("SELECT (.+) FROM users WHERE username").WithArgs("user").WillReturnRows(sqlmock.NewRows([]string{"id", "username", "createdAt", "password", "email"}))
+
+	// Mock config
+	cnf := config.Config{}
+
+	handler := LoginHandler(db, cnf, nil)
+	handler(res, req, nil)
+
+	if res.Code != http.StatusUnauthorized {
+		t.Errorf("Expected %v but got %v", http.StatusUnauthorized, res.Code)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestLoginHandlerDatabaseDown(t *testing.T) {
+	user := &models.User{Username: "user", Password: "secret"}
+
+	json, _ := json.Marshal(user)
+
+	req, err := http.NewRequest("POST", "http://localhost/users", bytes.NewBuffer(json))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res := httptest.NewRecorder()
+
+	// Mock database
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	expectLoginAllowed(mock, "user")
+	mock.ExpectQuery("SELECT (.+) FROM users WHERE username").WithArgs("user").WillReturnError(&net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")})
+	mock.ExpectExec("UPDATE login_failures").WithArgs("account", "user").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("UPDATE login_failures").WithArgs("ip", sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, 1))
+
+	// Mock config
+	cnf := config.Config{}
+
+	handler := LoginHandler(db, cnf, nil)
+	handler(res, req, nil)
+
+	if res.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected %v but got %v", http.StatusServiceUnavailable, res.Code)
+	}
+}
+
+// expectLoginAllowed expects the lookup of the failed logins of username, who has none, and the failure counted for
+// the attempt.
+func expectLoginAllowed(mock sqlmock.Sqlmock, username string) {
+	columns := []string{"failures", "lastFailureAt"}
+	mock.ExpectQuery("SELECT (.+) FROM login_failures").WithArgs("account", username).WillReturnRows(sqlmock.NewRows(columns))
+	mock.ExpectQuery("SELECT (.+) FROM login_failures").WithArgs("ip", sqlmock.AnyArg()).WillReturnRows(sqlmock.NewRows(columns))
+	mock.ExpectExec("INSERT INTO login_failures").WithArgs("account", username, sqlmock.AnyArg(), sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec("INSERT INTO login_failures").WithArgs("ip", sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(1, 1))
+}
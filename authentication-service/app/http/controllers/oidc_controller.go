@@ -0,0 +1,271 @@
+package controllers
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/bstaijen/mariadb-for-microservices/authentication-service/app/models"
+	"github.com/bstaijen/mariadb-for-microservices/authentication-service/app/oidc"
+	"github.com/bstaijen/mariadb-for-microservices/authentication-service/config"
+	"github.com/bstaijen/mariadb-for-microservices/authentication-service/database"
+	"github.com/bstaijen/mariadb-for-microservices/shared/apierror"
+	"github.com/bstaijen/mariadb-for-microservices/shared/ipc"
+	"github.com/bstaijen/mariadb-for-microservices/shared/jwks"
+	"github.com/bstaijen/mariadb-for-microservices/shared/session"
+	"github.com/bstaijen/mariadb-for-microservices/shared/util"
+	"github.com/bstaijen/mariadb-for-microservices/shared/util/middleware"
+
+	"github.com/gorilla/mux"
+	"github.com/urfave/negroni"
+)
+
+// OIDCLoginLifetime is how long a user has to log in at an OpenID Connect provider after the login was started.
+const OIDCLoginLifetime = 10 * time.Minute
+
+// OIDCProvidersHandler returns the names of the OpenID Connect providers users can log in with.
+func OIDCProvidersHandler(providers oidc.Providers) negroni.HandlerFunc {
+	return negroni.HandlerFunc(func(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+		util.SendOK(w, &models.OIDCProviders{Providers: providers.Names()})
+	})
+}
+
+// OIDCLoginHandler starts a login with the OpenID Connect provider of the route. It returns the URL of the login page
+// of the provider, which sends the user back to the client with a code and a state for OIDCCallbackHandler, and a
+// login secret which the client keeps and sends along with them.
+func OIDCLoginHandler(connection *sql.DB, providers oidc.Providers) negroni.HandlerFunc {
+	return negroni.HandlerFunc(func(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+		startOIDCLogin(w, r, connection, providers, 0)
+	})
+}
+
+// OIDCLinkHandler works like OIDCLoginHandler for the user of the request, who links an account of the provider to
+// log in with from then on.
+func OIDCLinkHandler(connection *sql.DB, providers oidc.Providers) negroni.HandlerFunc {
+	return negroni.HandlerFunc(func(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+		user, _ := middleware.UserFromContext(r.Context())
+		startOIDCLogin(w, r, connection, providers, user.ID)
+	})
+}
+
+// startOIDCLogin stores a new login with the provider of the route for the user with userID, 0 for a login, and
+// sends the URL of the login page of the provider and the login secret. The secret ties the login to the client: a
+// code and a state of a login started by someone else are refused, so nobody can be logged in to or linked with the
+// account of another.
+func startOIDCLogin(w http.ResponseWriter, r *http.Request, connection *sql.DB, providers oidc.Providers, userID int) {
+	provider, ok := providers[mux.Vars(r)["provider"]]
+	if !ok {
+		util.SendError(w, ErrUnknownProvider)
+		return
+	}
+
+	secrets := make([]string, 4)
+	for i := range secrets {
+		secret, err := oidc.NewSecret()
+		if err != nil {
+			util.SendError(w, err)
+			return
+		}
+		secrets[i] = secret
+	}
+	state, nonce, verifier, loginSecret := secrets[0], secrets[1], secrets[2], secrets[3]
+
+	authorizationURL, err := provider.AuthCodeURL(r.Context(), state, nonce, verifier)
+	if err != nil {
+		util.Log(r.Context()).Errorf("Can not start a login with %v: %v", provider.Name(), err)
+		util.SendError(w, ErrProviderUnavailable)
+		return
+	}
+
+	login := models.OIDCLogin{
+		Provider:     provider.Name(),
+		Nonce:        nonce,
+		CodeVerifier: verifier,
+		UserID:       userID,
+		SecretHash:   oidc.HashState(loginSecret),
+		ExpiresAt:    time.Now().Add(OIDCLoginLifetime),
+	}
+	if err := db.CreateOIDCLogin(r.Context(), connection, oidc.HashState(state), login); err != nil {
+		util.SendError(w, err)
+		return
+	}
+	util.SendOK(w, &models.OIDCAuthorization{AuthorizationURL: authorizationURL, LoginSecret: loginSecret})
+}
+
+// OIDCCallbackHandler completes a login with the OpenID Connect provider of the route. The request expects a json
+// object in the following format: {"code":"...","state":"...","login_secret":"..."}, the parameters of the redirect
+// back from the provider and the login secret from OIDCLoginHandler.
+//
+// A login which links the provider answers with the linked account. Otherwise the user the account is linked to is
+// logged in like by LoginHandler, which is a challenge for a user with two-factor authentication. An account which
+// isn't linked yet gets a new user, when its email address is verified by the provider and not taken.
+func OIDCCallbackHandler(connection *sql.DB, cnf config.Config, keys *jwks.Set, providers oidc.Providers, profile ipc.ProfileClient) negroni.HandlerFunc {
+	store := session.NewStore(connection, cnf.RefreshTokenLifetime)
+	return negroni.HandlerFunc(func(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+		provider, ok := providers[mux.Vars(r)["provider"]]
+		if !ok {
+			util.SendError(w, ErrUnknownProvider)
+			return
+		}
+
+		callback := &models.OIDCCallback{}
+		if err := util.RequestToJSON(r, callback); err != nil {
+			util.SendBadRequest(w, errors.New("Bad json"))
+			return
+		}
+		if len(callback.Code) < 1 || len(callback.State) < 1 || len(callback.LoginSecret) < 1 {
+			util.SendBadRequest(w, errors.New("Please provide code, state and login_secret in the body"))
+			return
+		}
+
+		login, err := db.UseOIDCLogin(r.Context(), connection, oidc.HashState(callback.State), time.Now())
+		if err != nil {
+			util.SendError(w, err)
+			return
+		}
+		if login == nil || login.Provider != provider.Name() {
+			util.SendError(w, ErrInvalidState)
+			return
+		}
+		// The state was used up anyway, so a state handed to another client can't be tried again
+		if subtle.ConstantTimeCompare([]byte(login.SecretHash), []byte(oidc.HashState(callback.LoginSecret))) != 1 {
+			util.Log(r.Context()).Warnf("Login with %v completed by another client than the one which started it", provider.Name())
+			util.SendError(w, ErrInvalidState)
+			return
+		}
+
+		identity, err := provider.Exchange(r.Context(), callback.Code, login.CodeVerifier, login.Nonce)
+		if err != nil {
+			util.Log(r.Context()).Infof("Rejected login with %v: %v", provider.Name(), err)
+			util.SendError(w, ErrOIDCLoginFailed)
+			return
+		}
+
+		userID, err := db.GetExternalIdentity(r.Context(), connection, provider.Name(), identity.Subject)
+		if err != nil {
+			util.SendError(w, err)
+			return
+		}
+
+		// Link the account to the user who started the login
+		if login.UserID > 0 {
+			if userID != 0 {
+				util.SendError(w, db.ErrIdentityLinked)
+				return
+			}
+			id, err := db.LinkExternalIdentity(r.Context(), connection, login.UserID, provider.Name(), identity.Subject, identity.Email)
+			if err != nil {
+				util.SendError(w, err)
+				return
+			}
+			util.SendOK(w, &models.ExternalIdentity{ID: id, Provider: provider.Name(), Email: identity.Email, CreatedAt: time.Now().UTC()})
+			return
+		}
+
+		// Create a user for an account which isn't linked. An existing user with the address has to log in and link
+		// the provider, so an account at the provider can't take over a user.
+		if userID == 0 {
+			if !identity.EmailVerified || identity.Email == "" {
+				util.SendError(w, ErrEmailNotVerified)
+				return
+			}
+			created, err := profile.CreateUser(r.Context(), identity.PreferredUsername(), identity.Email)
+			if err != nil {
+				util.SendError(w, err)
+				return
+			}
+			if created == nil {
+				util.SendError(w, ErrEmailTaken)
+				return
+			}
+			if _, err := db.LinkExternalIdentity(r.Context(), connection, created.ID, provider.Name(), identity.Subject, identity.Email); err != nil {
+				util.SendError(w, err)
+				return
+			}
+			userID = created.ID
+		}
+
+		user, err := db.GetUserByID(r.Context(), connection, userID)
+		if err != nil {
+			util.SendError(w, err)
+			return
+		}
+		twoFactor, err := db.GetTwoFactor(r.Context(), connection, user.ID)
+		if err != nil {
+			util.SendError(w, err)
+			return
+		}
+		if twoFactor.Enabled {
+			sendChallenge(w, r, connection, keys, user.ID)
+			return
+		}
+		refreshToken, err := store.Issue(r.Context(), user.ID)
+		if err != nil {
+			util.SendError(w, err)
+			return
+		}
+		sendTokens(w, r, connection, cnf, keys, user, refreshToken)
+	})
+}
+
+// ListIdentitiesHandler returns the accounts at OpenID Connect providers the user of the request is linked to.
+func ListIdentitiesHandler(connection *sql.DB) negroni.HandlerFunc {
+	return negroni.HandlerFunc(func(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+		user, _ := middleware.UserFromContext(r.Context())
+		identities, err := db.GetExternalIdentities(r.Context(), connection, user.ID)
+		if err != nil {
+			util.SendError(w, err)
+			return
+		}
+		util.SendOK(w, identities)
+	})
+}
+
+// DeleteIdentityHandler unlinks the account with the id of the route from the user of the request. A user without a
+// password can't unlink the last account.
+func DeleteIdentityHandler(connection *sql.DB) negroni.HandlerFunc {
+	return negroni.HandlerFunc(func(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+		id, err := strconv.Atoi(mux.Vars(r)["id"])
+		if err != nil {
+			util.SendBadRequest(w, err)
+			return
+		}
+
+		user, _ := middleware.UserFromContext(r.Context())
+		deleted, err := db.DeleteExternalIdentity(r.Context(), connection, user.ID, id)
+		if err != nil {
+			util.SendError(w, err)
+			return
+		}
+		if !deleted {
+			util.SendError(w, ErrIdentityNotFound)
+			return
+		}
+		util.SendOKMessage(w, "Identity unlinked")
+	})
+}
+
+// ErrUnknownProvider error if the OpenID Connect provider of the route isn't configured
+var ErrUnknownProvider = apierror.New(apierror.NotFound, "Unknown provider")
+
+// ErrProviderUnavailable error if the OpenID Connect provider can't be reached or is misconfigured
+var ErrProviderUnavailable = apierror.New(apierror.Unavailable, "The provider is unavailable")
+
+// ErrInvalidState error if the state of a login with a provider is unknown, used or expired, or the login was started
+// by another client
+var ErrInvalidState = apierror.New(apierror.Unauthenticated, "Invalid or expired state, please start the login again")
+
+// ErrOIDCLoginFailed error if the provider doesn't confirm the login
+var ErrOIDCLoginFailed = apierror.New(apierror.Unauthenticated, "The login with the provider failed")
+
+// ErrEmailNotVerified error if a new user of a provider has no email address verified by the provider
+var ErrEmailNotVerified = apierror.New(apierror.PermissionDenied, "The provider did not verify the email address of the account")
+
+// ErrEmailTaken error if a new user of a provider has the email address of an existing user
+var ErrEmailTaken = apierror.New(apierror.Conflict, "A user with this email address exists, log in and link the provider instead")
+
+// ErrIdentityNotFound error if the user has no linked account with the id of the request
+var ErrIdentityNotFound = apierror.New(apierror.NotFound, "Identity does not exist")
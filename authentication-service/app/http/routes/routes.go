@@ -2,37 +2,205 @@ package routes
 
 import (
 	"database/sql"
+	"time"
 
 	"github.com/bstaijen/mariadb-for-microservices/authentication-service/app/http/controllers"
+	"github.com/bstaijen/mariadb-for-microservices/authentication-service/app/oidc"
 	"github.com/bstaijen/mariadb-for-microservices/authentication-service/config"
+	"github.com/bstaijen/mariadb-for-microservices/shared/health"
+	"github.com/bstaijen/mariadb-for-microservices/shared/ipc"
+	"github.com/bstaijen/mariadb-for-microservices/shared/jwks"
+	"github.com/bstaijen/mariadb-for-microservices/shared/ratelimit"
 	"github.com/bstaijen/mariadb-for-microservices/shared/util/middleware"
 	"github.com/gorilla/mux"
 	"github.com/urfave/negroni"
 )
 
-// InitRoutes instantiates a new gorilla/mux router
-func InitRoutes(db *sql.DB, cnf config.Config) *mux.Router {
+// loginPolicy limits the login attempts of a client, which is always keyed by its IP address.
+var loginPolicy = ratelimit.Policy{Name: "login", Limit: 10, Period: time.Minute}
+
+// refreshPolicy limits the refreshes of a client, which is keyed by its IP address as well.
+var refreshPolicy = ratelimit.Policy{Name: "refresh", Limit: 30, Period: time.Minute}
+
+// twoFactorPolicy limits the two-factor codes a client can try, which is keyed by its IP address as well. A code has
+// six digits, so it must not be guessed.
+var twoFactorPolicy = ratelimit.Policy{Name: "2fa", Limit: 10, Period: time.Minute}
+
+// accessTokenPolicy limits the personal access tokens a user can create.
+var accessTokenPolicy = ratelimit.Policy{Name: "access-token", Limit: 10, Period: time.Hour}
+
+// InitRoutes instantiates a new gorilla/mux router. Keys sign the access tokens, ipcKeys sign and verify the IPC
+// calls and providers are the OpenID Connect providers users can log in with.
+func InitRoutes(db *sql.DB, cnf config.Config, keys *jwks.Set, ipcKeys *ipc.Keys, providers oidc.Providers) *mux.Router {
+	clients := &ipc.Clients{
+		Profile: ipc.NewProfileClient(cnf.ProfileServiceBaseurl, ipcKeys.Identity),
+	}
+
 	router := mux.NewRouter()
-	router = setAuthenticationRoutes(db, cnf, router)
+	router = setHealthRoutes(db, cnf, router)
+	router = setAuthenticationRoutes(db, cnf, keys, providers, clients, router)
+	router = setIPCRoutes(db, cnf, ipcKeys.Callers, router)
 	return router
 }
 
 // setAuthenticationRoutes specifies all routes for the authentication service
-func setAuthenticationRoutes(db *sql.DB, cnf config.Config, router *mux.Router) *mux.Router {
+func setAuthenticationRoutes(db *sql.DB, cnf config.Config, keys *jwks.Set, providers oidc.Providers, clients *ipc.Clients, router *mux.Router) *mux.Router {
+
+	// Public keys of the access tokens GET /.well-known/jwks.json
+	router.Handle(jwks.Path, negroni.New(
+		negroni.Wrap(jwks.Handler(keys)),
+	)).Methods("GET")
 
 	// Subrouter /token-auth
 	tokenAUTH := router.PathPrefix("/token-auth").Subrouter()
 
+	// Refresh the access token POST /token-auth/refresh. It, the logout, the two-factor, the token and the OpenID
+	// Connect routes are registered before the login route, which matches every path below /token-auth
+	tokenAUTH.Path("/refresh").Methods("POST").Handler(negroni.New(
+		ratelimit.Middleware(ratelimit.NewMemoryStore(), refreshPolicy),
+		controllers.RefreshHandler(db, cnf, keys),
+	))
+
+	// Revoke the access token and the session POST /token-auth/logout
+	tokenAUTH.Path("/logout").Methods("POST").Handler(negroni.New(
+		middleware.RequireTokenAuthenticationHandler(keys, controllers.Revocations(db)),
+		controllers.LogoutHandler(db, cnf),
+	))
+
+	// Revoke every access token and session of the user POST /token-auth/logout/all
+	tokenAUTH.Path("/logout/all").Methods("POST").Handler(negroni.New(
+		middleware.RequireTokenAuthenticationHandler(keys, controllers.Revocations(db)),
+		controllers.LogoutAllHandler(db, cnf),
+	))
+
+	// Complete the login with a two-factor code POST /token-auth/2fa
+	tokenAUTH.Path("/2fa").Methods("POST").Handler(negroni.New(
+		ratelimit.Middleware(ratelimit.NewMemoryStore(), twoFactorPolicy),
+		controllers.TwoFactorLoginHandler(db, cnf, keys),
+	))
+
+	// Start the two-factor authentication POST /token-auth/2fa/enroll
+	tokenAUTH.Path("/2fa/enroll").Methods("POST").Handler(negroni.New(
+		middleware.RequireTokenAuthenticationHandler(keys, controllers.Revocations(db)),
+		controllers.EnrollTwoFactorHandler(db, cnf),
+	))
+
+	// Enable the two-factor authentication POST /token-auth/2fa/confirm
+	tokenAUTH.Path("/2fa/confirm").Methods("POST").Handler(negroni.New(
+		ratelimit.Middleware(ratelimit.NewMemoryStore(), twoFactorPolicy),
+		middleware.RequireTokenAuthenticationHandler(keys, controllers.Revocations(db)),
+		controllers.ConfirmTwoFactorHandler(db),
+	))
+
+	// Disable the two-factor authentication POST /token-auth/2fa/disable
+	tokenAUTH.Path("/2fa/disable").Methods("POST").Handler(negroni.New(
+		ratelimit.Middleware(ratelimit.NewMemoryStore(), twoFactorPolicy),
+		middleware.RequireTokenAuthenticationHandler(keys, controllers.Revocations(db)),
+		controllers.DisableTwoFactorHandler(db),
+	))
+
+	// Personal access tokens of the user GET /token-auth/tokens. A personal access token can't manage the tokens
+	// itself, these routes only accept the access tokens of a login
+	tokenAUTH.Path("/tokens").Methods("GET").Handler(negroni.New(
+		middleware.RequireTokenAuthenticationHandler(keys, controllers.Revocations(db)),
+		controllers.ListAccessTokensHandler(db),
+	))
+
+	// Create a personal access token POST /token-auth/tokens
+	tokenAUTH.Path("/tokens").Methods("POST").Handler(negroni.New(
+		middleware.RequireTokenAuthenticationHandler(keys, controllers.Revocations(db)),
+		ratelimit.Middleware(ratelimit.NewMemoryStore(), accessTokenPolicy),
+		controllers.CreateAccessTokenHandler(db),
+	))
+
+	// Revoke a personal access token DELETE /token-auth/tokens/{id}
+	tokenAUTH.Path("/tokens/{id}").Methods("DELETE").Handler(negroni.New(
+		middleware.RequireTokenAuthenticationHandler(keys, controllers.Revocations(db)),
+		controllers.DeleteAccessTokenHandler(db),
+	))
+
+	// OpenID Connect providers to log in with GET /token-auth/oidc
+	tokenAUTH.Path("/oidc").Methods("GET").Handler(negroni.New(
+		controllers.OIDCProvidersHandler(providers),
+	))
+
+	// Start a login with a provider POST /token-auth/oidc/{provider}
+	tokenAUTH.Path("/oidc/{provider}").Methods("POST").Handler(negroni.New(
+		ratelimit.Middleware(ratelimit.NewMemoryStore(), loginPolicy),
+		controllers.OIDCLoginHandler(db, providers),
+	))
+
+	// Start linking a provider to the user POST /token-auth/oidc/{provider}/link
+	tokenAUTH.Path("/oidc/{provider}/link").Methods("POST").Handler(negroni.New(
+		middleware.RequireTokenAuthenticationHandler(keys, controllers.Revocations(db)),
+		ratelimit.Middleware(ratelimit.NewMemoryStore(), loginPolicy),
+		controllers.OIDCLinkHandler(db, providers),
+	))
+
+	// Complete a login with a provider POST /token-auth/oidc/{provider}/callback
+	tokenAUTH.Path("/oidc/{provider}/callback").Methods("POST").Handler(negroni.New(
+		ratelimit.Middleware(ratelimit.NewMemoryStore(), loginPolicy),
+		controllers.OIDCCallbackHandler(db, cnf, keys, providers, clients.Profile),
+	))
+
+	// Accounts at providers the user is linked to GET /token-auth/identities
+	tokenAUTH.Path("/identities").Methods("GET").Handler(negroni.New(
+		middleware.RequireTokenAuthenticationHandler(keys, controllers.Revocations(db)),
+		controllers.ListIdentitiesHandler(db),
+	))
+
+	// Unlink an account at a provider DELETE /token-auth/identities/{id}
+	tokenAUTH.Path("/identities/{id}").Methods("DELETE").Handler(negroni.New(
+		middleware.RequireTokenAuthenticationHandler(keys, controllers.Revocations(db)),
+		controllers.DeleteIdentityHandler(db),
+	))
+
 	// User Login POST /token-auth
 	tokenAUTH.Methods("POST").Handler(negroni.New(
-		negroni.HandlerFunc(middleware.AccessControlHandler),
-		controllers.LoginHandler(db, cnf),
+		ratelimit.Middleware(ratelimit.NewMemoryStore(), loginPolicy),
+		controllers.LoginHandler(db, cnf, keys),
 	))
 
-	// OPTIONS /token-auth
-	tokenAUTH.Methods("OPTIONS").Handler(negroni.New(
-		negroni.HandlerFunc(middleware.AcceptOPTIONS),
-	))
+	return router
+}
+
+func setIPCRoutes(db *sql.DB, cnf config.Config, callers middleware.ServiceKeys, router *mux.Router) *mux.Router {
+
+	// Subrouter /ipc
+	ipcRouter := router.PathPrefix("/ipc").Subrouter()
+
+	// Whether access tokens were revoked
+	ipcRouter.Handle("/tokenStatus", negroni.New(
+		middleware.RequireServiceAuthenticationHandler(callers, ipc.AuthenticationService, ipc.ProfileService, ipc.PhotoService, ipc.VoteService, ipc.CommentService),
+		controllers.IPCTokenStatus(db),
+	)).Methods("GET")
+
+	// Look up personal access tokens
+	ipcRouter.Handle("/accessTokens", negroni.New(
+		middleware.RequireServiceAuthenticationHandler(callers, ipc.AuthenticationService, ipc.PhotoService, ipc.VoteService, ipc.CommentService),
+		controllers.IPCAccessTokens(db),
+	)).Methods("GET")
+
+	// Log users out everywhere
+	ipcRouter.Handle("/revokeSessions", negroni.New(
+		middleware.RequireServiceAuthenticationHandler(callers, ipc.AuthenticationService, ipc.ProfileService),
+		controllers.IPCRevokeSessions(db, cnf),
+	)).Methods("POST")
+
+	return router
+}
+
+// setHealthRoutes specifies the liveness and readiness routes
+func setHealthRoutes(db *sql.DB, cnf config.Config, router *mux.Router) *mux.Router {
+	router.Handle("/healthz", negroni.New(
+		negroni.HandlerFunc(health.Liveness),
+	)).Methods("GET")
+
+	router.Handle("/readyz", negroni.New(
+		health.Readiness(health.DefaultTimeout,
+			health.Database(db),
+		),
+	)).Methods("GET")
 
 	return router
 }
@@ -2,10 +2,14 @@ package routes
 
 import (
 	"bytes"
+	"context"
 	"database/sql"
+	"database/sql/driver"
 	"encoding/json"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 
@@ -14,8 +18,16 @@ import (
 	sqlmock "gopkg.in/DATA-DOG/go-sqlmock.v1"
 
 	"github.com/bstaijen/mariadb-for-microservices/authentication-service/app/models"
+	"github.com/bstaijen/mariadb-for-microservices/authentication-service/app/oidc"
+	"github.com/bstaijen/mariadb-for-microservices/authentication-service/app/oidc/oidctest"
+	"github.com/bstaijen/mariadb-for-microservices/authentication-service/app/twofactor"
 	"github.com/bstaijen/mariadb-for-microservices/authentication-service/config"
+	"github.com/bstaijen/mariadb-for-microservices/shared/ipc"
+	"github.com/bstaijen/mariadb-for-microservices/shared/jwks"
+	sharedModels "github.com/bstaijen/mariadb-for-microservices/shared/models"
+	"github.com/bstaijen/mariadb-for-microservices/shared/util/middleware"
 	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/pquerna/otp/totp"
 )
 
 func TestPOSTTokenAuth(t *testing.T) {
@@ -31,11 +43,15 @@ func TestPOSTTokenAuth(t *testing.T) {
 	timeNow := time.Now().UTC()
 	hash, _ := bcrypt.GenerateFromPassword([]byte(user.Password), 10)
 	selectByIDRows := sqlmock.NewRows([]string{"id", "username", "createdAt", "password", "email"}).AddRow(user.ID, user.Username, timeNow, hash, user.Email)
+	expectLoginAllowed(mock, user)
 	mock.ExpectQuery("SELECT (.+) FROM users WHERE").WithArgs(user.Username).WillReturnRows(selectByIDRows)
+	mock.ExpectQuery("SELECT (.+) FROM two_factor").WithArgs(user.ID).WillReturnRows(sqlmock.NewRows(twoFactorColumns))
+	expectLoginSucceeded(mock, user)
+	mock.ExpectExec("INSERT INTO refresh_tokens").WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), user.ID, sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectQuery("SELECT (.+) FROM users").WithArgs(user.ID, user.ID).WillReturnRows(sqlmock.NewRows([]string{"version", "verified"}).AddRow(0, true))
 
 	// Mock config
 	cnf := config.Config{}
-	cnf.SecretKey = "ABC"
 
 	json, _ := json.Marshal(user)
 	res := doRequest(db, cnf, http.MethodPost, "/token-auth", bytes.NewBuffer(json), t)
@@ -54,8 +70,903 @@ func TestPOSTTokenAuth(t *testing.T) {
 	}
 }
 
+var loginFailureColumns = []string{"failures", "lastFailureAt"}
+
+// expectLoginAllowed expects the lookup of the failed logins of user, who has none, and the failure counted for the
+// attempt.
+func expectLoginAllowed(mock sqlmock.Sqlmock, user *models.User) {
+	mock.ExpectQuery("SELECT (.+) FROM login_failures").WithArgs("account", user.Username).WillReturnRows(sqlmock.NewRows(loginFailureColumns))
+	mock.ExpectQuery("SELECT (.+) FROM login_failures").WithArgs("ip", sqlmock.AnyArg()).WillReturnRows(sqlmock.NewRows(loginFailureColumns))
+	mock.ExpectExec("INSERT INTO login_failures").WithArgs("account", user.Username, sqlmock.AnyArg(), sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec("INSERT INTO login_failures").WithArgs("ip", sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(1, 1))
+}
+
+// expectLoginSucceeded expects the failures of user to be forgotten and the failure counted for the address to be
+// taken back.
+func expectLoginSucceeded(mock sqlmock.Sqlmock, user *models.User) {
+	mock.ExpectExec("DELETE FROM login_failures").WithArgs("account", user.Username).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("UPDATE login_failures").WithArgs("ip", sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, 1))
+}
+
+// Test if a wrong password is counted for the account and the address.
+func TestPOSTTokenAuthWrongPassword(t *testing.T) {
+	user := getTestUser()
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	hash, _ := bcrypt.GenerateFromPassword([]byte("another password"), 10)
+	expectLoginAllowed(mock, user)
+	mock.ExpectQuery("SELECT (.+) FROM users WHERE").WithArgs(user.Username).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "username", "createdAt", "password", "email"}).AddRow(user.ID, user.Username, time.Now(), hash, user.Email))
+
+	body, _ := json.Marshal(user)
+	res := doRequest(db, config.Config{}, http.MethodPost, "/token-auth", bytes.NewBuffer(body), t)
+	if res.Result().StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected %v but got %v: %v", http.StatusUnauthorized, res.Result().StatusCode, res.Body.String())
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+// Test if a locked account is refused before its password is checked.
+func TestPOSTTokenAuthLocked(t *testing.T) {
+	user := getTestUser()
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	cnf := config.Config{LoginMaxFailures: 10, LoginMaxFailuresIP: 50, LoginLockout: 15 * time.Minute}
+	mock.ExpectQuery("SELECT (.+) FROM login_failures").WithArgs("account", user.Username).
+		WillReturnRows(sqlmock.NewRows(loginFailureColumns).AddRow(10, time.Now()))
+	mock.ExpectQuery("SELECT (.+) FROM login_failures").WithArgs("ip", sqlmock.AnyArg()).WillReturnRows(sqlmock.NewRows(loginFailureColumns))
+
+	body, _ := json.Marshal(user)
+	res := doRequest(db, cnf, http.MethodPost, "/token-auth", bytes.NewBuffer(body), t)
+	if res.Result().StatusCode != http.StatusTooManyRequests {
+		t.Errorf("Expected %v but got %v: %v", http.StatusTooManyRequests, res.Result().StatusCode, res.Body.String())
+	}
+	if retryAfter := res.Header().Get("Retry-After"); retryAfter != "900" && retryAfter != "899" {
+		t.Errorf("Expected %v but got %v", 900, retryAfter)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+var twoFactorColumns = []string{"secret", "enabled", "last_step"}
+
+// Test if a user with two-factor authentication gets a challenge, which is exchanged for an access token with a code.
+func TestPOSTTokenAuthTwoFactor(t *testing.T) {
+	user := getTestUser()
+	secret, _, err := twofactor.NewSecret("test", user.Username)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	hash, _ := bcrypt.GenerateFromPassword([]byte(user.Password), 10)
+	expectLoginAllowed(mock, user)
+	mock.ExpectQuery("SELECT (.+) FROM users WHERE").WithArgs(user.Username).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "username", "createdAt", "password", "email"}).AddRow(user.ID, user.Username, time.Now(), hash, user.Email))
+	mock.ExpectQuery("SELECT (.+) FROM two_factor").WithArgs(user.ID).WillReturnRows(sqlmock.NewRows(twoFactorColumns).AddRow(secret, true, 0))
+	mock.ExpectExec("UPDATE login_failures").WithArgs("account", user.Username).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("UPDATE login_failures").WithArgs("ip", sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, 1))
+	expectChallengeCreated(mock, user)
+
+	cnf := config.Config{}
+	body, _ := json.Marshal(user)
+	res := doRequest(db, cnf, http.MethodPost, "/token-auth", bytes.NewBuffer(body), t)
+	if res.Result().StatusCode != http.StatusOK {
+		t.Fatalf("Expected %v but got %v: %v", http.StatusOK, res.Result().StatusCode, res.Body.String())
+	}
+	challenge := &models.Challenge{}
+	if err := json.NewDecoder(res.Body).Decode(challenge); err != nil || !challenge.TwoFactorRequired || challenge.ChallengeToken == "" {
+		t.Fatalf("Expected a challenge but got %+v", challenge)
+	}
+
+	code, err := totp.GenerateCode(secret, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	mock.ExpectExec("UPDATE two_factor_challenges").WithArgs(sqlmock.AnyArg(), user.ID, twofactor.ChallengeAttempts).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery("SELECT (.+) FROM users WHERE id").WithArgs(user.ID).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "username", "createdAt", "email"}).AddRow(user.ID, user.Username, time.Now(), user.Email))
+	expectLoginAllowed(mock, user)
+	mock.ExpectQuery("SELECT (.+) FROM two_factor").WithArgs(user.ID).WillReturnRows(sqlmock.NewRows(twoFactorColumns).AddRow(secret, true, 0))
+	mock.ExpectExec("UPDATE two_factor SET last_step").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("DELETE FROM two_factor_challenges WHERE jti").WillReturnResult(sqlmock.NewResult(0, 1))
+	expectLoginSucceeded(mock, user)
+	mock.ExpectExec("INSERT INTO refresh_tokens").WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), user.ID, sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectQuery("SELECT (.+) FROM users").WithArgs(user.ID, user.ID).WillReturnRows(sqlmock.NewRows([]string{"version", "verified"}).AddRow(0, true))
+
+	body, _ = json.Marshal(map[string]string{"challenge_token": challenge.ChallengeToken, "code": code})
+	res = doRequest(db, cnf, http.MethodPost, "/token-auth/2fa", bytes.NewBuffer(body), t)
+	if res.Result().StatusCode != http.StatusOK {
+		t.Fatalf("Expected %v but got %v: %v", http.StatusOK, res.Result().StatusCode, res.Body.String())
+	}
+	token := &models.Token{}
+	if err := json.NewDecoder(res.Body).Decode(token); err != nil || token.Token == "" || token.RefreshToken == "" {
+		t.Errorf("Expected an access token and a refresh token but got %+v", token)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+// Test if a wrong code is rejected and stays counted as a failed login of the account.
+func TestPOSTTokenAuthTwoFactorInvalidCode(t *testing.T) {
+	user := getTestUser()
+	secret, _, err := twofactor.NewSecret("test", user.Username)
+	if err != nil {
+		t.Fatal(err)
+	}
+	challenge, _, err := twofactor.NewChallenge(testKeys.SigningKey(), user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	mock.ExpectExec("UPDATE two_factor_challenges").WithArgs(sqlmock.AnyArg(), user.ID, twofactor.ChallengeAttempts).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery("SELECT (.+) FROM users WHERE id").WithArgs(user.ID).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "username", "createdAt", "email"}).AddRow(user.ID, user.Username, time.Now(), user.Email))
+	expectLoginAllowed(mock, user)
+	mock.ExpectQuery("SELECT (.+) FROM two_factor").WithArgs(user.ID).WillReturnRows(sqlmock.NewRows(twoFactorColumns).AddRow(secret, true, 0))
+	mock.ExpectExec("UPDATE recovery_codes SET usedAt").WithArgs(user.ID, sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, 0))
+
+	body, _ := json.Marshal(map[string]string{"challenge_token": challenge, "code": "aaaaa-bbbbb"})
+	res := doRequest(db, config.Config{}, http.MethodPost, "/token-auth/2fa", bytes.NewBuffer(body), t)
+	if res.Result().StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected %v but got %v: %v", http.StatusUnauthorized, res.Result().StatusCode, res.Body.String())
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+// Test if a challenge which is used up is rejected before its code is checked.
+func TestPOSTTokenAuthTwoFactorChallengeUsedUp(t *testing.T) {
+	user := getTestUser()
+	challenge, claims, err := twofactor.NewChallenge(testKeys.SigningKey(), user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	mock.ExpectExec("UPDATE two_factor_challenges").WithArgs(claims.ID, user.ID, twofactor.ChallengeAttempts).WillReturnResult(sqlmock.NewResult(0, 0))
+
+	body, _ := json.Marshal(map[string]string{"challenge_token": challenge, "code": "123456"})
+	res := doRequest(db, config.Config{}, http.MethodPost, "/token-auth/2fa", bytes.NewBuffer(body), t)
+	if res.Result().StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected %v but got %v: %v", http.StatusUnauthorized, res.Result().StatusCode, res.Body.String())
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+// expectChallengeCreated expects a challenge token of user to be stored.
+func expectChallengeCreated(mock sqlmock.Sqlmock, user *models.User) {
+	mock.ExpectExec("DELETE FROM two_factor_challenges WHERE expiresAt").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("INSERT INTO two_factor_challenges").WithArgs(sqlmock.AnyArg(), user.ID, sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(1, 1))
+}
+
+// Test if the codes of a locked account are refused before they are checked.
+func TestPOSTTokenAuthTwoFactorLocked(t *testing.T) {
+	user := getTestUser()
+	challenge, _, err := twofactor.NewChallenge(testKeys.SigningKey(), user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	cnf := config.Config{LoginMaxFailures: 10, LoginMaxFailuresIP: 50, LoginLockout: 15 * time.Minute}
+	mock.ExpectExec("UPDATE two_factor_challenges").WithArgs(sqlmock.AnyArg(), user.ID, twofactor.ChallengeAttempts).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery("SELECT (.+) FROM users WHERE id").WithArgs(user.ID).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "username", "createdAt", "email"}).AddRow(user.ID, user.Username, time.Now(), user.Email))
+	mock.ExpectQuery("SELECT (.+) FROM login_failures").WithArgs("account", user.Username).
+		WillReturnRows(sqlmock.NewRows(loginFailureColumns).AddRow(10, time.Now()))
+	mock.ExpectQuery("SELECT (.+) FROM login_failures").WithArgs("ip", sqlmock.AnyArg()).WillReturnRows(sqlmock.NewRows(loginFailureColumns))
+
+	body, _ := json.Marshal(map[string]string{"challenge_token": challenge, "code": "123456"})
+	res := doRequest(db, cnf, http.MethodPost, "/token-auth/2fa", bytes.NewBuffer(body), t)
+	if res.Result().StatusCode != http.StatusTooManyRequests {
+		t.Errorf("Expected %v but got %v: %v", http.StatusTooManyRequests, res.Result().StatusCode, res.Body.String())
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+// Test if confirming the enrollment enables two-factor authentication and returns the recovery codes.
+func TestPOSTTwoFactorConfirm(t *testing.T) {
+	user := getTestUser()
+	secret, _, err := twofactor.NewSecret("test", user.Username)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, err := totp.GenerateCode(secret, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	mock.ExpectQuery("SELECT EXISTS(.+) FROM revoked_tokens").WithArgs("test-token", user.ID).
+		WillReturnRows(sqlmock.NewRows([]string{"revoked", "version"}).AddRow(false, 0))
+	mock.ExpectQuery("SELECT (.+) FROM two_factor").WithArgs(user.ID).WillReturnRows(sqlmock.NewRows(twoFactorColumns).AddRow(secret, false, 0))
+	mock.ExpectBegin()
+	mock.ExpectExec("UPDATE two_factor SET enabled").WithArgs(sqlmock.AnyArg(), user.ID).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("DELETE FROM recovery_codes").WithArgs(user.ID).WillReturnResult(sqlmock.NewResult(0, 0))
+	for i := 0; i < twofactor.RecoveryCodes; i++ {
+		mock.ExpectExec("INSERT INTO recovery_codes").WithArgs(user.ID, sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(1, 1))
+	}
+	mock.ExpectCommit()
+
+	url := "/token-auth/2fa/confirm?token=" + getTokenString(user, t)
+	res := doRequest(db, config.Config{}, http.MethodPost, url, bytes.NewBufferString(`{"code":"`+code+`"}`), t)
+	if res.Result().StatusCode != http.StatusOK {
+		t.Fatalf("Expected %v but got %v: %v", http.StatusOK, res.Result().StatusCode, res.Body.String())
+	}
+	codes := struct {
+		RecoveryCodes []string `json:"recovery_codes"`
+	}{}
+	if err := json.NewDecoder(res.Body).Decode(&codes); err != nil || len(codes.RecoveryCodes) != twofactor.RecoveryCodes {
+		t.Errorf("Expected %v recovery codes but got %v", twofactor.RecoveryCodes, codes.RecoveryCodes)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+// Test if a refresh token is exchanged for a new access token and refresh token.
+func TestPOSTTokenAuthRefresh(t *testing.T) {
+	user := getTestUser()
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT (.+) FROM refresh_tokens WHERE token_hash").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "family_id", "user_id", "expiresAt", "rotatedAt", "revokedAt"}).AddRow(1, "family", user.ID, time.Now().Add(time.Hour), nil, nil))
+	mock.ExpectExec("UPDATE refresh_tokens SET rotatedAt").WithArgs(1).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO refresh_tokens").WithArgs(sqlmock.AnyArg(), "family", user.ID, sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(2, 1))
+	mock.ExpectCommit()
+	mock.ExpectQuery("SELECT (.+) FROM users WHERE id").WithArgs(user.ID).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "username", "createdAt", "email"}).AddRow(user.ID, user.Username, time.Now(), user.Email))
+	mock.ExpectQuery("SELECT (.+) FROM users").WithArgs(user.ID, user.ID).WillReturnRows(sqlmock.NewRows([]string{"version", "verified"}).AddRow(2, true))
+
+	cnf := config.Config{}
+
+	res := doRequest(db, cnf, http.MethodPost, "/token-auth/refresh", bytes.NewBufferString(`{"refresh_token":"refresh"}`), t)
+	if res.Result().StatusCode != http.StatusOK {
+		t.Fatalf("Expected %v but got %v: %v", http.StatusOK, res.Result().StatusCode, res.Body.String())
+	}
+
+	token := &models.Token{}
+	if err := json.Unmarshal(res.Body.Bytes(), token); err != nil {
+		t.Fatal(err)
+	}
+	if token.RefreshToken == "" || token.RefreshToken == "refresh" {
+		t.Errorf("Expected a new refresh token but got %q", token.RefreshToken)
+	}
+	if principal, err := middleware.ParseToken(context.Background(), testKeys, token.Token); err != nil || principal.ID != user.ID || principal.Version != 2 {
+		t.Errorf("Expected an access token of version 2 for user %v but got %v", user.ID, err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+// Test if a refresh token which was used before is rejected and revokes its session.
+func TestPOSTTokenAuthRefreshReused(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT (.+) FROM refresh_tokens WHERE token_hash").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "family_id", "user_id", "expiresAt", "rotatedAt", "revokedAt"}).AddRow(1, "family", 1, time.Now().Add(time.Hour), time.Now(), nil))
+	mock.ExpectExec("UPDATE refresh_tokens SET revokedAt").WithArgs("family").WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectCommit()
+
+	res := doRequest(db, config.Config{}, http.MethodPost, "/token-auth/refresh", bytes.NewBufferString(`{"refresh_token":"refresh"}`), t)
+	if res.Result().StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected %v but got %v", http.StatusUnauthorized, res.Result().StatusCode)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+// Test if logging out revokes the access token and the session of the refresh token.
+func TestPOSTTokenAuthLogout(t *testing.T) {
+	user := getTestUser()
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	cnf := config.Config{}
+
+	mock.ExpectQuery("SELECT EXISTS(.+) FROM revoked_tokens").WithArgs("test-token", user.ID).
+		WillReturnRows(sqlmock.NewRows([]string{"revoked", "version"}).AddRow(false, 0))
+	mock.ExpectExec("DELETE FROM revoked_tokens").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("INSERT IGNORE INTO revoked_tokens").WithArgs("test-token", user.ID, sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("UPDATE refresh_tokens SET revokedAt").WithArgs(user.ID, sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, 1))
+
+	url := "/token-auth/logout?token=" + getTokenString(user, t)
+	res := doRequest(db, cnf, http.MethodPost, url, bytes.NewBufferString(`{"refresh_token":"refresh"}`), t)
+	if res.Result().StatusCode != http.StatusOK {
+		t.Fatalf("Expected %v but got %v: %v", http.StatusOK, res.Result().StatusCode, res.Body.String())
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+// Test if a revoked access token can't be used to log out again.
+func TestPOSTTokenAuthLogoutRevoked(t *testing.T) {
+	user := getTestUser()
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	cnf := config.Config{}
+
+	mock.ExpectQuery("SELECT EXISTS(.+) FROM revoked_tokens").WithArgs("test-token", user.ID).
+		WillReturnRows(sqlmock.NewRows([]string{"revoked", "version"}).AddRow(true, 0))
+
+	res := doRequest(db, cnf, http.MethodPost, "/token-auth/logout?token="+getTokenString(user, t), bytes.NewBuffer(nil), t)
+	if res.Result().StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected %v but got %v", http.StatusUnauthorized, res.Result().StatusCode)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+// Test if logging out everywhere increments the token version and revokes every session.
+func TestPOSTTokenAuthLogoutAll(t *testing.T) {
+	user := getTestUser()
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	cnf := config.Config{}
+
+	mock.ExpectQuery("SELECT EXISTS(.+) FROM revoked_tokens").WithArgs("test-token", user.ID).
+		WillReturnRows(sqlmock.NewRows([]string{"revoked", "version"}).AddRow(false, 0))
+	mock.ExpectExec("INSERT INTO token_versions").WithArgs(user.ID).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("UPDATE refresh_tokens SET revokedAt").WithArgs(user.ID).WillReturnResult(sqlmock.NewResult(0, 3))
+
+	res := doRequest(db, cnf, http.MethodPost, "/token-auth/logout/all?token="+getTokenString(user, t), bytes.NewBuffer(nil), t)
+	if res.Result().StatusCode != http.StatusOK {
+		t.Fatalf("Expected %v but got %v: %v", http.StatusOK, res.Result().StatusCode, res.Body.String())
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+// Test if the other services can look up the status of a token.
+func TestGETIPCTokenStatus(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	cnf := config.Config{}
+
+	mock.ExpectQuery("SELECT EXISTS(.+) FROM revoked_tokens").WithArgs("abc", 1).
+		WillReturnRows(sqlmock.NewRows([]string{"revoked", "version"}).AddRow(true, 0))
+
+	ts := httptest.NewServer(InitRoutes(db, cnf, testKeys, ipc.FakeKeys(ipc.AuthenticationService), nil))
+	defer ts.Close()
+	revocations := ipc.NewRevocations(ts.URL, ipc.FakeKeys(ipc.PhotoService).Identity, 0)
+
+	revoked, err := revocations.Revoked(context.Background(), &middleware.Principal{ID: 1, TokenID: "abc"})
+	if err != nil {
+		t.Fatalf("Expected no error, instead got %v", err.Error())
+	}
+	if !revoked {
+		t.Errorf("Expected %v but got %v", true, revoked)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+// Test if the other services can verify the access tokens with the published keys.
+func TestGETJWKS(t *testing.T) {
+	ts := httptest.NewServer(InitRoutes(nil, config.Config{}, testKeys, ipc.FakeKeys(ipc.AuthenticationService), nil))
+	defer ts.Close()
+
+	kid := testKeys.SigningKey().ID
+	if _, err := jwks.NewRemote(ts.URL, 0).PublicKey(context.Background(), kid); err != nil {
+		t.Errorf("Expected no error, instead got %v", err.Error())
+	}
+}
+
+// Test if the profile service can log a user out everywhere.
+func TestPOSTIPCRevokeSessions(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	cnf := config.Config{}
+
+	mock.ExpectExec("INSERT INTO token_versions").WithArgs(5).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("UPDATE refresh_tokens SET revokedAt").WithArgs(5).WillReturnResult(sqlmock.NewResult(0, 2))
+
+	ts := httptest.NewServer(InitRoutes(db, cnf, testKeys, ipc.FakeKeys(ipc.AuthenticationService), nil))
+	defer ts.Close()
+
+	client := ipc.NewAuthenticationClient(ts.URL, ipc.FakeKeys(ipc.ProfileService).Identity)
+	if err := client.RevokeSessions(context.Background(), 5); err != nil {
+		t.Fatalf("Expected no error, instead got %v", err.Error())
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+// Test if a user can create a personal access token, which is only stored hashed.
+func TestPOSTTokenAuthTokens(t *testing.T) {
+	user := getTestUser()
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	cnf := config.Config{}
+
+	mock.ExpectQuery("SELECT EXISTS(.+) FROM revoked_tokens").WithArgs("test-token", user.ID).
+		WillReturnRows(sqlmock.NewRows([]string{"revoked", "version"}).AddRow(false, 0))
+	mock.ExpectExec("INSERT INTO personal_access_tokens").WithArgs(user.ID, "upload bot", "photos:write votes:read", sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(4, 1))
+
+	body := `{"name":"upload bot","scopes":["photos:write","votes:read"]}`
+	res := doRequest(db, cnf, http.MethodPost, "/token-auth/tokens?token="+getTokenString(user, t), bytes.NewBuffer([]byte(body)), t)
+	if res.Result().StatusCode != http.StatusOK {
+		t.Fatalf("Expected %v but got %v: %v", http.StatusOK, res.Result().StatusCode, res.Body.String())
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	token := &models.AccessToken{}
+	if err := json.Unmarshal(res.Body.Bytes(), token); err != nil {
+		t.Fatal(err)
+	}
+	if token.ID != 4 || !middleware.IsAccessToken(token.Token) {
+		t.Errorf("Expected token 4 with a personal access token but got %+v", token)
+	}
+}
+
+// Test if a personal access token can't manage the personal access tokens.
+func TestGETTokenAuthTokensWithAccessToken(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	res := doRequest(db, config.Config{}, http.MethodGet, "/token-auth/tokens?token="+middleware.AccessTokenPrefix+"abc", bytes.NewBuffer(nil), t)
+	if res.Result().StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected %v but got %v", http.StatusUnauthorized, res.Result().StatusCode)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+// Test if revoking a token of another user is answered with not found.
+func TestDELETETokenAuthTokensUnknown(t *testing.T) {
+	user := getTestUser()
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	mock.ExpectQuery("SELECT EXISTS(.+) FROM revoked_tokens").WithArgs("test-token", user.ID).
+		WillReturnRows(sqlmock.NewRows([]string{"revoked", "version"}).AddRow(false, 0))
+	mock.ExpectExec("DELETE FROM personal_access_tokens").WithArgs(8, user.ID).WillReturnResult(sqlmock.NewResult(0, 0))
+
+	res := doRequest(db, config.Config{}, http.MethodDelete, "/token-auth/tokens/8?token="+getTokenString(user, t), bytes.NewBuffer(nil), t)
+	if res.Result().StatusCode != http.StatusNotFound {
+		t.Errorf("Expected %v but got %v", http.StatusNotFound, res.Result().StatusCode)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+// Test if the other services can look up a personal access token and if its use is recorded.
+func TestGETIPCAccessTokens(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	cnf := config.Config{}
+
+	mock.ExpectQuery("SELECT (.+) FROM personal_access_tokens").WithArgs("abc").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "user_id", "scopes", "verified"}).AddRow(4, 1, "photos:write votes:read", true))
+	mock.ExpectExec("UPDATE personal_access_tokens SET lastUsedAt").WithArgs(4).WillReturnResult(sqlmock.NewResult(0, 1))
+
+	ts := httptest.NewServer(InitRoutes(db, cnf, testKeys, ipc.FakeKeys(ipc.AuthenticationService), nil))
+	defer ts.Close()
+	accessTokens := ipc.NewAccessTokens(ts.URL, ipc.FakeKeys(ipc.PhotoService).Identity, 0)
+
+	principal, err := accessTokens.AccessToken(context.Background(), "abc")
+	if err != nil {
+		t.Fatalf("Expected no error, instead got %v", err.Error())
+	}
+	if principal == nil || principal.ID != 1 || !principal.EmailVerified || !principal.HasScope(middleware.ScopeVotesRead) || principal.HasScope(middleware.ScopeVotesWrite) {
+		t.Errorf("Expected user 1 with the scopes of the token but got %+v", principal)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+// capture is a sqlmock argument which matches every value and records it.
+type capture struct {
+	value *string
+}
+
+func (c capture) Match(v driver.Value) bool {
+	*c.value = fmt.Sprint(v)
+	return true
+}
+
+// oidcLogin is a login with the mock provider which was started and sent back with a code.
+type oidcLogin struct {
+	code     string
+	state    string
+	secret   string
+	nonce    string
+	verifier string
+}
+
+// startOIDCLogin starts a login with the mock provider for the user with userID, 0 for a login, on r and follows the
+// authorization URL. The nonce and the code verifier are captured from the database.
+func startOIDCLogin(r http.Handler, mock sqlmock.Sqlmock, provider *oidctest.Provider, userID int, header http.Header, t *testing.T) *oidcLogin {
+	login := &oidcLogin{}
+	mock.ExpectExec("DELETE FROM oidc_logins WHERE expiresAt").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("INSERT INTO oidc_logins").WithArgs(sqlmock.AnyArg(), "mock", capture{&login.nonce}, capture{&login.verifier}, userID, sqlmock.AnyArg(), sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, 1))
+
+	url := "/token-auth/oidc/mock"
+	if userID > 0 {
+		url += "/link"
+	}
+	req, _ := http.NewRequest(http.MethodPost, url, nil)
+	for key := range header {
+		req.Header.Set(key, header.Get(key))
+	}
+	res := httptest.NewRecorder()
+	r.ServeHTTP(res, req)
+	if res.Code != http.StatusOK {
+		t.Fatalf("Expected %v but got %v: %v", http.StatusOK, res.Code, res.Body.String())
+	}
+
+	authorization := &models.OIDCAuthorization{}
+	if err := json.Unmarshal(res.Body.Bytes(), authorization); err != nil {
+		t.Fatal(err)
+	}
+	code, state, err := provider.Authorize(authorization.AuthorizationURL)
+	if err != nil {
+		t.Fatalf("Expected no error, instead got %v", err.Error())
+	}
+	login.code = code
+	login.state = state
+	login.secret = authorization.LoginSecret
+	return login
+}
+
+var oidcLoginColumns = []string{"provider", "nonce", "code_verifier", "user_id", "secret_hash", "expiresAt"}
+
+// expectOIDCLogin expects the use of login, started by the user with userID.
+func expectOIDCLogin(mock sqlmock.Sqlmock, login *oidcLogin, userID int) {
+	mock.ExpectQuery("SELECT (.+) FROM oidc_logins").WithArgs(oidc.HashState(login.state)).
+		WillReturnRows(sqlmock.NewRows(oidcLoginColumns).AddRow("mock", login.nonce, login.verifier, userID, oidc.HashState(login.secret), time.Now().Add(time.Minute)))
+	mock.ExpectExec("DELETE FROM oidc_logins WHERE state_hash").WithArgs(oidc.HashState(login.state)).WillReturnResult(sqlmock.NewResult(0, 1))
+}
+
+// completeOIDCLogin sends login back to r.
+func completeOIDCLogin(r http.Handler, login *oidcLogin) *httptest.ResponseRecorder {
+	body, _ := json.Marshal(&models.OIDCCallback{Code: login.code, State: login.state, LoginSecret: login.secret})
+	req, _ := http.NewRequest(http.MethodPost, "/token-auth/oidc/mock/callback", bytes.NewBuffer(body))
+	res := httptest.NewRecorder()
+	r.ServeHTTP(res, req)
+	return res
+}
+
+// newOIDCRoutes returns the routes with the mock provider and a profile service which creates the user with ID 9,
+// unless the email address is taken@example.com.
+func newOIDCRoutes(db *sql.DB, t *testing.T) (http.Handler, *oidctest.Provider, func()) {
+	provider := oidctest.NewServer("mfm")
+	profile := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests := make([]*sharedModels.CreateUserRequest, 0)
+		if err := ipc.ReadRequests(r, &requests); err != nil {
+			t.Fatal(err)
+		}
+		users := make([]*sharedModels.CreateUserResponse, 0)
+		for _, request := range requests {
+			if request.Email != "taken@example.com" {
+				users = append(users, &sharedModels.CreateUserResponse{ID: 9, Username: request.Username, Email: request.Email})
+			}
+		}
+		ipc.SendResults(w, users)
+	}))
+
+	cnf := config.Config{}
+	cnf.ProfileServiceBaseurl = profile.URL
+	providers := oidc.NewProviders([]oidc.ProviderConfig{provider.Config("mock", "http://localhost:4999/oidc/mock/callback")})
+	return InitRoutes(db, cnf, testKeys, ipc.FakeKeys(ipc.AuthenticationService), providers), provider, func() {
+		provider.Close()
+		profile.Close()
+	}
+}
+
+// Test if the first login with a provider creates a user, links the account and logs the user in.
+func TestPOSTTokenAuthOIDCNewUser(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	r, provider, closeAll := newOIDCRoutes(db, t)
+	defer closeAll()
+	identity := oidctest.Identity
+
+	login := startOIDCLogin(r, mock, provider, 0, nil, t)
+	expectOIDCLogin(mock, login, 0)
+	mock.ExpectQuery("SELECT (.+) FROM external_identities").WithArgs("mock", identity.Subject).WillReturnRows(sqlmock.NewRows([]string{"id", "user_id"}))
+	mock.ExpectExec("INSERT IGNORE INTO external_identities").WithArgs(9, "mock", identity.Subject, identity.Email).WillReturnResult(sqlmock.NewResult(3, 1))
+	mock.ExpectQuery("SELECT (.+) FROM users WHERE id").WithArgs(9).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "username", "createdAt", "email"}).AddRow(9, identity.Username, time.Now(), identity.Email))
+	mock.ExpectQuery("SELECT (.+) FROM two_factor").WithArgs(9).WillReturnRows(sqlmock.NewRows(twoFactorColumns))
+	mock.ExpectExec("INSERT INTO refresh_tokens").WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), 9, sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectQuery("SELECT (.+) FROM users").WithArgs(9, 9).WillReturnRows(sqlmock.NewRows([]string{"version", "verified"}).AddRow(0, true))
+
+	res := completeOIDCLogin(r, login)
+	if res.Code != http.StatusOK {
+		t.Fatalf("Expected %v but got %v: %v", http.StatusOK, res.Code, res.Body.String())
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	token := &models.Token{}
+	if err := json.Unmarshal(res.Body.Bytes(), token); err != nil {
+		t.Fatal(err)
+	}
+	if token.User.ID != 9 || token.Token == "" || token.RefreshToken == "" {
+		t.Errorf("Expected the tokens of user 9 but got %+v", token)
+	}
+}
+
+// Test if an account of a provider can't take over an existing user with the same email address.
+func TestPOSTTokenAuthOIDCEmailTaken(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	r, provider, closeAll := newOIDCRoutes(db, t)
+	defer closeAll()
+	identity := oidctest.Identity
+	identity.Email = "taken@example.com"
+	provider.SetIdentity(identity)
+
+	login := startOIDCLogin(r, mock, provider, 0, nil, t)
+	expectOIDCLogin(mock, login, 0)
+	mock.ExpectQuery("SELECT (.+) FROM external_identities").WithArgs("mock", identity.Subject).WillReturnRows(sqlmock.NewRows([]string{"id", "user_id"}))
+
+	res := completeOIDCLogin(r, login)
+	if res.Code != http.StatusConflict {
+		t.Errorf("Expected %v but got %v: %v", http.StatusConflict, res.Code, res.Body.String())
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+// Test if a logged in user can link an account of a provider.
+func TestPOSTTokenAuthOIDCLink(t *testing.T) {
+	user := getTestUser()
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	r, provider, closeAll := newOIDCRoutes(db, t)
+	defer closeAll()
+	identity := oidctest.Identity
+	identity.EmailVerified = false
+	provider.SetIdentity(identity)
+
+	mock.ExpectQuery("SELECT EXISTS(.+) FROM revoked_tokens").WithArgs("test-token", user.ID).
+		WillReturnRows(sqlmock.NewRows([]string{"revoked", "version"}).AddRow(false, 0))
+	login := startOIDCLogin(r, mock, provider, user.ID, http.Header{"Token": []string{getTokenString(user, t)}}, t)
+	expectOIDCLogin(mock, login, user.ID)
+	mock.ExpectQuery("SELECT (.+) FROM external_identities").WithArgs("mock", identity.Subject).WillReturnRows(sqlmock.NewRows([]string{"id", "user_id"}))
+	mock.ExpectExec("INSERT IGNORE INTO external_identities").WithArgs(user.ID, "mock", identity.Subject, identity.Email).WillReturnResult(sqlmock.NewResult(3, 1))
+
+	res := completeOIDCLogin(r, login)
+	if res.Code != http.StatusOK {
+		t.Fatalf("Expected %v but got %v: %v", http.StatusOK, res.Code, res.Body.String())
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	linked := &models.ExternalIdentity{}
+	if err := json.Unmarshal(res.Body.Bytes(), linked); err != nil {
+		t.Fatal(err)
+	}
+	if linked.ID != 3 || linked.Provider != "mock" {
+		t.Errorf("Expected identity 3 of mock but got %+v", linked)
+	}
+}
+
+// Test if a state which is unknown, used or expired is refused before the provider is asked.
+func TestPOSTTokenAuthOIDCInvalidState(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	r, _, closeAll := newOIDCRoutes(db, t)
+	defer closeAll()
+
+	mock.ExpectQuery("SELECT (.+) FROM oidc_logins").WithArgs(oidc.HashState("guessed")).
+		WillReturnRows(sqlmock.NewRows(oidcLoginColumns))
+
+	req, _ := http.NewRequest(http.MethodPost, "/token-auth/oidc/mock/callback", bytes.NewBuffer([]byte(`{"code":"code-1","state":"guessed","login_secret":"secret"}`)))
+	res := httptest.NewRecorder()
+	r.ServeHTTP(res, req)
+	if res.Code != http.StatusUnauthorized {
+		t.Errorf("Expected %v but got %v", http.StatusUnauthorized, res.Code)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+// Test if a login started by another client, like an attacker who hands the code and the state of a login with an
+// account of their own to a victim, is refused before the provider is asked.
+func TestPOSTTokenAuthOIDCOtherClient(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	r, provider, closeAll := newOIDCRoutes(db, t)
+	defer closeAll()
+
+	login := startOIDCLogin(r, mock, provider, 0, nil, t)
+	expectOIDCLogin(mock, login, 0)
+
+	secret, err := oidc.NewSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	login.secret = secret
+	res := completeOIDCLogin(r, login)
+	if res.Code != http.StatusUnauthorized {
+		t.Errorf("Expected %v but got %v: %v", http.StatusUnauthorized, res.Code, res.Body.String())
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+// Test if the providers are listed and an unknown provider is not found.
+func TestGETTokenAuthOIDC(t *testing.T) {
+	r, _, closeAll := newOIDCRoutes(nil, t)
+	defer closeAll()
+
+	req, _ := http.NewRequest(http.MethodGet, "/token-auth/oidc", nil)
+	res := httptest.NewRecorder()
+	r.ServeHTTP(res, req)
+	expected := `{"providers":["mock"]}`
+	if actual := strings.TrimSpace(res.Body.String()); actual != expected {
+		t.Errorf("Expected %v but got %v", expected, actual)
+	}
+
+	req, _ = http.NewRequest(http.MethodPost, "/token-auth/oidc/other", nil)
+	res = httptest.NewRecorder()
+	r.ServeHTTP(res, req)
+	if res.Code != http.StatusNotFound {
+		t.Errorf("Expected %v but got %v", http.StatusNotFound, res.Code)
+	}
+}
+
+// Test if the login attempts of a client are throttled.
+func TestPOSTTokenAuthThrottled(t *testing.T) {
+	r := InitRoutes(nil, config.Config{}, testKeys, ipc.FakeKeys(ipc.AuthenticationService), nil)
+
+	for i := 0; i <= loginPolicy.Limit; i++ {
+		req, err := http.NewRequest(http.MethodPost, "/token-auth", bytes.NewBuffer([]byte(`{}`)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.RemoteAddr = "10.0.0.1:1234"
+		res := httptest.NewRecorder()
+		r.ServeHTTP(res, req)
+
+		expected := http.StatusBadRequest
+		if i == loginPolicy.Limit {
+			expected = http.StatusTooManyRequests
+		}
+		if res.Result().StatusCode != expected {
+			t.Fatalf("Expected %v but got %v", expected, res.Result().StatusCode)
+		}
+	}
+}
+
 func doRequest(db *sql.DB, cnf config.Config, method string, url string, body *bytes.Buffer, t *testing.T) *httptest.ResponseRecorder {
-	r := InitRoutes(db, cnf)
+	r := InitRoutes(db, cnf, testKeys, ipc.FakeKeys(ipc.AuthenticationService), nil)
 	res := httptest.NewRecorder()
 	req, err := http.NewRequest(method, url, body)
 	if err != nil {
@@ -75,17 +986,34 @@ func getTestUser() *models.User {
 	return user
 }
 
-func getTokenString(cnf config.Config, user *models.User, t *testing.T) string {
+// testKeys sign the access tokens of the tests.
+var testKeys = newTestKeys()
+
+func newTestKeys() *jwks.Set {
+	key, err := jwks.GenerateKey()
+	if err != nil {
+		panic(err)
+	}
+	keys, err := jwks.NewSet(key)
+	if err != nil {
+		panic(err)
+	}
+	return keys
+}
+
+func getTokenString(user *models.User, t *testing.T) string {
 	expiration := time.Now().Add(time.Hour * 24 * 31).Unix()
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
 		"sub": user.ID,
+		"jti": "test-token",
+		"iss": middleware.TokenIssuer,
 		"iat": time.Now().Unix(),
 		"exp": expiration,
 	})
+	token.Header["kid"] = testKeys.SigningKey().ID
 
 	// Generate a signed token
-	secretKey := cnf.SecretKey
-	tokenString, err := token.SignedString([]byte(secretKey))
+	tokenString, err := token.SignedString(testKeys.SigningKey().Key)
 	if err != nil {
 		t.Error(err)
 		return ""
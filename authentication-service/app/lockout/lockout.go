@@ -0,0 +1,160 @@
+// Package lockout slows down and stops password guessing. The failed logins are counted per account and per IP
+// address. After half of the allowed failures every further failure doubles the time before the next attempt,
+// starting at a second, and once all of them are used up the account or the address is locked.
+//
+// The failures of an account or an address are forgotten when it didn't fail for the lockout duration, and a
+// successful login forgets the failures of the account.
+package lockout
+
+import (
+	"context"
+	"time"
+)
+
+// Kind is what the failures are counted for.
+type Kind string
+
+// The kinds of subjects.
+const (
+	Account Kind = "account"
+	Address Kind = "ip"
+)
+
+// Failures are the failed logins of a subject. LastFailureAt is the moment of the last one.
+type Failures struct {
+	Count         int
+	LastFailureAt time.Time
+}
+
+// Policy is how many failures a kind of subject is allowed and how long it is locked after them.
+type Policy struct {
+	MaxFailures int
+	Duration    time.Duration
+}
+
+// RetryAfter returns how long a subject with failures has to wait at now before its next attempt. It is zero when
+// the subject may try now.
+func (p Policy) RetryAfter(failures Failures, now time.Time) time.Duration {
+	free := p.MaxFailures / 2
+	if failures.Count <= free {
+		return 0
+	}
+
+	wait := p.Duration
+	if failures.Count < p.MaxFailures {
+		if shift := uint(failures.Count - free - 1); shift < 30 && time.Second<<shift < p.Duration {
+			wait = time.Second << shift
+		}
+	}
+	if retry := failures.LastFailureAt.Add(wait).Sub(now); retry > 0 {
+		return retry
+	}
+	return 0
+}
+
+// Store keeps the failures.
+type Store interface {
+	// Failures returns the failures of subject of kind.
+	Failures(ctx context.Context, kind Kind, subject string) (Failures, error)
+
+	// Add adds a failure at now to subject of kind and returns the number of its failures with it. The failures before
+	// forgetBefore are forgotten. Concurrent calls for a subject must count every failure once.
+	Add(ctx context.Context, kind Kind, subject string, now time.Time, forgetBefore time.Time) (int, error)
+
+	// Release takes back a failure of subject of kind.
+	Release(ctx context.Context, kind Kind, subject string) error
+
+	// Reset forgets the failures of subject of kind.
+	Reset(ctx context.Context, kind Kind, subject string) error
+}
+
+// Guard checks the logins of accounts from addresses against their policies.
+type Guard struct {
+	store    Store
+	policies map[Kind]Policy
+	now      func() time.Time
+}
+
+// NewGuard returns a Guard which keeps the failures in store and applies account to the accounts and address to the
+// IP addresses.
+func NewGuard(store Store, account Policy, address Policy) *Guard {
+	return &Guard{
+		store:    store,
+		policies: map[Kind]Policy{Account: account, Address: address},
+		now:      time.Now,
+	}
+}
+
+// Attempt returns how long a login to account from address has to wait, it is zero when the login may be tried now.
+// A login which may be tried is counted as a failure right away, before the credentials are checked, so concurrent
+// logins can't pass the policies together. Call Succeed or Release once the credentials turn out to be right.
+func (g *Guard) Attempt(ctx context.Context, account string, address string) (time.Duration, error) {
+	now := g.now()
+	subjects := g.subjects(account, address)
+
+	var retryAfter time.Duration
+	for _, subject := range subjects {
+		failures, err := g.store.Failures(ctx, subject.kind, subject.name)
+		if err != nil {
+			return 0, err
+		}
+		if retry := g.policies[subject.kind].RetryAfter(failures, now); retry > retryAfter {
+			retryAfter = retry
+		}
+	}
+	if retryAfter > 0 {
+		return retryAfter, nil
+	}
+
+	for i, subject := range subjects {
+		policy := g.policies[subject.kind]
+		count, err := g.store.Add(ctx, subject.kind, subject.name, now, now.Add(-policy.Duration))
+		if err != nil {
+			g.release(ctx, subjects[:i])
+			return 0, err
+		}
+		if count > policy.MaxFailures && policy.Duration > retryAfter {
+			retryAfter = policy.Duration
+		}
+	}
+	// Concurrent logins took the last failures
+	if retryAfter > 0 {
+		g.release(ctx, subjects)
+	}
+	return retryAfter, nil
+}
+
+// Release takes back the failure counted by Attempt for a login to account from address which didn't fail, like a
+// login with the right password which still needs a second factor.
+func (g *Guard) Release(ctx context.Context, account string, address string) error {
+	return g.release(ctx, g.subjects(account, address))
+}
+
+// Succeed forgets the failures of account after a login from address. The failures of the address are kept, otherwise
+// an attacker could reset them by logging in to an account of their own now and then.
+func (g *Guard) Succeed(ctx context.Context, account string, address string) error {
+	if err := g.store.Reset(ctx, Account, account); err != nil {
+		return err
+	}
+	return g.store.Release(ctx, Address, address)
+}
+
+// release takes back a failure of each of subjects.
+func (g *Guard) release(ctx context.Context, subjects []subject) error {
+	for _, subject := range subjects {
+		if err := g.store.Release(ctx, subject.kind, subject.name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type subject struct {
+	kind Kind
+	name string
+}
+
+// subjects returns the subjects of a login, the account first.
+func (g *Guard) subjects(account string, address string) []subject {
+	return []subject{{Account, account}, {Address, address}}
+}
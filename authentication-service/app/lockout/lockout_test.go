@@ -0,0 +1,176 @@
+package lockout
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type memoryStore struct {
+	mu       sync.Mutex
+	failures map[Kind]map[string]Failures
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{failures: map[Kind]map[string]Failures{Account: {}, Address: {}}}
+}
+
+func (s *memoryStore) Failures(ctx context.Context, kind Kind, subject string) (Failures, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.failures[kind][subject], nil
+}
+
+func (s *memoryStore) Add(ctx context.Context, kind Kind, subject string, now time.Time, forgetBefore time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	failures := s.failures[kind][subject]
+	if failures.LastFailureAt.Before(forgetBefore) {
+		failures.Count = 0
+	}
+	s.failures[kind][subject] = Failures{Count: failures.Count + 1, LastFailureAt: now}
+	return failures.Count + 1, nil
+}
+
+func (s *memoryStore) Release(ctx context.Context, kind Kind, subject string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if failures := s.failures[kind][subject]; failures.Count > 0 {
+		failures.Count--
+		s.failures[kind][subject] = failures
+	}
+	return nil
+}
+
+func (s *memoryStore) Reset(ctx context.Context, kind Kind, subject string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.failures[kind], subject)
+	return nil
+}
+
+func TestRetryAfter(t *testing.T) {
+	policy := Policy{MaxFailures: 10, Duration: 15 * time.Minute}
+	now := time.Now()
+
+	tests := []struct {
+		failures int
+		expected time.Duration
+	}{
+		{5, 0},
+		{6, time.Second},
+		{7, 2 * time.Second},
+		{9, 8 * time.Second},
+		{10, 15 * time.Minute},
+	}
+	for _, test := range tests {
+		actual := policy.RetryAfter(Failures{Count: test.failures, LastFailureAt: now}, now)
+		if actual != test.expected {
+			t.Errorf("Expected %v after %v failures but got %v", test.expected, test.failures, actual)
+		}
+	}
+
+	// The wait is counted from the last failure
+	if actual := policy.RetryAfter(Failures{Count: 10, LastFailureAt: now.Add(-time.Hour)}, now); actual != 0 {
+		t.Errorf("Expected %v but got %v", 0, actual)
+	}
+}
+
+// Test if an account is locked after its failures, independent of the addresses, and unlocked by a success.
+func TestGuard(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+	guard := NewGuard(newMemoryStore(), Policy{MaxFailures: 4, Duration: time.Minute}, Policy{MaxFailures: 100, Duration: time.Minute})
+	guard.now = func() time.Time { return now }
+
+	for i := 0; i < 4; i++ {
+		if retry, err := guard.Attempt(ctx, "username", "10.0.0."+strconv.Itoa(i+1)); err != nil || retry != 0 {
+			t.Fatalf("Expected attempt %v to be allowed but got %v, %v", i+1, retry, err)
+		}
+		now = now.Add(time.Minute / 2)
+	}
+	now = now.Add(-time.Minute / 2)
+	if retry, _ := guard.Attempt(ctx, "username", "10.0.0.9"); retry != time.Minute {
+		t.Errorf("Expected %v but got %v", time.Minute, retry)
+	}
+	if retry, _ := guard.Attempt(ctx, "other", "10.0.0.1"); retry != 0 {
+		t.Errorf("Expected another account to be allowed but got %v", retry)
+	}
+
+	if err := guard.Succeed(ctx, "username", "10.0.0.9"); err != nil {
+		t.Fatal(err)
+	}
+	if retry, _ := guard.Attempt(ctx, "username", "10.0.0.9"); retry != 0 {
+		t.Errorf("Expected %v but got %v", 0, retry)
+	}
+}
+
+// Test if an address is locked after its failures, independent of the accounts.
+func TestGuardAddress(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+	guard := NewGuard(newMemoryStore(), Policy{MaxFailures: 100, Duration: time.Minute}, Policy{MaxFailures: 4, Duration: time.Minute})
+	guard.now = func() time.Time { return now }
+
+	for _, account := range []string{"a", "b", "c", "d"} {
+		if retry, err := guard.Attempt(ctx, account, "10.0.0.1"); err != nil || retry != 0 {
+			t.Fatalf("Expected %v to be allowed but got %v, %v", account, retry, err)
+		}
+		now = now.Add(time.Minute / 2)
+	}
+	now = now.Add(-time.Minute / 2)
+	if retry, _ := guard.Attempt(ctx, "e", "10.0.0.1"); retry != time.Minute {
+		t.Errorf("Expected %v but got %v", time.Minute, retry)
+	}
+
+	// The failures are forgotten after the lockout
+	now = now.Add(2 * time.Minute)
+	if retry, _ := guard.Attempt(ctx, "e", "10.0.0.1"); retry != 0 {
+		t.Errorf("Expected %v but got %v", 0, retry)
+	}
+}
+
+// Test if a released attempt isn't counted.
+func TestGuardRelease(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryStore()
+	guard := NewGuard(store, Policy{MaxFailures: 4, Duration: time.Minute}, Policy{MaxFailures: 4, Duration: time.Minute})
+
+	for i := 0; i < 10; i++ {
+		if retry, err := guard.Attempt(ctx, "username", "10.0.0.1"); err != nil || retry != 0 {
+			t.Fatalf("Expected attempt %v to be allowed but got %v, %v", i+1, retry, err)
+		}
+		if err := guard.Release(ctx, "username", "10.0.0.1"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if failures, _ := store.Failures(ctx, Account, "username"); failures.Count != 0 {
+		t.Errorf("Expected %v but got %v", 0, failures.Count)
+	}
+}
+
+// Test if concurrent attempts can't pass the policy together.
+func TestGuardConcurrent(t *testing.T) {
+	ctx := context.Background()
+	guard := NewGuard(newMemoryStore(), Policy{MaxFailures: 4, Duration: time.Minute}, Policy{MaxFailures: 100, Duration: time.Minute})
+
+	var allowed int32
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if retry, err := guard.Attempt(ctx, "username", "10.0.0."+strconv.Itoa(i)); err == nil && retry == 0 {
+				atomic.AddInt32(&allowed, 1)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if allowed > 4 {
+		t.Errorf("Expected at most %v attempts but got %v", 4, allowed)
+	}
+}
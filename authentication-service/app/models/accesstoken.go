@@ -0,0 +1,75 @@
+package models
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/bstaijen/mariadb-for-microservices/shared/apierror"
+	"github.com/bstaijen/mariadb-for-microservices/shared/util/middleware"
+)
+
+// MaxAccessTokenNameLength is the maximum length of the name of a personal access token.
+const MaxAccessTokenNameLength = 100
+
+// AccessToken is a personal access token of a user. LastUsedAt is nil for a token which was never used. Token is
+// only set in the answer to its creation, only its hash is stored.
+type AccessToken struct {
+	ID         int        `json:"id"`
+	Name       string     `json:"name"`
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	LastUsedAt *time.Time `json:"lastUsedAt"`
+	Token      string     `json:"token,omitempty"`
+}
+
+// AccessTokenCreate is the body of the creation of a personal access token.
+type AccessTokenCreate struct {
+	Name   string   `json:"name"`
+	Scopes []string `json:"scopes"`
+}
+
+// Validate returns an error when the name is empty or too long, or when the scopes are empty or unknown.
+// Duplicate scopes are removed.
+func (a *AccessTokenCreate) Validate() error {
+	a.Name = strings.TrimSpace(a.Name)
+	if len(a.Name) < 1 {
+		return ErrAccessTokenNameMissing
+	}
+	if len(a.Name) > MaxAccessTokenNameLength {
+		return ErrAccessTokenNameTooLong
+	}
+	if len(a.Scopes) < 1 {
+		return ErrAccessTokenScopesMissing
+	}
+
+	scopes := make([]string, 0, len(a.Scopes))
+	for _, scope := range a.Scopes {
+		if !contains(middleware.Scopes, scope) {
+			return apierror.New(apierror.InvalidArgument, fmt.Sprintf("Unknown scope %q, expected one of %v", scope, strings.Join(middleware.Scopes, ", ")))
+		}
+		if !contains(scopes, scope) {
+			scopes = append(scopes, scope)
+		}
+	}
+	a.Scopes = scopes
+	return nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// ErrAccessTokenNameMissing is returned when a personal access token has no name.
+var ErrAccessTokenNameMissing = apierror.New(apierror.InvalidArgument, "Please provide a name for the token")
+
+// ErrAccessTokenNameTooLong is returned when the name of a personal access token is too long.
+var ErrAccessTokenNameTooLong = apierror.New(apierror.InvalidArgument, fmt.Sprintf("The name of the token can't be longer than %v characters", MaxAccessTokenNameLength))
+
+// ErrAccessTokenScopesMissing is returned when a personal access token has no scopes.
+var ErrAccessTokenScopesMissing = apierror.New(apierror.InvalidArgument, "Please provide at least one scope for the token")
@@ -1 +1,30 @@
 package models
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/bstaijen/mariadb-for-microservices/shared/util/middleware"
+)
+
+func TestAccessTokenCreateValidate(t *testing.T) {
+	token := &AccessTokenCreate{Name: " upload bot ", Scopes: []string{middleware.ScopePhotosWrite, middleware.ScopePhotosWrite}}
+	if err := token.Validate(); err != nil {
+		t.Fatalf("Expected no error, instead got %v", err.Error())
+	}
+	if token.Name != "upload bot" || len(token.Scopes) != 1 {
+		t.Errorf("Expected %v with 1 scope but got %+v", "upload bot", token)
+	}
+
+	invalid := []*AccessTokenCreate{
+		{Name: "", Scopes: []string{middleware.ScopePhotosWrite}},
+		{Name: strings.Repeat("a", MaxAccessTokenNameLength+1), Scopes: []string{middleware.ScopePhotosWrite}},
+		{Name: "bot"},
+		{Name: "bot", Scopes: []string{"admin"}},
+	}
+	for _, token := range invalid {
+		if err := token.Validate(); err == nil {
+			t.Errorf("Expected an error for %+v", token)
+		}
+	}
+}
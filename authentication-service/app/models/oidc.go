@@ -0,0 +1,45 @@
+package models
+
+import "time"
+
+// OIDCProviders lists the names of the OpenID Connect providers users can log in with.
+type OIDCProviders struct {
+	Providers []string `json:"providers"`
+}
+
+// OIDCAuthorization is the answer to the start of a login with an OpenID Connect provider. The client sends the user
+// to AuthorizationURL, the provider sends the user back to the redirect URL of the provider with a code and a state.
+// The client keeps LoginSecret to itself and sends it along with them, so only the client which started the login can
+// complete it.
+type OIDCAuthorization struct {
+	AuthorizationURL string `json:"authorization_url"`
+	LoginSecret      string `json:"login_secret"`
+}
+
+// OIDCCallback is the body of the completion of a login with an OpenID Connect provider, the parameters of the
+// redirect back from the provider and the login secret of the client which started the login.
+type OIDCCallback struct {
+	Code        string `json:"code"`
+	State       string `json:"state"`
+	LoginSecret string `json:"login_secret"`
+}
+
+// OIDCLogin is a login with an OpenID Connect provider which was started and not completed yet. UserID is the user
+// who links the provider, or 0 for a login. SecretHash is the hash of the login secret of the client which started it.
+type OIDCLogin struct {
+	Provider     string
+	Nonce        string
+	CodeVerifier string
+	UserID       int
+	SecretHash   string
+	ExpiresAt    time.Time
+}
+
+// ExternalIdentity is an account of a user at an OpenID Connect provider, which the user can log in with. Email is
+// the address the provider knew when the identity was linked.
+type ExternalIdentity struct {
+	ID        int       `json:"id"`
+	Provider  string    `json:"provider"`
+	Email     string    `json:"email"`
+	CreatedAt time.Time `json:"createdAt"`
+}
@@ -1,8 +1,19 @@
 package models
 
-// Token contains the token properties
+// Token contains the token properties. Token is the short-lived access token, RefreshToken renews it on
+// POST /token-auth/refresh.
 type Token struct {
-	Token     string `json:"token"`
-	ExpiresOn string `json:"expires_on"`
-	User      User   `json:"user"`
+	Token            string `json:"token"`
+	ExpiresOn        string `json:"expires_on"`
+	RefreshToken     string `json:"refresh_token"`
+	RefreshExpiresOn string `json:"refresh_expires_on"`
+	User             User   `json:"user"`
+}
+
+// Challenge is sent instead of a Token when the user enabled two-factor authentication. ChallengeToken together with
+// a code is exchanged for the Token on POST /token-auth/2fa.
+type Challenge struct {
+	TwoFactorRequired bool   `json:"two_factor_required"`
+	ChallengeToken    string `json:"challenge_token"`
+	ExpiresOn         string `json:"expires_on"`
 }
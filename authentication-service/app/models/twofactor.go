@@ -0,0 +1,10 @@
+package models
+
+// TwoFactor contains the TOTP secret of a user. It is only used to log in once it is Enabled, after the user proved
+// that the authenticator app was set up. LastStep is the step of the last code used, which can't be used again.
+type TwoFactor struct {
+	UserID   int
+	Secret   string
+	Enabled  bool
+	LastStep int64
+}
@@ -0,0 +1,405 @@
+// Package oidc signs users in with external OpenID Connect providers. It implements the authorization code flow with
+// PKCE (RFC 7636): the user is sent to the login page of the provider with a state, a nonce and a code challenge,
+// and the provider sends the user back with a code. The code is exchanged for an ID token together with the code
+// verifier, and the ID token tells who the user is.
+//
+// The endpoints and the signing keys of a provider are discovered from its issuer, see
+// https://openid.net/specs/openid-connect-discovery-1_0.html.
+package oidc
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bstaijen/mariadb-for-microservices/shared/jwks"
+	jwt "github.com/dgrijalva/jwt-go"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// DiscoveryPath is the path below the issuer of the configuration of a provider.
+const DiscoveryPath = "/.well-known/openid-configuration"
+
+// Timeout is how long a request to a provider may take.
+const Timeout = 10 * time.Second
+
+// DefaultScopes are the scopes requested from a provider which configures none.
+var DefaultScopes = []string{"openid", "email", "profile"}
+
+// ProviderConfig is the configuration of a provider. Name identifies the provider in the routes and in the linked
+// identities, so it must not change once users signed in with it.
+type ProviderConfig struct {
+	Name         string   `yaml:"name"`
+	Issuer       string   `yaml:"issuer"`
+	ClientID     string   `yaml:"client_id"`
+	ClientSecret string   `yaml:"client_secret"`
+	RedirectURL  string   `yaml:"redirect_url"`
+	Scopes       []string `yaml:"scopes"`
+}
+
+var validName = regexp.MustCompile(`^[a-z0-9-]{1,64}$`)
+
+// ParseProviders parses text, a YAML or JSON list of provider configurations. Empty text means no providers. It
+// returns an error which lists every problem when a provider is invalid.
+func ParseProviders(text string) ([]ProviderConfig, error) {
+	configs := make([]ProviderConfig, 0)
+	if strings.TrimSpace(text) == "" {
+		return configs, nil
+	}
+	if err := yaml.UnmarshalStrict([]byte(text), &configs); err != nil {
+		return nil, fmt.Errorf("oidc: can not parse the providers: %v", err)
+	}
+
+	problems := make([]string, 0)
+	names := make(map[string]bool)
+	for i := range configs {
+		config := &configs[i]
+		if !validName.MatchString(config.Name) {
+			problems = append(problems, fmt.Sprintf("the name %q of provider %v must consist of 1 to 64 lower case letters, digits and dashes", config.Name, i+1))
+		} else if names[config.Name] {
+			problems = append(problems, fmt.Sprintf("the name %q is used by more than one provider", config.Name))
+		}
+		names[config.Name] = true
+
+		if u, err := url.Parse(config.Issuer); err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			problems = append(problems, fmt.Sprintf("the issuer of provider %q must be a URL", config.Name))
+		}
+		if config.ClientID == "" {
+			problems = append(problems, fmt.Sprintf("provider %q needs a client_id", config.Name))
+		}
+		if u, err := url.Parse(config.RedirectURL); err != nil || !u.IsAbs() || u.Fragment != "" {
+			problems = append(problems, fmt.Sprintf("the redirect_url of provider %q must be an absolute URL without a fragment", config.Name))
+		}
+
+		if len(config.Scopes) == 0 {
+			config.Scopes = DefaultScopes
+		} else if !contains(config.Scopes, "openid") {
+			config.Scopes = append([]string{"openid"}, config.Scopes...)
+		}
+	}
+	if len(problems) > 0 {
+		return nil, fmt.Errorf("oidc: invalid providers:\n  - %v", strings.Join(problems, "\n  - "))
+	}
+	return configs, nil
+}
+
+// Identity is the user an ID token was issued for. Subject identifies the user at the provider and never changes,
+// the other claims can. Username is the preferred username of the user, it may be empty.
+type Identity struct {
+	Subject       string
+	Email         string
+	EmailVerified bool
+	Username      string
+}
+
+// PreferredUsername returns the username a new user of the identity gets: the preferred username, or else the part
+// of the email address before the @.
+func (i *Identity) PreferredUsername() string {
+	if username := strings.TrimSpace(i.Username); username != "" {
+		return username
+	}
+	if at := strings.LastIndex(i.Email, "@"); at > 0 {
+		return i.Email[:at]
+	}
+	return "user"
+}
+
+// metadata is the part of the discovered configuration of a provider which the flow needs.
+type metadata struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// Provider is an OpenID Connect provider. The configuration of the provider is discovered on first use, so the
+// service starts while a provider is down.
+//
+// The provider is called with a plain HTTP client. The IPC client would send the request ID and the trace context of
+// the service to it, and its circuit breaker and retries are meant for the other services.
+type Provider struct {
+	config ProviderConfig
+	client *http.Client
+
+	mu       sync.Mutex
+	metadata *metadata
+	keys     *jwks.Remote
+}
+
+// NewProvider returns the provider of config.
+func NewProvider(config ProviderConfig) *Provider {
+	return &Provider{config: config, client: &http.Client{Timeout: Timeout}}
+}
+
+// Name returns the name of the provider.
+func (p *Provider) Name() string {
+	return p.config.Name
+}
+
+// Providers are the configured providers by their name.
+type Providers map[string]*Provider
+
+// NewProviders returns the providers of configs.
+func NewProviders(configs []ProviderConfig) Providers {
+	providers := make(Providers, len(configs))
+	for _, config := range configs {
+		providers[config.Name] = NewProvider(config)
+	}
+	return providers
+}
+
+// Names returns the names of the providers in alphabetical order.
+func (p Providers) Names() []string {
+	names := make([]string, 0, len(p))
+	for name := range p {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// AuthCodeURL returns the URL of the login page of the provider. State and nonce are random values which come back
+// in the redirect and in the ID token, verifier is the PKCE code verifier of the login.
+func (p *Provider) AuthCodeURL(ctx context.Context, state string, nonce string, verifier string) (string, error) {
+	m, err := p.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+	u, err := url.Parse(m.AuthorizationEndpoint)
+	if err != nil {
+		return "", err
+	}
+	query := u.Query()
+	query.Set("response_type", "code")
+	query.Set("client_id", p.config.ClientID)
+	query.Set("redirect_uri", p.config.RedirectURL)
+	query.Set("scope", strings.Join(p.config.Scopes, " "))
+	query.Set("state", state)
+	query.Set("nonce", nonce)
+	query.Set("code_challenge", Challenge(verifier))
+	query.Set("code_challenge_method", "S256")
+	u.RawQuery = query.Encode()
+	return u.String(), nil
+}
+
+// Exchange redeems code, which the provider handed out for the login with verifier and nonce, for an ID token and
+// returns the identity in it.
+func (p *Provider) Exchange(ctx context.Context, code string, verifier string, nonce string) (*Identity, error) {
+	m, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", p.config.RedirectURL)
+	form.Set("code_verifier", verifier)
+	form.Set("client_id", p.config.ClientID)
+
+	header := http.Header{}
+	header.Set("Content-Type", "application/x-www-form-urlencoded")
+	header.Set("Accept", "application/json")
+	if p.config.ClientSecret != "" {
+		// RFC 6749 section 2.3.1: the credentials are form encoded before they are put in the basic auth header
+		credentials := url.QueryEscape(p.config.ClientID) + ":" + url.QueryEscape(p.config.ClientSecret)
+		header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(credentials)))
+	}
+
+	type tokenResponse struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	token := &tokenResponse{}
+	var exchangeErr error
+	err = p.do(ctx, http.MethodPost, m.TokenEndpoint, header, []byte(form.Encode()), func(res *http.Response) {
+		body, err := ioutil.ReadAll(res.Body)
+		if err != nil {
+			exchangeErr = err
+			return
+		}
+		if err := json.Unmarshal(body, token); err != nil {
+			exchangeErr = fmt.Errorf("oidc: the token endpoint of %v answered %v with %v", p.config.Name, res.StatusCode, err)
+			return
+		}
+		if res.StatusCode != http.StatusOK {
+			exchangeErr = fmt.Errorf("oidc: the token endpoint of %v answered %v: %v %v", p.config.Name, res.StatusCode, token.Error, token.ErrorDescription)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if exchangeErr != nil {
+		return nil, exchangeErr
+	}
+	if token.IDToken == "" {
+		return nil, fmt.Errorf("oidc: the token endpoint of %v answered without an ID token", p.config.Name)
+	}
+	return p.verify(ctx, m, token.IDToken, nonce)
+}
+
+// verify checks the ID token rawIDToken of the login with nonce and returns its identity. The token must be signed
+// with RS256 and a key of the provider, must be issued by the provider for the client and must not be expired.
+func (p *Provider) verify(ctx context.Context, m *metadata, rawIDToken string, nonce string) (*Identity, error) {
+	tok, err := jwt.Parse(rawIDToken, func(t *jwt.Token) (interface{}, error) {
+		if t.Method != jwt.SigningMethodRS256 {
+			return nil, fmt.Errorf("unexpected signing method %v", t.Header["alg"])
+		}
+		kid, _ := t.Header["kid"].(string)
+		if kid == "" {
+			return nil, errors.New("token has no kid")
+		}
+		return p.keys.PublicKey(ctx, kid)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("oidc: invalid ID token of %v: %v", p.config.Name, err)
+	}
+
+	claims, ok := tok.Claims.(jwt.MapClaims)
+	if !ok || !tok.Valid {
+		return nil, fmt.Errorf("oidc: invalid ID token of %v", p.config.Name)
+	}
+	if !claims.VerifyExpiresAt(time.Now().Unix(), true) {
+		return nil, fmt.Errorf("oidc: the ID token of %v is expired or has no expiry", p.config.Name)
+	}
+	if iss, _ := claims["iss"].(string); iss != m.Issuer {
+		return nil, fmt.Errorf("oidc: unexpected issuer %v of an ID token of %v", claims["iss"], p.config.Name)
+	}
+	if !audienceContains(claims["aud"], p.config.ClientID) {
+		return nil, fmt.Errorf("oidc: the ID token of %v is not issued for the client", p.config.Name)
+	}
+	if claimed, _ := claims["nonce"].(string); claimed == "" || claimed != nonce {
+		return nil, fmt.Errorf("oidc: the ID token of %v has the wrong nonce", p.config.Name)
+	}
+
+	identity := &Identity{}
+	identity.Subject, _ = claims["sub"].(string)
+	if identity.Subject == "" {
+		return nil, fmt.Errorf("oidc: the ID token of %v has no subject", p.config.Name)
+	}
+	identity.Email, _ = claims["email"].(string)
+	identity.Username, _ = claims["preferred_username"].(string)
+	// Some providers send email_verified as a string
+	switch verified := claims["email_verified"].(type) {
+	case bool:
+		identity.EmailVerified = verified
+	case string:
+		identity.EmailVerified = verified == "true"
+	}
+	return identity, nil
+}
+
+// discover returns the configuration of the provider, which is fetched once.
+func (p *Provider) discover(ctx context.Context) (*metadata, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.metadata != nil {
+		return p.metadata, nil
+	}
+
+	issuer := strings.TrimSuffix(p.config.Issuer, "/")
+	m := &metadata{}
+	var discoverErr error
+	err := p.do(ctx, http.MethodGet, issuer+DiscoveryPath, nil, nil, func(res *http.Response) {
+		if res.StatusCode != http.StatusOK {
+			discoverErr = fmt.Errorf("oidc: the discovery of %v answered with statuscode %v", p.config.Name, res.StatusCode)
+			return
+		}
+		discoverErr = json.NewDecoder(res.Body).Decode(m)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if discoverErr != nil {
+		return nil, discoverErr
+	}
+	if strings.TrimSuffix(m.Issuer, "/") != issuer {
+		return nil, fmt.Errorf("oidc: %v claims to be the issuer %v instead of %v", p.config.Name, m.Issuer, p.config.Issuer)
+	}
+	if m.AuthorizationEndpoint == "" || m.TokenEndpoint == "" || m.JWKSURI == "" {
+		return nil, fmt.Errorf("oidc: the configuration of %v misses an endpoint", p.config.Name)
+	}
+
+	p.metadata = m
+	p.keys = jwks.NewRemoteURL(m.JWKSURI, 0, p.client)
+	return m, nil
+}
+
+// do sends a request with header and body to rawurl of the provider and hands the response to cb.
+func (p *Provider) do(ctx context.Context, method string, rawurl string, header http.Header, body []byte, cb func(*http.Response)) error {
+	req, err := http.NewRequestWithContext(ctx, method, rawurl, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	res, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	cb(res)
+	return nil
+}
+
+// NewSecret returns a random value for a state, a nonce or a code verifier: 32 random bytes, base64url encoded.
+func NewSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// HashState returns the hex encoded SHA-256 hash of state, or of the login secret of a login. The logins which were
+// started are stored by the hash of their state, so the database doesn't hold a state which can complete them.
+func HashState(state string) string {
+	sum := sha256.Sum256([]byte(state))
+	return hex.EncodeToString(sum[:])
+}
+
+// Challenge returns the S256 code challenge of verifier.
+func Challenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// audienceContains reports whether aud, the aud claim of a token, a string or a list of strings, contains clientID.
+func audienceContains(aud interface{}, clientID string) bool {
+	switch aud := aud.(type) {
+	case string:
+		return aud == clientID
+	case []interface{}:
+		for _, a := range aud {
+			if a == clientID {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
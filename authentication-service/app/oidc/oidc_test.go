@@ -0,0 +1,162 @@
+package oidc_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/bstaijen/mariadb-for-microservices/authentication-service/app/oidc"
+	"github.com/bstaijen/mariadb-for-microservices/authentication-service/app/oidc/oidctest"
+	"github.com/bstaijen/mariadb-for-microservices/shared/util"
+)
+
+func TestParseProviders(t *testing.T) {
+	configs, err := oidc.ParseProviders(`
+- name: corporate
+  issuer: https://login.example.com
+  client_id: mfm
+  redirect_url: https://app.example.com/oidc/corporate/callback
+  scopes: [email]
+`)
+	if err != nil {
+		t.Fatalf("Expected no error, instead got %v", err.Error())
+	}
+	if len(configs) != 1 {
+		t.Fatalf("Expected %v but got %v", 1, len(configs))
+	}
+	expected := "openid email"
+	if actual := strings.Join(configs[0].Scopes, " "); actual != expected {
+		t.Errorf("Expected %v but got %v", expected, actual)
+	}
+
+	configs, err = oidc.ParseProviders(`[{"name": "Corporate", "issuer": "login.example.com"}, {"name": "mock"}, {"name": "mock"}]`)
+	if err == nil {
+		t.Fatalf("Expected an error")
+	}
+	for _, expected := range []string{"lower case", "used by more than one", "issuer", "client_id", "redirect_url"} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("Expected %q in %q", expected, err.Error())
+		}
+	}
+}
+
+// Test if the requests to a provider don't carry the request ID of the service.
+func TestExchangeHeaders(t *testing.T) {
+	mock, err := oidctest.New("mfm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mu sync.Mutex
+	leaked := make([]string, 0)
+	mock.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get(util.RequestIDHeader) != "" {
+			mu.Lock()
+			leaked = append(leaked, r.URL.Path)
+			mu.Unlock()
+		}
+		mock.ServeHTTP(w, r)
+	}))
+	defer mock.Close()
+	provider := oidc.NewProvider(mock.Config("mock", "http://localhost:4999/callback"))
+
+	ctx := util.WithRequestID(context.Background(), "request-1")
+	authorizationURL, err := provider.AuthCodeURL(ctx, "state", "nonce", "verifier")
+	if err != nil {
+		t.Fatalf("Expected no error, instead got %v", err.Error())
+	}
+	code, _, err := mock.Authorize(authorizationURL)
+	if err != nil {
+		t.Fatalf("Expected no error, instead got %v", err.Error())
+	}
+	if _, err := provider.Exchange(ctx, code, "verifier", "nonce"); err != nil {
+		t.Fatalf("Expected no error, instead got %v", err.Error())
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(leaked) > 0 {
+		t.Errorf("Expected no request ID but got it at %v", leaked)
+	}
+}
+
+// Test the authorization code flow against the mock provider.
+func TestExchange(t *testing.T) {
+	mock := oidctest.NewServer("mfm")
+	defer mock.Close()
+	provider := oidc.NewProvider(mock.Config("mock", "http://localhost:4999/callback"))
+
+	authorizationURL, err := provider.AuthCodeURL(context.Background(), "state", "nonce", "verifier")
+	if err != nil {
+		t.Fatalf("Expected no error, instead got %v", err.Error())
+	}
+	u, _ := url.Parse(authorizationURL)
+	if u.Query().Get("code_challenge") != oidc.Challenge("verifier") {
+		t.Errorf("Expected %v but got %v", oidc.Challenge("verifier"), u.Query().Get("code_challenge"))
+	}
+
+	code, state, err := mock.Authorize(authorizationURL)
+	if err != nil {
+		t.Fatalf("Expected no error, instead got %v", err.Error())
+	}
+	if state != "state" {
+		t.Errorf("Expected %v but got %v", "state", state)
+	}
+
+	identity, err := provider.Exchange(context.Background(), code, "verifier", "nonce")
+	if err != nil {
+		t.Fatalf("Expected no error, instead got %v", err.Error())
+	}
+	if *identity != oidctest.Identity {
+		t.Errorf("Expected %v but got %v", oidctest.Identity, *identity)
+	}
+
+	// A code can be redeemed once
+	if _, err := provider.Exchange(context.Background(), code, "verifier", "nonce"); err == nil {
+		t.Errorf("Expected an error")
+	}
+}
+
+// Test if a code is only redeemed with the verifier and the nonce of its login.
+func TestExchangeWrongLogin(t *testing.T) {
+	mock := oidctest.NewServer("mfm")
+	defer mock.Close()
+	provider := oidc.NewProvider(mock.Config("mock", "http://localhost:4999/callback"))
+
+	cases := []struct {
+		verifier string
+		nonce    string
+	}{
+		{"other verifier", "nonce"},
+		{"verifier", "other nonce"},
+	}
+	for _, c := range cases {
+		authorizationURL, err := provider.AuthCodeURL(context.Background(), "state", "nonce", "verifier")
+		if err != nil {
+			t.Fatalf("Expected no error, instead got %v", err.Error())
+		}
+		code, _, err := mock.Authorize(authorizationURL)
+		if err != nil {
+			t.Fatalf("Expected no error, instead got %v", err.Error())
+		}
+		if _, err := provider.Exchange(context.Background(), code, c.verifier, c.nonce); err == nil {
+			t.Errorf("Expected an error for %v", c)
+		}
+	}
+}
+
+// Test if a provider which claims another issuer is refused.
+func TestDiscoveryWrongIssuer(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"issuer": "https://login.example.com", "authorization_endpoint": "https://login.example.com/authorize", "token_endpoint": "https://login.example.com/token", "jwks_uri": "https://login.example.com/keys"}`))
+	}))
+	defer server.Close()
+
+	provider := oidc.NewProvider(oidc.ProviderConfig{Name: "mock", Issuer: server.URL, ClientID: "mfm", RedirectURL: "http://localhost:4999/callback"})
+	if _, err := provider.AuthCodeURL(context.Background(), "state", "nonce", "verifier"); err == nil {
+		t.Errorf("Expected an error")
+	}
+}
@@ -0,0 +1,182 @@
+// Package oidctest provides a mock OpenID Connect provider for tests and local development. It publishes a
+// discovery document and a key set, redirects every authorization request straight back with a code, and redeems
+// the code for an ID token of a configurable identity after it checked the PKCE code verifier. The issuer is the
+// scheme and host the provider is reached on.
+package oidctest
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/bstaijen/mariadb-for-microservices/authentication-service/app/oidc"
+	"github.com/bstaijen/mariadb-for-microservices/shared/jwks"
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+// Identity is the user the mock provider signs in by default.
+var Identity = oidc.Identity{Subject: "248289761001", Email: "jane@example.com", EmailVerified: true, Username: "jane"}
+
+// Provider is a mock OpenID Connect provider.
+type Provider struct {
+	// Server serves the provider when it was started with NewServer, its URL is the issuer.
+	Server *httptest.Server
+	// ClientID is the client the provider issues ID tokens for.
+	ClientID string
+
+	keys *jwks.Set
+	mux  *http.ServeMux
+
+	mu       sync.Mutex
+	identity oidc.Identity
+	codes    map[string]grant
+	next     int
+}
+
+type grant struct {
+	challenge   string
+	nonce       string
+	redirectURI string
+}
+
+// New returns a mock provider which issues ID tokens for clientID, signed with a new key.
+func New(clientID string) (*Provider, error) {
+	key, err := jwks.GenerateKey()
+	if err != nil {
+		return nil, err
+	}
+	keys, err := jwks.NewSet(key)
+	if err != nil {
+		return nil, err
+	}
+	p := &Provider{ClientID: clientID, keys: keys, mux: http.NewServeMux(), identity: Identity, codes: make(map[string]grant)}
+	p.mux.HandleFunc(oidc.DiscoveryPath, p.discovery)
+	p.mux.Handle(jwks.Path, jwks.Handler(keys))
+	p.mux.HandleFunc("/authorize", p.authorize)
+	p.mux.HandleFunc("/token", p.token)
+	return p, nil
+}
+
+// NewServer starts a mock provider which issues ID tokens for clientID on a local port. The caller closes it.
+func NewServer(clientID string) *Provider {
+	p, err := New(clientID)
+	if err != nil {
+		panic(err)
+	}
+	p.Server = httptest.NewServer(p)
+	return p
+}
+
+// ServeHTTP serves the endpoints of the provider.
+func (p *Provider) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p.mux.ServeHTTP(w, r)
+}
+
+// Close shuts the server of the provider down.
+func (p *Provider) Close() {
+	p.Server.Close()
+}
+
+// Config returns the configuration of the provider for a client with redirectURL.
+func (p *Provider) Config(name string, redirectURL string) oidc.ProviderConfig {
+	return oidc.ProviderConfig{Name: name, Issuer: p.Server.URL, ClientID: p.ClientID, RedirectURL: redirectURL, Scopes: oidc.DefaultScopes}
+}
+
+// SetIdentity sets the user the next logins sign in.
+func (p *Provider) SetIdentity(identity oidc.Identity) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.identity = identity
+}
+
+// Authorize follows authorizationURL like a browser of a user who logs in, and returns the code and the state of
+// the redirect back to the client.
+func (p *Provider) Authorize(authorizationURL string) (code string, state string, err error) {
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	res, err := client.Get(authorizationURL)
+	if err != nil {
+		return "", "", err
+	}
+	defer res.Body.Close()
+	location, err := res.Location()
+	if err != nil {
+		return "", "", err
+	}
+	return location.Query().Get("code"), location.Query().Get("state"), nil
+}
+
+// issuer returns the issuer the provider is reached as by r.
+func issuer(r *http.Request) string {
+	if r.TLS != nil {
+		return "https://" + r.Host
+	}
+	return "http://" + r.Host
+}
+
+func (p *Provider) discovery(w http.ResponseWriter, r *http.Request) {
+	iss := issuer(r)
+	json.NewEncoder(w).Encode(map[string]string{
+		"issuer":                 iss,
+		"authorization_endpoint": iss + "/authorize",
+		"token_endpoint":         iss + "/token",
+		"jwks_uri":               iss + jwks.Path,
+	})
+}
+
+func (p *Provider) authorize(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	redirect, err := url.Parse(query.Get("redirect_uri"))
+	if err != nil || query.Get("client_id") != p.ClientID || query.Get("response_type") != "code" || query.Get("code_challenge_method") != "S256" {
+		http.Error(w, "invalid_request", http.StatusBadRequest)
+		return
+	}
+
+	p.mu.Lock()
+	p.next++
+	code := "code-" + strconv.Itoa(p.next)
+	p.codes[code] = grant{challenge: query.Get("code_challenge"), nonce: query.Get("nonce"), redirectURI: redirect.String()}
+	p.mu.Unlock()
+
+	values := redirect.Query()
+	values.Set("code", code)
+	values.Set("state", query.Get("state"))
+	redirect.RawQuery = values.Encode()
+	http.Redirect(w, r, redirect.String(), http.StatusFound)
+}
+
+func (p *Provider) token(w http.ResponseWriter, r *http.Request) {
+	p.mu.Lock()
+	g, ok := p.codes[r.PostFormValue("code")]
+	delete(p.codes, r.PostFormValue("code"))
+	identity := p.identity
+	p.mu.Unlock()
+
+	if !ok || r.PostFormValue("grant_type") != "authorization_code" || r.PostFormValue("redirect_uri") != g.redirectURI || oidc.Challenge(r.PostFormValue("code_verifier")) != g.challenge {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+		return
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+		"iss":                issuer(r),
+		"aud":                []string{p.ClientID},
+		"sub":                identity.Subject,
+		"email":              identity.Email,
+		"email_verified":     identity.EmailVerified,
+		"preferred_username": identity.Username,
+		"nonce":              g.nonce,
+		"iat":                time.Now().Unix(),
+		"exp":                time.Now().Add(5 * time.Minute).Unix(),
+	})
+	token.Header["kid"] = p.keys.SigningKey().ID
+	idToken, err := token.SignedString(p.keys.SigningKey().Key)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]string{"access_token": "mock", "token_type": "Bearer", "id_token": idToken})
+}
@@ -0,0 +1,185 @@
+// Package twofactor contains the second factor of a login: a TOTP code (RFC 6238) from an authenticator app or one of
+// the one-time recovery codes which are handed out when the user enables it.
+//
+// A user with two-factor authentication who logs in with the right password gets a challenge token instead of an
+// access token. The challenge token together with a code is exchanged for the access token. A challenge token is used
+// up by the right code or after ChallengeAttempts codes.
+package twofactor
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/bstaijen/mariadb-for-microservices/shared/jwks"
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/pquerna/otp"
+	"github.com/pquerna/otp/totp"
+)
+
+// Period is the number of seconds a TOTP code is valid.
+const Period = 30
+
+// Skew is the number of periods before and after the current one of which the codes are accepted as well, to allow
+// for clock drift.
+const Skew = 1
+
+// RecoveryCodes is the number of recovery codes a user gets.
+const RecoveryCodes = 10
+
+// ChallengeIssuer is the iss claim of a challenge token. It differs from the issuer of the access tokens, so a
+// challenge token is never accepted as an access token.
+const ChallengeIssuer = "mariadb-for-microservices/2fa"
+
+// ChallengeLifetime is how long the user has to enter the code after the password.
+const ChallengeLifetime = 5 * time.Minute
+
+// ChallengeAttempts is how many codes can be tried with a challenge token. After them the user has to log in with the
+// password again.
+const ChallengeAttempts = 5
+
+// Challenge is a challenge token. ID is its jti claim, with which the token is used up.
+type Challenge struct {
+	ID        string
+	UserID    int
+	ExpiresAt time.Time
+}
+
+var validateOpts = totp.ValidateOpts{Period: Period, Digits: otp.DigitsSix, Algorithm: otp.AlgorithmSHA1}
+
+// NewSecret returns a new TOTP secret for the user named account and the otpauth:// URI with which an authenticator
+// app adds it, usually shown as a QR code.
+func NewSecret(issuer string, account string) (secret string, uri string, err error) {
+	key, err := totp.Generate(totp.GenerateOpts{Issuer: issuer, AccountName: account, Period: Period})
+	if err != nil {
+		return "", "", err
+	}
+	return key.Secret(), key.URL(), nil
+}
+
+// Step returns the number of the period of t.
+func Step(t time.Time) int64 {
+	return t.Unix() / Period
+}
+
+// Validate checks code against secret at now. It returns the step of the code, which must be greater than lastStep,
+// the step of the code used before, so a code can't be used twice.
+func Validate(secret string, code string, now time.Time, lastStep int64) (int64, bool) {
+	code = strings.TrimSpace(code)
+	current := Step(now)
+	for step := current - Skew; step <= current+Skew; step++ {
+		if step <= lastStep {
+			continue
+		}
+		expected, err := totp.GenerateCodeCustom(secret, time.Unix(step*Period, 0), validateOpts)
+		if err != nil {
+			return 0, false
+		}
+		if expected == code {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// IsRecoveryCode returns true when code looks like a recovery code instead of a TOTP code.
+func IsRecoveryCode(code string) bool {
+	return len(normalize(code)) == 10
+}
+
+// NewRecoveryCodes returns RecoveryCodes new recovery codes, formatted for the user, and their hashes, which are
+// stored.
+func NewRecoveryCodes() ([]string, []string, error) {
+	const alphabet = "abcdefghijklmnopqrstuvwxyz234567"
+
+	codes := make([]string, 0, RecoveryCodes)
+	hashes := make([]string, 0, RecoveryCodes)
+	for i := 0; i < RecoveryCodes; i++ {
+		b := make([]byte, 10)
+		if _, err := rand.Read(b); err != nil {
+			return nil, nil, err
+		}
+		for j := range b {
+			b[j] = alphabet[b[j]&31]
+		}
+		code := fmt.Sprintf("%s-%s", b[:5], b[5:])
+		codes = append(codes, code)
+		hashes = append(hashes, HashRecoveryCode(code))
+	}
+	return codes, hashes, nil
+}
+
+// HashRecoveryCode returns the SHA-256 hash of code, ignoring case, spaces and dashes.
+func HashRecoveryCode(code string) string {
+	sum := sha256.Sum256([]byte(normalize(code)))
+	return hex.EncodeToString(sum[:])
+}
+
+func normalize(code string) string {
+	return strings.NewReplacer("-", "", " ", "").Replace(strings.ToLower(strings.TrimSpace(code)))
+}
+
+// NewChallenge returns a challenge token for the user with userID, signed with key, and its claims.
+func NewChallenge(key *jwks.PrivateKey, userID int) (string, Challenge, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", Challenge{}, err
+	}
+	now := time.Now()
+	challenge := Challenge{ID: hex.EncodeToString(b), UserID: userID, ExpiresAt: now.Add(ChallengeLifetime)}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+		"sub": userID,
+		"jti": challenge.ID,
+		"iss": ChallengeIssuer,
+		"iat": now.Unix(),
+		"exp": challenge.ExpiresAt.Unix(),
+	})
+	token.Header["kid"] = key.ID
+	tokenString, err := token.SignedString(key.Key)
+	if err != nil {
+		return "", Challenge{}, err
+	}
+	return tokenString, challenge, nil
+}
+
+// ParseChallenge verifies the challenge token tokenString against keys and returns its claims.
+func ParseChallenge(ctx context.Context, keys jwks.KeySet, tokenString string) (Challenge, error) {
+	tok, err := jwt.Parse(tokenString, func(t *jwt.Token) (interface{}, error) {
+		if t.Method != jwt.SigningMethodRS256 {
+			return nil, fmt.Errorf("unexpected signing method %v", t.Header["alg"])
+		}
+		kid, _ := t.Header["kid"].(string)
+		return keys.PublicKey(ctx, kid)
+	})
+	if err != nil {
+		return Challenge{}, err
+	}
+
+	claims, ok := tok.Claims.(jwt.MapClaims)
+	if !ok || !tok.Valid {
+		return Challenge{}, errors.New("challenge is invalid")
+	}
+	if !claims.VerifyExpiresAt(time.Now().Unix(), true) {
+		return Challenge{}, errors.New("challenge is expired or has no expiry")
+	}
+	if !claims.VerifyIssuer(ChallengeIssuer, true) {
+		return Challenge{}, fmt.Errorf("unexpected issuer %v", claims["iss"])
+	}
+	sub, ok := claims["sub"].(float64)
+	if !ok || sub < 1 || sub != math.Trunc(sub) {
+		return Challenge{}, fmt.Errorf("subject %v is not a user ID", claims["sub"])
+	}
+	jti, _ := claims["jti"].(string)
+	if jti == "" {
+		return Challenge{}, errors.New("challenge has no ID")
+	}
+	exp, _ := claims["exp"].(float64)
+	return Challenge{ID: jti, UserID: int(sub), ExpiresAt: time.Unix(int64(exp), 0)}, nil
+}
@@ -0,0 +1,97 @@
+package twofactor
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bstaijen/mariadb-for-microservices/shared/jwks"
+	"github.com/bstaijen/mariadb-for-microservices/shared/util/middleware"
+	"github.com/pquerna/otp/totp"
+)
+
+func TestValidate(t *testing.T) {
+	secret, uri, err := NewSecret("issuer", "username")
+	if err != nil {
+		t.Fatalf("Expected no error, instead got %v", err.Error())
+	}
+	if !strings.HasPrefix(uri, "otpauth://totp/") || !strings.Contains(uri, secret) {
+		t.Errorf("Expected an otpauth URI with the secret but got %v", uri)
+	}
+
+	now := time.Now()
+	code, err := totp.GenerateCodeCustom(secret, now, validateOpts)
+	if err != nil {
+		t.Fatalf("Expected no error, instead got %v", err.Error())
+	}
+
+	step, ok := Validate(secret, code, now, 0)
+	if !ok || step != Step(now) {
+		t.Errorf("Expected %v but got %v", Step(now), step)
+	}
+
+	// A code can't be used twice
+	if _, ok := Validate(secret, code, now, step); ok {
+		t.Errorf("Expected a used code to be rejected")
+	}
+
+	// The code of the previous period is still accepted
+	if _, ok := Validate(secret, code, now.Add(Period*time.Second), 0); !ok {
+		t.Errorf("Expected the code of the previous period to be accepted")
+	}
+	if _, ok := Validate(secret, code, now.Add(3*Period*time.Second), 0); ok {
+		t.Errorf("Expected an old code to be rejected")
+	}
+}
+
+func TestRecoveryCodes(t *testing.T) {
+	codes, hashes, err := NewRecoveryCodes()
+	if err != nil {
+		t.Fatalf("Expected no error, instead got %v", err.Error())
+	}
+	if len(codes) != RecoveryCodes || len(hashes) != RecoveryCodes {
+		t.Fatalf("Expected %v but got %v", RecoveryCodes, len(codes))
+	}
+	if !IsRecoveryCode(codes[0]) || IsRecoveryCode("123456") {
+		t.Errorf("Expected %v to be a recovery code", codes[0])
+	}
+	if HashRecoveryCode(strings.ToUpper(codes[0])) != hashes[0] {
+		t.Errorf("Expected the hash to ignore case")
+	}
+}
+
+// Test if a challenge token is not accepted as an access token.
+func TestChallenge(t *testing.T) {
+	key, err := jwks.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := jwks.NewSet(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	challenge, claims, err := NewChallenge(key, 5)
+	if err != nil {
+		t.Fatalf("Expected no error, instead got %v", err.Error())
+	}
+	parsed, err := ParseChallenge(context.Background(), keys, challenge)
+	if err != nil || parsed.UserID != 5 {
+		t.Errorf("Expected %v but got %v (%v)", 5, parsed.UserID, err)
+	}
+	if parsed.ID == "" || parsed.ID != claims.ID {
+		t.Errorf("Expected %v but got %v", claims.ID, parsed.ID)
+	}
+	if _, err := middleware.ParseToken(context.Background(), keys, challenge); err == nil {
+		t.Errorf("Expected the challenge to be rejected as an access token")
+	}
+
+	token, _, err := middleware.NewToken(key, 5, 0, false, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ParseChallenge(context.Background(), keys, token); err == nil {
+		t.Errorf("Expected the access token to be rejected as a challenge")
+	}
+}
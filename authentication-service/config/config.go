@@ -1,59 +1,50 @@
 package config
 
-import "os"
-import "strconv"
+import (
+	"time"
 
-// Config contains the configuration for the service
+	"github.com/bstaijen/mariadb-for-microservices/shared/settings"
+)
+
+// Config contains the configuration for the service. The tags describe how each field is loaded and validated,
+// see the settings package.
 type Config struct {
-	Port       int
-	DBUsername string
-	DBPassword string
-	DBHost     string
-	DBPort     int
-	Database   string
-	SecretKey  string
+	Port                  int           `env:"PORT" required:"true" min:"1" max:"65535"`
+	DBUsername            string        `env:"DB_USERNAME" required:"true"`
+	DBPassword            string        `env:"DB_PASSWORD"`
+	DBHost                string        `env:"DB_HOST" required:"true"`
+	DBPort                int           `env:"DB_PORT" default:"3306" min:"1" max:"65535"`
+	Database              string        `env:"DB" required:"true"`
+	DBConnectTimeout      time.Duration `env:"DB_CONNECT_TIMEOUT"`
+	DBMaxOpenConns        int           `env:"DB_MAX_OPEN_CONNS" min:"0"`
+	DBMaxIdleConns        int           `env:"DB_MAX_IDLE_CONNS" min:"0"`
+	DBConnMaxLifetime     time.Duration `env:"DB_CONN_MAX_LIFETIME"`
+	ShutdownTimeout       time.Duration `env:"SHUTDOWN_TIMEOUT"`
+	SigningKeyFiles       []string      `env:"SIGNING_KEY_FILES"`
+	IPCKeyFile            string        `env:"IPC_KEY_FILE" required:"true"`
+	IPCPublicKeys         string        `env:"IPC_PUBLIC_KEYS"`
+	AccessTokenLifetime   time.Duration `env:"ACCESS_TOKEN_LIFETIME" default:"15m"`
+	RefreshTokenLifetime  time.Duration `env:"REFRESH_TOKEN_LIFETIME" default:"720h"`
+	TOTPIssuer            string        `env:"TOTP_ISSUER" default:"mariadb-for-microservices"`
+	LoginMaxFailures      int           `env:"LOGIN_MAX_FAILURES" default:"10" min:"1"`
+	LoginMaxFailuresIP    int           `env:"LOGIN_MAX_FAILURES_PER_IP" default:"50" min:"1"`
+	LoginLockout          time.Duration `env:"LOGIN_LOCKOUT" default:"15m"`
+	OIDCProviders         string        `env:"OIDC_PROVIDERS"`
+	ProfileServiceBaseurl string        `env:"PROFILE_SERVICE_URL"`
+	RequestTimeout        time.Duration `env:"REQUEST_TIMEOUT"`
+	OTLPEndpoint          string        `env:"OTEL_EXPORTER_OTLP_ENDPOINT"`
+	CORSAllowedOrigins    []string      `env:"CORS_ALLOWED_ORIGINS"`
+	CORSAllowedMethods    []string      `env:"CORS_ALLOWED_METHODS"`
+	CORSAllowedHeaders    []string      `env:"CORS_ALLOWED_HEADERS"`
+	CORSAllowCredentials  bool          `env:"CORS_ALLOW_CREDENTIALS"`
+	CORSMaxAge            time.Duration `env:"CORS_MAX_AGE"`
 }
 
-// LoadConfig returns the config from the environment variables
-func LoadConfig() Config {
-
+// LoadConfig returns the config from the defaults, the configuration file, the environment variables and args, the
+// command-line arguments without the program name. It returns a *settings.Error with every problem when the
+// config is invalid.
+func LoadConfig(args []string) (Config, error) {
 	config := Config{}
-
-	if _, ok := os.LookupEnv("PORT"); ok {
-		portString := os.Getenv("PORT")
-		port, err := strconv.ParseInt(portString, 10, 0)
-		if err == nil {
-			config.Port = int(port)
-		}
-	}
-
-	if _, ok := os.LookupEnv("DB_USERNAME"); ok {
-		config.DBUsername = os.Getenv("DB_USERNAME")
-	}
-
-	if _, ok := os.LookupEnv("DB_PASSWORD"); ok {
-		config.DBPassword = os.Getenv("DB_PASSWORD")
-	}
-
-	if _, ok := os.LookupEnv("DB_HOST"); ok {
-		config.DBHost = os.Getenv("DB_HOST")
-	}
-
-	if _, ok := os.LookupEnv("DB_PORT"); ok {
-		portString := os.Getenv("DB_PORT")
-		port, err := strconv.Atoi(portString)
-		if err == nil {
-			config.DBPort = port
-		}
-	}
-
-	if _, ok := os.LookupEnv("DB"); ok {
-		config.Database = os.Getenv("DB")
-	}
-
-	if _, ok := os.LookupEnv("SECRET_KEY"); ok {
-		config.SecretKey = os.Getenv("SECRET_KEY")
-	}
-
-	return config
+	err := settings.Load(&config, args)
+	return config, err
 }
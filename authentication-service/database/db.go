@@ -1,19 +1,26 @@
 package db
 
 import (
+	"context"
 	"database/sql"
-	"errors"
 	"fmt"
+	"strings"
 
 	log "github.com/Sirupsen/logrus"
 
 	"time"
 
+	"github.com/bstaijen/mariadb-for-microservices/authentication-service/app/lockout"
 	"github.com/bstaijen/mariadb-for-microservices/authentication-service/app/models"
 	"github.com/bstaijen/mariadb-for-microservices/authentication-service/config"
+	"github.com/bstaijen/mariadb-for-microservices/shared/apierror"
+	"github.com/bstaijen/mariadb-for-microservices/shared/bootstrap"
+	"github.com/bstaijen/mariadb-for-microservices/shared/tracing"
+	"github.com/bstaijen/mariadb-for-microservices/shared/util/middleware"
 )
 
-// OpenConnection opens the connection to the database
+// OpenConnection opens the connection to the database. It waits for the database to come online for at most
+// cnf.DBConnectTimeout.
 func OpenConnection(cnf config.Config) (*sql.DB, error) {
 	username := cnf.DBUsername
 	password := cnf.DBPassword
@@ -24,14 +31,14 @@ func OpenConnection(cnf config.Config) (*sql.DB, error) {
 	dsn := fmt.Sprintf("%v:%v@tcp(%v:%v)/%v?parseTime=true", username, password, host, port, database)
 
 	log.Debugf("Connect to : %v", dsn)
-	db, err := sql.Open("mysql", dsn)
-	if err != nil {
-		return nil, ErrCanNotConnectWithDatabase
-	}
-
-	// Open doesn't open a connection. Validate DSN data:
-	err = db.Ping()
+	db, err := bootstrap.OpenDB(context.Background(), "mysql", dsn, bootstrap.DBOptions{
+		ConnectTimeout:  cnf.DBConnectTimeout,
+		MaxOpenConns:    cnf.DBMaxOpenConns,
+		MaxIdleConns:    cnf.DBMaxIdleConns,
+		ConnMaxLifetime: cnf.DBConnMaxLifetime,
+	})
 	if err != nil {
+		log.Error(err)
 		return nil, ErrCanNotConnectWithDatabase
 	}
 	return db, nil
@@ -43,9 +50,9 @@ func CloseConnection(db *sql.DB) {
 }
 
 // GetUserByUsername return the models.User object based on the username
-func GetUserByUsername(db *sql.DB, username string) (models.User, error) {
+func GetUserByUsername(ctx context.Context, db *sql.DB, username string) (models.User, error) {
 	// Query the database
-	rows, err := db.Query("SELECT id, username, createdAt, password, email FROM users WHERE username = ? ", username)
+	rows, err := tracing.QueryContext(ctx, db, "SELECT id, username, createdAt, password, email FROM users WHERE username = ? ", username)
 	if err != nil {
 		return models.User{}, err
 	}
@@ -67,8 +74,474 @@ func GetUserByUsername(db *sql.DB, username string) (models.User, error) {
 	return models.User{}, ErrUserNotFound
 }
 
+// GetUserByID return the models.User object based on the ID of the user
+func GetUserByID(ctx context.Context, db *sql.DB, id int) (models.User, error) {
+	rows, err := tracing.QueryContext(ctx, db, "SELECT id, username, createdAt, email FROM users WHERE id = ? ", id)
+	if err != nil {
+		return models.User{}, err
+	}
+	defer rows.Close()
+
+	if rows.Next() {
+		user := models.User{}
+		err = rows.Scan(&user.ID, &user.Username, &user.CreatedAt, &user.Email)
+		if err != nil {
+			return models.User{}, err
+		}
+		return user, nil
+	}
+	return models.User{}, ErrUserNotFound
+}
+
+// RevokeToken revokes the access token tokenID of the user with userID until it expires at expiresAt. The
+// revocations of tokens which expired are removed, they are rejected anyway.
+func RevokeToken(ctx context.Context, db *sql.DB, userID int, tokenID string, expiresAt time.Time) error {
+	if _, err := tracing.ExecContext(ctx, db, "DELETE FROM revoked_tokens WHERE expiresAt < NOW()"); err != nil {
+		return err
+	}
+	_, err := tracing.ExecContext(ctx, db, "INSERT IGNORE INTO revoked_tokens (jti, user_id, expiresAt) VALUES (?, ?, ?)", tokenID, userID, expiresAt)
+	return err
+}
+
+// IncrementTokenVersion increments the token version of the user with userID, which revokes every access token
+// issued before.
+func IncrementTokenVersion(ctx context.Context, db *sql.DB, userID int) error {
+	_, err := tracing.ExecContext(ctx, db, "INSERT INTO token_versions (user_id, version) VALUES (?, 1) ON DUPLICATE KEY UPDATE version = version + 1", userID)
+	return err
+}
+
+// GetTokenClaims returns what the access tokens of the user with userID say about them: the token version, which is
+// 0 for a user who never logged out everywhere, and whether the user verified their email address. It returns
+// ErrUserNotFound when the user doesn't exist.
+func GetTokenClaims(ctx context.Context, db *sql.DB, userID int) (int, bool, error) {
+	rows, err := tracing.QueryContext(ctx, db, "SELECT COALESCE((SELECT version FROM token_versions WHERE user_id = ?), 0), verified FROM users WHERE id = ?", userID, userID)
+	if err != nil {
+		return 0, false, err
+	}
+	defer rows.Close()
+
+	if rows.Next() {
+		var version int
+		var verified bool
+		if err := rows.Scan(&version, &verified); err != nil {
+			return 0, false, err
+		}
+		return version, verified, nil
+	}
+	if err := rows.Err(); err != nil {
+		return 0, false, err
+	}
+	return 0, false, ErrUserNotFound
+}
+
+// GetTokenStatus returns whether the access token tokenID was revoked together with the token version of the user
+// with userID.
+func GetTokenStatus(ctx context.Context, db *sql.DB, userID int, tokenID string) (middleware.TokenStatus, error) {
+	rows, err := tracing.QueryContext(ctx, db, "SELECT EXISTS(SELECT 1 FROM revoked_tokens WHERE jti = ?), COALESCE((SELECT version FROM token_versions WHERE user_id = ?), 0)", tokenID, userID)
+	if err != nil {
+		return middleware.TokenStatus{}, err
+	}
+	defer rows.Close()
+
+	status := middleware.TokenStatus{}
+	if rows.Next() {
+		if err := rows.Scan(&status.Revoked, &status.Version); err != nil {
+			return middleware.TokenStatus{}, err
+		}
+	}
+	return status, rows.Err()
+}
+
+// GetTwoFactor returns the two-factor authentication of the user with userID. It is disabled for a user who never
+// enrolled.
+func GetTwoFactor(ctx context.Context, db *sql.DB, userID int) (models.TwoFactor, error) {
+	rows, err := tracing.QueryContext(ctx, db, "SELECT secret, enabled, last_step FROM two_factor WHERE user_id = ?", userID)
+	if err != nil {
+		return models.TwoFactor{}, err
+	}
+	defer rows.Close()
+
+	twoFactor := models.TwoFactor{UserID: userID}
+	if rows.Next() {
+		if err := rows.Scan(&twoFactor.Secret, &twoFactor.Enabled, &twoFactor.LastStep); err != nil {
+			return models.TwoFactor{}, err
+		}
+	}
+	return twoFactor, rows.Err()
+}
+
+// SaveTwoFactorSecret stores secret as the pending TOTP secret of the user with userID. It replaces a pending secret
+// but never an enabled one, it returns ErrTwoFactorEnabled then.
+func SaveTwoFactorSecret(ctx context.Context, db *sql.DB, userID int, secret string) error {
+	res, err := tracing.ExecContext(ctx, db, "INSERT INTO two_factor (user_id, secret) VALUES (?, ?) ON DUPLICATE KEY UPDATE secret = IF(enabled, secret, VALUES(secret))", userID, secret)
+	if err != nil {
+		return err
+	}
+	// MariaDB reports 0 affected rows when the row was left as it was.
+	if affected, err := res.RowsAffected(); err == nil && affected == 0 {
+		return ErrTwoFactorEnabled
+	}
+	return nil
+}
+
+// EnableTwoFactor enables the pending secret of the user with userID. Step is the step of the code which confirmed
+// it and hashes are the hashes of the new recovery codes, which replace the old ones.
+func EnableTwoFactor(ctx context.Context, db *sql.DB, userID int, step int64, hashes []string) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.ExecContext(ctx, "UPDATE two_factor SET enabled = TRUE, last_step = ? WHERE user_id = ? AND enabled = FALSE", step, userID)
+	if err != nil {
+		return err
+	}
+	if affected, err := res.RowsAffected(); err != nil || affected == 0 {
+		return ErrTwoFactorEnabled
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM recovery_codes WHERE user_id = ?", userID); err != nil {
+		return err
+	}
+	for _, hash := range hashes {
+		if _, err := tx.ExecContext(ctx, "INSERT INTO recovery_codes (user_id, code_hash) VALUES (?, ?)", userID, hash); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// UseTwoFactorStep records that the code of step was used by the user with userID. It returns false when that code,
+// or a later one, was used before.
+func UseTwoFactorStep(ctx context.Context, db *sql.DB, userID int, step int64) (bool, error) {
+	res, err := tracing.ExecContext(ctx, db, "UPDATE two_factor SET last_step = ? WHERE user_id = ? AND last_step < ?", step, userID, step)
+	if err != nil {
+		return false, err
+	}
+	affected, err := res.RowsAffected()
+	return affected == 1, err
+}
+
+// UseRecoveryCode marks the recovery code with hash of the user with userID as used. It returns false when the code
+// is unknown or was used before.
+func UseRecoveryCode(ctx context.Context, db *sql.DB, userID int, hash string) (bool, error) {
+	res, err := tracing.ExecContext(ctx, db, "UPDATE recovery_codes SET usedAt = NOW() WHERE user_id = ? AND code_hash = ? AND usedAt IS NULL", userID, hash)
+	if err != nil {
+		return false, err
+	}
+	affected, err := res.RowsAffected()
+	return affected == 1, err
+}
+
+// DeleteTwoFactor disables the two-factor authentication of the user with userID and removes the recovery codes.
+func DeleteTwoFactor(ctx context.Context, db *sql.DB, userID int) error {
+	if _, err := tracing.ExecContext(ctx, db, "DELETE FROM recovery_codes WHERE user_id = ?", userID); err != nil {
+		return err
+	}
+	_, err := tracing.ExecContext(ctx, db, "DELETE FROM two_factor WHERE user_id = ?", userID)
+	return err
+}
+
+// CreateTwoFactorChallenge stores the challenge token with id of the user with userID, which expires at expiresAt.
+// The challenges which expired are removed.
+func CreateTwoFactorChallenge(ctx context.Context, db *sql.DB, id string, userID int, expiresAt time.Time) error {
+	if _, err := tracing.ExecContext(ctx, db, "DELETE FROM two_factor_challenges WHERE expiresAt < NOW()"); err != nil {
+		return err
+	}
+	_, err := tracing.ExecContext(ctx, db, "INSERT INTO two_factor_challenges (jti, user_id, expiresAt) VALUES (?, ?, ?)", id, userID, expiresAt)
+	return err
+}
+
+// AttemptTwoFactorChallenge counts a code tried with the challenge token with id of the user with userID. It returns
+// false when the challenge is unknown, used or had maxAttempts codes already.
+func AttemptTwoFactorChallenge(ctx context.Context, db *sql.DB, id string, userID int, maxAttempts int) (bool, error) {
+	res, err := tracing.ExecContext(ctx, db, "UPDATE two_factor_challenges SET attempts = attempts + 1 WHERE jti = ? AND user_id = ? AND attempts < ?", id, userID, maxAttempts)
+	if err != nil {
+		return false, err
+	}
+	affected, err := res.RowsAffected()
+	return affected == 1, err
+}
+
+// UseTwoFactorChallenge removes the challenge token with id, so it can't be used again. It returns false when it was
+// used before.
+func UseTwoFactorChallenge(ctx context.Context, db *sql.DB, id string) (bool, error) {
+	res, err := tracing.ExecContext(ctx, db, "DELETE FROM two_factor_challenges WHERE jti = ?", id)
+	if err != nil {
+		return false, err
+	}
+	affected, err := res.RowsAffected()
+	return affected == 1, err
+}
+
+// LoginFailures returns the store of the failed logins in the database.
+func LoginFailures(db *sql.DB) lockout.Store {
+	return &loginFailures{db: db}
+}
+
+type loginFailures struct {
+	db *sql.DB
+}
+
+func (s *loginFailures) Failures(ctx context.Context, kind lockout.Kind, subject string) (lockout.Failures, error) {
+	rows, err := tracing.QueryContext(ctx, s.db, "SELECT failures, lastFailureAt FROM login_failures WHERE kind = ? AND subject = ?", string(kind), subject)
+	if err != nil {
+		return lockout.Failures{}, err
+	}
+	defer rows.Close()
+
+	failures := lockout.Failures{}
+	if rows.Next() {
+		if err := rows.Scan(&failures.Count, &failures.LastFailureAt); err != nil {
+			return lockout.Failures{}, err
+		}
+	}
+	return failures, rows.Err()
+}
+
+// Add counts the failure and reads the count in one statement. LAST_INSERT_ID(expr) makes the server report the new
+// count as the id of the statement.
+func (s *loginFailures) Add(ctx context.Context, kind lockout.Kind, subject string, now time.Time, forgetBefore time.Time) (int, error) {
+	res, err := tracing.ExecContext(ctx, s.db, "INSERT INTO login_failures (kind, subject, failures, lastFailureAt) VALUES (?, ?, LAST_INSERT_ID(1), ?) ON DUPLICATE KEY UPDATE failures = LAST_INSERT_ID(IF(lastFailureAt < ?, 1, failures + 1)), lastFailureAt = VALUES(lastFailureAt)", string(kind), subject, now, forgetBefore)
+	if err != nil {
+		return 0, err
+	}
+	count, err := res.LastInsertId()
+	return int(count), err
+}
+
+func (s *loginFailures) Release(ctx context.Context, kind lockout.Kind, subject string) error {
+	_, err := tracing.ExecContext(ctx, s.db, "UPDATE login_failures SET failures = failures - 1 WHERE kind = ? AND subject = ? AND failures > 0", string(kind), subject)
+	return err
+}
+
+func (s *loginFailures) Reset(ctx context.Context, kind lockout.Kind, subject string) error {
+	_, err := tracing.ExecContext(ctx, s.db, "DELETE FROM login_failures WHERE kind = ? AND subject = ?", string(kind), subject)
+	return err
+}
+
+// Unlock forgets the failed logins of subject, an account or an IP address. It returns whether it was locked or had
+// failures.
+func Unlock(ctx context.Context, db *sql.DB, subject string) (bool, error) {
+	res, err := tracing.ExecContext(ctx, db, "DELETE FROM login_failures WHERE subject = ?", subject)
+	if err != nil {
+		return false, err
+	}
+	affected, err := res.RowsAffected()
+	return affected > 0, err
+}
+
+// CreateAccessToken stores the personal access token with tokenHash of the user with userID and returns its ID.
+func CreateAccessToken(ctx context.Context, db *sql.DB, userID int, name string, scopes []string, tokenHash string) (int, error) {
+	res, err := tracing.ExecContext(ctx, db, "INSERT INTO personal_access_tokens (user_id, name, scopes, token_hash) VALUES (?, ?, ?, ?)", userID, name, strings.Join(scopes, " "), tokenHash)
+	if err != nil {
+		return 0, err
+	}
+	id, err := res.LastInsertId()
+	return int(id), err
+}
+
+// GetAccessTokens returns the personal access tokens of the user with userID, the oldest first.
+func GetAccessTokens(ctx context.Context, db *sql.DB, userID int) ([]models.AccessToken, error) {
+	rows, err := tracing.QueryContext(ctx, db, "SELECT id, name, scopes, createdAt, lastUsedAt FROM personal_access_tokens WHERE user_id = ? ORDER BY id", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tokens := make([]models.AccessToken, 0)
+	for rows.Next() {
+		token := models.AccessToken{}
+		var scopes string
+		if err := rows.Scan(&token.ID, &token.Name, &scopes, &token.CreatedAt, &token.LastUsedAt); err != nil {
+			return nil, err
+		}
+		token.Scopes = strings.Fields(scopes)
+		tokens = append(tokens, token)
+	}
+	return tokens, rows.Err()
+}
+
+// DeleteAccessToken revokes the personal access token with id of the user with userID. It returns false when the
+// user has no such token.
+func DeleteAccessToken(ctx context.Context, db *sql.DB, userID int, id int) (bool, error) {
+	res, err := tracing.ExecContext(ctx, db, "DELETE FROM personal_access_tokens WHERE id = ? AND user_id = ?", id, userID)
+	if err != nil {
+		return false, err
+	}
+	affected, err := res.RowsAffected()
+	return affected == 1, err
+}
+
+// UseAccessToken returns the user of the personal access token with tokenHash, with the scopes of the token, and
+// records that the token was used. It returns nil when there is no such token or its user was deleted.
+func UseAccessToken(ctx context.Context, db *sql.DB, tokenHash string) (*middleware.Principal, error) {
+	rows, err := tracing.QueryContext(ctx, db, "SELECT t.id, t.user_id, t.scopes, u.verified FROM personal_access_tokens t JOIN users u ON u.id = t.user_id WHERE t.token_hash = ?", tokenHash)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		return nil, rows.Err()
+	}
+	var id int
+	var scopes string
+	principal := &middleware.Principal{}
+	if err := rows.Scan(&id, &principal.ID, &scopes, &principal.EmailVerified); err != nil {
+		return nil, err
+	}
+	principal.Scopes = strings.Fields(scopes)
+	rows.Close()
+
+	if _, err := tracing.ExecContext(ctx, db, "UPDATE personal_access_tokens SET lastUsedAt = NOW() WHERE id = ?", id); err != nil {
+		return nil, err
+	}
+	return principal, nil
+}
+
+// CreateOIDCLogin stores login, a login with an OpenID Connect provider which was started, under the hash of its
+// state. The logins which expired are removed.
+func CreateOIDCLogin(ctx context.Context, db *sql.DB, stateHash string, login models.OIDCLogin) error {
+	if _, err := tracing.ExecContext(ctx, db, "DELETE FROM oidc_logins WHERE expiresAt < NOW()"); err != nil {
+		return err
+	}
+	_, err := tracing.ExecContext(ctx, db, "INSERT INTO oidc_logins (state_hash, provider, nonce, code_verifier, user_id, secret_hash, expiresAt) VALUES (?, ?, ?, ?, ?, ?, ?)", stateHash, login.Provider, login.Nonce, login.CodeVerifier, login.UserID, login.SecretHash, login.ExpiresAt)
+	return err
+}
+
+// UseOIDCLogin removes the login with an OpenID Connect provider with stateHash and returns it, so its state can be
+// used once. It returns nil when there is no such login or it expired before now.
+func UseOIDCLogin(ctx context.Context, db *sql.DB, stateHash string, now time.Time) (*models.OIDCLogin, error) {
+	rows, err := tracing.QueryContext(ctx, db, "SELECT provider, nonce, code_verifier, user_id, secret_hash, expiresAt FROM oidc_logins WHERE state_hash = ?", stateHash)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		return nil, rows.Err()
+	}
+	login := &models.OIDCLogin{}
+	if err := rows.Scan(&login.Provider, &login.Nonce, &login.CodeVerifier, &login.UserID, &login.SecretHash, &login.ExpiresAt); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	// Only the request which removes the login may use it
+	res, err := tracing.ExecContext(ctx, db, "DELETE FROM oidc_logins WHERE state_hash = ?", stateHash)
+	if err != nil {
+		return nil, err
+	}
+	if affected, err := res.RowsAffected(); err != nil || affected != 1 {
+		return nil, err
+	}
+	if now.After(login.ExpiresAt) {
+		return nil, nil
+	}
+	return login, nil
+}
+
+// GetExternalIdentity returns the ID of the user the account subject at provider is linked to, or 0 when it isn't
+// linked. A link to a user who was deleted is removed.
+func GetExternalIdentity(ctx context.Context, db *sql.DB, provider string, subject string) (int, error) {
+	rows, err := tracing.QueryContext(ctx, db, "SELECT e.id, u.id FROM external_identities e LEFT JOIN users u ON u.id = e.user_id WHERE e.provider = ? AND e.subject = ?", provider, subject)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		return 0, rows.Err()
+	}
+	var id int
+	var userID sql.NullInt64
+	if err := rows.Scan(&id, &userID); err != nil {
+		return 0, err
+	}
+	rows.Close()
+
+	if !userID.Valid {
+		_, err := tracing.ExecContext(ctx, db, "DELETE FROM external_identities WHERE id = ?", id)
+		return 0, err
+	}
+	return int(userID.Int64), nil
+}
+
+// LinkExternalIdentity links the account subject at provider with email to the user with userID and returns the ID
+// of the link. It returns ErrIdentityLinked when the account is linked already.
+func LinkExternalIdentity(ctx context.Context, db *sql.DB, userID int, provider string, subject string, email string) (int, error) {
+	res, err := tracing.ExecContext(ctx, db, "INSERT IGNORE INTO external_identities (user_id, provider, subject, email) VALUES (?, ?, ?, ?)", userID, provider, subject, email)
+	if err != nil {
+		return 0, err
+	}
+	if affected, err := res.RowsAffected(); err != nil || affected == 0 {
+		return 0, ErrIdentityLinked
+	}
+	id, err := res.LastInsertId()
+	return int(id), err
+}
+
+// GetExternalIdentities returns the accounts at OpenID Connect providers the user with userID is linked to, the
+// oldest first.
+func GetExternalIdentities(ctx context.Context, db *sql.DB, userID int) ([]models.ExternalIdentity, error) {
+	rows, err := tracing.QueryContext(ctx, db, "SELECT id, provider, email, createdAt FROM external_identities WHERE user_id = ? ORDER BY id", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	identities := make([]models.ExternalIdentity, 0)
+	for rows.Next() {
+		identity := models.ExternalIdentity{}
+		if err := rows.Scan(&identity.ID, &identity.Provider, &identity.Email, &identity.CreatedAt); err != nil {
+			return nil, err
+		}
+		identities = append(identities, identity)
+	}
+	return identities, rows.Err()
+}
+
+// DeleteExternalIdentity unlinks the account with id from the user with userID. It returns false when the user has no
+// such account, and ErrLastLoginMethod when the user has no password and it is the last account the user can log in
+// with.
+func DeleteExternalIdentity(ctx context.Context, db *sql.DB, userID int, id int) (bool, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.ExecContext(ctx, "DELETE FROM external_identities WHERE id = ? AND user_id = ?", id, userID)
+	if err != nil {
+		return false, err
+	}
+	if affected, err := res.RowsAffected(); err != nil || affected != 1 {
+		return false, err
+	}
+
+	var password string
+	var remaining int
+	if err := tx.QueryRowContext(ctx, "SELECT password, (SELECT COUNT(*) FROM external_identities WHERE user_id = ?) FROM users WHERE id = ?", userID, userID).Scan(&password, &remaining); err != nil {
+		return false, err
+	}
+	if password == "" && remaining == 0 {
+		return false, ErrLastLoginMethod
+	}
+	return true, tx.Commit()
+}
+
+// ErrIdentityLinked error if an account at an OpenID Connect provider is linked to a user already
+var ErrIdentityLinked = apierror.New(apierror.Conflict, "This account of the provider is linked to a user already")
+
+// ErrLastLoginMethod error if a user without a password unlinks the last account the user can log in with
+var ErrLastLoginMethod = apierror.New(apierror.Conflict, "Set a password before you unlink the last provider")
+
+// ErrTwoFactorEnabled error if the user already enabled two-factor authentication
+var ErrTwoFactorEnabled = apierror.New(apierror.Conflict, "Two-factor authentication is already enabled")
+
 // ErrUserNotFound error if user does not exist in database
-var ErrUserNotFound = errors.New("User does not exist")
+var ErrUserNotFound = apierror.New(apierror.NotFound, "User does not exist")
 
 // ErrCanNotConnectWithDatabase error if database is unreachable
-var ErrCanNotConnectWithDatabase = errors.New("Can not connect with database")
+var ErrCanNotConnectWithDatabase = apierror.New(apierror.Unavailable, "Can not connect with database")
@@ -1,6 +1,7 @@
 package db
 
 import (
+	"context"
 	"testing"
 	"time"
 
@@ -27,7 +28,7 @@ func TestGetUserByUsername(t *testing.T) {
 	mock.ExpectQuery("SELECT (.+) FROM users WHERE").WithArgs(user.Username).WillReturnRows(rows)
 
 	// Execute the method
-	if _, err := GetUserByUsername(db, user.Username); err != nil {
+	if _, err := GetUserByUsername(context.Background(), db, user.Username); err != nil {
 		t.Errorf("there was an unexpected error: %s", err)
 	}
 
@@ -37,6 +38,109 @@ func TestGetUserByUsername(t *testing.T) {
 	}
 }
 
+func TestGetUserByID(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	user := getTestUser()
+	rows := sqlmock.NewRows([]string{"id", "username", "createdAt", "email"}).AddRow(user.ID, user.Username, time.Now().UTC(), user.Email)
+	mock.ExpectQuery("SELECT (.+) FROM users WHERE id").WithArgs(user.ID).WillReturnRows(rows)
+
+	actual, err := GetUserByID(context.Background(), db, user.ID)
+	if err != nil {
+		t.Errorf("there was an unexpected error: %s", err)
+	}
+	if actual.Username != user.Username {
+		t.Errorf("Expected %v but got %v", user.Username, actual.Username)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestGetTokenStatus(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	rows := sqlmock.NewRows([]string{"revoked", "version"}).AddRow(true, 3)
+	mock.ExpectQuery("SELECT EXISTS(.+) FROM revoked_tokens").WithArgs("abc", 1).WillReturnRows(rows)
+
+	status, err := GetTokenStatus(context.Background(), db, 1, "abc")
+	if err != nil {
+		t.Errorf("there was an unexpected error: %s", err)
+	}
+	if !status.Revoked || status.Version != 3 {
+		t.Errorf("Expected %v but got %+v", "a revoked token of version 3", status)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+// Test if an enabled secret is not replaced by a new enrollment.
+func TestSaveTwoFactorSecretEnabled(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	mock.ExpectExec("INSERT INTO two_factor").WithArgs(1, "SECRET").WillReturnResult(sqlmock.NewResult(0, 0))
+
+	if err := SaveTwoFactorSecret(context.Background(), db, 1, "SECRET"); err != ErrTwoFactorEnabled {
+		t.Errorf("Expected %v but got %v", ErrTwoFactorEnabled, err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+// Test if a code can't be used again.
+func TestUseTwoFactorStep(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	mock.ExpectExec("UPDATE two_factor SET last_step").WithArgs(100, 1, 100).WillReturnResult(sqlmock.NewResult(0, 0))
+
+	ok, err := UseTwoFactorStep(context.Background(), db, 1, 100)
+	if err != nil {
+		t.Errorf("there was an unexpected error: %s", err)
+	}
+	if ok {
+		t.Errorf("Expected %v but got %v", false, ok)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+// Test if a token can't be issued to a user who doesn't exist.
+func TestGetTokenClaimsUnknownUser(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	mock.ExpectQuery("SELECT (.+) FROM users").WithArgs(7, 7).WillReturnRows(sqlmock.NewRows([]string{"version", "verified"}))
+
+	if _, _, err := GetTokenClaims(context.Background(), db, 7); err != ErrUserNotFound {
+		t.Errorf("Expected %v but got %v", ErrUserNotFound, err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
 func getTestUser() *models.User {
 	user := &models.User{}
 	user.ID = 1
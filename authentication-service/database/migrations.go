@@ -0,0 +1,87 @@
+package db
+
+import (
+	"database/sql"
+
+	"github.com/bstaijen/mariadb-for-microservices/shared/migrate"
+	"github.com/bstaijen/mariadb-for-microservices/shared/session"
+)
+
+// Migrations are the versions of the tables of the authentication service. They live in the ProfileService schema
+// next to the users table, which is migrated by the profile service, and are tracked in a table of their own.
+var Migrations = []migrate.Migration{
+	{
+		Version: 1,
+		Name:    "create refresh tokens",
+		Up:      session.Migration,
+		Down: []string{
+			"DROP TABLE refresh_tokens",
+		},
+	},
+	{
+		Version: 2,
+		Name:    "create token revocations",
+		Up: []string{
+			"CREATE TABLE IF NOT EXISTS revoked_tokens (jti char(32) NOT NULL PRIMARY KEY, user_id INT NOT NULL, expiresAt timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP, INDEX revoked_tokens_expires (expiresAt))",
+			"CREATE TABLE IF NOT EXISTS token_versions (user_id INT NOT NULL PRIMARY KEY, version INT NOT NULL DEFAULT 0)",
+		},
+		Down: []string{
+			"DROP TABLE token_versions",
+			"DROP TABLE revoked_tokens",
+		},
+	},
+	{
+		Version: 3,
+		Name:    "create two-factor authentication",
+		Up: []string{
+			"CREATE TABLE IF NOT EXISTS two_factor (user_id INT NOT NULL PRIMARY KEY, secret varchar(64) NOT NULL, enabled BOOLEAN NOT NULL DEFAULT FALSE, last_step BIGINT NOT NULL DEFAULT 0, createdAt timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP)",
+			"CREATE TABLE IF NOT EXISTS recovery_codes (id INT NOT NULL AUTO_INCREMENT PRIMARY KEY, user_id INT NOT NULL, code_hash char(64) NOT NULL, usedAt timestamp NULL DEFAULT NULL, INDEX recovery_codes_user (user_id))",
+			"CREATE TABLE IF NOT EXISTS two_factor_challenges (jti char(32) NOT NULL PRIMARY KEY, user_id INT NOT NULL, attempts INT NOT NULL DEFAULT 0, expiresAt timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP, INDEX two_factor_challenges_expires (expiresAt))",
+		},
+		Down: []string{
+			"DROP TABLE two_factor_challenges",
+			"DROP TABLE recovery_codes",
+			"DROP TABLE two_factor",
+		},
+	},
+	{
+		Version: 4,
+		Name:    "create login failures",
+		Up: []string{
+			"CREATE TABLE IF NOT EXISTS login_failures (kind varchar(16) NOT NULL, subject varchar(255) NOT NULL, failures INT NOT NULL DEFAULT 0, lastFailureAt timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP, PRIMARY KEY (kind, subject))",
+		},
+		Down: []string{
+			"DROP TABLE login_failures",
+		},
+	},
+	{
+		Version: 5,
+		Name:    "create personal access tokens",
+		Up: []string{
+			"CREATE TABLE IF NOT EXISTS personal_access_tokens (id INT NOT NULL AUTO_INCREMENT PRIMARY KEY, user_id INT NOT NULL, name varchar(100) NOT NULL, scopes varchar(255) NOT NULL, token_hash char(64) NOT NULL, lastUsedAt timestamp NULL DEFAULT NULL, createdAt timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP, UNIQUE KEY personal_access_tokens_hash (token_hash), INDEX personal_access_tokens_user (user_id))",
+		},
+		Down: []string{
+			"DROP TABLE personal_access_tokens",
+		},
+	},
+	{
+		Version: 6,
+		Name:    "create external identities",
+		Up: []string{
+			"CREATE TABLE IF NOT EXISTS oidc_logins (state_hash char(64) NOT NULL PRIMARY KEY, provider varchar(64) NOT NULL, nonce varchar(64) NOT NULL, code_verifier varchar(128) NOT NULL, secret_hash char(64) NOT NULL, user_id INT NOT NULL DEFAULT 0, expiresAt timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP, INDEX oidc_logins_expires (expiresAt))",
+			"CREATE TABLE IF NOT EXISTS external_identities (id INT NOT NULL AUTO_INCREMENT PRIMARY KEY, user_id INT NOT NULL, provider varchar(64) NOT NULL, subject varchar(255) NOT NULL, email varchar(255) NOT NULL, createdAt timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP, UNIQUE KEY external_identities_subject (provider, subject), INDEX external_identities_user (user_id))",
+		},
+		Down: []string{
+			"DROP TABLE external_identities",
+			"DROP TABLE oidc_logins",
+		},
+	},
+}
+
+// MigrationsTable is the tracking table of Migrations.
+const MigrationsTable = "authentication_schema_migrations"
+
+// Migrator returns the migrator of the schema of the service.
+func Migrator(db *sql.DB) *migrate.Migrator {
+	return migrate.New(db, MigrationsTable, Migrations)
+}
@@ -1,12 +1,25 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"net/http"
+	"os"
 	"strconv"
+	"strings"
 
 	"github.com/bstaijen/mariadb-for-microservices/authentication-service/app/http/routes"
+	"github.com/bstaijen/mariadb-for-microservices/authentication-service/app/oidc"
 	"github.com/bstaijen/mariadb-for-microservices/authentication-service/config"
 	"github.com/bstaijen/mariadb-for-microservices/authentication-service/database"
+	"github.com/bstaijen/mariadb-for-microservices/shared/bootstrap"
+	"github.com/bstaijen/mariadb-for-microservices/shared/ipc"
+	"github.com/bstaijen/mariadb-for-microservices/shared/jwks"
+	"github.com/bstaijen/mariadb-for-microservices/shared/metrics"
+	"github.com/bstaijen/mariadb-for-microservices/shared/migrate"
+	"github.com/bstaijen/mariadb-for-microservices/shared/tracing"
+	"github.com/bstaijen/mariadb-for-microservices/shared/util/middleware"
 	negronilogrus "github.com/meatballhat/negroni-logrus"
 	"github.com/urfave/negroni"
 
@@ -23,7 +36,19 @@ func main() {
 	log.SetLevel(log.DebugLevel)
 
 	// Get config
-	cnf := config.LoadConfig()
+	command, args := migrate.ParseCommand(os.Args[1:])
+	unlock, args := parseUnlock(args)
+	cnf, err := config.LoadConfig(args)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Export traces
+	shutdownTracing, err := tracing.Init("authentication-service", cnf.OTLPEndpoint)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer shutdownTracing(context.Background())
 
 	// Get database
 	connection, err := db.OpenConnection(cnf)
@@ -32,13 +57,118 @@ func main() {
 	}
 	defer db.CloseConnection(connection)
 
+	// Run the migrate subcommand, or refuse to start while migrations are pending
+	migrator := db.Migrator(connection)
+	if command != nil {
+		if err := migrator.Run(context.Background(), command, os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if err := migrator.Check(context.Background()); err != nil {
+		log.Fatal(err)
+	}
+
+	// Run the unlock subcommand
+	if unlock != "" {
+		unlocked, err := db.Unlock(context.Background(), connection, unlock)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if unlocked {
+			fmt.Printf("unlocked %v\n", unlock)
+		} else {
+			fmt.Printf("%v has no failed logins\n", unlock)
+		}
+		return
+	}
+	if err := metrics.RegisterDB("authentication", connection); err != nil {
+		log.Fatal(err)
+	}
+
+	// Load the keys which sign the access tokens
+	keys, err := signingKeys(cnf)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Load the keys which sign and verify the IPC calls
+	ipcKeys, err := ipc.LoadKeys(ipc.AuthenticationService, cnf.IPCKeyFile, cnf.IPCPublicKeys)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Load the OpenID Connect providers users can log in with
+	providers, err := oidcProviders(cnf)
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	// Set the REST API routes
-	routes := routes.InitRoutes(connection, cnf)
+	routes := routes.InitRoutes(connection, cnf, keys, ipcKeys, providers)
+	routes.Handle("/metrics", metrics.Handler()).Methods("GET")
 	n := negroni.Classic()
+	n.Use(negroni.HandlerFunc(middleware.RequestID))
+	n.Use(negroni.HandlerFunc(tracing.Middleware))
+	n.Use(metrics.Middleware(routes))
 	n.Use(negronilogrus.NewMiddleware())
+	n.Use(middleware.Deadline(cnf.RequestTimeout))
+	n.Use(middleware.CORS(middleware.CORSOptions{
+		AllowedOrigins:   cnf.CORSAllowedOrigins,
+		AllowedMethods:   cnf.CORSAllowedMethods,
+		AllowedHeaders:   cnf.CORSAllowedHeaders,
+		AllowCredentials: cnf.CORSAllowCredentials,
+		MaxAge:           cnf.CORSMaxAge,
+	}))
 	n.UseHandler(routes)
 
-	// Start and listen on port in cbf.Port
+	// Start and listen on port in cnf.Port until the process is stopped. The deferred calls close the database
+	// after the requests in flight are finished.
+	server := &http.Server{Addr: ":" + strconv.Itoa(cnf.Port), Handler: n}
 	log.Info("Starting server on port " + strconv.Itoa(cnf.Port))
-	log.Fatal(http.ListenAndServe(":"+strconv.Itoa(cnf.Port), n))
+	if err := bootstrap.Serve(server, cnf.ShutdownTimeout); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// parseUnlock splits the unlock subcommand from the command-line arguments, e.g. "unlock username --db-host db" into
+// "username" and ["--db-host", "db"]. It lets an administrator unlock an account or an IP address which failed to log
+// in too often. The subject is empty when args don't start with unlock.
+func parseUnlock(args []string) (string, []string) {
+	if len(args) < 2 || args[0] != "unlock" {
+		return "", args
+	}
+	return strings.ToLower(args[1]), args[2:]
+}
+
+// oidcProviders returns the OpenID Connect providers in cnf.OIDCProviders. The users of a provider who log in for the
+// first time are created by the profile service, so it needs cnf.ProfileServiceBaseurl.
+func oidcProviders(cnf config.Config) (oidc.Providers, error) {
+	configs, err := oidc.ParseProviders(cnf.OIDCProviders)
+	if err != nil {
+		return nil, err
+	}
+	if len(configs) > 0 && cnf.ProfileServiceBaseurl == "" {
+		return nil, errors.New("OIDC_PROVIDERS needs PROFILE_SERVICE_URL")
+	}
+	providers := oidc.NewProviders(configs)
+	if len(providers) > 0 {
+		log.Infof("Users can log in with %v", strings.Join(providers.Names(), ", "))
+	}
+	return providers, nil
+}
+
+// signingKeys loads the keys in cnf.SigningKeyFiles, the signing key first. Without files a temporary key is
+// generated, which only suits development: its tokens are invalid after a restart and every instance has a key of
+// its own.
+func signingKeys(cnf config.Config) (*jwks.Set, error) {
+	if len(cnf.SigningKeyFiles) > 0 {
+		return jwks.LoadSet(cnf.SigningKeyFiles)
+	}
+	log.Warn("No SIGNING_KEY_FILES configured, signing the access tokens with a temporary key")
+	key, err := jwks.GenerateKey()
+	if err != nil {
+		return nil, err
+	}
+	return jwks.NewSet(key)
 }
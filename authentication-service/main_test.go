@@ -1 +1,21 @@
 package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseUnlock(t *testing.T) {
+	subject, args := parseUnlock([]string{"unlock", "UserName", "--db-host", "db"})
+	if subject != "username" {
+		t.Errorf("Expected %v but got %v", "username", subject)
+	}
+	if strings.Join(args, " ") != "--db-host db" {
+		t.Errorf("Expected %v but got %v", "--db-host db", args)
+	}
+
+	subject, args = parseUnlock([]string{"--port", "5001"})
+	if subject != "" || len(args) != 2 {
+		t.Errorf("Expected no subject but got %v", subject)
+	}
+}
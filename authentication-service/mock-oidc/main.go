@@ -0,0 +1,34 @@
+// Command mock-oidc runs the mock OpenID Connect provider of the oidctest package, so the login with an external
+// provider can be tried locally. Every login at the provider signs in the identity of the flags at once.
+//
+//	go run ./authentication-service/mock-oidc -addr :5010 -client-id mfm -email jane@example.com
+package main
+
+import (
+	"flag"
+	"net/http"
+
+	"github.com/bstaijen/mariadb-for-microservices/authentication-service/app/oidc"
+	"github.com/bstaijen/mariadb-for-microservices/authentication-service/app/oidc/oidctest"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+func main() {
+	addr := flag.String("addr", ":5010", "address to listen on")
+	clientID := flag.String("client-id", "mfm", "client the ID tokens are issued for")
+	subject := flag.String("subject", oidctest.Identity.Subject, "subject of the signed in identity")
+	email := flag.String("email", oidctest.Identity.Email, "email address of the signed in identity")
+	unverified := flag.Bool("unverified", false, "whether the email address is unverified")
+	username := flag.String("username", oidctest.Identity.Username, "preferred username of the signed in identity")
+	flag.Parse()
+
+	provider, err := oidctest.New(*clientID)
+	if err != nil {
+		log.Fatal(err)
+	}
+	provider.SetIdentity(oidc.Identity{Subject: *subject, Email: *email, EmailVerified: !*unverified, Username: *username})
+
+	log.Infof("Mock OpenID Connect provider for client %v listening on %v", *clientID, *addr)
+	log.Fatal(http.ListenAndServe(*addr, provider))
+}
@@ -1,63 +1,67 @@
 package controllers
 
 import (
+	"context"
 	"database/sql"
-	"encoding/json"
-	"io/ioutil"
-	"log"
 	"net/http"
-	"strings"
 
-	"github.com/Sirupsen/logrus"
 	"github.com/bstaijen/mariadb-for-microservices/comment-service/app/models"
 	"github.com/bstaijen/mariadb-for-microservices/comment-service/config"
 	"github.com/bstaijen/mariadb-for-microservices/comment-service/database"
 	"github.com/bstaijen/mariadb-for-microservices/shared/util"
-	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/bstaijen/mariadb-for-microservices/shared/util/middleware"
 	"github.com/gorilla/mux"
 	"github.com/urfave/negroni"
 
 	"strconv"
 
+	"github.com/bstaijen/mariadb-for-microservices/shared/apierror"
 	"github.com/bstaijen/mariadb-for-microservices/shared/helper"
+	"github.com/bstaijen/mariadb-for-microservices/shared/ipc"
 	sharedModels "github.com/bstaijen/mariadb-for-microservices/shared/models"
 )
 
-// CreateHandler creates a comment and stores it in the database
-func CreateHandler(connection *sql.DB, cnf config.Config) negroni.HandlerFunc {
+// CreateHandler creates a comment and stores it in the database. The comment is always posted as the user of the
+// request, a different user ID in the body is rejected.
+func CreateHandler(connection *sql.DB, cnf config.Config, clients *ipc.Clients) negroni.HandlerFunc {
 	return negroni.HandlerFunc(func(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+		user, ok := middleware.UserFromContext(r.Context())
+		if !ok {
+			util.SendError(w, middleware.ErrTokenMandatory)
+			return
+		}
+
 		commentObject := &models.CommentCreate{}
 		err := util.RequestToJSON(r, commentObject)
 		if err != nil {
 			util.SendErrorMessage(w, "bad json")
 			return
 		}
+		if commentObject.UserID != 0 && commentObject.UserID != user.ID {
+			util.SendError(w, apierror.New(apierror.PermissionDenied, "you can only comment as yourself"))
+			return
+		}
+		commentObject.UserID = user.ID
+
 		if commentObject.UserID > 0 && commentObject.PhotoID > 0 && len(commentObject.Comment) > 0 {
-			comment, err := db.Create(connection, commentObject)
+			comment, err := db.Create(r.Context(), connection, commentObject)
 			if err != nil {
-				util.SendBadRequest(w, err)
+				util.SendError(w, err)
 				return
 			}
-			identifiers := make([]*sharedModels.GetUsernamesRequest, 0)
-			identifiers = append(identifiers, &sharedModels.GetUsernamesRequest{
-				ID: comment.UserID,
-			})
-			username := getUsernames(cnf, identifiers)
-			if len(username) > 0 {
-				comment.Username = username[0].Username
-			}
+			appendUsernames(r.Context(), clients, []*sharedModels.CommentResponse{comment})
 			util.SendOK(w, comment)
 
 			return
 		}
-		util.SendErrorMessage(w, "UserID, PhotoID and Comment are mandatory")
+		util.SendError(w, apierror.New(apierror.ValidationFailed, "PhotoID and Comment are mandatory"))
 	})
 }
 
 // ListCommentsHandler return a list of comments
-func ListCommentsHandler(connection *sql.DB, cnf config.Config) negroni.HandlerFunc {
+func ListCommentsHandler(connection *sql.DB, cnf config.Config, clients *ipc.Clients) negroni.HandlerFunc {
 	return negroni.HandlerFunc(func(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
-		logrus.Info("List comments")
+		util.Log(r.Context()).Info("List comments")
 		offset, rows := helper.PaginationFromRequest(r)
 
 		// get PhotoID
@@ -70,31 +74,14 @@ func ListCommentsHandler(connection *sql.DB, cnf config.Config) negroni.HandlerF
 
 		comments := make([]*sharedModels.CommentResponse, 0)
 
-		comments, err = db.GetComments(connection, photoID, offset, rows)
+		comments, err = db.GetComments(r.Context(), connection, photoID, offset, rows)
 		if err != nil {
 			util.SendError(w, err)
 			return
 		}
 
 		// include usernames
-		identifiers := make([]*sharedModels.GetUsernamesRequest, 0)
-		for index := 0; index < len(comments); index++ {
-			comment := comments[index]
-			identifiers = append(identifiers, &sharedModels.GetUsernamesRequest{
-				ID: comment.UserID,
-			})
-		}
-		usernames := getUsernames(cnf, identifiers)
-		for index := 0; index < len(comments); index++ {
-			comment := comments[index]
-			for undex := 0; undex < len(usernames); undex++ {
-				username := usernames[undex]
-
-				if comment.UserID == username.ID {
-					comment.Username = username.Username
-				}
-			}
-		}
+		appendUsernames(r.Context(), clients, comments)
 
 		// return
 		util.SendOK(w, comments)
@@ -102,64 +89,40 @@ func ListCommentsHandler(connection *sql.DB, cnf config.Config) negroni.HandlerF
 }
 
 // ListCommentsFromUser : Return all comments from an user and add the photo(extra information) too.
-func ListCommentsFromUser(connection *sql.DB, cnf config.Config) negroni.HandlerFunc {
+func ListCommentsFromUser(connection *sql.DB, cnf config.Config, clients *ipc.Clients) negroni.HandlerFunc {
 	return negroni.HandlerFunc(func(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
-		logrus.Info("List comments from user")
+		util.Log(r.Context()).Info("List comments from user")
 
 		offset, rows := helper.PaginationFromRequest(r)
 
-		var queryToken = r.URL.Query().Get("token")
-
-		if len(queryToken) < 1 {
-			queryToken = r.Header.Get("token")
-		}
-
-		if len(queryToken) < 1 {
-			w.WriteHeader(http.StatusBadRequest)
-			w.Write([]byte(string("token is mandatory")))
+		user, ok := middleware.UserFromContext(r.Context())
+		if !ok {
+			util.SendError(w, middleware.ErrTokenMandatory)
 			return
 		}
-		tok, err := jwt.Parse(queryToken, func(t *jwt.Token) (interface{}, error) {
-			return []byte(cnf.SecretKey), nil
-		})
 
+		comments, err := db.GetCommentsByUserID(r.Context(), connection, user.ID, offset, rows)
 		if err != nil {
-			logrus.Info(err)
-			logrus.Info(err.Error())
-			util.SendErrorMessage(w, "You are not authorized")
+			util.SendError(w, err)
 			return
 		}
 
-		claims := tok.Claims.(jwt.MapClaims)
-		var ID = claims["sub"].(float64) // gets the ID
-
-		comments, err := db.GetCommentsByUserID(connection, int(ID), offset, rows)
-
 		// collect photo IDs.
-		ids := make([]*sharedModels.TopRatedPhotoResponse, 0)
-		f := make([]*sharedModels.HasVotedRequest, 0)
-		g := make([]*sharedModels.VoteCountRequest, 0)
+		ids := make([]int, 0)
 		for _, v := range comments {
-			ids = append(ids, &sharedModels.TopRatedPhotoResponse{
-				PhotoID: v.PhotoID,
-			})
-
-			f = append(f, &sharedModels.HasVotedRequest{
-				PhotoID: v.PhotoID,
-				UserID:  v.UserID,
-			})
-
-			g = append(g, &sharedModels.VoteCountRequest{
-				PhotoID: v.PhotoID,
-			})
+			ids = append(ids, v.PhotoID)
 		}
 
 		// get photos
-		photos := getPhotos(cnf, ids)
+		photos, err := clients.Photo.Photos(r.Context(), ids)
+		if err != nil {
+			util.SendError(w, err)
+			return
+		}
 
 		// get votes
-		photos = appendUserVoted(cnf, f, photos)
-		photos = appendVotesCount(cnf, g, photos)
+		photos = appendUserVoted(r.Context(), clients, user.ID, ids, photos)
+		photos = appendVotesCount(r.Context(), clients, ids, photos)
 
 		// merge with comments
 		type Res struct {
@@ -195,80 +158,45 @@ func ListCommentsFromUser(connection *sql.DB, cnf config.Config) negroni.Handler
 // GetCommentCountHandler returns a list of counts beloning to comments.
 func GetCommentCountHandler(connection *sql.DB, cnf config.Config) negroni.HandlerFunc {
 	return negroni.HandlerFunc(func(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
-		if r.Body == nil {
-			util.SendErrorMessage(w, "bad json")
-			return
-		}
-
-		type Collection struct {
-			Objects []*sharedModels.CommentCountRequest `json:"requests"`
-		}
-		col := &Collection{}
-		col.Objects = make([]*sharedModels.CommentCountRequest, 0)
-		err := util.RequestToJSON(r, &col)
+		requests := make([]*sharedModels.CommentCountRequest, 0)
+		err := ipc.ReadRequests(r, &requests)
 		if err != nil {
-			log.Fatal(err)
+			util.SendBadRequest(w, err)
+			return
 		}
 
-		responses, err := db.GetCommentCount(connection, col.Objects)
+		responses, err := db.GetCommentCount(r.Context(), connection, requests)
 
 		if err != nil {
 			util.SendError(w, err)
 			return
 		}
 
-		type Resp struct {
-			Result []*sharedModels.CommentCountResponse `json:"result"`
-		}
-		util.SendOK(w, &Resp{Result: responses})
+		ipc.SendResults(w, responses)
 	})
 }
 
 // GetLastTenHandler returns a list of last 10 comments
-func GetLastTenHandler(connection *sql.DB, cnf config.Config) negroni.HandlerFunc {
+func GetLastTenHandler(connection *sql.DB, cnf config.Config, clients *ipc.Clients) negroni.HandlerFunc {
 	return negroni.HandlerFunc(func(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
 
-		type Collection struct {
-			Objects []*sharedModels.CommentRequest `json:"requests"`
-		}
-		col := &Collection{}
-		col.Objects = make([]*sharedModels.CommentRequest, 0)
-		err := util.RequestToJSON(r, &col)
+		requests := make([]*sharedModels.CommentRequest, 0)
+		err := ipc.ReadRequests(r, &requests)
 		if err != nil {
-			util.SendError(w, err)
+			util.SendBadRequest(w, err)
 			return
 		}
 
-		responses, err := db.GetLastTenComments(connection, col.Objects)
+		responses, err := db.GetLastTenComments(r.Context(), connection, requests)
 		if err != nil {
 			util.SendError(w, err)
 			return
 		}
 
 		// include usernames
-		identifiers := make([]*sharedModels.GetUsernamesRequest, 0)
-		for index := 0; index < len(responses); index++ {
-			comment := responses[index]
-			identifiers = append(identifiers, &sharedModels.GetUsernamesRequest{
-				ID: comment.UserID,
-			})
-		}
-		usernames := getUsernames(cnf, identifiers)
-		for index := 0; index < len(responses); index++ {
-			comment := responses[index]
-			for undex := 0; undex < len(usernames); undex++ {
-				username := usernames[undex]
-
-				if comment.UserID == username.ID {
-					comment.Username = username.Username
-				}
-			}
-		}
+		appendUsernames(r.Context(), clients, responses)
 
-		type Resp struct {
-			Comments []*sharedModels.CommentResponse `json:"comments"`
-		}
-		util.SendOK(w, &Resp{Comments: responses})
+		ipc.SendResults(w, responses)
 	})
 }
 
@@ -276,30 +204,12 @@ func GetLastTenHandler(connection *sql.DB, cnf config.Config) negroni.HandlerFun
 func DeleteCommentHandler(connection *sql.DB, cnf config.Config) negroni.HandlerFunc {
 	return negroni.HandlerFunc(func(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
 
-		var queryToken = r.URL.Query().Get("token")
-
-		if len(queryToken) < 1 {
-			queryToken = r.Header.Get("token")
-		}
-
-		if len(queryToken) < 1 {
-			w.WriteHeader(http.StatusBadRequest)
-			w.Write([]byte(string("token is mandatory")))
+		user, ok := middleware.UserFromContext(r.Context())
+		if !ok {
+			util.SendError(w, middleware.ErrTokenMandatory)
 			return
 		}
 
-		tok, err := jwt.Parse(queryToken, func(t *jwt.Token) (interface{}, error) {
-			return []byte(cnf.SecretKey), nil
-		})
-
-		if err != nil {
-			util.SendErrorMessage(w, "You are not authorized")
-			return
-		}
-
-		claims := tok.Claims.(jwt.MapClaims)
-		var userID = claims["sub"].(float64) // gets the ID
-
 		// Get commentID
 		vars := mux.Vars(r)
 		strID := vars["id"]
@@ -315,18 +225,18 @@ func DeleteCommentHandler(connection *sql.DB, cnf config.Config) negroni.Handler
 			return
 		}
 
-		comment, err := db.GetCommentByID(connection, commentID)
+		comment, err := db.GetCommentByID(r.Context(), connection, commentID)
 		if err != nil {
 			util.SendError(w, err)
 			return
 		}
 
-		if comment.UserID != int(userID) {
-			util.SendErrorMessage(w, "you can only remove your own comment")
+		if comment.UserID != user.ID {
+			util.SendError(w, apierror.New(apierror.PermissionDenied, "you can only remove your own comment"))
 			return
 		}
 
-		_, err = db.DeleteCommentByID(connection, commentID)
+		_, err = db.DeleteCommentByID(r.Context(), connection, commentID)
 		if err != nil {
 			util.SendError(w, err)
 			return
@@ -335,86 +245,35 @@ func DeleteCommentHandler(connection *sql.DB, cnf config.Config) negroni.Handler
 	})
 }
 
-func getUsernames(cnf config.Config, input []*sharedModels.GetUsernamesRequest) []*sharedModels.GetUsernamesResponse {
-	type Req struct {
-		Requests []*sharedModels.GetUsernamesRequest `json:"requests"`
+// appendUsernames looks up the usernames of the authors and adds them to the comments.
+func appendUsernames(ctx context.Context, clients *ipc.Clients, comments []*sharedModels.CommentResponse) {
+	ids := make([]int, 0, len(comments))
+	for _, comment := range comments {
+		ids = append(ids, comment.UserID)
 	}
-	body, _ := json.Marshal(Req{Requests: input})
-	// Make url
-	url := cnf.ProfileServiceBaseurl + "ipc/usernames"
-
-	// Return object
-	usernames := make([]*sharedModels.GetUsernamesResponse, 0)
-
-	// GET data and append to return object
-	util.Request("GET", url, body, func(res *http.Response) {
-		// Error handling
-		if res.StatusCode < 200 || res.StatusCode > 299 {
-			logrus.Errorf("ERROR with code %v.", res.Status)
-			data, _ := ioutil.ReadAll(res.Body)
-			logrus.Error(string(data))
-			return
-		}
-
-		type Collection struct {
-			Objects []*sharedModels.GetUsernamesResponse `json:"usernames"`
-		}
-		col := &Collection{}
-		col.Objects = make([]*sharedModels.GetUsernamesResponse, 0)
-
-		err := util.ResponseJSONToObject(res, &col)
-		if err != nil {
-			log.Fatal(err)
-			return
-		}
-		usernames = col.Objects
-	})
-	return usernames
-}
 
-func getPhotos(cnf config.Config, input []*sharedModels.TopRatedPhotoResponse) []*sharedModels.PhotoResponse {
-	type Req struct {
-		Requests []*sharedModels.TopRatedPhotoResponse `json:"requests"`
+	usernames, err := clients.Profile.Usernames(ctx, ids)
+	if err != nil {
+		util.Log(ctx).Warn(err)
+		return
 	}
-	body, _ := json.Marshal(&Req{Requests: input})
-
-	// Make url
-	url := cnf.PhotoServiceBaseurl + "ipc/getPhotos"
-
-	photos := make([]*sharedModels.PhotoResponse, 0)
-	if strings.HasPrefix(url, "http") {
-		err := util.Request("GET", url, body, func(res *http.Response) {
-			// Error handling
-			if res.StatusCode < 200 || res.StatusCode > 299 {
-				printResponseError(res)
-				return
+	for _, comment := range comments {
+		for _, username := range usernames {
+			if comment.UserID == username.ID {
+				comment.Username = username.Username
 			}
-
-			// Happy path
-			type Collection struct {
-				Objects []*sharedModels.PhotoResponse `json:"results"`
-			}
-			col := &Collection{}
-			col.Objects = make([]*sharedModels.PhotoResponse, 0)
-			err := util.ResponseJSONToObject(res, &col)
-			if err != nil {
-				log.Fatal(err)
-			}
-			photos = col.Objects
-		})
-		if err != nil {
-			logrus.Fatal(err)
 		}
-	} else {
-		logrus.Errorf("Wrong URL. Expected something which starts with http, instead got %v.", url)
 	}
-	return photos
 }
 
-// appendVotesCount triggers `GET votes request` and appends result to []Photo
-func appendVotesCount(cnf config.Config, photoCountIdentifiers []*sharedModels.VoteCountRequest, photos []*sharedModels.PhotoResponse) []*sharedModels.PhotoResponse {
+// appendVotesCount looks up the votes count of each photo and adds them to the photos.
+func appendVotesCount(ctx context.Context, clients *ipc.Clients, photoIDs []int, photos []*sharedModels.PhotoResponse) []*sharedModels.PhotoResponse {
 	// Get the vote counts and add them
-	results := getVotes(cnf, photoCountIdentifiers)
+	results, err := clients.Vote.Counts(ctx, photoIDs)
+	if err != nil {
+		util.Log(ctx).Warn(err)
+		return photos
+	}
 	for index := 0; index < len(photos); index++ {
 		photoObject := photos[index]
 
@@ -430,10 +289,13 @@ func appendVotesCount(cnf config.Config, photoCountIdentifiers []*sharedModels.V
 	return photos
 }
 
-// appendUserVoted triggers `GET voted request` and appends results to []Photo. This function will
-// lookup whether the user has voted on the Photo
-func appendUserVoted(cnf config.Config, photoVotedIdentifiers []*sharedModels.HasVotedRequest, photos []*sharedModels.PhotoResponse) []*sharedModels.PhotoResponse {
-	youVoted := voted(cnf, photoVotedIdentifiers)
+// appendUserVoted looks up whether the user has voted on the photos and adds the result to the photos.
+func appendUserVoted(ctx context.Context, clients *ipc.Clients, userID int, photoIDs []int, photos []*sharedModels.PhotoResponse) []*sharedModels.PhotoResponse {
+	youVoted, err := clients.Vote.Voted(ctx, userID, photoIDs)
+	if err != nil {
+		util.Log(ctx).Warn(err)
+		return photos
+	}
 
 	for index := 0; index < len(photos); index++ {
 		photoObject := photos[index]
@@ -448,91 +310,3 @@ func appendUserVoted(cnf config.Config, photoVotedIdentifiers []*sharedModels.Ha
 	}
 	return photos
 }
-
-// Get votes from the VotesSerivce
-func getVotes(cnf config.Config, input []*sharedModels.VoteCountRequest) []*sharedModels.VoteCountResponse {
-	type Req struct {
-		Requests []*sharedModels.VoteCountRequest `json:"requests"`
-	}
-	body, _ := json.Marshal(&Req{Requests: input})
-
-	// Make url
-	url := cnf.VoteServiceBaseurl + "ipc/count"
-
-	//Return object
-	votes := make([]*sharedModels.VoteCountResponse, 0)
-	if strings.HasPrefix(url, "http") {
-		err := util.Request("GET", url, body, func(res *http.Response) {
-			// Error handling
-			if res.StatusCode < 200 || res.StatusCode > 299 {
-				printResponseError(res)
-				return
-			}
-
-			// Happy path
-			type Collection struct {
-				Objects []*sharedModels.VoteCountResponse `json:"results"`
-			}
-			col := &Collection{}
-			col.Objects = make([]*sharedModels.VoteCountResponse, 0)
-			err := util.ResponseJSONToObject(res, &col)
-			if err != nil {
-				logrus.Warn(err)
-			}
-			votes = col.Objects
-		})
-		if err != nil {
-			logrus.Warn(err)
-		}
-	} else {
-		logrus.Errorf("Wrong URL. Expected something which starts with http, instead got %v.", url)
-	}
-	return votes
-}
-
-// Determine if the user has voted on a photo. VotesService
-func voted(cnf config.Config, input []*sharedModels.HasVotedRequest) []*sharedModels.HasVotedResponse {
-	type Req struct {
-		Requests []*sharedModels.HasVotedRequest `json:"requests"`
-	}
-	body, _ := json.Marshal(&Req{Requests: input})
-
-	// Make url
-	url := cnf.VoteServiceBaseurl + "ipc/voted"
-
-	//Return object
-	hasVoted := make([]*sharedModels.HasVotedResponse, 0)
-	if strings.HasPrefix(url, "http") {
-		err := util.Request("GET", url, body, func(res *http.Response) {
-			// Error handling
-			if res.StatusCode < 200 || res.StatusCode > 299 {
-				printResponseError(res)
-				return
-			}
-
-			// Happy path
-			type Collection struct {
-				Objects []*sharedModels.HasVotedResponse `json:"results"`
-			}
-			col := &Collection{}
-			col.Objects = make([]*sharedModels.HasVotedResponse, 0)
-			err := util.ResponseJSONToObject(res, &col)
-			if err != nil {
-				logrus.Warn(err)
-			}
-			hasVoted = col.Objects
-		})
-		if err != nil {
-			logrus.Warn(err)
-		}
-	} else {
-		logrus.Errorf("Wrong URL. Expected something which starts with http, instead got %v.", url)
-	}
-	return hasVoted
-}
-
-func printResponseError(res *http.Response) {
-	logrus.Errorf("Response error with statuscode %v.", res.Status)
-	data, _ := ioutil.ReadAll(res.Body)
-	logrus.Error(string(data))
-}
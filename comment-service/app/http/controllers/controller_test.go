@@ -2,7 +2,9 @@ package controllers
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"log"
 	"net/http"
 	"net/http/httptest"
@@ -14,30 +16,18 @@ import (
 	"github.com/bstaijen/mariadb-for-microservices/comment-service/app/models"
 	"github.com/bstaijen/mariadb-for-microservices/comment-service/config"
 
+	"github.com/bstaijen/mariadb-for-microservices/shared/ipc"
 	sharedModels "github.com/bstaijen/mariadb-for-microservices/shared/models"
 	"github.com/bstaijen/mariadb-for-microservices/shared/util"
+	"github.com/bstaijen/mariadb-for-microservices/shared/util/middleware"
 )
 
 func TestCreateHandler(t *testing.T) {
 
-	// MOCK SERVER
-	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-
-		// MOCK RESPONSE
-		if r.URL.String() == "/ipc/usernames" {
-			users := make([]*sharedModels.GetUsernamesResponse, 0)
-			users = append(users, &sharedModels.GetUsernamesResponse{
-				ID:       1,
-				Username: "mockuser",
-			})
-
-			type Resp struct {
-				Usernames []*sharedModels.GetUsernamesResponse `json:"usernames"`
-			}
-			util.SendOK(w, &Resp{Usernames: users})
-		}
-	}))
-	defer ts.Close()
+	// Fake profile service
+	clients := &ipc.Clients{
+		Profile: &ipc.FakeProfileClient{Users: map[int]string{1: "mockuser"}},
+	}
 
 	// Test Comment
 	comment := &models.CommentCreate{}
@@ -47,10 +37,11 @@ func TestCreateHandler(t *testing.T) {
 
 	// Prepare request. (does not go to mock server, doens't go to any server at all)
 	json, err := json.Marshal(comment)
-	req, err := http.NewRequest("POST", ts.URL+"/comment", bytes.NewBuffer(json))
+	req, err := http.NewRequest("POST", "/comment", bytes.NewBuffer(json))
 	if err != nil {
 		t.Fatal(err)
 	}
+	req = req.WithContext(middleware.WithUser(req.Context(), &middleware.Principal{ID: comment.UserID}))
 	res := httptest.NewRecorder()
 
 	// Mock database
@@ -69,10 +60,9 @@ func TestCreateHandler(t *testing.T) {
 
 	// Mock config
 	cnf := config.Config{}
-	cnf.ProfileServiceBaseurl = ts.URL + "/"
 
 	// Invoke handler
-	handler := CreateHandler(db, cnf)
+	handler := CreateHandler(db, cnf, clients)
 	handler(res, req, nil)
 
 	// Make sure expectations are met
@@ -87,6 +77,94 @@ func TestCreateHandler(t *testing.T) {
 
 }
 
+// Test if a comment can not be posted in the name of another user.
+func TestCreateHandlerOtherUser(t *testing.T) {
+	comment := &models.CommentCreate{}
+	comment.Comment = "comment"
+	comment.PhotoID = 5
+	comment.UserID = 9
+
+	json, err := json.Marshal(comment)
+	req, err := http.NewRequest("POST", "/comment", bytes.NewBuffer(json))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req = req.WithContext(middleware.WithUser(req.Context(), &middleware.Principal{ID: 1}))
+	res := httptest.NewRecorder()
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	handler := CreateHandler(db, config.Config{}, &ipc.Clients{})
+	handler(res, req, nil)
+
+	// Nothing may be stored
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+	if res.Result().StatusCode != http.StatusForbidden {
+		t.Errorf("Expected %v but got %v", http.StatusForbidden, res.Result().StatusCode)
+	}
+}
+
+// Test if the comment is posted as the user of the request when the body has no user ID.
+func TestCreateHandlerUserFromToken(t *testing.T) {
+	clients := &ipc.Clients{
+		Profile: &ipc.FakeProfileClient{Users: map[int]string{1: "mockuser"}},
+	}
+
+	comment := &models.CommentCreate{}
+	comment.Comment = "comment"
+	comment.PhotoID = 5
+
+	json, err := json.Marshal(comment)
+	req, err := http.NewRequest("POST", "/comment", bytes.NewBuffer(json))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req = req.WithContext(middleware.WithUser(req.Context(), &middleware.Principal{ID: 1}))
+	res := httptest.NewRecorder()
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	mock.ExpectExec("INSERT INTO comments").WithArgs(1, comment.PhotoID, comment.Comment).WillReturnResult(sqlmock.NewResult(1, 1))
+	rows := sqlmock.NewRows([]string{"id", "user_id", "photo_id", "comment", "createdAt"}).AddRow(1, 1, comment.PhotoID, comment.Comment, time.Now().UTC())
+	mock.ExpectQuery("SELECT (.+) FROM comments WHERE").WithArgs(1).WillReturnRows(rows)
+
+	handler := CreateHandler(db, config.Config{}, clients)
+	handler(res, req, nil)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+	if res.Result().StatusCode != http.StatusOK {
+		t.Errorf("Expected %v but got %v", http.StatusOK, res.Result().StatusCode)
+	}
+}
+
+// Test if a comment can not be posted without a user.
+func TestCreateHandlerWithoutUser(t *testing.T) {
+	req, err := http.NewRequest("POST", "/comment", bytes.NewBuffer([]byte(`{"photo_id":5,"comment":"comment"}`)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := httptest.NewRecorder()
+
+	handler := CreateHandler(nil, config.Config{}, &ipc.Clients{})
+	handler(res, req, nil)
+
+	if res.Result().StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected %v but got %v", http.StatusUnauthorized, res.Result().StatusCode)
+	}
+}
+
 func TestListCommentsHandler(t *testing.T) {
 	// Test Comment
 	comment := &models.CommentCreate{}
@@ -94,26 +172,12 @@ func TestListCommentsHandler(t *testing.T) {
 	comment.PhotoID = 5
 	comment.UserID = 9
 
-	// MOCK SERVER
-	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-
-		// MOCK RESPONSE
-		if r.URL.String() == "/ipc/usernames" {
-			users := make([]*sharedModels.GetUsernamesResponse, 0)
-			users = append(users, &sharedModels.GetUsernamesResponse{
-				ID:       1,
-				Username: "mockuser",
-			})
-
-			type Resp struct {
-				Usernames []*sharedModels.GetUsernamesResponse `json:"usernames"`
-			}
-			util.SendOK(w, &Resp{Usernames: users})
-		}
-	}))
-	defer ts.Close()
+	// Fake profile service
+	clients := &ipc.Clients{
+		Profile: &ipc.FakeProfileClient{Users: map[int]string{1: "mockuser"}},
+	}
 
-	req, err := http.NewRequest("POST", ts.URL+"/comment?photoID=5", nil)
+	req, err := http.NewRequest("POST", "/comment?photoID=5", nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -132,8 +196,7 @@ func TestListCommentsHandler(t *testing.T) {
 
 	// Mock config
 	cnf := config.Config{}
-	cnf.ProfileServiceBaseurl = ts.URL + "/"
-	handler := ListCommentsHandler(db, cnf)
+	handler := ListCommentsHandler(db, cnf, clients)
 	handler(res, req, nil)
 
 	// Make sure expectations are met
@@ -148,29 +211,9 @@ func TestListCommentsHandler(t *testing.T) {
 }
 
 func TestGetCommentCountHandler(t *testing.T) {
-
-	// MOCK SERVER
-	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-
-		// MOCK RESPONSE
-		if r.URL.String() == "/ipc/usernames" {
-			users := make([]*sharedModels.GetUsernamesResponse, 0)
-			users = append(users, &sharedModels.GetUsernamesResponse{
-				ID:       1,
-				Username: "mockuser",
-			})
-
-			type Resp struct {
-				Usernames []*sharedModels.GetUsernamesResponse `json:"usernames"`
-			}
-			util.SendOK(w, &Resp{Usernames: users})
-		}
-	}))
-	defer ts.Close()
-
 	body := []byte(`{ "requests":[{"photo_id":1} ,{"photo_id":2},{"photo_id":3}, {"photo_id":4} ]}`)
 
-	req, err := http.NewRequest("POST", ts.URL+"/comment?photoID=5", bytes.NewBuffer(body))
+	req, err := http.NewRequest("POST", "/comment?photoID=5", bytes.NewBuffer(body))
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -188,7 +231,6 @@ func TestGetCommentCountHandler(t *testing.T) {
 
 	// Mock config
 	cnf := config.Config{}
-	cnf.ProfileServiceBaseurl = ts.URL + "/"
 	handler := GetCommentCountHandler(db, cnf)
 	handler(res, req, nil)
 
@@ -202,7 +244,7 @@ func TestGetCommentCountHandler(t *testing.T) {
 		t.Errorf(res.Body.String())
 	}
 
-	expected := `{"result":[{"photo_id":5,"count":10},{"photo_id":6,"count":11}]}`
+	expected := `{"results":[{"photo_id":5,"count":10},{"photo_id":6,"count":11}]}`
 	actual := res.Body.String()
 	if expected != actual {
 		t.Fatalf("Expected %s got %s", expected, actual)
@@ -210,28 +252,14 @@ func TestGetCommentCountHandler(t *testing.T) {
 }
 
 func TestGetLastTenHandler(t *testing.T) {
-	// MOCK SERVER
-	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-
-		// MOCK RESPONSE
-		if r.URL.String() == "/ipc/usernames" {
-			users := make([]*sharedModels.GetUsernamesResponse, 0)
-			users = append(users, &sharedModels.GetUsernamesResponse{
-				ID:       1,
-				Username: "mockuser",
-			})
-
-			type Resp struct {
-				Usernames []*sharedModels.GetUsernamesResponse `json:"usernames"`
-			}
-			util.SendOK(w, &Resp{Usernames: users})
-		}
-	}))
-	defer ts.Close()
+	// Fake profile service
+	clients := &ipc.Clients{
+		Profile: &ipc.FakeProfileClient{Users: map[int]string{1: "mockuser"}},
+	}
 
 	body := []byte(`{ "requests":[{"photo_id":1} ,{"photo_id":2},{"photo_id":3}, {"photo_id":4} ]}`)
 
-	req, err := http.NewRequest("POST", ts.URL+"/comment?photoID=5", bytes.NewBuffer(body))
+	req, err := http.NewRequest("POST", "/comment?photoID=5", bytes.NewBuffer(body))
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -252,8 +280,7 @@ func TestGetLastTenHandler(t *testing.T) {
 
 	// Mock config
 	cnf := config.Config{}
-	cnf.ProfileServiceBaseurl = ts.URL + "/"
-	handler := GetLastTenHandler(db, cnf)
+	handler := GetLastTenHandler(db, cnf, clients)
 	handler(res, req, nil)
 
 	// Make sure expectations are met
@@ -267,7 +294,7 @@ func TestGetLastTenHandler(t *testing.T) {
 	}
 
 	type Collection struct {
-		Objects []*sharedModels.CommentResponse `json:"comments"`
+		Objects []*sharedModels.CommentResponse `json:"results"`
 	}
 	col := &Collection{}
 	col.Objects = make([]*sharedModels.CommentResponse, 0)
@@ -309,47 +336,37 @@ func TestGetLastTenHandler(t *testing.T) {
 
 }
 
-// This test is only testing of the method getUsernames can be called and if it correctly parses the data back. It is not meant to test whether the whole IPC-call is performed correctly.
-func TestGetUsernames(t *testing.T) {
-
-	// Mock server
-	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if r.URL.String() == "/ipc/usernames" {
-			users := make([]*sharedModels.GetUsernamesResponse, 0)
-			users = append(users, &sharedModels.GetUsernamesResponse{
-				ID:       19,
-				Username: "mockuser19",
-			})
-			users = append(users, &sharedModels.GetUsernamesResponse{
-				ID:       54,
-				Username: "mockuser54",
-			})
-
-			type Resp struct {
-				Usernames []*sharedModels.GetUsernamesResponse `json:"usernames"`
-			}
-			util.SendOK(w, &Resp{Usernames: users})
+func TestAppendUsernames(t *testing.T) {
+	clients := &ipc.Clients{
+		Profile: &ipc.FakeProfileClient{Users: map[int]string{19: "mockuser19", 54: "mockuser54"}},
+	}
+
+	comments := []*sharedModels.CommentResponse{
+		&sharedModels.CommentResponse{ID: 1, UserID: 19},
+		&sharedModels.CommentResponse{ID: 2, UserID: 54},
+		&sharedModels.CommentResponse{ID: 3, UserID: 77},
+	}
+	appendUsernames(context.Background(), clients, comments)
+
+	expected := []string{"mockuser19", "mockuser54", ""}
+	for index, comment := range comments {
+		if comment.Username != expected[index] {
+			t.Errorf("Expected %v but got %v", expected[index], comment.Username)
 		}
-	}))
-	defer ts.Close()
+	}
+}
 
-	// Mock config
-	cnf := config.Config{}
-	cnf.ProfileServiceBaseurl = ts.URL + "/"
-
-	// Mocking list with desired ID's.
-	identifiers := make([]*sharedModels.GetUsernamesRequest, 0)
-	identifiers = append(identifiers, &sharedModels.GetUsernamesRequest{
-		ID: 19,
-	})
-	identifiers = append(identifiers, &sharedModels.GetUsernamesRequest{
-		ID: 54,
-	})
-
-	result := getUsernames(cnf, identifiers)
-	if len(result) == 2 {
-		// OK
-	} else {
-		t.Errorf("Expected 2 rows to return but got %v", len(result))
+func TestAppendUsernamesProfileServiceDown(t *testing.T) {
+	clients := &ipc.Clients{
+		Profile: &ipc.FakeProfileClient{Err: errors.New("connection refused")},
+	}
+
+	comments := []*sharedModels.CommentResponse{
+		&sharedModels.CommentResponse{ID: 1, UserID: 19},
+	}
+	appendUsernames(context.Background(), clients, comments)
+
+	if comments[0].Username != "" {
+		t.Errorf("Expected empty username but got %v", comments[0].Username)
 	}
 }
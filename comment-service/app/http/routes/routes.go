@@ -2,69 +2,115 @@ package routes
 
 import (
 	"database/sql"
+	"time"
 
 	"github.com/bstaijen/mariadb-for-microservices/comment-service/app/http/controllers"
 	"github.com/bstaijen/mariadb-for-microservices/comment-service/config"
+	"github.com/bstaijen/mariadb-for-microservices/shared/health"
+	"github.com/bstaijen/mariadb-for-microservices/shared/ipc"
+	"github.com/bstaijen/mariadb-for-microservices/shared/jwks"
+	"github.com/bstaijen/mariadb-for-microservices/shared/ratelimit"
+	"github.com/bstaijen/mariadb-for-microservices/shared/util"
 	"github.com/bstaijen/mariadb-for-microservices/shared/util/middleware"
 	"github.com/gorilla/mux"
 	"github.com/urfave/negroni"
 )
 
-// InitRoutes instantiates a new gorilla/mux router
-func InitRoutes(db *sql.DB, cnf config.Config) *mux.Router {
+// commentPolicy limits the comments a user can post.
+var commentPolicy = ratelimit.Policy{Name: "comment", Limit: 10, Period: time.Minute}
+
+// InitRoutes instantiates a new gorilla/mux router. IPCKeys sign and verify the IPC calls.
+func InitRoutes(db *sql.DB, cnf config.Config, ipcKeys *ipc.Keys) *mux.Router {
+	identity := ipcKeys.Identity
+	clients := &ipc.Clients{
+		Profile: ipc.NewProfileClient(cnf.ProfileServiceBaseurl, identity),
+		Photo:   ipc.NewPhotoClient(cnf.PhotoServiceBaseurl, identity),
+		Vote:    ipc.NewVoteClient(cnf.VoteServiceBaseurl, identity),
+	}
+	revocations := ipc.NewRevocations(cnf.AuthenticationServiceBaseurl, identity, middleware.DefaultRevocationTTL)
+	accessTokens := ipc.NewAccessTokens(cnf.AuthenticationServiceBaseurl, identity, middleware.DefaultRevocationTTL)
+	keys := jwks.NewRemote(cnf.AuthenticationServiceBaseurl, 0)
+
 	router := mux.NewRouter()
-	router = setRESTRoutes(db, cnf, router)
-	router = setIPCRoutes(db, cnf, router)
+	router = setHealthRoutes(db, cnf, router)
+	router = setRESTRoutes(db, cnf, clients, keys, revocations, accessTokens, router)
+	router = setIPCRoutes(db, cnf, ipcKeys.Callers, clients, router)
 	return router
 }
 
 // setRESTRoutes specifies all public routes for the comment service
-func setRESTRoutes(db *sql.DB, cnf config.Config, router *mux.Router) *mux.Router {
+func setRESTRoutes(db *sql.DB, cnf config.Config, clients *ipc.Clients, keys jwks.KeySet, revocations middleware.Revocations, accessTokens middleware.AccessTokens, router *mux.Router) *mux.Router {
+	limiter := ratelimit.NewMemoryStore()
+
 	// Subrouter /comments
 	comments := router.PathPrefix("/comments").Subrouter()
-	comments.Methods("OPTIONS").Handler(negroni.New(
-		negroni.HandlerFunc(middleware.AcceptOPTIONS),
-	))
 
 	comments.Handle("/fromuser", negroni.New(
-		negroni.HandlerFunc(middleware.AccessControlHandler),
-		controllers.ListCommentsFromUser(db, cnf),
+		middleware.RequireScopedTokenAuthenticationHandler(keys, revocations, accessTokens, middleware.ScopeCommentsRead),
+		controllers.ListCommentsFromUser(db, cnf, clients),
 	)).Methods("GET")
 
 	comments.Handle("/{id}/delete", negroni.New(
-		negroni.HandlerFunc(middleware.AccessControlHandler),
+		middleware.RequireScopedTokenAuthenticationHandler(keys, revocations, accessTokens, middleware.ScopeCommentsWrite),
 		controllers.DeleteCommentHandler(db, cnf),
 	)).Methods("POST")
 
 	// Create a comment /comments
 	comments.Methods("POST").Handler(negroni.New(
-		negroni.HandlerFunc(middleware.AccessControlHandler),
-		controllers.CreateHandler(db, cnf),
+		middleware.RequireScopedTokenAuthenticationHandler(keys, revocations, accessTokens, middleware.ScopeCommentsWrite),
+		middleware.RequireVerifiedEmail(cnf.RequireVerifiedEmail),
+		ratelimit.Middleware(limiter, commentPolicy),
+		controllers.CreateHandler(db, cnf, clients),
 	))
 	comments.Methods("GET").Handler(negroni.New(
-		negroni.HandlerFunc(middleware.AccessControlHandler),
-		controllers.ListCommentsHandler(db, cnf),
+		controllers.ListCommentsHandler(db, cnf, clients),
 	))
 
 	return router
 }
 
 // Inter-Process Communication routes specifies the routes for internal communication
-func setIPCRoutes(db *sql.DB, cnf config.Config, router *mux.Router) *mux.Router {
+func setIPCRoutes(db *sql.DB, cnf config.Config, callers middleware.ServiceKeys, clients *ipc.Clients, router *mux.Router) *mux.Router {
+
 	// IPC subrouter /ipc
-	ipc := router.PathPrefix("/ipc").Subrouter()
+	ipcRouter := router.PathPrefix("/ipc").Subrouter()
 
 	// get last 10 comments /ipc/getLast10
-	ipc.Handle("/getLast10", negroni.New(
-		negroni.HandlerFunc(middleware.AccessControlHandler),
-		controllers.GetLastTenHandler(db, cnf),
+	ipcRouter.Handle("/getLast10", negroni.New(
+		middleware.RequireServiceAuthenticationHandler(callers, ipc.CommentService, ipc.PhotoService),
+		controllers.GetLastTenHandler(db, cnf, clients),
 	)).Methods("GET")
 
 	// get the number of comments of a photo /ipc/getCount
-	ipc.Handle("/getCount", negroni.New(
-		negroni.HandlerFunc(middleware.AccessControlHandler),
+	ipcRouter.Handle("/getCount", negroni.New(
+		middleware.RequireServiceAuthenticationHandler(callers, ipc.CommentService, ipc.PhotoService),
 		controllers.GetCommentCountHandler(db, cnf),
 	)).Methods("GET")
 
+	// State of the circuit breakers of the outgoing IPC calls
+	ipcRouter.Handle("/breakers", negroni.New(
+		middleware.RequireServiceAuthenticationHandler(callers, ipc.CommentService, ipc.Services...),
+		negroni.HandlerFunc(util.BreakersHandler),
+	)).Methods("GET")
+
+	return router
+}
+
+// setHealthRoutes specifies the liveness and readiness routes
+func setHealthRoutes(db *sql.DB, cnf config.Config, router *mux.Router) *mux.Router {
+	router.Handle("/healthz", negroni.New(
+		negroni.HandlerFunc(health.Liveness),
+	)).Methods("GET")
+
+	router.Handle("/readyz", negroni.New(
+		health.Readiness(health.DefaultTimeout,
+			health.Database(db),
+			health.Service(ipc.AuthenticationService, cnf.AuthenticationServiceBaseurl),
+			health.Service(ipc.ProfileService, cnf.ProfileServiceBaseurl),
+			health.Service(ipc.PhotoService, cnf.PhotoServiceBaseurl),
+			health.Service(ipc.VoteService, cnf.VoteServiceBaseurl),
+		),
+	)).Methods("GET")
+
 	return router
 }
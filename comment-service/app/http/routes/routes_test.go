@@ -15,7 +15,11 @@ import (
 
 	"github.com/bstaijen/mariadb-for-microservices/comment-service/app/models"
 	"github.com/bstaijen/mariadb-for-microservices/comment-service/config"
+	"github.com/bstaijen/mariadb-for-microservices/shared/ipc"
+	"github.com/bstaijen/mariadb-for-microservices/shared/jwks"
 	"github.com/bstaijen/mariadb-for-microservices/shared/util"
+	"github.com/bstaijen/mariadb-for-microservices/shared/util/middleware"
+	jwt "github.com/dgrijalva/jwt-go"
 
 	sharedModels "github.com/bstaijen/mariadb-for-microservices/shared/models"
 )
@@ -40,9 +44,9 @@ func TestPostComment(t *testing.T) {
 			})
 
 			type Resp struct {
-				Usernames []*sharedModels.GetUsernamesResponse `json:"usernames"`
+				Results []*sharedModels.GetUsernamesResponse `json:"results"`
 			}
-			util.SendOK(w, &Resp{Usernames: users})
+			util.SendOK(w, &Resp{Results: users})
 		} else {
 			util.SendBadRequest(w, errors.New("Not implemented"))
 		}
@@ -64,9 +68,13 @@ func TestPostComment(t *testing.T) {
 
 	cnf := config.Config{}
 	cnf.ProfileServiceBaseurl = ts.URL + "/"
+	auth := authServer()
+	defer auth.Close()
+	cnf.AuthenticationServiceBaseurl = auth.URL
+	token := getTokenString(comment.UserID, t)
 
 	json, _ := json.Marshal(comment)
-	res := doRequest(db, cnf, "POST", ts.URL+"/comments", bytes.NewBuffer(json), t)
+	res := doRequest(db, cnf, "POST", ts.URL+"/comments?token="+token, bytes.NewBuffer(json), t)
 	// Make sure expectations are met
 	if err := mock.ExpectationsWereMet(); err != nil {
 		t.Errorf("there were unfulfilled expectations: %s", err)
@@ -81,6 +89,49 @@ func TestPostComment(t *testing.T) {
 	}
 }
 
+// Test if a comment can not be posted without a token.
+func TestPostCommentWithoutToken(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	cnf := config.Config{}
+	res := doRequest(db, cnf, "POST", "http://localhost/comments", bytes.NewBuffer([]byte(`{"user_id":9,"photo_id":5,"comment":"comment"}`)), t)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+	if res.Result().StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected %v but got %v", http.StatusUnauthorized, res.Result().StatusCode)
+	}
+}
+
+// Test if an unverified user can not post a comment when verification is required.
+func TestPostCommentUnverified(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	cnf := config.Config{}
+	cnf.RequireVerifiedEmail = true
+	auth := authServer()
+	defer auth.Close()
+	cnf.AuthenticationServiceBaseurl = auth.URL
+	token := getTokenString(9, t)
+	res := doRequest(db, cnf, "POST", "http://localhost/comments?token="+token, bytes.NewBuffer([]byte(`{"user_id":9,"photo_id":5,"comment":"comment"}`)), t)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+	if res.Result().StatusCode != http.StatusForbidden {
+		t.Errorf("Expected %v but got %v", http.StatusForbidden, res.Result().StatusCode)
+	}
+}
+
 // test get comments on photo
 func TestGetCommentsFromPhoto(t *testing.T) {
 	// Test Comment
@@ -101,9 +152,9 @@ func TestGetCommentsFromPhoto(t *testing.T) {
 			})
 
 			type Resp struct {
-				Usernames []*sharedModels.GetUsernamesResponse `json:"usernames"`
+				Results []*sharedModels.GetUsernamesResponse `json:"results"`
 			}
-			util.SendOK(w, &Resp{Usernames: users})
+			util.SendOK(w, &Resp{Results: users})
 		} else {
 			util.SendBadRequest(w, errors.New("Not implemented"))
 		}
@@ -155,9 +206,9 @@ func TestIPCGetLast10(t *testing.T) {
 			})
 
 			type Resp struct {
-				Usernames []*sharedModels.GetUsernamesResponse `json:"usernames"`
+				Results []*sharedModels.GetUsernamesResponse `json:"results"`
 			}
-			util.SendOK(w, &Resp{Usernames: users})
+			util.SendOK(w, &Resp{Results: users})
 		} else {
 			util.SendBadRequest(w, errors.New("Not implemented"))
 		}
@@ -183,7 +234,7 @@ func TestIPCGetLast10(t *testing.T) {
 	cnf := config.Config{}
 	cnf.ProfileServiceBaseurl = ts.URL + "/"
 
-	res := doRequest(db, cnf, "GET", ts.URL+"/ipc/getLast10", bytes.NewBuffer(body), t)
+	res := doIPCRequest(db, cnf, ipc.PhotoService, "GET", ts.URL+"/ipc/getLast10", bytes.NewBuffer(body), t)
 
 	// Make sure expectations are met
 	if err := mock.ExpectationsWereMet(); err != nil {
@@ -196,7 +247,7 @@ func TestIPCGetLast10(t *testing.T) {
 
 	// Compare results
 	type Collection struct {
-		Objects []*sharedModels.CommentResponse `json:"comments"`
+		Objects []*sharedModels.CommentResponse `json:"results"`
 	}
 	col := &Collection{}
 	col.Objects = make([]*sharedModels.CommentResponse, 0)
@@ -252,9 +303,9 @@ func TestIPCGetCommentCount(t *testing.T) {
 			})
 
 			type Resp struct {
-				Usernames []*sharedModels.GetUsernamesResponse `json:"usernames"`
+				Results []*sharedModels.GetUsernamesResponse `json:"results"`
 			}
-			util.SendOK(w, &Resp{Usernames: users})
+			util.SendOK(w, &Resp{Results: users})
 		} else {
 			util.SendBadRequest(w, errors.New("Not implemented"))
 		}
@@ -277,7 +328,7 @@ func TestIPCGetCommentCount(t *testing.T) {
 	cnf := config.Config{}
 	cnf.ProfileServiceBaseurl = ts.URL + "/"
 
-	res := doRequest(db, cnf, "GET", ts.URL+"/ipc/getCount", bytes.NewBuffer(body), t)
+	res := doIPCRequest(db, cnf, ipc.PhotoService, "GET", ts.URL+"/ipc/getCount", bytes.NewBuffer(body), t)
 
 	// Make sure expectations are met
 	if err := mock.ExpectationsWereMet(); err != nil {
@@ -288,7 +339,7 @@ func TestIPCGetCommentCount(t *testing.T) {
 		t.Errorf(res.Body.String())
 	}
 
-	expected := `{"result":[{"photo_id":5,"count":10},{"photo_id":6,"count":11}]}`
+	expected := `{"results":[{"photo_id":5,"count":10},{"photo_id":6,"count":11}]}`
 	actual := res.Body.String()
 	if expected != actual {
 		t.Fatalf("Expected %s got %s", expected, actual)
@@ -296,7 +347,7 @@ func TestIPCGetCommentCount(t *testing.T) {
 }
 
 func doRequest(db *sql.DB, cnf config.Config, method string, url string, body *bytes.Buffer, t *testing.T) *httptest.ResponseRecorder {
-	r := InitRoutes(db, cnf)
+	r := InitRoutes(db, cnf, ipc.FakeKeys(ipc.CommentService))
 	res := httptest.NewRecorder()
 	req, err := http.NewRequest(method, url, body)
 	if err != nil {
@@ -305,3 +356,74 @@ func doRequest(db *sql.DB, cnf config.Config, method string, url string, body *b
 	r.ServeHTTP(res, req)
 	return res
 }
+
+var testKeys = newTestKeys()
+
+func newTestKeys() *jwks.Set {
+	key, err := jwks.GenerateKey()
+	if err != nil {
+		panic(err)
+	}
+	keys, err := jwks.NewSet(key)
+	if err != nil {
+		panic(err)
+	}
+	return keys
+}
+
+// authServer stands in for the authentication service. It publishes testKeys and answers that no token was
+// revoked.
+func authServer() *httptest.Server {
+	mux := http.NewServeMux()
+	mux.Handle(jwks.Path, jwks.Handler(testKeys))
+	mux.HandleFunc("/ipc/tokenStatus", func(w http.ResponseWriter, r *http.Request) {
+		requests := make([]*sharedModels.TokenStatusRequest, 0)
+		if err := ipc.ReadRequests(r, &requests); err != nil {
+			util.SendBadRequest(w, err)
+			return
+		}
+		statuses := make([]*sharedModels.TokenStatusResponse, 0, len(requests))
+		for _, request := range requests {
+			statuses = append(statuses, &sharedModels.TokenStatusResponse{UserID: request.UserID, TokenID: request.TokenID})
+		}
+		ipc.SendResults(w, statuses)
+	})
+	return httptest.NewServer(mux)
+}
+
+func getTokenString(userID int, t *testing.T) string {
+	expiration := time.Now().Add(time.Hour * 24 * 31).Unix()
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+		"sub": userID,
+		"jti": "test-token",
+		"iss": middleware.TokenIssuer,
+		"iat": time.Now().Unix(),
+		"exp": expiration,
+	})
+	token.Header["kid"] = testKeys.SigningKey().ID
+
+	// Generate a signed token
+	tokenString, err := token.SignedString(testKeys.SigningKey().Key)
+	if err != nil {
+		t.Error(err)
+		return ""
+	}
+	return tokenString
+}
+
+// doIPCRequest works like doRequest and authenticates the request with a service token of caller.
+func doIPCRequest(db *sql.DB, cnf config.Config, caller string, method string, url string, body *bytes.Buffer, t *testing.T) *httptest.ResponseRecorder {
+	r := InitRoutes(db, cnf, ipc.FakeKeys(ipc.CommentService))
+	res := httptest.NewRecorder()
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := middleware.NewServiceToken(ipc.FakeKeys(caller).Identity.Key, caller, ipc.CommentService)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	r.ServeHTTP(res, req)
+	return res
+}
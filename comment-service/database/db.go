@@ -1,18 +1,22 @@
 package db
 
 import (
+	"context"
 	"database/sql"
-	"errors"
 	"fmt"
 
 	log "github.com/Sirupsen/logrus"
 
 	"github.com/bstaijen/mariadb-for-microservices/comment-service/app/models"
 	"github.com/bstaijen/mariadb-for-microservices/comment-service/config"
+	"github.com/bstaijen/mariadb-for-microservices/shared/apierror"
+	"github.com/bstaijen/mariadb-for-microservices/shared/bootstrap"
 	sharedModels "github.com/bstaijen/mariadb-for-microservices/shared/models"
+	"github.com/bstaijen/mariadb-for-microservices/shared/tracing"
 )
 
-// OpenConnection method
+// OpenConnection opens the connection to the database. It waits for the database to come online for at most
+// cnf.DBConnectTimeout.
 func OpenConnection(cnf config.Config) (*sql.DB, error) {
 	username := cnf.DBUsername
 	password := cnf.DBPassword
@@ -23,14 +27,14 @@ func OpenConnection(cnf config.Config) (*sql.DB, error) {
 	dsn := fmt.Sprintf("%v:%v@tcp(%v:%v)/%v?parseTime=true", username, password, host, port, database)
 
 	log.Debugf("Connect to : %v", dsn)
-	db, err := sql.Open("mysql", dsn)
-	if err != nil {
-		return nil, ErrCanNotConnectWithDatabase
-	}
-
-	// Open doesn't open a connection. Validate DSN data:
-	err = db.Ping()
+	db, err := bootstrap.OpenDB(context.Background(), "mysql", dsn, bootstrap.DBOptions{
+		ConnectTimeout:  cnf.DBConnectTimeout,
+		MaxOpenConns:    cnf.DBMaxOpenConns,
+		MaxIdleConns:    cnf.DBMaxIdleConns,
+		ConnMaxLifetime: cnf.DBConnMaxLifetime,
+	})
 	if err != nil {
+		log.Error(err)
 		return nil, ErrCanNotConnectWithDatabase
 	}
 	return db, nil
@@ -42,8 +46,8 @@ func CloseConnection(db *sql.DB) {
 }
 
 // Create : saves a comment in the database
-func Create(db *sql.DB, comment *models.CommentCreate) (*sharedModels.CommentResponse, error) {
-	res, err := db.Exec("INSERT INTO comments(user_id, photo_id, comment) VALUES(?,?,?)", comment.UserID, comment.PhotoID, comment.Comment)
+func Create(ctx context.Context, db *sql.DB, comment *models.CommentCreate) (*sharedModels.CommentResponse, error) {
+	res, err := tracing.ExecContext(ctx, db, "INSERT INTO comments(user_id, photo_id, comment) VALUES(?,?,?)", comment.UserID, comment.PhotoID, comment.Comment)
 	if err != nil {
 		return &sharedModels.CommentResponse{}, err
 	}
@@ -53,7 +57,7 @@ func Create(db *sql.DB, comment *models.CommentCreate) (*sharedModels.CommentRes
 		return &sharedModels.CommentResponse{}, err
 	}
 
-	c, err := GetCommentByID(db, int(insertedID))
+	c, err := GetCommentByID(ctx, db, int(insertedID))
 	if err != nil {
 		return &sharedModels.CommentResponse{}, err
 	}
@@ -61,8 +65,8 @@ func Create(db *sql.DB, comment *models.CommentCreate) (*sharedModels.CommentRes
 }
 
 // GetCommentByID returns a comment from the database
-func GetCommentByID(db *sql.DB, id int) (*sharedModels.CommentResponse, error) {
-	rows, err := db.Query("SELECT id, user_id, photo_id, comment, createdAt FROM comments WHERE id = ?", id)
+func GetCommentByID(ctx context.Context, db *sql.DB, id int) (*sharedModels.CommentResponse, error) {
+	rows, err := tracing.QueryContext(ctx, db, "SELECT id, user_id, photo_id, comment, createdAt FROM comments WHERE id = ?", id)
 	if err != nil {
 		return &sharedModels.CommentResponse{}, err
 	}
@@ -75,8 +79,8 @@ func GetCommentByID(db *sql.DB, id int) (*sharedModels.CommentResponse, error) {
 }
 
 // GetComments return an array of comments.
-func GetComments(db *sql.DB, photoID, offset, nrOfRows int) ([]*sharedModels.CommentResponse, error) {
-	rows, err := db.Query("SELECT id, user_id, photo_id, comment, createdAt FROM comments WHERE photo_id=? ORDER BY createdAt DESC LIMIT ?, ?", photoID, offset, nrOfRows)
+func GetComments(ctx context.Context, db *sql.DB, photoID, offset, nrOfRows int) ([]*sharedModels.CommentResponse, error) {
+	rows, err := tracing.QueryContext(ctx, db, "SELECT id, user_id, photo_id, comment, createdAt FROM comments WHERE photo_id=? ORDER BY createdAt DESC LIMIT ?, ?", photoID, offset, nrOfRows)
 	if err != nil {
 		return nil, err
 	}
@@ -91,8 +95,8 @@ func GetComments(db *sql.DB, photoID, offset, nrOfRows int) ([]*sharedModels.Com
 }
 
 // GetCommentsByUserID get all comments from a user.
-func GetCommentsByUserID(db *sql.DB, userID, offset, nrOfRows int) ([]*sharedModels.CommentResponse, error) {
-	rows, err := db.Query("SELECT id, user_id, photo_id, comment, createdAt FROM comments WHERE user_id=? ORDER BY createdAt DESC LIMIT ?, ?", userID, offset, nrOfRows)
+func GetCommentsByUserID(ctx context.Context, db *sql.DB, userID, offset, nrOfRows int) ([]*sharedModels.CommentResponse, error) {
+	rows, err := tracing.QueryContext(ctx, db, "SELECT id, user_id, photo_id, comment, createdAt FROM comments WHERE user_id=? ORDER BY createdAt DESC LIMIT ?, ?", userID, offset, nrOfRows)
 	if err != nil {
 		return nil, err
 	}
@@ -107,7 +111,7 @@ func GetCommentsByUserID(db *sql.DB, userID, offset, nrOfRows int) ([]*sharedMod
 }
 
 // GetCommentCount returns the number of comment counts
-func GetCommentCount(db *sql.DB, items []*sharedModels.CommentCountRequest) ([]*sharedModels.CommentCountResponse, error) {
+func GetCommentCount(ctx context.Context, db *sql.DB, items []*sharedModels.CommentCountRequest) ([]*sharedModels.CommentCountResponse, error) {
 
 	if len(items) < 1 {
 		return nil, nil
@@ -124,7 +128,7 @@ func GetCommentCount(db *sql.DB, items []*sharedModels.CommentCountRequest) ([]*
 		}
 	}
 
-	rows, err := db.Query(query)
+	rows, err := tracing.QueryContext(ctx, db, query)
 	if err != nil {
 		return nil, err
 	}
@@ -139,7 +143,7 @@ func GetCommentCount(db *sql.DB, items []*sharedModels.CommentCountRequest) ([]*
 }
 
 // GetLastTenComments return the 10 comments for each comment in the [] parameter.
-func GetLastTenComments(db *sql.DB, items []*sharedModels.CommentRequest) ([]*sharedModels.CommentResponse, error) {
+func GetLastTenComments(ctx context.Context, db *sql.DB, items []*sharedModels.CommentRequest) ([]*sharedModels.CommentResponse, error) {
 	responses := make([]*sharedModels.CommentResponse, 0)
 
 	if len(items) < 1 {
@@ -157,7 +161,7 @@ func GetLastTenComments(db *sql.DB, items []*sharedModels.CommentRequest) ([]*sh
 		}
 	}
 
-	rows, err := db.Query(query)
+	rows, err := tracing.QueryContext(ctx, db, query)
 	if err != nil {
 		return nil, err
 	}
@@ -171,8 +175,8 @@ func GetLastTenComments(db *sql.DB, items []*sharedModels.CommentRequest) ([]*sh
 }
 
 // DeleteCommentByID delete a comment in the database based on ID.
-func DeleteCommentByID(db *sql.DB, commentID int) (int64, error) {
-	res, err := db.Exec("DELETE FROM comments WHERE id = ?", commentID)
+func DeleteCommentByID(ctx context.Context, db *sql.DB, commentID int) (int64, error) {
+	res, err := tracing.ExecContext(ctx, db, "DELETE FROM comments WHERE id = ?", commentID)
 	if err != nil {
 		return 0, err
 	}
@@ -180,7 +184,7 @@ func DeleteCommentByID(db *sql.DB, commentID int) (int64, error) {
 }
 
 // ErrCommentNotFound error if comment does not exist in database
-var ErrCommentNotFound = errors.New("Comment does not exist")
+var ErrCommentNotFound = apierror.New(apierror.NotFound, "Comment does not exist")
 
 // ErrCanNotConnectWithDatabase error if database is unreachable
-var ErrCanNotConnectWithDatabase = errors.New("Can not connect with database")
+var ErrCanNotConnectWithDatabase = apierror.New(apierror.Unavailable, "Can not connect with database")
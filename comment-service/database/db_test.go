@@ -1,6 +1,7 @@
 package db
 
 import (
+	"context"
 	"testing"
 	"time"
 
@@ -33,7 +34,7 @@ func TestCreate(t *testing.T) {
 	mock.ExpectQuery("SELECT (.+) FROM comments WHERE").WithArgs(1).WillReturnRows(selectByIDRows)
 
 	// Execute the method
-	if _, err := Create(db, comment); err != nil {
+	if _, err := Create(context.Background(), db, comment); err != nil {
 		t.Errorf("there was an unexpected error: %s", err)
 	}
 
@@ -62,7 +63,7 @@ func TestGetCommentByID(t *testing.T) {
 	mock.ExpectQuery("SELECT (.+) FROM comments WHERE").WithArgs(comment.PhotoID).WillReturnRows(selectByIDRows)
 
 	// Execute the method
-	if _, err := GetCommentByID(db, comment.PhotoID); err != nil {
+	if _, err := GetCommentByID(context.Background(), db, comment.PhotoID); err != nil {
 		t.Errorf("there was an unexpected error: %s", err)
 	}
 
@@ -91,7 +92,7 @@ func TestGetComments(t *testing.T) {
 	mock.ExpectQuery("SELECT (.+) FROM comments WHERE").WithArgs(5, 1, 10).WillReturnRows(selectByIDRows)
 
 	// Execute the method
-	if _, err := GetComments(db, comment.PhotoID, 1, 10); err != nil {
+	if _, err := GetComments(context.Background(), db, comment.PhotoID, 1, 10); err != nil {
 		t.Errorf("there was an unexpected error: %s", err)
 	}
 
@@ -118,7 +119,7 @@ func TestCommentCount(t *testing.T) {
 	})
 
 	// Execute the method
-	if _, err := GetCommentCount(db, objects); err != nil {
+	if _, err := GetCommentCount(context.Background(), db, objects); err != nil {
 		t.Errorf("there was an unexpected error: %s", err)
 	}
 
@@ -148,7 +149,7 @@ func TestGetLastTenComments(t *testing.T) {
 	})
 
 	// Execute the method
-	if _, err := GetLastTenComments(db, objects); err != nil {
+	if _, err := GetLastTenComments(context.Background(), db, objects); err != nil {
 		t.Errorf("there was an unexpected error: %s", err)
 	}
 
@@ -0,0 +1,26 @@
+package db
+
+import (
+	"database/sql"
+
+	"github.com/bstaijen/mariadb-for-microservices/shared/migrate"
+)
+
+// Migrations are the versions of the comments table in the CommentService schema.
+var Migrations = []migrate.Migration{
+	{
+		Version: 1,
+		Name:    "create comments",
+		Up: []string{
+			"CREATE TABLE IF NOT EXISTS comments (id INT NOT NULL AUTO_INCREMENT PRIMARY KEY, user_id INT NOT NULL, photo_id INT NOT NULL, comment TEXT NOT NULL, createdAt timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP, updatedAt timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP)",
+		},
+		Down: []string{
+			"DROP TABLE comments",
+		},
+	},
+}
+
+// Migrator returns the migrator of the schema of the service.
+func Migrator(db *sql.DB) *migrate.Migrator {
+	return migrate.New(db, migrate.DefaultTable, Migrations)
+}
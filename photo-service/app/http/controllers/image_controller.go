@@ -9,7 +9,6 @@ import (
 	"strings"
 	"time"
 
-	"github.com/Sirupsen/logrus"
 	"github.com/bstaijen/mariadb-for-microservices/photo-service/config"
 	"github.com/gorilla/mux"
 	"github.com/urfave/negroni"
@@ -20,7 +19,10 @@ import (
 
 	"github.com/bstaijen/mariadb-for-microservices/photo-service/app/models"
 	"github.com/bstaijen/mariadb-for-microservices/photo-service/database"
+	"github.com/bstaijen/mariadb-for-microservices/shared/apierror"
+	"github.com/bstaijen/mariadb-for-microservices/shared/ipc"
 	"github.com/bstaijen/mariadb-for-microservices/shared/util"
+	"github.com/bstaijen/mariadb-for-microservices/shared/util/middleware"
 )
 
 // CreateHandler create a photo object and store it in the database.
@@ -30,17 +32,26 @@ func CreateHandler(connection *sql.DB) negroni.HandlerFunc {
 		var title = r.URL.Query().Get("title")
 		if len(title) < 1 {
 			util.SendBadRequest(w, errors.New("Title is mandatory"))
+			return
 		}
 
-		// Get userID
+		// Get userID. Users can only add photos to their own account.
+		user, ok := middleware.UserFromContext(r.Context())
+		if !ok {
+			util.SendError(w, middleware.ErrTokenMandatory)
+			return
+		}
 		vars := mux.Vars(r)
 		strID := vars["id"]
-		id, _ := strconv.Atoi(strID)
+		if id, err := strconv.Atoi(strID); err != nil || id != user.ID {
+			util.SendError(w, apierror.New(apierror.PermissionDenied, "you can only add photos to your own account"))
+			return
+		}
 
 		// Read file
 		file, fileheader, err := r.FormFile("file")
 		if err != nil {
-			util.SendError(w, err)
+			util.SendBadRequest(w, err)
 			return
 		}
 		defer file.Close()
@@ -58,7 +69,7 @@ func CreateHandler(connection *sql.DB) negroni.HandlerFunc {
 
 		// Create model
 		img := &models.CreatePhoto{
-			UserID:      id,
+			UserID:      user.ID,
 			Filename:    filename,
 			Title:       title,
 			ContentType: contentType,
@@ -66,9 +77,9 @@ func CreateHandler(connection *sql.DB) negroni.HandlerFunc {
 		}
 
 		// Save
-		err = db.InsertPhoto(connection, img)
+		err = db.InsertPhoto(r.Context(), connection, img)
 		if err != nil {
-			util.SendBadRequest(w, err)
+			util.SendError(w, err)
 			return
 		}
 
@@ -83,7 +94,7 @@ func IndexHandler(connection *sql.DB) negroni.HandlerFunc {
 		file := vars["file"]
 		// TODO : what if file not exist?
 
-		photo, err := db.GetPhotoByFilename(connection, file)
+		photo, err := db.GetPhotoByFilename(r.Context(), connection, file)
 		if err != nil {
 			util.SendError(w, err)
 			return
@@ -93,7 +104,7 @@ func IndexHandler(connection *sql.DB) negroni.HandlerFunc {
 }
 
 // ListByUserIDHandler list all photos owned by an user.
-func ListByUserIDHandler(connection *sql.DB, cnf config.Config) negroni.HandlerFunc {
+func ListByUserIDHandler(connection *sql.DB, cnf config.Config, clients *ipc.Clients) negroni.HandlerFunc {
 	return negroni.HandlerFunc(func(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
 		vars := mux.Vars(r)
 		strID := vars["id"]
@@ -103,24 +114,24 @@ func ListByUserIDHandler(connection *sql.DB, cnf config.Config) negroni.HandlerF
 			return
 		}
 
-		photos, err := db.ListImagesByUserID(connection, id)
+		photos, err := db.ListImagesByUserID(r.Context(), connection, id)
 		if err != nil {
 			util.SendError(w, err)
 			return
 		}
 
-		photos = findResources(cnf, photos, id, true, true, true)
+		photos = findResources(r.Context(), clients, photos, userIDFromContext(r.Context()), true, true, true)
 
 		util.SendOK(w, photos)
 	})
 }
 
-func GetPhotoByID(connection *sql.DB, cnf config.Config) negroni.HandlerFunc {
+func GetPhotoByID(connection *sql.DB, cnf config.Config, clients *ipc.Clients) negroni.HandlerFunc {
 	return negroni.HandlerFunc(func(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
 
-		userID, err := getUserIDFromRequest(cnf, r)
-		if err != nil {
-			util.SendError(w, err)
+		user, ok := middleware.UserFromContext(r.Context())
+		if !ok {
+			util.SendError(w, middleware.ErrTokenMandatory)
 			return
 		}
 
@@ -132,17 +143,17 @@ func GetPhotoByID(connection *sql.DB, cnf config.Config) negroni.HandlerFunc {
 			return
 		}
 
-		photo, err := db.GetPhotoById(connection, id)
+		photo, err := db.GetPhotoById(r.Context(), connection, id)
 		if err != nil {
 			util.SendError(w, err)
 			return
 		}
 
-		logrus.Info(photo.ID)
+		util.Log(r.Context()).Info(photo.ID)
 
 		photos := make([]*models.Photo, 0)
 		photos = append(photos, photo)
-		photos = findResources(cnf, photos, userID, true, true, true)
+		photos = findResources(r.Context(), clients, photos, user.ID, true, true, true)
 
 		util.SendOK(w, photos[0])
 	})
@@ -1,10 +1,8 @@
 package controllers
 
 import (
+	"context"
 	"database/sql"
-	"encoding/json"
-	"errors"
-	"fmt"
 	"net/http"
 	"strconv"
 
@@ -13,153 +11,96 @@ import (
 	"github.com/gorilla/mux"
 	"github.com/urfave/negroni"
 
-	"io/ioutil"
-
-	"strings"
-
-	"github.com/Sirupsen/logrus"
 	"github.com/bstaijen/mariadb-for-microservices/photo-service/config"
+	"github.com/bstaijen/mariadb-for-microservices/shared/apierror"
 	"github.com/bstaijen/mariadb-for-microservices/shared/helper"
+	"github.com/bstaijen/mariadb-for-microservices/shared/ipc"
 	sharedModels "github.com/bstaijen/mariadb-for-microservices/shared/models"
 	"github.com/bstaijen/mariadb-for-microservices/shared/util"
-	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/bstaijen/mariadb-for-microservices/shared/util/middleware"
 )
 
 // IncomingHandler is the handler for serving the default photos timeline
-func IncomingHandler(connection *sql.DB, cnf config.Config) negroni.HandlerFunc {
+func IncomingHandler(connection *sql.DB, cnf config.Config, clients *ipc.Clients) negroni.HandlerFunc {
 	return negroni.HandlerFunc(func(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
 		// Get user ID. It is allowed to be 0.
-		userID, _ := getUserIDFromRequest(cnf, r)
+		userID := userIDFromContext(r.Context())
 
 		// get offset and rows
 		offset, rows := helper.PaginationFromRequest(r)
 
-		photos, err := db.ListIncoming(connection, offset, rows)
+		photos, err := db.ListIncoming(r.Context(), connection, offset, rows)
 
-		logrus.Infof("Number of photos retrieved from database : %v.", len(photos))
+		util.Log(r.Context()).Infof("Number of photos retrieved from database : %v.", len(photos))
 
 		if err != nil {
 			util.SendError(w, err)
 			return
 		}
-		photos = findResources(cnf, photos, userID, true, true, true)
+		photos = findResources(r.Context(), clients, photos, userID, true, true, true)
 
 		util.SendOK(w, photos)
 	})
 }
 
 // TopRatedHandler is the handler for serving the Top Rated photos timeline
-func TopRatedHandler(connection *sql.DB, cnf config.Config) negroni.HandlerFunc {
+func TopRatedHandler(connection *sql.DB, cnf config.Config, clients *ipc.Clients) negroni.HandlerFunc {
 	return negroni.HandlerFunc(func(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
 		// Get user ID. It is allowed to be 0.
-		userID, _ := getUserIDFromRequest(cnf, r)
+		userID := userIDFromContext(r.Context())
 
-		// get offset and rows and pass into URL toprated
+		// get offset and rows
 		offset, rows := helper.PaginationFromRequest(r)
 
-		// Make url
-		urlpart := fmt.Sprintf("ipc/toprated?offset=%v&rows=%v", offset, rows)
-		url := cnf.VoteServiceBaseurl + urlpart
+		results, err := clients.Vote.TopRated(r.Context(), offset, rows)
+		if err != nil {
+			util.SendError(w, apierror.Wrap(apierror.Unavailable, "Could not retrieve top rated photos.", err))
+			return
+		}
 
-		// Save object
 		photos := make([]*models.Photo, 0)
-
-		// GET
-		if strings.HasPrefix(url, "http") {
-			err := util.Request("GET", url, []byte(string("")), func(res *http.Response) {
-
-				// Error handling
-				if res.StatusCode < 200 || res.StatusCode > 299 {
-					printResponseError(res)
-					util.SendErrorMessage(w, "Could not retrieve top rated photos.")
-					return
-				}
-
-				// Happy path
-				type Collection struct {
-					Objects []*sharedModels.TopRatedPhotoResponse `json:"results"`
-				}
-				col := &Collection{}
-				col.Objects = make([]*sharedModels.TopRatedPhotoResponse, 0)
-				err := util.ResponseJSONToObject(res, &col)
-				if err != nil {
-					logrus.Warn(err)
-				}
-				for _, v := range col.Objects {
-					photo, err := db.GetPhotoById(connection, v.PhotoID)
-					if err != nil {
-						logrus.Warn(err)
-					}
-					if photo != nil {
-						photos = append(photos, photo)
-					}
-				}
-			})
+		for _, v := range results {
+			photo, err := db.GetPhotoById(r.Context(), connection, v.PhotoID)
 			if err != nil {
-				util.SendError(w, err)
-				return
+				util.Log(r.Context()).Warn(err)
+			}
+			if photo != nil {
+				photos = append(photos, photo)
 			}
-		} else {
-			logrus.Errorf("Wrong URL. Expected something which starts with http, instead got %v.", url)
 		}
 
-		photos = findResources(cnf, photos, userID, true, true, true)
+		photos = findResources(r.Context(), clients, photos, userID, true, true, true)
 		util.SendOK(w, photos)
 	})
 }
 
 // HotHandler is the handler for serving the Hot photos timeline
-func HotHandler(connection *sql.DB, cnf config.Config) negroni.HandlerFunc {
+func HotHandler(connection *sql.DB, cnf config.Config, clients *ipc.Clients) negroni.HandlerFunc {
 	return negroni.HandlerFunc(func(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
-		userID, _ := getUserIDFromRequest(cnf, r)
+		// Get user ID. It is allowed to be 0.
+		userID := userIDFromContext(r.Context())
 
-		// get offset and rows and pass into URL toprated
+		// get offset and rows
 		offset, rows := helper.PaginationFromRequest(r)
 
-		// Make url
-		urlpart := fmt.Sprintf("ipc/hot?offset=%v&rows=%v", offset, rows)
-		url := cnf.VoteServiceBaseurl + urlpart
+		results, err := clients.Vote.Hot(r.Context(), offset, rows)
+		if err != nil {
+			util.SendError(w, apierror.Wrap(apierror.Unavailable, "Could not retrieve photos.", err))
+			return
+		}
 
-		// Save object
 		photos := make([]*models.Photo, 0)
-
-		// GET
-		if strings.HasPrefix(url, "http") {
-			err := util.Request("GET", url, []byte(string("")), func(res *http.Response) {
-				// Error handling
-				if res.StatusCode < 200 || res.StatusCode > 299 {
-					printResponseError(res)
-					util.SendErrorMessage(w, "Could not retrieve photos.")
-					return
-				}
-
-				// Happy path
-				type Collection struct {
-					Objects []*sharedModels.TopRatedPhotoResponse `json:"results"`
-				}
-				col := &Collection{}
-				col.Objects = make([]*sharedModels.TopRatedPhotoResponse, 0)
-				err := util.ResponseJSONToObject(res, &col)
-				if err != nil {
-					logrus.Warn(err)
-				}
-				for _, v := range col.Objects {
-					photo, err := db.GetPhotoById(connection, v.PhotoID)
-					if err != nil {
-						logrus.Warn(err)
-					}
-					if photo != nil {
-						photos = append(photos, photo)
-					}
-				}
-			})
+		for _, v := range results {
+			photo, err := db.GetPhotoById(r.Context(), connection, v.PhotoID)
 			if err != nil {
-				util.SendError(w, err)
+				util.Log(r.Context()).Warn(err)
+			}
+			if photo != nil {
+				photos = append(photos, photo)
 			}
-		} else {
-			logrus.Errorf("Wrong URL. Expected something which starts with http, instead got %v.", url)
 		}
-		photos = findResources(cnf, photos, userID, true, true, true)
+
+		photos = findResources(r.Context(), clients, photos, userID, true, true, true)
 		util.SendOK(w, photos)
 	})
 }
@@ -168,30 +109,12 @@ func HotHandler(connection *sql.DB, cnf config.Config) negroni.HandlerFunc {
 func DeletePhotoHandler(connection *sql.DB, cnf config.Config) negroni.HandlerFunc {
 	return negroni.HandlerFunc(func(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
 
-		var queryToken = r.URL.Query().Get("token")
-
-		if len(queryToken) < 1 {
-			queryToken = r.Header.Get("token")
-		}
-
-		if len(queryToken) < 1 {
-			w.WriteHeader(http.StatusBadRequest)
-			w.Write([]byte(string("token is mandatory")))
+		user, ok := middleware.UserFromContext(r.Context())
+		if !ok {
+			util.SendError(w, middleware.ErrTokenMandatory)
 			return
 		}
 
-		tok, err := jwt.Parse(queryToken, func(t *jwt.Token) (interface{}, error) {
-			return []byte(cnf.SecretKey), nil
-		})
-
-		if err != nil {
-			util.SendErrorMessage(w, "You are not authorized")
-			return
-		}
-
-		claims := tok.Claims.(jwt.MapClaims)
-		var userID = claims["sub"].(float64) // gets the ID
-
 		// Get photoID
 		vars := mux.Vars(r)
 		strID := vars["id"]
@@ -207,18 +130,18 @@ func DeletePhotoHandler(connection *sql.DB, cnf config.Config) negroni.HandlerFu
 			return
 		}
 
-		photo, err := db.GetPhotoById(connection, photoID)
+		photo, err := db.GetPhotoById(r.Context(), connection, photoID)
 		if err != nil {
 			util.SendError(w, err)
 			return
 		}
 
-		if photo.UserID != int(userID) {
-			util.SendErrorMessage(w, "you can only remove your own photo")
+		if photo.UserID != user.ID {
+			util.SendError(w, apierror.New(apierror.PermissionDenied, "you can only remove your own photo"))
 			return
 		}
 
-		_, err = db.DeletePhotoByID(connection, photoID)
+		_, err = db.DeletePhotoByID(r.Context(), connection, photoID)
 		if err != nil {
 			util.SendError(w, err)
 			return
@@ -230,69 +153,51 @@ func DeletePhotoHandler(connection *sql.DB, cnf config.Config) negroni.HandlerFu
 // FindResources searches for related resources to a collection of photos and adds them to the photo object.
 // By specifying parameters the caller of this func can determine which resources will be added and which
 // will be skippd. If userID is 0 or less then this func cannot determine if the user has voted on the photos.
-func findResources(cnf config.Config, photos []*models.Photo, userID int, comments bool, usernames bool, votes bool) []*models.Photo {
-
-	// PhotoID holder
-	photoCountIdentifiers := make([]*sharedModels.VoteCountRequest, 0)
-	photoCommentCountIdentifiers := make([]*sharedModels.CommentCountRequest, 0)
-	photoVotedIdentifiers := make([]*sharedModels.HasVotedRequest, 0)
-	photoCommentsIdentifiers := make([]*sharedModels.CommentRequest, 0)
-	photoUsernamesIndentifiers := make([]*sharedModels.GetUsernamesRequest, 0)
-
-	// Append the username to the photos
-	for index := 0; index < len(photos); index++ {
-		photoObject := photos[index]
-
-		// Collect photoIDs
-		photoCountIdentifiers = append(photoCountIdentifiers, &sharedModels.VoteCountRequest{
-			PhotoID: photoObject.ID,
-		})
-		photoCommentCountIdentifiers = append(photoCommentCountIdentifiers, &sharedModels.CommentCountRequest{
-			PhotoID: photoObject.ID,
-		})
-		photoVotedIdentifiers = append(photoVotedIdentifiers, &sharedModels.HasVotedRequest{
-			PhotoID: photoObject.ID,
-			UserID:  userID,
-		})
-		photoCommentsIdentifiers = append(photoCommentsIdentifiers, &sharedModels.CommentRequest{
-			PhotoID: photoObject.ID,
-		})
-		photoUsernamesIndentifiers = append(photoUsernamesIndentifiers, &sharedModels.GetUsernamesRequest{
-			ID: photoObject.UserID,
-		})
-
-	} // end: for photos
+// A service which cannot be reached is logged and skipped, the photos are returned without its resources.
+func findResources(ctx context.Context, clients *ipc.Clients, photos []*models.Photo, userID int, comments bool, usernames bool, votes bool) []*models.Photo {
+
+	// Collect photo and user IDs
+	photoIDs := make([]int, 0)
+	userIDs := make([]int, 0)
+	for _, photoObject := range photos {
+		photoIDs = append(photoIDs, photoObject.ID)
+		userIDs = append(userIDs, photoObject.UserID)
+	}
 
 	// Searches and adds comments to the photos
 	if comments {
-		photos = appendComments(cnf, photoCommentsIdentifiers, photos)
-		photos = appendCommentCount(cnf, photoCommentCountIdentifiers, photos)
+		photos = appendComments(ctx, clients, photoIDs, photos)
+		photos = appendCommentCount(ctx, clients, photoIDs, photos)
 	}
 
 	// Searches and adds usernames to the photos
 	if usernames {
-		photos = appendUsernames(cnf, photoUsernamesIndentifiers, photos)
+		photos = appendUsernames(ctx, clients, userIDs, photos)
 	}
 
 	// Searches and adds the votes count on each photo and
 	// whether or not the user has voted on this particular picture.
 	if votes {
 
-		photos = appendVotesCount(cnf, photoCountIdentifiers, photos)
+		photos = appendVotesCount(ctx, clients, photoIDs, photos)
 
 		// Get up/downvote from requesting user and add them
 		if userID > 0 {
-			photos = appendUserVoted(cnf, photoVotedIdentifiers, photos)
+			photos = appendUserVoted(ctx, clients, userID, photoIDs, photos)
 		} else {
-			logrus.Infof("UserID is to small for voting. User ID : %v\n", userID)
+			util.Log(ctx).Infof("UserID is to small for voting. User ID : %v\n", userID)
 		}
 	}
 	return photos
 }
 
-// appendComments triggers `GET comments request` (last 10 comments for each photo) and appends results to []Photo
-func appendComments(cnf config.Config, photoCommentsIdentifiers []*sharedModels.CommentRequest, photos []*models.Photo) []*models.Photo {
-	comments := getComments(cnf, photoCommentsIdentifiers)
+// appendComments requests the last 10 comments for each photo and appends results to []Photo
+func appendComments(ctx context.Context, clients *ipc.Clients, photoIDs []int, photos []*models.Photo) []*models.Photo {
+	comments, err := clients.Comment.LastTen(ctx, photoIDs)
+	if err != nil {
+		util.Log(ctx).Warn(err)
+		return photos
+	}
 	for ind := 0; ind < len(photos); ind++ {
 
 		// Get reference
@@ -311,8 +216,12 @@ func appendComments(cnf config.Config, photoCommentsIdentifiers []*sharedModels.
 	return photos
 }
 
-func appendCommentCount(cnf config.Config, photoCommentCountIdentifiers []*sharedModels.CommentCountRequest, photos []*models.Photo) []*models.Photo {
-	count := getCommentCount(cnf, photoCommentCountIdentifiers)
+func appendCommentCount(ctx context.Context, clients *ipc.Clients, photoIDs []int, photos []*models.Photo) []*models.Photo {
+	count, err := clients.Comment.Counts(ctx, photoIDs)
+	if err != nil {
+		util.Log(ctx).Warn(err)
+		return photos
+	}
 	for ind := 0; ind < len(photos); ind++ {
 		// Get reference
 		phot := photos[ind]
@@ -326,10 +235,14 @@ func appendCommentCount(cnf config.Config, photoCommentCountIdentifiers []*share
 	return photos
 }
 
-// appendUsernames triggers `GET usernames request` and appends result to []Photo
-func appendUsernames(cnf config.Config, photoUsernamesIndentifiers []*sharedModels.GetUsernamesRequest, photos []*models.Photo) []*models.Photo {
+// appendUsernames requests the usernames of the owners and appends result to []Photo
+func appendUsernames(ctx context.Context, clients *ipc.Clients, userIDs []int, photos []*models.Photo) []*models.Photo {
 	// Append the username to the photos
-	usernames := getUsername(cnf, photoUsernamesIndentifiers)
+	usernames, err := clients.Profile.Usernames(ctx, userIDs)
+	if err != nil {
+		util.Log(ctx).Warn(err)
+		return photos
+	}
 	for index := 0; index < len(photos); index++ {
 		photoObject := photos[index]
 		for resultIndex := 0; resultIndex < len(usernames); resultIndex++ {
@@ -342,10 +255,14 @@ func appendUsernames(cnf config.Config, photoUsernamesIndentifiers []*sharedMode
 	return photos
 }
 
-// appendVotesCount triggers `GET votes request` and appends result to []Photo
-func appendVotesCount(cnf config.Config, photoCountIdentifiers []*sharedModels.VoteCountRequest, photos []*models.Photo) []*models.Photo {
+// appendVotesCount requests the vote counts and appends result to []Photo
+func appendVotesCount(ctx context.Context, clients *ipc.Clients, photoIDs []int, photos []*models.Photo) []*models.Photo {
 	// Get the vote counts and add them
-	results := getVotes(cnf, photoCountIdentifiers)
+	results, err := clients.Vote.Counts(ctx, photoIDs)
+	if err != nil {
+		util.Log(ctx).Warn(err)
+		return photos
+	}
 	for index := 0; index < len(photos); index++ {
 		photoObject := photos[index]
 
@@ -361,10 +278,14 @@ func appendVotesCount(cnf config.Config, photoCountIdentifiers []*sharedModels.V
 	return photos
 }
 
-// appendUserVoted triggers `GET voted request` and appends results to []Photo. This function will
+// appendUserVoted requests the votes of userID and appends results to []Photo. This function will
 // lookup whether the user has voted on the Photo
-func appendUserVoted(cnf config.Config, photoVotedIdentifiers []*sharedModels.HasVotedRequest, photos []*models.Photo) []*models.Photo {
-	youVoted := voted(cnf, photoVotedIdentifiers)
+func appendUserVoted(ctx context.Context, clients *ipc.Clients, userID int, photoIDs []int, photos []*models.Photo) []*models.Photo {
+	youVoted, err := clients.Vote.Voted(ctx, userID, photoIDs)
+	if err != nil {
+		util.Log(ctx).Warn(err)
+		return photos
+	}
 
 	for index := 0; index < len(photos); index++ {
 		photoObject := photos[index]
@@ -380,243 +301,10 @@ func appendUserVoted(cnf config.Config, photoVotedIdentifiers []*sharedModels.Ha
 	return photos
 }
 
-// Get the usernames from the ProfileService
-func getUsername(cnf config.Config, input []*sharedModels.GetUsernamesRequest) []*sharedModels.GetUsernamesResponse {
-	type Req struct {
-		Requests []*sharedModels.GetUsernamesRequest `json:"requests"`
+// userIDFromContext returns the ID of the user of the request, or 0 for anonymous requests.
+func userIDFromContext(ctx context.Context) int {
+	if user, ok := middleware.UserFromContext(ctx); ok {
+		return user.ID
 	}
-	body, _ := json.Marshal(Req{Requests: input})
-	// Make url
-	url := cnf.ProfileServiceBaseurl + "ipc/usernames"
-
-	// Return object
-	usernames := make([]*sharedModels.GetUsernamesResponse, 0)
-
-	// GET data and append to return object
-	if strings.HasPrefix(url, "http") {
-		err := util.Request("GET", url, body, func(res *http.Response) {
-			// Error handling
-			if res.StatusCode < 200 || res.StatusCode > 299 {
-				printResponseError(res)
-				return
-			}
-
-			// Happy path
-			type Collection struct {
-				Objects []*sharedModels.GetUsernamesResponse `json:"usernames"`
-			}
-			col := &Collection{}
-			col.Objects = make([]*sharedModels.GetUsernamesResponse, 0)
-			err := util.ResponseJSONToObject(res, &col)
-			if err != nil {
-				logrus.Warn(err)
-			}
-			usernames = col.Objects
-		})
-		if err != nil {
-			logrus.Warn(err)
-		}
-	} else {
-		logrus.Errorf("Wrong URL. Expected something which starts with http, instead got %v.", url)
-	}
-	return usernames
-}
-
-// Get comments from CommentsService
-func getComments(cnf config.Config, input []*sharedModels.CommentRequest) []*sharedModels.CommentResponse {
-	type Req struct {
-		Requests []*sharedModels.CommentRequest `json:"requests"`
-	}
-	body, _ := json.Marshal(Req{Requests: input})
-
-	// Make url
-	url := cnf.CommentServiceBaseurl + "ipc/getLast10"
-
-	// Return object
-	comments := make([]*sharedModels.CommentResponse, 0)
-
-	// GET data and append to return object
-
-	if strings.HasPrefix(url, "http") {
-		err := util.Request("GET", url, body, func(res *http.Response) {
-			// Error handling
-			if res.StatusCode < 200 || res.StatusCode > 299 {
-				printResponseError(res)
-				return
-			}
-
-			// Happy path
-			type Collection struct {
-				Objects []*sharedModels.CommentResponse `json:"comments"`
-			}
-			col := &Collection{}
-			col.Objects = make([]*sharedModels.CommentResponse, 0)
-			err := util.ResponseJSONToObject(res, &col)
-			if err != nil {
-				logrus.Warn(err)
-			}
-			comments = col.Objects
-		})
-		if err != nil {
-			logrus.Warn(err)
-		}
-	} else {
-		logrus.Errorf("Wrong URL. Expected something which starts with http, instead got %v.", url)
-	}
-	return comments
-}
-
-// Get comment count from CommentsService
-func getCommentCount(cnf config.Config, input []*sharedModels.CommentCountRequest) []*sharedModels.CommentCountResponse {
-	type Req struct {
-		Requests []*sharedModels.CommentCountRequest `json:"requests"`
-	}
-	body, _ := json.Marshal(Req{Requests: input})
-
-	// Make url
-	url := cnf.CommentServiceBaseurl + "ipc/getCount"
-
-	// Return object
-	comments := make([]*sharedModels.CommentCountResponse, 0)
-
-	// GET data and append to return object
-	if strings.HasPrefix(url, "http") {
-		err := util.Request("GET", url, body, func(res *http.Response) {
-			// Error handling
-			if res.StatusCode < 200 || res.StatusCode > 299 {
-				printResponseError(res)
-				return
-			}
-
-			// Happy path
-			type Collection struct {
-				Objects []*sharedModels.CommentCountResponse `json:"result"`
-			}
-			col := &Collection{}
-			col.Objects = make([]*sharedModels.CommentCountResponse, 0)
-			err := util.ResponseJSONToObject(res, &col)
-			if err != nil {
-				logrus.Warn(err)
-			}
-			comments = col.Objects
-		})
-		if err != nil {
-			logrus.Warn(err)
-		}
-	} else {
-		logrus.Errorf("Wrong URL. Expected something which starts with http, instead got %v.", url)
-	}
-	return comments
-}
-
-// Get votes from the VotesSerivce
-func getVotes(cnf config.Config, input []*sharedModels.VoteCountRequest) []*sharedModels.VoteCountResponse {
-	type Req struct {
-		Requests []*sharedModels.VoteCountRequest `json:"requests"`
-	}
-	body, _ := json.Marshal(&Req{Requests: input})
-
-	// Make url
-	url := cnf.VoteServiceBaseurl + "ipc/count"
-
-	//Return object
-	votes := make([]*sharedModels.VoteCountResponse, 0)
-	if strings.HasPrefix(url, "http") {
-		err := util.Request("GET", url, body, func(res *http.Response) {
-			// Error handling
-			if res.StatusCode < 200 || res.StatusCode > 299 {
-				printResponseError(res)
-				return
-			}
-
-			// Happy path
-			type Collection struct {
-				Objects []*sharedModels.VoteCountResponse `json:"results"`
-			}
-			col := &Collection{}
-			col.Objects = make([]*sharedModels.VoteCountResponse, 0)
-			err := util.ResponseJSONToObject(res, &col)
-			if err != nil {
-				logrus.Warn(err)
-			}
-			votes = col.Objects
-		})
-		if err != nil {
-			logrus.Warn(err)
-		}
-	} else {
-		logrus.Errorf("Wrong URL. Expected something which starts with http, instead got %v.", url)
-	}
-	return votes
-}
-
-// Determine if the user has voted on a photo. VotesService
-func voted(cnf config.Config, input []*sharedModels.HasVotedRequest) []*sharedModels.HasVotedResponse {
-	type Req struct {
-		Requests []*sharedModels.HasVotedRequest `json:"requests"`
-	}
-	body, _ := json.Marshal(&Req{Requests: input})
-
-	// Make url
-	url := cnf.VoteServiceBaseurl + "ipc/voted"
-
-	//Return object
-	hasVoted := make([]*sharedModels.HasVotedResponse, 0)
-	if strings.HasPrefix(url, "http") {
-		err := util.Request("GET", url, body, func(res *http.Response) {
-			// Error handling
-			if res.StatusCode < 200 || res.StatusCode > 299 {
-				printResponseError(res)
-				return
-			}
-
-			// Happy path
-			type Collection struct {
-				Objects []*sharedModels.HasVotedResponse `json:"results"`
-			}
-			col := &Collection{}
-			col.Objects = make([]*sharedModels.HasVotedResponse, 0)
-			err := util.ResponseJSONToObject(res, &col)
-			if err != nil {
-				logrus.Warn(err)
-			}
-			hasVoted = col.Objects
-		})
-		if err != nil {
-			logrus.Warn(err)
-		}
-	} else {
-		logrus.Errorf("Wrong URL. Expected something which starts with http, instead got %v.", url)
-	}
-	return hasVoted
-}
-
-func getUserIDFromRequest(cnf config.Config, req *http.Request) (int, error) {
-	var queryToken = req.URL.Query().Get("token")
-
-	if len(queryToken) < 1 {
-		queryToken = req.Header.Get("token")
-	}
-
-	if len(queryToken) < 1 {
-		return 0, errors.New("No token available")
-	}
-
-	tok, err := jwt.Parse(queryToken, func(t *jwt.Token) (interface{}, error) {
-		return []byte(cnf.SecretKey), nil
-	})
-	if err != nil {
-		return 0, err
-	}
-
-	claims := tok.Claims.(jwt.MapClaims)
-	var ID = claims["sub"].(float64) // gets the ID
-
-	return int(ID), nil
-}
-
-func printResponseError(res *http.Response) {
-	logrus.Errorf("Response error with statuscode %v.", res.Status)
-	data, _ := ioutil.ReadAll(res.Body)
-	logrus.Error(string(data))
+	return 0
 }
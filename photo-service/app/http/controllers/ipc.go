@@ -2,11 +2,11 @@ package controllers
 
 import (
 	"database/sql"
-	"log"
 	"net/http"
 
 	"github.com/bstaijen/mariadb-for-microservices/photo-service/config"
 	"github.com/bstaijen/mariadb-for-microservices/photo-service/database"
+	"github.com/bstaijen/mariadb-for-microservices/shared/ipc"
 	"github.com/bstaijen/mariadb-for-microservices/shared/util"
 	"github.com/urfave/negroni"
 
@@ -15,29 +15,18 @@ import (
 
 func IPCGetPhotos(connection *sql.DB, cnf config.Config) negroni.HandlerFunc {
 	return negroni.HandlerFunc(func(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
-		if r.Body == nil {
-			util.SendErrorMessage(w, "bad json")
-			return
-		}
-
-		type Collection struct {
-			Objects []*sharedModels.PhotoRequest `json:"requests"`
-		}
-		col := &Collection{}
-		col.Objects = make([]*sharedModels.PhotoRequest, 0)
-		err := util.RequestToJSON(r, &col)
+		requests := make([]*sharedModels.PhotoRequest, 0)
+		err := ipc.ReadRequests(r, &requests)
 		if err != nil {
-			log.Fatal(err)
+			util.SendBadRequest(w, err)
+			return
 		}
 
-		photos, err := db.GetPhotos(connection, col.Objects)
+		photos, err := db.GetPhotos(r.Context(), connection, requests)
 		if err != nil {
 			util.SendError(w, err)
 			return
 		}
-		type Resp struct {
-			Photos []*sharedModels.PhotoResponse `json:"results"`
-		}
-		util.SendOK(w, &Resp{Photos: photos})
+		ipc.SendResults(w, photos)
 	})
 }
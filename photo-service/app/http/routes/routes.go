@@ -2,78 +2,91 @@ package routes
 
 import (
 	"database/sql"
+	"time"
 
 	"github.com/bstaijen/mariadb-for-microservices/photo-service/app/http/controllers"
 	"github.com/bstaijen/mariadb-for-microservices/photo-service/config"
+	"github.com/bstaijen/mariadb-for-microservices/shared/health"
+	"github.com/bstaijen/mariadb-for-microservices/shared/ipc"
+	"github.com/bstaijen/mariadb-for-microservices/shared/jwks"
+	"github.com/bstaijen/mariadb-for-microservices/shared/ratelimit"
+	"github.com/bstaijen/mariadb-for-microservices/shared/util"
 	"github.com/bstaijen/mariadb-for-microservices/shared/util/middleware"
 
 	"github.com/gorilla/mux"
 	"github.com/urfave/negroni"
 )
 
-// InitRoutes instantiates a new gorilla/mux router
-func InitRoutes(db *sql.DB, cnf config.Config) *mux.Router {
+// uploadPolicy limits the photos a user can upload.
+var uploadPolicy = ratelimit.Policy{Name: "upload", Limit: 30, Period: time.Hour, Burst: 10}
+
+// InitRoutes instantiates a new gorilla/mux router. IPCKeys sign and verify the IPC calls.
+func InitRoutes(db *sql.DB, cnf config.Config, ipcKeys *ipc.Keys) *mux.Router {
+	identity := ipcKeys.Identity
+	clients := &ipc.Clients{
+		Profile: ipc.NewProfileClient(cnf.ProfileServiceBaseurl, identity),
+		Vote:    ipc.NewVoteClient(cnf.VoteServiceBaseurl, identity),
+		Comment: ipc.NewCommentClient(cnf.CommentServiceBaseurl, identity),
+	}
+	revocations := ipc.NewRevocations(cnf.AuthenticationServiceBaseurl, identity, middleware.DefaultRevocationTTL)
+	accessTokens := ipc.NewAccessTokens(cnf.AuthenticationServiceBaseurl, identity, middleware.DefaultRevocationTTL)
+	keys := jwks.NewRemote(cnf.AuthenticationServiceBaseurl, 0)
+
 	router := mux.NewRouter()
-	router = setPhotoRoutes(db, cnf, router)
-	router = setIPCRoutes(db, cnf, router)
+	router = setHealthRoutes(db, cnf, router)
+	router = setPhotoRoutes(db, cnf, clients, keys, revocations, accessTokens, router)
+	router = setIPCRoutes(db, cnf, ipcKeys.Callers, router)
 	return router
 }
 
 // setPhotoRoutes specifies all routes for the authentication service
-func setPhotoRoutes(db *sql.DB, cnf config.Config, router *mux.Router) *mux.Router {
+func setPhotoRoutes(db *sql.DB, cnf config.Config, clients *ipc.Clients, keys jwks.KeySet, revocations middleware.Revocations, accessTokens middleware.AccessTokens, router *mux.Router) *mux.Router {
+	limiter := ratelimit.NewMemoryStore()
 
 	// Subrouter /image
 	image := router.PathPrefix("/image").Subrouter()
 
-	// Options
-	image.Methods("OPTIONS").Handler(negroni.New(
-		negroni.HandlerFunc(middleware.AcceptOPTIONS),
-	))
-
 	image.Handle("/{id}/delete", negroni.New(
-		negroni.HandlerFunc(middleware.AccessControlHandler),
+		middleware.RequireScopedTokenAuthenticationHandler(keys, revocations, accessTokens, middleware.ScopePhotosWrite),
 		controllers.DeletePhotoHandler(db, cnf),
 	)).Methods("POST")
 
 	// Add image for user /image/{id}
 	image.Handle("/{id}", negroni.New(
-		negroni.HandlerFunc(middleware.AccessControlHandler),
-		negroni.HandlerFunc(middleware.RequireTokenAuthenticationHandler(cnf.SecretKey)),
+		middleware.RequireScopedTokenAuthenticationHandler(keys, revocations, accessTokens, middleware.ScopePhotosWrite),
+		middleware.RequireVerifiedEmail(cnf.RequireVerifiedEmail),
+		ratelimit.Middleware(limiter, uploadPolicy),
 		controllers.CreateHandler(db),
 	)).Methods("POST")
 
-	image.Handle("/{id}", negroni.New(
-		negroni.HandlerFunc(middleware.AcceptOPTIONS),
-	)).Methods("OPTIONS")
-
 	// Image for user /image/{id}/list
 	image.Handle("/{id}/list", negroni.New(
-		negroni.HandlerFunc(middleware.AccessControlHandler),
-		controllers.ListByUserIDHandler(db, cnf),
+		middleware.OptionalScopedTokenAuthenticationHandler(keys, revocations, accessTokens, middleware.ScopePhotosRead),
+		controllers.ListByUserIDHandler(db, cnf, clients),
 	)).Methods("GET")
 
 	// Incoming Timeline /image/list
 	image.Handle("/list", negroni.New(
-		negroni.HandlerFunc(middleware.AccessControlHandler),
-		controllers.IncomingHandler(db, cnf),
+		middleware.OptionalScopedTokenAuthenticationHandler(keys, revocations, accessTokens, middleware.ScopePhotosRead),
+		controllers.IncomingHandler(db, cnf, clients),
 	)).Methods("GET")
 
 	// Top Rated Timeline /image/toprated
 	image.Handle("/toprated", negroni.New(
-		negroni.HandlerFunc(middleware.AccessControlHandler),
-		controllers.TopRatedHandler(db, cnf),
+		middleware.OptionalScopedTokenAuthenticationHandler(keys, revocations, accessTokens, middleware.ScopePhotosRead),
+		controllers.TopRatedHandler(db, cnf, clients),
 	)).Methods("GET")
 
 	// Hot Timeline /image/hot
 	image.Handle("/hot", negroni.New(
-		negroni.HandlerFunc(middleware.AccessControlHandler),
-		controllers.HotHandler(db, cnf),
+		middleware.OptionalScopedTokenAuthenticationHandler(keys, revocations, accessTokens, middleware.ScopePhotosRead),
+		controllers.HotHandler(db, cnf, clients),
 	)).Methods("GET")
 
 	// Add image for user /image/{id}
 	image.Handle("/{id}", negroni.New(
-		negroni.HandlerFunc(middleware.AccessControlHandler),
-		controllers.GetPhotoByID(db, cnf),
+		middleware.RequireScopedTokenAuthenticationHandler(keys, revocations, accessTokens, middleware.ScopePhotosRead),
+		controllers.GetPhotoByID(db, cnf, clients),
 	)).Methods("GET")
 
 	// Subrouter /images/{file}
@@ -81,27 +94,47 @@ func setPhotoRoutes(db *sql.DB, cnf config.Config, router *mux.Router) *mux.Rout
 
 	// Retrieve single image /images/{file}
 	images.Methods("GET").Handler(negroni.New(
-		negroni.HandlerFunc(middleware.AccessControlHandler),
 		controllers.IndexHandler(db),
 	))
 
 	return router
 }
 
-func setIPCRoutes(db *sql.DB, cnf config.Config, router *mux.Router) *mux.Router {
+func setIPCRoutes(db *sql.DB, cnf config.Config, callers middleware.ServiceKeys, router *mux.Router) *mux.Router {
+
 	// Subrouter /ipc
 	image := router.PathPrefix("/ipc").Subrouter()
 
-	// Options
-	image.Methods("OPTIONS").Handler(negroni.New(
-		negroni.HandlerFunc(middleware.AcceptOPTIONS),
-	))
-
 	// Get photos
 	image.Handle("/getPhotos", negroni.New(
-		negroni.HandlerFunc(middleware.AccessControlHandler),
+		middleware.RequireServiceAuthenticationHandler(callers, ipc.PhotoService, ipc.VoteService, ipc.CommentService),
 		controllers.IPCGetPhotos(db, cnf),
 	)).Methods("GET")
 
+	// State of the circuit breakers of the outgoing IPC calls
+	image.Handle("/breakers", negroni.New(
+		middleware.RequireServiceAuthenticationHandler(callers, ipc.PhotoService, ipc.Services...),
+		negroni.HandlerFunc(util.BreakersHandler),
+	)).Methods("GET")
+
+	return router
+}
+
+// setHealthRoutes specifies the liveness and readiness routes
+func setHealthRoutes(db *sql.DB, cnf config.Config, router *mux.Router) *mux.Router {
+	router.Handle("/healthz", negroni.New(
+		negroni.HandlerFunc(health.Liveness),
+	)).Methods("GET")
+
+	router.Handle("/readyz", negroni.New(
+		health.Readiness(health.DefaultTimeout,
+			health.Database(db),
+			health.Service(ipc.AuthenticationService, cnf.AuthenticationServiceBaseurl),
+			health.Service(ipc.ProfileService, cnf.ProfileServiceBaseurl),
+			health.Service(ipc.VoteService, cnf.VoteServiceBaseurl),
+			health.Service(ipc.CommentService, cnf.CommentServiceBaseurl),
+		),
+	)).Methods("GET")
+
 	return router
 }
@@ -10,6 +10,7 @@ import (
 	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 
@@ -17,9 +18,13 @@ import (
 
 	"github.com/bstaijen/mariadb-for-microservices/photo-service/app/models"
 	"github.com/bstaijen/mariadb-for-microservices/photo-service/config"
+	"github.com/bstaijen/mariadb-for-microservices/shared/ipc"
+	"github.com/bstaijen/mariadb-for-microservices/shared/jwks"
 	sharedModels "github.com/bstaijen/mariadb-for-microservices/shared/models"
 	"github.com/bstaijen/mariadb-for-microservices/shared/util"
+	"github.com/bstaijen/mariadb-for-microservices/shared/util/middleware"
 	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/urfave/negroni"
 )
 
 type TestFilename struct{}
@@ -30,22 +35,30 @@ func (a TestFilename) Match(v driver.Value) bool {
 }
 
 func TestOPTIONSImage(t *testing.T) {
-	// Router
-	r := InitRoutes(nil, config.Config{})
+	// Router behind the CORS middleware, like in main
+	n := negroni.New(middleware.CORS(middleware.CORSOptions{}))
+	n.UseHandler(InitRoutes(nil, config.Config{}, ipc.FakeKeys(ipc.PhotoService)))
 	res := httptest.NewRecorder()
 
-	// Do Request
+	// Do preflight request
 	req, err := http.NewRequest(http.MethodOptions, "/image", nil)
 	if err != nil {
 		t.Fatal(err)
 	}
-	r.ServeHTTP(res, req)
+	req.Header.Set("Origin", "http://localhost:4000")
+	req.Header.Set("Access-Control-Request-Method", http.MethodPost)
+	req.Header.Set("Access-Control-Request-Headers", "token")
+	n.ServeHTTP(res, req)
 
 	// Make sure response statuscode expectation is met
-	if res.Result().StatusCode != 200 {
-		t.Errorf("Expected statuscode to be 200 but got %v", res.Result().StatusCode)
-	} else {
-		t.Logf("Result statuscode %v. (As expected)", res.Result().StatusCode)
+	if res.Result().StatusCode != http.StatusNoContent {
+		t.Errorf("Expected statuscode to be 204 but got %v", res.Result().StatusCode)
+	}
+	if !strings.Contains(res.Header().Get("Access-Control-Allow-Methods"), http.MethodPost) {
+		t.Errorf("Expected %v to be allowed but got %v", http.MethodPost, res.Header().Get("Access-Control-Allow-Methods"))
+	}
+	if !strings.Contains(res.Header().Get("Access-Control-Allow-Headers"), "token") {
+		t.Errorf("Expected the token header to be allowed but got %v", res.Header().Get("Access-Control-Allow-Headers"))
 	}
 }
 
@@ -75,8 +88,10 @@ func TestPostImage(t *testing.T) {
 	mock.ExpectExec("INSERT INTO photos").WithArgs(photo.UserID, TestFilename{}, photo.Title, photo.ContentType, photo.Image).WillReturnResult(sqlmock.NewResult(1, 1))
 
 	cnf := config.Config{}
-	cnf.SecretKey = "ABCDEF"
-	token := getTokenString(cnf, photo.UserID, t)
+	auth := authServer()
+	defer auth.Close()
+	cnf.AuthenticationServiceBaseurl = auth.URL
+	token := getTokenString(photo.UserID, t)
 	res := doPostRequest(db, cnf, ts.URL+"/image/1?title=TestTitle&token="+token, bytes.NewBuffer(photo.Image), t)
 
 	t.Log(res.Body.String())
@@ -95,6 +110,57 @@ func TestPostImage(t *testing.T) {
 	}
 }
 
+// Test if a user can not upload a photo to the account of another user.
+func TestPostImageOtherUser(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	cnf := config.Config{}
+	auth := authServer()
+	defer auth.Close()
+	cnf.AuthenticationServiceBaseurl = auth.URL
+	token := getTokenString(2, t)
+	res := doPostRequest(db, cnf, "http://localhost/image/1?title=TestTitle&token="+token, bytes.NewBuffer([]byte(`ABCDEFGHIJ`)), t)
+
+	// Nothing may be stored
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	if res.Result().StatusCode != http.StatusForbidden {
+		t.Errorf("Expected %v but got %v", http.StatusForbidden, res.Result().StatusCode)
+	}
+}
+
+// Test if an unverified user can not upload a photo when verification is required.
+func TestPostImageUnverified(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	cnf := config.Config{}
+	cnf.RequireVerifiedEmail = true
+	auth := authServer()
+	defer auth.Close()
+	cnf.AuthenticationServiceBaseurl = auth.URL
+	token := getTokenString(1, t)
+	res := doPostRequest(db, cnf, "http://localhost/image/1?title=TestTitle&token="+token, bytes.NewBuffer([]byte(`ABCDEFGHIJ`)), t)
+
+	// Nothing may be stored
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	if res.Result().StatusCode != http.StatusForbidden {
+		t.Errorf("Expected %v but got %v", http.StatusForbidden, res.Result().StatusCode)
+	}
+}
+
 func TestListImagesFromUser(t *testing.T) {
 	photo := &models.CreatePhoto{}
 	photo.ContentType = "image/png"
@@ -306,7 +372,7 @@ func TestGetHotTimeline(t *testing.T) {
 }
 
 func doRequest(db *sql.DB, cnf config.Config, method string, url string, body *bytes.Buffer, t *testing.T) *httptest.ResponseRecorder {
-	r := InitRoutes(db, cnf)
+	r := InitRoutes(db, cnf, ipc.FakeKeys(ipc.PhotoService))
 	res := httptest.NewRecorder()
 	req, err := http.NewRequest(method, url, body)
 
@@ -318,7 +384,7 @@ func doRequest(db *sql.DB, cnf config.Config, method string, url string, body *b
 }
 
 func doPostRequest(db *sql.DB, cnf config.Config, url string, body *bytes.Buffer, t *testing.T) *httptest.ResponseRecorder {
-	r := InitRoutes(db, cnf)
+	r := InitRoutes(db, cnf, ipc.FakeKeys(ipc.PhotoService))
 	bodyBuf := &bytes.Buffer{}
 	bodyWriter := multipart.NewWriter(bodyBuf)
 
@@ -351,17 +417,53 @@ func doPostRequest(db *sql.DB, cnf config.Config, url string, body *bytes.Buffer
 	return res
 }
 
-func getTokenString(cnf config.Config, userID int, t *testing.T) string {
+var testKeys = newTestKeys()
+
+func newTestKeys() *jwks.Set {
+	key, err := jwks.GenerateKey()
+	if err != nil {
+		panic(err)
+	}
+	keys, err := jwks.NewSet(key)
+	if err != nil {
+		panic(err)
+	}
+	return keys
+}
+
+// authServer stands in for the authentication service. It publishes testKeys and answers that no token was
+// revoked.
+func authServer() *httptest.Server {
+	mux := http.NewServeMux()
+	mux.Handle(jwks.Path, jwks.Handler(testKeys))
+	mux.HandleFunc("/ipc/tokenStatus", func(w http.ResponseWriter, r *http.Request) {
+		requests := make([]*sharedModels.TokenStatusRequest, 0)
+		if err := ipc.ReadRequests(r, &requests); err != nil {
+			util.SendBadRequest(w, err)
+			return
+		}
+		statuses := make([]*sharedModels.TokenStatusResponse, 0, len(requests))
+		for _, request := range requests {
+			statuses = append(statuses, &sharedModels.TokenStatusResponse{UserID: request.UserID, TokenID: request.TokenID})
+		}
+		ipc.SendResults(w, statuses)
+	})
+	return httptest.NewServer(mux)
+}
+
+func getTokenString(userID int, t *testing.T) string {
 	expiration := time.Now().Add(time.Hour * 24 * 31).Unix()
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
 		"sub": userID,
+		"jti": "test-token",
+		"iss": middleware.TokenIssuer,
 		"iat": time.Now().Unix(),
 		"exp": expiration,
 	})
+	token.Header["kid"] = testKeys.SigningKey().ID
 
 	// Generate a signed token
-	secretKey := cnf.SecretKey
-	tokenString, err := token.SignedString([]byte(secretKey))
+	tokenString, err := token.SignedString(testKeys.SigningKey().Key)
 	if err != nil {
 		t.Error(err)
 		return ""
@@ -1,75 +1,46 @@
 package config
 
 import (
-	"os"
-	"strconv"
+	"time"
+
+	"github.com/bstaijen/mariadb-for-microservices/shared/settings"
 )
 
-// Config contains the configuration for the service
+// Config contains the configuration for the service. The tags describe how each field is loaded and validated,
+// see the settings package.
 type Config struct {
-	Port                  int
-	CommentServiceBaseurl string
-	VoteServiceBaseurl    string
-	ProfileServiceBaseurl string
-	DBUsername            string
-	DBPassword            string
-	DBHost                string
-	DBPort                int
-	Database              string
-	SecretKey             string
+	Port                         int           `env:"PORT" required:"true" min:"1" max:"65535"`
+	CommentServiceBaseurl        string        `env:"COMMENT_SERVICE_URL" required:"true"`
+	VoteServiceBaseurl           string        `env:"VOTE_SERVICE_URL" required:"true"`
+	ProfileServiceBaseurl        string        `env:"PROFILE_SERVICE_URL" required:"true"`
+	DBUsername                   string        `env:"DB_USERNAME" required:"true"`
+	DBPassword                   string        `env:"DB_PASSWORD"`
+	DBHost                       string        `env:"DB_HOST" required:"true"`
+	DBPort                       int           `env:"DB_PORT" default:"3306" min:"1" max:"65535"`
+	Database                     string        `env:"DB" required:"true"`
+	DBConnectTimeout             time.Duration `env:"DB_CONNECT_TIMEOUT"`
+	DBMaxOpenConns               int           `env:"DB_MAX_OPEN_CONNS" min:"0"`
+	DBMaxIdleConns               int           `env:"DB_MAX_IDLE_CONNS" min:"0"`
+	DBConnMaxLifetime            time.Duration `env:"DB_CONN_MAX_LIFETIME"`
+	ShutdownTimeout              time.Duration `env:"SHUTDOWN_TIMEOUT"`
+	AuthenticationServiceBaseurl string        `env:"AUTHENTICATION_SERVICE_URL" required:"true"`
+	IPCKeyFile                   string        `env:"IPC_KEY_FILE" required:"true"`
+	IPCPublicKeys                string        `env:"IPC_PUBLIC_KEYS"`
+	RequestTimeout               time.Duration `env:"REQUEST_TIMEOUT"`
+	OTLPEndpoint                 string        `env:"OTEL_EXPORTER_OTLP_ENDPOINT"`
+	CORSAllowedOrigins           []string      `env:"CORS_ALLOWED_ORIGINS"`
+	CORSAllowedMethods           []string      `env:"CORS_ALLOWED_METHODS"`
+	CORSAllowedHeaders           []string      `env:"CORS_ALLOWED_HEADERS"`
+	CORSAllowCredentials         bool          `env:"CORS_ALLOW_CREDENTIALS"`
+	CORSMaxAge                   time.Duration `env:"CORS_MAX_AGE"`
+	RequireVerifiedEmail         bool          `env:"REQUIRE_VERIFIED_EMAIL"`
 }
 
-// LoadConfig returns the config from the environment variables
-func LoadConfig() Config {
-
-	var config Config
-
-	if _, ok := os.LookupEnv("PORT"); ok {
-		portString := os.Getenv("PORT")
-		port, err := strconv.Atoi(portString)
-		if err == nil {
-			config.Port = port
-		}
-	}
-
-	if _, ok := os.LookupEnv("COMMENT_SERVICE_URL"); ok {
-		config.CommentServiceBaseurl = os.Getenv("COMMENT_SERVICE_URL")
-	}
-
-	if _, ok := os.LookupEnv("VOTE_SERVICE_URL"); ok {
-		config.VoteServiceBaseurl = os.Getenv("VOTE_SERVICE_URL")
-	}
-
-	if _, ok := os.LookupEnv("PROFILE_SERVICE_URL"); ok {
-		config.ProfileServiceBaseurl = os.Getenv("PROFILE_SERVICE_URL")
-	}
-
-	if _, ok := os.LookupEnv("DB_USERNAME"); ok {
-		config.DBUsername = os.Getenv("DB_USERNAME")
-	}
-
-	if _, ok := os.LookupEnv("DB_PASSWORD"); ok {
-		config.DBPassword = os.Getenv("DB_PASSWORD")
-	}
-
-	if _, ok := os.LookupEnv("DB_HOST"); ok {
-		config.DBHost = os.Getenv("DB_HOST")
-	}
-
-	if _, ok := os.LookupEnv("DB_PORT"); ok {
-		portString := os.Getenv("DB_PORT")
-		port, err := strconv.Atoi(portString)
-		if err == nil {
-			config.DBPort = port
-		}
-	}
-
-	if _, ok := os.LookupEnv("DB"); ok {
-		config.Database = os.Getenv("DB")
-	}
-
-	if _, ok := os.LookupEnv("SECRET_KEY"); ok {
-		config.SecretKey = os.Getenv("SECRET_KEY")
-	}
-	return config
+// LoadConfig returns the config from the defaults, the configuration file, the environment variables and args, the
+// command-line arguments without the program name. It returns a *settings.Error with every problem when the
+// config is invalid.
+func LoadConfig(args []string) (Config, error) {
+	config := Config{}
+	err := settings.Load(&config, args)
+	return config, err
 }
@@ -2,14 +2,36 @@ package config_test
 
 import (
 	"os"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/bstaijen/mariadb-for-microservices/photo-service/config"
+	"github.com/bstaijen/mariadb-for-microservices/shared/settings"
 )
 
+// load returns the config without its validation, so a single field can be tested.
+func load() config.Config {
+	cnf, _ := config.LoadConfig(nil)
+	return cnf
+}
+
+// setRequired sets every required environment variable.
+func setRequired() {
+	os.Setenv("PORT", "5000")
+	os.Setenv("COMMENT_SERVICE_URL", "http://comment:5004/")
+	os.Setenv("VOTE_SERVICE_URL", "http://vote:5003/")
+	os.Setenv("PROFILE_SERVICE_URL", "http://profile:5000/")
+	os.Setenv("DB_USERNAME", "user")
+	os.Setenv("DB_HOST", "localhost")
+	os.Setenv("DB", "TestDatabase")
+	os.Setenv("IPC_KEY_FILE", "/run/secrets/ipc.pem")
+	os.Setenv("AUTHENTICATION_SERVICE_URL", "http://authentication:5001/")
+}
+
 func TestPort(t *testing.T) {
 	os.Setenv("PORT", "1000")
-	actual := config.LoadConfig().Port
+	actual := load().Port
 	expected := 1000
 	if expected != actual {
 		t.Fatalf("Expected %v got %v", expected, actual)
@@ -19,7 +41,7 @@ func TestPort(t *testing.T) {
 
 func TestPortEmpty(t *testing.T) {
 	os.Clearenv()
-	actual := config.LoadConfig().Port
+	actual := load().Port
 	expected := 0
 	if expected != actual {
 		t.Fatalf("Expected %v got %v", expected, actual)
@@ -28,7 +50,7 @@ func TestPortEmpty(t *testing.T) {
 
 func TestProfileServiceBaseurl(t *testing.T) {
 	os.Setenv("PROFILE_SERVICE_URL", "/test")
-	actual := config.LoadConfig().ProfileServiceBaseurl
+	actual := load().ProfileServiceBaseurl
 	expected := "/test"
 	if expected != actual {
 		t.Fatalf("Expected %v got %v", expected, actual)
@@ -38,7 +60,7 @@ func TestProfileServiceBaseurl(t *testing.T) {
 
 func TestProfileServiceBaseurlEmpty(t *testing.T) {
 	os.Clearenv()
-	actual := config.LoadConfig().ProfileServiceBaseurl
+	actual := load().ProfileServiceBaseurl
 	expected := ""
 	if expected != actual {
 		t.Fatalf("Expected %v got %v", expected, actual)
@@ -47,7 +69,7 @@ func TestProfileServiceBaseurlEmpty(t *testing.T) {
 
 func TestCommentServiceBaseurl(t *testing.T) {
 	os.Setenv("COMMENT_SERVICE_URL", "/testc")
-	actual := config.LoadConfig().CommentServiceBaseurl
+	actual := load().CommentServiceBaseurl
 	expected := "/testc"
 	if expected != actual {
 		t.Fatalf("Expected %v got %v", expected, actual)
@@ -57,7 +79,7 @@ func TestCommentServiceBaseurl(t *testing.T) {
 
 func TestCommentServiceBaseurlEmpty(t *testing.T) {
 	os.Clearenv()
-	actual := config.LoadConfig().CommentServiceBaseurl
+	actual := load().CommentServiceBaseurl
 	expected := ""
 	if expected != actual {
 		t.Fatalf("Expected %v got %v", expected, actual)
@@ -66,7 +88,7 @@ func TestCommentServiceBaseurlEmpty(t *testing.T) {
 
 func TestVoteServiceBaseurl(t *testing.T) {
 	os.Setenv("VOTE_SERVICE_URL", "/testv")
-	actual := config.LoadConfig().VoteServiceBaseurl
+	actual := load().VoteServiceBaseurl
 	expected := "/testv"
 	if expected != actual {
 		t.Fatalf("Expected %v got %v", expected, actual)
@@ -76,7 +98,7 @@ func TestVoteServiceBaseurl(t *testing.T) {
 
 func TestVoteServiceBaseurlEmpty(t *testing.T) {
 	os.Clearenv()
-	actual := config.LoadConfig().VoteServiceBaseurl
+	actual := load().VoteServiceBaseurl
 	expected := ""
 	if expected != actual {
 		t.Fatalf("Expected %v got %v", expected, actual)
@@ -85,7 +107,7 @@ func TestVoteServiceBaseurlEmpty(t *testing.T) {
 
 func TestDBUsername(t *testing.T) {
 	os.Setenv("DB_USERNAME", "user")
-	actual := config.LoadConfig().DBUsername
+	actual := load().DBUsername
 	expected := "user"
 	if expected != actual {
 		t.Fatalf("Expected %s got %s", expected, actual)
@@ -95,7 +117,7 @@ func TestDBUsername(t *testing.T) {
 
 func TestDBUsernameEmpty(t *testing.T) {
 	os.Clearenv()
-	actual := config.LoadConfig().DBUsername
+	actual := load().DBUsername
 	expected := ""
 	if expected != actual {
 		t.Fatalf("Expected %s got %s", expected, actual)
@@ -104,7 +126,7 @@ func TestDBUsernameEmpty(t *testing.T) {
 
 func TestDBPassword(t *testing.T) {
 	os.Setenv("DB_PASSWORD", "pass")
-	actual := config.LoadConfig().DBPassword
+	actual := load().DBPassword
 	expected := "pass"
 	if expected != actual {
 		t.Fatalf("Expected %s got %s", expected, actual)
@@ -114,7 +136,7 @@ func TestDBPassword(t *testing.T) {
 
 func TestDBPasswordEmpty(t *testing.T) {
 	os.Clearenv()
-	actual := config.LoadConfig().DBPassword
+	actual := load().DBPassword
 	expected := ""
 	if expected != actual {
 		t.Fatalf("Expected %s got %s", expected, actual)
@@ -123,7 +145,7 @@ func TestDBPasswordEmpty(t *testing.T) {
 
 func TestDBHost(t *testing.T) {
 	os.Setenv("DB_HOST", "localhost")
-	actual := config.LoadConfig().DBHost
+	actual := load().DBHost
 	expected := "localhost"
 	if expected != actual {
 		t.Fatalf("Expected %s got %s", expected, actual)
@@ -133,7 +155,7 @@ func TestDBHost(t *testing.T) {
 
 func TestDBHostEmpty(t *testing.T) {
 	os.Clearenv()
-	actual := config.LoadConfig().DBHost
+	actual := load().DBHost
 	expected := ""
 	if expected != actual {
 		t.Fatalf("Expected %s got %s", expected, actual)
@@ -142,7 +164,7 @@ func TestDBHostEmpty(t *testing.T) {
 
 func TestDBPort(t *testing.T) {
 	os.Setenv("DB_PORT", "3306")
-	actual := config.LoadConfig().DBPort
+	actual := load().DBPort
 	expected := 3306
 	if expected != actual {
 		t.Fatalf("Expected %v got %v", expected, actual)
@@ -152,8 +174,8 @@ func TestDBPort(t *testing.T) {
 
 func TestDBPortEmpty(t *testing.T) {
 	os.Clearenv()
-	actual := config.LoadConfig().DBPort
-	expected := 0
+	actual := load().DBPort
+	expected := 3306
 	if expected != actual {
 		t.Fatalf("Expected %v got %v", expected, actual)
 	}
@@ -161,7 +183,7 @@ func TestDBPortEmpty(t *testing.T) {
 
 func TestDB(t *testing.T) {
 	os.Setenv("DB", "TestDatabase")
-	actual := config.LoadConfig().Database
+	actual := load().Database
 	expected := "TestDatabase"
 	if expected != actual {
 		t.Fatalf("Expected %s got %s", expected, actual)
@@ -171,9 +193,255 @@ func TestDB(t *testing.T) {
 
 func TestDBEmpty(t *testing.T) {
 	os.Clearenv()
-	actual := config.LoadConfig().Database
+	actual := load().Database
+	expected := ""
+	if expected != actual {
+		t.Fatalf("Expected %s got %s", expected, actual)
+	}
+}
+
+func TestAuthenticationServiceBaseurl(t *testing.T) {
+	os.Setenv("AUTHENTICATION_SERVICE_URL", "/testa")
+	actual := load().AuthenticationServiceBaseurl
+	expected := "/testa"
+	if expected != actual {
+		t.Fatalf("Expected %v got %v", expected, actual)
+	}
+	os.Clearenv()
+}
+
+func TestAuthenticationServiceBaseurlEmpty(t *testing.T) {
+	os.Clearenv()
+	actual := load().AuthenticationServiceBaseurl
+	expected := ""
+	if expected != actual {
+		t.Fatalf("Expected %v got %v", expected, actual)
+	}
+}
+
+func TestIPCKeys(t *testing.T) {
+	os.Setenv("IPC_KEY_FILE", "/run/secrets/ipc.pem")
+	os.Setenv("IPC_PUBLIC_KEYS", "photo-service=/run/secrets/photo-service.pub")
+	cnf := load()
+	if expected := "/run/secrets/ipc.pem"; expected != cnf.IPCKeyFile {
+		t.Fatalf("Expected %s got %s", expected, cnf.IPCKeyFile)
+	}
+	if expected := "photo-service=/run/secrets/photo-service.pub"; expected != cnf.IPCPublicKeys {
+		t.Fatalf("Expected %s got %s", expected, cnf.IPCPublicKeys)
+	}
+	os.Clearenv()
+}
+
+func TestIPCKeysEmpty(t *testing.T) {
+	os.Clearenv()
+	actual := load().IPCKeyFile
 	expected := ""
 	if expected != actual {
 		t.Fatalf("Expected %s got %s", expected, actual)
 	}
 }
+
+func TestRequestTimeout(t *testing.T) {
+	os.Setenv("REQUEST_TIMEOUT", "2500ms")
+	actual := load().RequestTimeout
+	expected := 2500 * time.Millisecond
+	if expected != actual {
+		t.Fatalf("Expected %v got %v", expected, actual)
+	}
+	os.Clearenv()
+}
+
+func TestRequestTimeoutInvalid(t *testing.T) {
+	os.Setenv("REQUEST_TIMEOUT", "10")
+	cnf, err := config.LoadConfig(nil)
+	var expected time.Duration
+	if expected != cnf.RequestTimeout {
+		t.Fatalf("Expected %v got %v", expected, cnf.RequestTimeout)
+	}
+	if _, ok := err.(*settings.Error); !ok {
+		t.Fatalf("Expected a *settings.Error but got %v", err)
+	}
+	os.Clearenv()
+}
+
+func TestOTLPEndpoint(t *testing.T) {
+	os.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", "http://collector:4318")
+	actual := load().OTLPEndpoint
+	expected := "http://collector:4318"
+	if expected != actual {
+		t.Fatalf("Expected %v got %v", expected, actual)
+	}
+	os.Clearenv()
+}
+
+func TestOTLPEndpointEmpty(t *testing.T) {
+	os.Clearenv()
+	actual := load().OTLPEndpoint
+	expected := ""
+	if expected != actual {
+		t.Fatalf("Expected %v got %v", expected, actual)
+	}
+}
+
+func TestCORSAllowedOrigins(t *testing.T) {
+	os.Setenv("CORS_ALLOWED_ORIGINS", "https://example.com, http://localhost:4000,")
+	actual := strings.Join(load().CORSAllowedOrigins, "|")
+	expected := "https://example.com|http://localhost:4000"
+	if expected != actual {
+		t.Fatalf("Expected %v got %v", expected, actual)
+	}
+	os.Clearenv()
+}
+
+func TestCORSAllowedOriginsEmpty(t *testing.T) {
+	os.Clearenv()
+	actual := load().CORSAllowedOrigins
+	if actual != nil {
+		t.Fatalf("Expected %v got %v", nil, actual)
+	}
+}
+
+func TestCORSAllowCredentials(t *testing.T) {
+	os.Setenv("CORS_ALLOW_CREDENTIALS", "true")
+	actual := load().CORSAllowCredentials
+	expected := true
+	if expected != actual {
+		t.Fatalf("Expected %v got %v", expected, actual)
+	}
+	os.Clearenv()
+}
+
+func TestCORSMaxAge(t *testing.T) {
+	os.Setenv("CORS_MAX_AGE", "1h")
+	actual := load().CORSMaxAge
+	expected := time.Hour
+	if expected != actual {
+		t.Fatalf("Expected %v got %v", expected, actual)
+	}
+	os.Clearenv()
+}
+
+func TestDBConnectTimeout(t *testing.T) {
+	os.Setenv("DB_CONNECT_TIMEOUT", "30s")
+	actual := load().DBConnectTimeout
+	expected := 30 * time.Second
+	if expected != actual {
+		t.Fatalf("Expected %v got %v", expected, actual)
+	}
+	os.Clearenv()
+}
+
+func TestDBMaxOpenConns(t *testing.T) {
+	os.Setenv("DB_MAX_OPEN_CONNS", "50")
+	actual := load().DBMaxOpenConns
+	expected := 50
+	if expected != actual {
+		t.Fatalf("Expected %v got %v", expected, actual)
+	}
+	os.Clearenv()
+}
+
+func TestDBMaxIdleConns(t *testing.T) {
+	os.Setenv("DB_MAX_IDLE_CONNS", "5")
+	actual := load().DBMaxIdleConns
+	expected := 5
+	if expected != actual {
+		t.Fatalf("Expected %v got %v", expected, actual)
+	}
+	os.Clearenv()
+}
+
+func TestDBConnMaxLifetime(t *testing.T) {
+	os.Setenv("DB_CONN_MAX_LIFETIME", "10m")
+	actual := load().DBConnMaxLifetime
+	expected := 10 * time.Minute
+	if expected != actual {
+		t.Fatalf("Expected %v got %v", expected, actual)
+	}
+	os.Clearenv()
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	os.Setenv("SHUTDOWN_TIMEOUT", "20s")
+	actual := load().ShutdownTimeout
+	expected := 20 * time.Second
+	if expected != actual {
+		t.Fatalf("Expected %v got %v", expected, actual)
+	}
+	os.Clearenv()
+}
+
+func TestShutdownTimeoutEmpty(t *testing.T) {
+	os.Clearenv()
+	actual := load().ShutdownTimeout
+	var expected time.Duration
+	if expected != actual {
+		t.Fatalf("Expected %v got %v", expected, actual)
+	}
+}
+
+func TestRequireVerifiedEmail(t *testing.T) {
+	os.Setenv("REQUIRE_VERIFIED_EMAIL", "true")
+	actual := load().RequireVerifiedEmail
+	expected := true
+	if expected != actual {
+		t.Fatalf("Expected %v got %v", expected, actual)
+	}
+	os.Clearenv()
+}
+
+func TestRequireVerifiedEmailEmpty(t *testing.T) {
+	os.Clearenv()
+	actual := load().RequireVerifiedEmail
+	expected := false
+	if expected != actual {
+		t.Fatalf("Expected %v got %v", expected, actual)
+	}
+}
+
+func TestValid(t *testing.T) {
+	os.Clearenv()
+	setRequired()
+	if _, err := config.LoadConfig(nil); err != nil {
+		t.Fatalf("Expected no error, instead got %v", err.Error())
+	}
+	os.Clearenv()
+}
+
+// Test if every missing required variable is reported at once.
+func TestRequired(t *testing.T) {
+	os.Clearenv()
+	_, err := config.LoadConfig(nil)
+	validationErr, ok := err.(*settings.Error)
+	if !ok {
+		t.Fatalf("Expected a *settings.Error but got %v", err)
+	}
+	expected := 9
+	if actual := len(validationErr.Problems); actual != expected {
+		t.Fatalf("Expected %v got %v", expected, actual)
+	}
+}
+
+func TestPortOutOfRange(t *testing.T) {
+	os.Clearenv()
+	setRequired()
+	os.Setenv("PORT", "70000")
+	if _, err := config.LoadConfig(nil); err == nil {
+		t.Fatal("Expected an error but got nil")
+	}
+	os.Clearenv()
+}
+
+func TestPortFlag(t *testing.T) {
+	os.Clearenv()
+	setRequired()
+	cnf, err := config.LoadConfig([]string{"--port", "6000"})
+	if err != nil {
+		t.Fatalf("Expected no error, instead got %v", err.Error())
+	}
+	expected := 6000
+	if expected != cnf.Port {
+		t.Fatalf("Expected %v got %v", expected, cnf.Port)
+	}
+	os.Clearenv()
+}
@@ -1,8 +1,8 @@
 package db
 
 import (
+	"context"
 	"database/sql"
-	"errors"
 	"fmt"
 	"strconv"
 
@@ -10,10 +10,15 @@ import (
 
 	"github.com/bstaijen/mariadb-for-microservices/photo-service/app/models"
 	"github.com/bstaijen/mariadb-for-microservices/photo-service/config"
+	"github.com/bstaijen/mariadb-for-microservices/shared/apierror"
+	"github.com/bstaijen/mariadb-for-microservices/shared/bootstrap"
 	sharedModels "github.com/bstaijen/mariadb-for-microservices/shared/models"
+	"github.com/bstaijen/mariadb-for-microservices/shared/tracing"
+	"github.com/bstaijen/mariadb-for-microservices/shared/util"
 )
 
-// OpenConnection opens the connection to the database
+// OpenConnection opens the connection to the database. It waits for the database to come online for at most
+// cnf.DBConnectTimeout.
 func OpenConnection(cnf config.Config) (*sql.DB, error) {
 	username := cnf.DBUsername
 	password := cnf.DBPassword
@@ -24,14 +29,14 @@ func OpenConnection(cnf config.Config) (*sql.DB, error) {
 	dsn := fmt.Sprintf("%v:%v@tcp(%v:%v)/%v?parseTime=true", username, password, host, port, database)
 
 	log.Debugf("Connect to : %v", dsn)
-	db, err := sql.Open("mysql", dsn)
-	if err != nil {
-		return nil, errCanNotConnectWithDatabase
-	}
-
-	// Open doesn't open a connection. Validate DSN data:
-	err = db.Ping()
+	db, err := bootstrap.OpenDB(context.Background(), "mysql", dsn, bootstrap.DBOptions{
+		ConnectTimeout:  cnf.DBConnectTimeout,
+		MaxOpenConns:    cnf.DBMaxOpenConns,
+		MaxIdleConns:    cnf.DBMaxIdleConns,
+		ConnMaxLifetime: cnf.DBConnMaxLifetime,
+	})
 	if err != nil {
+		log.Error(err)
 		return nil, errCanNotConnectWithDatabase
 	}
 	return db, nil
@@ -43,9 +48,9 @@ func CloseConnection(db *sql.DB) {
 }
 
 // InsertPhoto : inserts a photo in the database
-func InsertPhoto(db *sql.DB, photo *models.CreatePhoto) error {
+func InsertPhoto(ctx context.Context, db *sql.DB, photo *models.CreatePhoto) error {
 	//Insert
-	_, err := db.Exec("INSERT INTO photos(user_id, filename, title, contentType, photo) VALUES(?,?,?,?,?)", photo.UserID, photo.Filename, photo.Title, photo.ContentType, photo.Image)
+	_, err := tracing.ExecContext(ctx, db, "INSERT INTO photos(user_id, filename, title, contentType, photo) VALUES(?,?,?,?,?)", photo.UserID, photo.Filename, photo.Title, photo.ContentType, photo.Image)
 	if err != nil {
 		return err
 	}
@@ -53,39 +58,43 @@ func InsertPhoto(db *sql.DB, photo *models.CreatePhoto) error {
 }
 
 // ListImagesByUserID returns a list of photo's uploaded by the user.
-func ListImagesByUserID(db *sql.DB, id int) ([]*models.Photo, error) {
-	return selectQuery(db, "SELECT id, user_id, filename, title, createdAt, contentType, photo FROM photos WHERE user_id=? ORDER BY createdAt DESC", id)
+func ListImagesByUserID(ctx context.Context, db *sql.DB, id int) ([]*models.Photo, error) {
+	return selectQuery(ctx, db, "SELECT id, user_id, filename, title, createdAt, contentType, photo FROM photos WHERE user_id=? ORDER BY createdAt DESC", id)
 }
 
 // ListIncoming returns a list of photos ordered by last inserted
-func ListIncoming(db *sql.DB, offset int, nrOfRows int) ([]*models.Photo, error) {
-	return selectQuery(db, "SELECT id, user_id, filename, title, createdAt, contentType, photo FROM photos ORDER BY createdAt DESC LIMIT ?, ?", offset, nrOfRows)
+func ListIncoming(ctx context.Context, db *sql.DB, offset int, nrOfRows int) ([]*models.Photo, error) {
+	return selectQuery(ctx, db, "SELECT id, user_id, filename, title, createdAt, contentType, photo FROM photos ORDER BY createdAt DESC LIMIT ?, ?", offset, nrOfRows)
 }
 
 // GetPhotoByFilename return a photo based on the filename
-func GetPhotoByFilename(db *sql.DB, filename string) (*models.Photo, error) {
-	photos, err := selectQuery(db, "SELECT id, user_id, filename, title, createdAt, contentType, photo FROM photos WHERE filename = ?", filename)
-	if len(photos) > 0 {
-		return photos[0], err
+func GetPhotoByFilename(ctx context.Context, db *sql.DB, filename string) (*models.Photo, error) {
+	photos, err := selectQuery(ctx, db, "SELECT id, user_id, filename, title, createdAt, contentType, photo FROM photos WHERE filename = ?", filename)
+	if err != nil {
+		return nil, err
 	}
-	return nil, err 
+	if len(photos) == 0 {
+		return nil, ErrPhotoNotFound
+	}
+	return photos[0], nil
 }
 
 // GetPhotoById returns a photo indexed by id
-func GetPhotoById(db *sql.DB, id int) (*models.Photo, error) {
-	photos, err := selectQuery(db, "SELECT id, user_id, filename, title, createdAt, contentType, photo FROM photos WHERE id = ?", id)
+func GetPhotoById(ctx context.Context, db *sql.DB, id int) (*models.Photo, error) {
+	photos, err := selectQuery(ctx, db, "SELECT id, user_id, filename, title, createdAt, contentType, photo FROM photos WHERE id = ?", id)
 
-	log.Info(photos)
+	util.Log(ctx).Info(photos)
 
-	if len(photos) > 0 {
-		return photos[0], err
-	} else if len(photos) == 0 {
-		return nil, errors.New("photo not found")
+	if err != nil {
+		return nil, err
 	}
-	return nil, err
+	if len(photos) == 0 {
+		return nil, ErrPhotoNotFound
+	}
+	return photos[0], nil
 }
 
-func GetPhotos(db *sql.DB, items []*sharedModels.PhotoRequest) ([]*sharedModels.PhotoResponse, error) {
+func GetPhotos(ctx context.Context, db *sql.DB, items []*sharedModels.PhotoRequest) ([]*sharedModels.PhotoResponse, error) {
 	if len(items) < 1 {
 		return make([]*sharedModels.PhotoResponse, 0), nil
 	}
@@ -106,7 +115,7 @@ func GetPhotos(db *sql.DB, items []*sharedModels.PhotoRequest) ([]*sharedModels.
 
 	query += ")"
 
-	rows, err := db.Query(query)
+	rows, err := tracing.QueryContext(ctx, db, query)
 	if err != nil {
 		return nil, err
 	}
@@ -126,8 +135,8 @@ func GetPhotos(db *sql.DB, items []*sharedModels.PhotoRequest) ([]*sharedModels.
 }
 
 // DeletePhotoByID delete a photo in the database based on ID.
-func DeletePhotoByID(db *sql.DB, photoID int) (int64, error) {
-	res, err := db.Exec("DELETE FROM photos WHERE id = ?", photoID)
+func DeletePhotoByID(ctx context.Context, db *sql.DB, photoID int) (int64, error) {
+	res, err := tracing.ExecContext(ctx, db, "DELETE FROM photos WHERE id = ?", photoID)
 	if err != nil {
 		return 0, err
 	}
@@ -135,8 +144,8 @@ func DeletePhotoByID(db *sql.DB, photoID int) (int64, error) {
 }
 
 // A parameter type prefixed with three dots (...) is called a variadic parameter.
-func selectQuery(db *sql.DB, query string, args ...interface{}) ([]*models.Photo, error) {
-	rows, err := db.Query(query, args...)
+func selectQuery(ctx context.Context, db *sql.DB, query string, args ...interface{}) ([]*models.Photo, error) {
+	rows, err := tracing.QueryContext(ctx, db, query, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -156,4 +165,7 @@ func selectQuery(db *sql.DB, query string, args ...interface{}) ([]*models.Photo
 }
 
 // errCanNotConnectWithDatabase error if database is unreachable
-var errCanNotConnectWithDatabase = errors.New("Can not connect with database")
+var errCanNotConnectWithDatabase = apierror.New(apierror.Unavailable, "Can not connect with database")
+
+// ErrPhotoNotFound error if photo does not exist in database
+var ErrPhotoNotFound = apierror.New(apierror.NotFound, "Photo does not exist")
@@ -1,6 +1,7 @@
 package db
 
 import (
+	"context"
 	"testing"
 	"time"
 
@@ -29,7 +30,7 @@ func TestInsertPhoto(t *testing.T) {
 	mock.ExpectExec("INSERT INTO photos").WithArgs(photo.UserID, photo.Filename, photo.Title, photo.ContentType, photo.Image).WillReturnResult(sqlmock.NewResult(1, 1))
 
 	// Execute the method
-	if err := InsertPhoto(db, photo); err != nil {
+	if err := InsertPhoto(context.Background(), db, photo); err != nil {
 		t.Errorf("there was an unexpected error: %s", err)
 	}
 
@@ -59,7 +60,7 @@ func TestListImagesByUserID(t *testing.T) {
 	mock.ExpectQuery("SELECT (.+) FROM photos WHERE").WithArgs(1).WillReturnRows(selectByIDRows)
 
 	// Execute the method
-	if _, err := ListImagesByUserID(db, 1); err != nil {
+	if _, err := ListImagesByUserID(context.Background(), db, 1); err != nil {
 		t.Errorf("there was an unexpected error: %s", err)
 	}
 
@@ -89,7 +90,7 @@ func TestListIncoming(t *testing.T) {
 	mock.ExpectQuery("SELECT (.+) FROM photos").WithArgs(1, 10).WillReturnRows(selectByIDRows)
 
 	// Execute the method
-	if _, err := ListIncoming(db, 1, 10); err != nil {
+	if _, err := ListIncoming(context.Background(), db, 1, 10); err != nil {
 		t.Errorf("there was an unexpected error: %s", err)
 	}
 
@@ -119,7 +120,7 @@ func TestGetPhotoByFilename(t *testing.T) {
 	mock.ExpectQuery("SELECT (.+) FROM photos").WithArgs(photo.Filename).WillReturnRows(selectByIDRows)
 
 	// Execute the method
-	if _, err := GetPhotoByFilename(db, photo.Filename); err != nil {
+	if _, err := GetPhotoByFilename(context.Background(), db, photo.Filename); err != nil {
 		t.Errorf("there was an unexpected error: %s", err)
 	}
 
@@ -149,7 +150,7 @@ func TestGetPhotoById(t *testing.T) {
 	mock.ExpectQuery("SELECT (.+) FROM photos").WithArgs(1).WillReturnRows(selectByIDRows)
 
 	// Execute the method
-	if _, err := GetPhotoById(db, 1); err != nil {
+	if _, err := GetPhotoById(context.Background(), db, 1); err != nil {
 		t.Errorf("there was an unexpected error: %s", err)
 	}
 
@@ -158,3 +159,29 @@ func TestGetPhotoById(t *testing.T) {
 		t.Errorf("there were unfulfilled expectations: %s", err)
 	}
 }
+
+func TestSeedDemoPhoto(t *testing.T) {
+
+	// Mock database
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	// Expectation: the embedded image is inserted unless it is there
+	mock.ExpectExec("INSERT IGNORE INTO photos").WithArgs(1, demoFilename, "The MariaDB seal", "image/png", demoPhoto).WillReturnResult(sqlmock.NewResult(1, 1))
+
+	// Execute the method
+	if err := SeedDemoPhoto(context.Background(), db); err != nil {
+		t.Errorf("there was an unexpected error: %s", err)
+	}
+	if len(demoPhoto) == 0 {
+		t.Error("Expected the demo photo to be embedded")
+	}
+
+	// Make sure expectations are met
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
@@ -0,0 +1,26 @@
+package db
+
+import (
+	"database/sql"
+
+	"github.com/bstaijen/mariadb-for-microservices/shared/migrate"
+)
+
+// Migrations are the versions of the photos table in the PhotoService schema.
+var Migrations = []migrate.Migration{
+	{
+		Version: 1,
+		Name:    "create photos",
+		Up: []string{
+			"CREATE TABLE IF NOT EXISTS photos (id INT NOT NULL AUTO_INCREMENT PRIMARY KEY, title varchar(255) NOT NULL, user_id INT NOT NULL, filename varchar(255) NOT NULL UNIQUE, contentType varchar(255), photo MEDIUMBLOB, createdAt timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP, updatedAt timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP)",
+		},
+		Down: []string{
+			"DROP TABLE photos",
+		},
+	},
+}
+
+// Migrator returns the migrator of the schema of the service.
+func Migrator(db *sql.DB) *migrate.Migrator {
+	return migrate.New(db, migrate.DefaultTable, Migrations)
+}
@@ -0,0 +1,23 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	_ "embed" // the demo photo is compiled into the binary
+
+	"github.com/bstaijen/mariadb-for-microservices/shared/tracing"
+)
+
+// demoPhoto is the image of the demo photo.
+//
+//go:embed mariadb.png
+var demoPhoto []byte
+
+// demoFilename is the filename of the demo photo, the UNIQUE filename makes seeding it more than once a no-op.
+const demoFilename = "94049535630251382.png"
+
+// SeedDemoPhoto adds the demo photo of the first user unless it was added before.
+func SeedDemoPhoto(ctx context.Context, db *sql.DB) error {
+	_, err := tracing.ExecContext(ctx, db, "INSERT IGNORE INTO photos(user_id, filename, title, contentType, photo) VALUES(?,?,?,?,?)", 1, demoFilename, "The MariaDB seal", "image/png", demoPhoto)
+	return err
+}
@@ -1,12 +1,20 @@
 package main
 
 import (
+	"context"
 	"net/http"
+	"os"
 	"strconv"
 
 	"github.com/bstaijen/mariadb-for-microservices/photo-service/app/http/routes"
 	"github.com/bstaijen/mariadb-for-microservices/photo-service/config"
 	"github.com/bstaijen/mariadb-for-microservices/photo-service/database"
+	"github.com/bstaijen/mariadb-for-microservices/shared/bootstrap"
+	"github.com/bstaijen/mariadb-for-microservices/shared/ipc"
+	"github.com/bstaijen/mariadb-for-microservices/shared/metrics"
+	"github.com/bstaijen/mariadb-for-microservices/shared/migrate"
+	"github.com/bstaijen/mariadb-for-microservices/shared/tracing"
+	"github.com/bstaijen/mariadb-for-microservices/shared/util/middleware"
 	negronilogrus "github.com/meatballhat/negroni-logrus"
 	"github.com/urfave/negroni"
 
@@ -22,22 +30,73 @@ func main() {
 	log.SetLevel(log.DebugLevel)
 
 	// Get config
-	cnf := config.LoadConfig()
+	command, args := migrate.ParseCommand(os.Args[1:])
+	cnf, err := config.LoadConfig(args)
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	// Get database // TODO : wait for the DB to go online for max 1 min?
+	// Export traces
+	shutdownTracing, err := tracing.Init("photo-service", cnf.OTLPEndpoint)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer shutdownTracing(context.Background())
+
+	// Get database, waits for it to come online
 	connection, err := db.OpenConnection(cnf)
 	if err != nil {
 		log.Fatal(err)
 	}
 	defer db.CloseConnection(connection)
 
+	// Run the migrate subcommand, or refuse to start while migrations are pending
+	migrator := db.Migrator(connection)
+	if command != nil {
+		if err := migrator.Run(context.Background(), command, os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if err := migrator.Check(context.Background()); err != nil {
+		log.Fatal(err)
+	}
+	if err := db.SeedDemoPhoto(context.Background(), connection); err != nil {
+		log.Fatal(err)
+	}
+	if err := metrics.RegisterDB("photo", connection); err != nil {
+		log.Fatal(err)
+	}
+
+	// Load the keys which sign and verify the IPC calls
+	ipcKeys, err := ipc.LoadKeys(ipc.PhotoService, cnf.IPCKeyFile, cnf.IPCPublicKeys)
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	// Set the REST API routes
-	r := routes.InitRoutes(connection, cnf)
+	r := routes.InitRoutes(connection, cnf, ipcKeys)
+	r.Handle("/metrics", metrics.Handler()).Methods("GET")
 	n := negroni.Classic()
+	n.Use(negroni.HandlerFunc(middleware.RequestID))
+	n.Use(negroni.HandlerFunc(tracing.Middleware))
+	n.Use(metrics.Middleware(r))
 	n.Use(negronilogrus.NewMiddleware())
+	n.Use(middleware.Deadline(cnf.RequestTimeout))
+	n.Use(middleware.CORS(middleware.CORSOptions{
+		AllowedOrigins:   cnf.CORSAllowedOrigins,
+		AllowedMethods:   cnf.CORSAllowedMethods,
+		AllowedHeaders:   cnf.CORSAllowedHeaders,
+		AllowCredentials: cnf.CORSAllowCredentials,
+		MaxAge:           cnf.CORSMaxAge,
+	}))
 	n.UseHandler(r)
 
-	// Start and listen on port in cbf.Port
+	// Start and listen on port in cnf.Port until the process is stopped. The deferred calls close the database
+	// after the requests in flight are finished.
+	server := &http.Server{Addr: ":" + strconv.Itoa(cnf.Port), Handler: n}
 	log.Info("Starting server on port " + strconv.Itoa(cnf.Port))
-	log.Fatal(http.ListenAndServe(":"+strconv.Itoa(cnf.Port), n))
+	if err := bootstrap.Serve(server, cnf.ShutdownTimeout); err != nil {
+		log.Fatal(err)
+	}
 }
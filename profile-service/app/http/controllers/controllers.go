@@ -1,9 +1,18 @@
 package controllers
 
 import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
 	"net/http"
+	"net/url"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"golang.org/x/crypto/bcrypt"
@@ -13,19 +22,23 @@ import (
 	"github.com/bstaijen/mariadb-for-microservices/profile-service/app/models"
 	"github.com/bstaijen/mariadb-for-microservices/profile-service/config"
 	"github.com/bstaijen/mariadb-for-microservices/profile-service/database"
+	"github.com/bstaijen/mariadb-for-microservices/shared/apierror"
+	"github.com/bstaijen/mariadb-for-microservices/shared/ipc"
+	"github.com/bstaijen/mariadb-for-microservices/shared/mail"
 	"github.com/bstaijen/mariadb-for-microservices/shared/util"
+	"github.com/bstaijen/mariadb-for-microservices/shared/util/middleware"
 
 	sharedModels "github.com/bstaijen/mariadb-for-microservices/shared/models"
 	"github.com/gorilla/mux"
 
-	jwt "github.com/dgrijalva/jwt-go"
 	"github.com/urfave/negroni"
 
 	log "github.com/Sirupsen/logrus"
 )
 
-// CreateUserHandler creates a new user in the database. Password is saved as a hash.
-func CreateUserHandler(connection *sql.DB, cnf config.Config) negroni.HandlerFunc {
+// CreateUserHandler creates a new user in the database. Password is saved as a hash. The user gets a mail with a link
+// which verifies the email address, and logs in at the authentication service like any other user.
+func CreateUserHandler(connection *sql.DB, cnf config.Config, mailer mail.Mailer) negroni.HandlerFunc {
 	return negroni.HandlerFunc(func(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
 		user := &models.UserCreate{}
 		err := util.RequestToJSON(r, user)
@@ -40,66 +53,41 @@ func CreateUserHandler(connection *sql.DB, cnf config.Config) negroni.HandlerFun
 				hash, _ := bcrypt.GenerateFromPassword([]byte(user.Password), 10)
 				user.Hash = string(hash)
 
-				createdID, err := db.CreateUser(connection, user)
+				createdID, err := db.CreateUser(r.Context(), connection, user)
 
 				if err != nil {
-					util.SendBadRequest(w, err)
-					return
-				}
-				createdUser, err := db.GetUserByID(connection, createdID)
-				if err != nil {
-					util.SendBadRequest(w, err)
+					util.SendError(w, err)
 					return
 				}
-
-				// create JWT object with claims
-				expiration := time.Now().Add(time.Hour * 24 * 31).Unix()
-				token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-					"sub": createdUser.ID,
-					"iat": time.Now().Unix(),
-					"exp": expiration,
-				})
-
-				// Load secret key from config and generate a signed token
-				secretKey := cnf.SecretKey
-				tokenString, err := token.SignedString([]byte(secretKey))
+				createdUser, err := db.GetUserByID(r.Context(), connection, createdID)
 				if err != nil {
 					util.SendError(w, err)
 					return
 				}
 
-				type Token struct {
-					Token     string               `json:"token"`
-					ExpiresOn string               `json:"expires_on"`
-					User      *models.UserResponse `json:"user"`
+				// The account works without a verified address, the user can ask for another mail.
+				if err := sendVerification(r.Context(), connection, cnf, mailer, createdUser); err != nil {
+					util.Log(r.Context()).Errorf("Can not send the verification mail of user %v: %v", createdUser.ID, err)
 				}
 
-				util.SendOK(w, &Token{
-					Token:     tokenString,
-					ExpiresOn: strconv.Itoa(int(expiration)),
-					User:      &createdUser,
-				})
+				util.SendOK(w, &createdUser)
 
 			} else {
-				util.SendBadRequest(w, err)
+				util.SendError(w, err)
 			}
 		} else {
-			util.SendBadRequest(w, err)
+			util.SendError(w, err)
 		}
 	})
 }
 
-// DeleteUserHandler removes a user from the database. User can only deletes it's own record.
-func DeleteUserHandler(connection *sql.DB, cnf config.Config) negroni.HandlerFunc {
+// DeleteUserHandler removes a user from the database. User can only deletes it's own record. The user is logged out
+// everywhere first, so the tokens of the deleted user stop working.
+func DeleteUserHandler(connection *sql.DB, cnf config.Config, clients *ipc.Clients) negroni.HandlerFunc {
 	return negroni.HandlerFunc(func(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
-		var queryToken = r.URL.Query().Get("token")
-
-		if len(queryToken) < 1 {
-			queryToken = r.Header.Get("token")
-		}
-
-		if len(queryToken) < 1 {
-			util.SendBadRequest(w, errors.New("token is mandatory"))
+		principal, ok := middleware.UserFromContext(r.Context())
+		if !ok {
+			util.SendError(w, middleware.ErrTokenMandatory)
 			return
 		}
 
@@ -110,22 +98,19 @@ func DeleteUserHandler(connection *sql.DB, cnf config.Config) negroni.HandlerFun
 			return
 		}
 
-		secretKey := cnf.SecretKey
-		tok, err := jwt.Parse(queryToken, func(t *jwt.Token) (interface{}, error) {
-			return []byte(secretKey), nil
-		})
-
-		claims := tok.Claims.(jwt.MapClaims)
-		var ID = claims["sub"].(float64)
+		if principal.ID != user.ID {
+			util.SendError(w, apierror.New(apierror.PermissionDenied, "you can only delete your own user object"))
+			return
+		}
 
-		if int(ID) != user.ID {
-			util.SendBadRequest(w, errors.New("you can only delete your own user object"))
+		if err := clients.Authentication.RevokeSessions(r.Context(), principal.ID); err != nil {
+			util.SendError(w, err)
 			return
 		}
 
-		db.DeleteUser(connection, user)
+		_, err = db.DeleteUser(r.Context(), connection, user)
 		if err != nil {
-			util.SendBadRequest(w, err)
+			util.SendError(w, err)
 			return
 		}
 		util.SendOK(w, string(""))
@@ -133,18 +118,12 @@ func DeleteUserHandler(connection *sql.DB, cnf config.Config) negroni.HandlerFun
 	})
 }
 
-// UpdateUserHandler updates an user based on it's user ID. User is only allowed to update it's own record. Verification is being done based on the JWT in the request.
-func UpdateUserHandler(connection *sql.DB, cnf config.Config) negroni.HandlerFunc {
+// UpdateUserHandler updates an user based on it's user ID. User is only allowed to update it's own record. Verification is being done based on the user in the request context. A new email address has to be verified, the user gets a mail for it.
+func UpdateUserHandler(connection *sql.DB, cnf config.Config, mailer mail.Mailer) negroni.HandlerFunc {
 	return negroni.HandlerFunc(func(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
-		var queryToken = r.URL.Query().Get("token")
-
-		if len(queryToken) < 1 {
-			queryToken = r.Header.Get("token")
-		}
-
-		if len(queryToken) < 1 {
-			w.WriteHeader(http.StatusBadRequest)
-			w.Write([]byte(string("token is mandatory")))
+		principal, ok := middleware.UserFromContext(r.Context())
+		if !ok {
+			util.SendError(w, middleware.ErrTokenMandatory)
 			return
 		}
 
@@ -155,35 +134,291 @@ func UpdateUserHandler(connection *sql.DB, cnf config.Config) negroni.HandlerFun
 			return
 		}
 
-		secretKey := cnf.SecretKey
-		tok, err := jwt.Parse(queryToken, func(t *jwt.Token) (interface{}, error) {
-			return []byte(secretKey), nil
-		})
+		if principal.ID != user.ID {
+			util.SendError(w, apierror.New(apierror.PermissionDenied, "you can only change your own user object"))
+			return
+		}
+
+		if err := user.Validate(); err == nil {
+
+			oldEmail, _, err := db.GetEmailVerification(r.Context(), connection, user.ID)
+			if err != nil {
+				util.SendError(w, err)
+				return
+			}
+
+			if _, err := db.UpdateUser(r.Context(), connection, user); err != nil {
+				util.SendError(w, err)
+				return
+			}
+
+			if user.Email != oldEmail {
+				if err := sendVerification(r.Context(), connection, cnf, mailer, *user); err != nil {
+					util.Log(r.Context()).Errorf("Can not send the verification mail of user %v: %v", user.ID, err)
+				}
+			}
+
+			util.SendOK(w, user)
+
+		} else {
+			util.SendError(w, err)
+		}
+	})
+}
+
+// ChangePasswordHandler changes the password of the user in the request context. The request has to contain the old
+// password as well. The user is logged out everywhere, this client included, and logs in again with the new password.
+func ChangePasswordHandler(connection *sql.DB, clients *ipc.Clients) negroni.HandlerFunc {
+	return negroni.HandlerFunc(func(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+		principal, ok := middleware.UserFromContext(r.Context())
+		if !ok {
+			util.SendError(w, middleware.ErrTokenMandatory)
+			return
+		}
+
+		change := &models.PasswordChange{}
+		if err := util.RequestToJSON(r, change); err != nil {
+			util.SendBadRequest(w, errors.New("bad json"))
+			return
+		}
+		if err := change.Validate(); err != nil {
+			util.SendError(w, err)
+			return
+		}
+
+		oldHash, err := db.GetPasswordHash(r.Context(), connection, principal.ID)
 		if err != nil {
-			util.SendBadRequest(w, err)
+			util.SendError(w, err)
+			return
+		}
+		if bcrypt.CompareHashAndPassword([]byte(oldHash), []byte(change.OldPassword)) != nil {
+			util.SendError(w, ErrWrongPassword)
 			return
 		}
 
-		claims := tok.Claims.(jwt.MapClaims)
-		var ID = claims["sub"].(float64) // gets the ID
+		hash, err := hashPassword(change.NewPassword)
+		if err != nil {
+			util.SendError(w, err)
+			return
+		}
 
-		if int(ID) != user.ID {
-			util.SendBadRequest(w, errors.New("you can only change your own user object"))
+		// Whoever else knew the old password is logged out first, the password stays the same when that fails
+		if err := clients.Authentication.RevokeSessions(r.Context(), principal.ID); err != nil {
+			util.SendError(w, err)
+			return
+		}
+		if err := db.UpdatePassword(r.Context(), connection, principal.ID, hash); err != nil {
+			util.SendError(w, err)
 			return
 		}
+		util.SendOKMessage(w, "Password is changed, please log in again")
+	})
+}
 
-		if err := user.Validate(); err == nil {
+// ForgotPasswordHandler mails a link with a single use reset token to the user with the email address in the request.
+// The link is mailed in the background and the answer is always the same, so neither the answer nor the time it
+// takes tells who has an account.
+func ForgotPasswordHandler(connection *sql.DB, cnf config.Config, mailer mail.Mailer) negroni.HandlerFunc {
+	return negroni.HandlerFunc(func(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+		forgot := &models.PasswordForgot{}
+		if err := util.RequestToJSON(r, forgot); err != nil {
+			util.SendBadRequest(w, errors.New("bad json"))
+			return
+		}
+		if len(forgot.Email) < 1 {
+			util.SendError(w, models.ErrEmailTooShort)
+			return
+		}
 
-			db.UpdateUser(connection, user)
+		// The mail outlives the request, but keeps its request ID for the log
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(r.Context()), mailTimeout)
+		mailing.Add(1)
+		go func() {
+			defer mailing.Done()
+			defer cancel()
+			if err := sendResetLink(ctx, connection, cnf, mailer, forgot.Email); err != nil {
+				util.Log(ctx).Errorf("Can not send a reset link: %v", err)
+			}
+		}()
+		util.SendOKMessage(w, resetLinkSent)
+	})
+}
 
-			util.SendOK(w, user)
+// sendResetLink mails a reset link to the user with email, when there is one.
+func sendResetLink(ctx context.Context, connection *sql.DB, cnf config.Config, mailer mail.Mailer, email string) error {
+	user, err := db.GetUserByEmail(ctx, connection, email)
+	if err == db.ErrUserNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
 
-		} else {
-			util.SendBadRequest(w, err)
+	token, tokenHash, err := newToken()
+	if err != nil {
+		return err
+	}
+	expiresAt := time.Now().Add(cnf.PasswordResetLifetime)
+	if err := db.CreatePasswordReset(ctx, connection, user.ID, tokenHash, expiresAt); err != nil {
+		return err
+	}
+
+	return mailer.Send(ctx, mail.Message{
+		To:      user.Email,
+		Subject: "Reset your password",
+		Body: fmt.Sprintf("Hi %v,\n\nSomeone asked to reset the password of your account. Follow this link to choose a new one:\n\n%v\n\nThe link works once, until %v. If you didn't ask for it, ignore this mail and your password stays the same.\n",
+			user.Username, tokenLink(cnf.PasswordResetURL, token), expiresAt.UTC().Format(time.RFC1123)),
+	})
+}
+
+// WaitForMail blocks until the reset links which are mailed in the background are sent, so the service doesn't
+// drop them when it stops.
+func WaitForMail() {
+	mailing.Wait()
+}
+
+// ResetPasswordHandler sets a new password with a reset token from ForgotPasswordHandler. The user is logged out
+// everywhere before the new password is stored, the token can be used again when that fails.
+func ResetPasswordHandler(connection *sql.DB, clients *ipc.Clients) negroni.HandlerFunc {
+	return negroni.HandlerFunc(func(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+		reset := &models.PasswordReset{}
+		if err := util.RequestToJSON(r, reset); err != nil {
+			util.SendBadRequest(w, errors.New("bad json"))
+			return
+		}
+		if err := reset.Validate(); err != nil {
+			util.SendError(w, err)
+			return
+		}
+
+		hash, err := hashPassword(reset.Password)
+		if err != nil {
+			util.SendError(w, err)
+			return
+		}
+		revoke := func(userID int) error {
+			return clients.Authentication.RevokeSessions(r.Context(), userID)
+		}
+		if _, err := db.ResetPassword(r.Context(), connection, hashToken(reset.Token), hash, time.Now(), revoke); err != nil {
+			util.SendError(w, err)
+			return
+		}
+		util.SendOKMessage(w, "Password is reset")
+	})
+}
+
+// VerifyEmailHandler verifies the email address of a user with the token of the link from the verification mail.
+// The access tokens issued before still say that the address isn't verified, the client refreshes its token.
+func VerifyEmailHandler(connection *sql.DB) negroni.HandlerFunc {
+	return negroni.HandlerFunc(func(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+		verification := &models.EmailVerification{}
+		if err := util.RequestToJSON(r, verification); err != nil {
+			util.SendBadRequest(w, errors.New("bad json"))
+			return
+		}
+		if err := verification.Validate(); err != nil {
+			util.SendError(w, err)
+			return
+		}
+
+		if _, err := db.VerifyEmail(r.Context(), connection, hashToken(verification.Token), time.Now()); err != nil {
+			util.SendError(w, err)
+			return
+		}
+		util.SendOKMessage(w, "Email address is verified")
+	})
+}
+
+// ResendVerificationHandler sends the user in the request context another verification mail.
+func ResendVerificationHandler(connection *sql.DB, cnf config.Config, mailer mail.Mailer) negroni.HandlerFunc {
+	return negroni.HandlerFunc(func(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+		principal, ok := middleware.UserFromContext(r.Context())
+		if !ok {
+			util.SendError(w, middleware.ErrTokenMandatory)
+			return
+		}
+
+		_, verified, err := db.GetEmailVerification(r.Context(), connection, principal.ID)
+		if err != nil {
+			util.SendError(w, err)
+			return
+		}
+		if verified {
+			util.SendError(w, ErrEmailAlreadyVerified)
+			return
+		}
+
+		user, err := db.GetUserByID(r.Context(), connection, principal.ID)
+		if err != nil {
+			util.SendError(w, err)
+			return
 		}
+		if err := sendVerification(r.Context(), connection, cnf, mailer, user); err != nil {
+			util.SendError(w, err)
+			return
+		}
+		util.SendOKMessage(w, "A verification link was sent to "+user.Email)
+	})
+}
+
+// sendVerification mails user a link with a single use token which verifies their email address.
+func sendVerification(ctx context.Context, connection *sql.DB, cnf config.Config, mailer mail.Mailer, user models.UserResponse) error {
+	token, tokenHash, err := newToken()
+	if err != nil {
+		return err
+	}
+	expiresAt := time.Now().Add(cnf.EmailVerificationLifetime)
+	if err := db.CreateEmailVerification(ctx, connection, user.ID, user.Email, tokenHash, expiresAt); err != nil {
+		return err
+	}
+
+	return mailer.Send(ctx, mail.Message{
+		To:      user.Email,
+		Subject: "Verify your email address",
+		Body: fmt.Sprintf("Hi %v,\n\nFollow this link to verify that %v is your email address:\n\n%v\n\nThe link works once, until %v. If you didn't create an account, ignore this mail.\n",
+			user.Username, user.Email, tokenLink(cnf.EmailVerificationURL, token), expiresAt.UTC().Format(time.RFC1123)),
 	})
 }
 
+// resetLinkSent is the answer to every request for a reset link.
+const resetLinkSent = "If the email address belongs to an account, a reset link was sent to it"
+
+// mailTimeout is how long a reset link which is mailed in the background may take.
+const mailTimeout = time.Minute
+
+// mailing counts the reset links which are mailed in the background.
+var mailing sync.WaitGroup
+
+// hashPassword returns the bcrypt hash of password.
+func hashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), 10)
+	return string(hash), err
+}
+
+// newToken returns a random token for a reset or verification link and its hash. Only the hash is stored.
+func newToken() (string, string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+	return token, hashToken(token), nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// tokenLink returns the link to the page on base which takes token.
+func tokenLink(base string, token string) string {
+	separator := "?"
+	if strings.Contains(base, "?") {
+		separator = "&"
+	}
+	return base + separator + "token=" + url.QueryEscape(token)
+}
+
 // UserByIndexHandler retrieves an user from the database based on its id. This handler expects the id being passed in the route variable in the current request.
 func UserByIndexHandler(connection *sql.DB) negroni.HandlerFunc {
 	return negroni.HandlerFunc(func(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
@@ -197,10 +432,10 @@ func UserByIndexHandler(connection *sql.DB) negroni.HandlerFunc {
 			return
 		}
 
-		user, err := db.GetUserByID(connection, id)
+		user, err := db.GetUserByID(r.Context(), connection, id)
 
 		if err != nil {
-			util.SendBadRequest(w, err)
+			util.SendError(w, err)
 			return
 		}
 		util.SendOK(w, user)
@@ -213,36 +448,67 @@ func GetUsernamesHandler(connection *sql.DB) negroni.HandlerFunc {
 		result, err := bodyToArrayWithIDs(r)
 
 		if err != nil {
-			util.SendError(w, err)
+			util.SendBadRequest(w, err)
 			return
 		}
 
-		users, err := db.GetUsernames(connection, result)
+		users, err := db.GetUsernames(r.Context(), connection, result)
 		if err != nil {
 			util.SendError(w, err)
 			return
 		}
 
-		type Resp struct {
-			Usernames []*sharedModels.GetUsernamesResponse `json:"usernames"`
-		}
 		log.Printf("Nr of usernames returned %v.", len(users))
-		util.SendOK(w, &Resp{Usernames: users})
+		ipc.SendResults(w, users)
+	})
+}
+
+// CreateExternalUserHandler is a handler which creates the users who sign in with an external identity provider for
+// the authentication service. The users have no password and a verified email address. A taken email address is
+// left out of the answer, a taken username gets a number appended. The request expects a json object in the
+// following format: {"requests":[{"username":"jane","email":"jane@example.com"}]}.
+func CreateExternalUserHandler(connection *sql.DB) negroni.HandlerFunc {
+	return negroni.HandlerFunc(func(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+		requests := make([]*sharedModels.CreateUserRequest, 0)
+		if err := ipc.ReadRequests(r, &requests); err != nil {
+			util.SendBadRequest(w, err)
+			return
+		}
+
+		users := make([]*sharedModels.CreateUserResponse, 0, len(requests))
+		for _, request := range requests {
+			user := &models.UserCreate{Username: request.Username, Email: request.Email}
+			if err := user.Validate(); err != nil {
+				util.SendError(w, err)
+				return
+			}
+
+			id, username, err := db.CreateExternalUser(r.Context(), connection, user.Username, user.Email)
+			if err == db.ErrEmailIsNotUnique {
+				continue
+			}
+			if err != nil {
+				util.SendError(w, err)
+				return
+			}
+			users = append(users, &sharedModels.CreateUserResponse{ID: id, Username: username, Email: user.Email})
+		}
+		ipc.SendResults(w, users)
 	})
 }
 
 // Converts a json object to a list of ID's. Expects JSON to be in the following format: {"requests":[{"id":1},{"id":2},{"id":3},{"id":4} ]}
 func bodyToArrayWithIDs(req *http.Request) ([]*sharedModels.GetUsernamesRequest, error) {
-	type Collection struct {
-		Objects []*sharedModels.GetUsernamesRequest `json:"requests"`
-	}
-	col := &Collection{}
-	col.Objects = make([]*sharedModels.GetUsernamesRequest, 0)
-
-	err := util.RequestToJSON(req, &col)
+	identifiers := make([]*sharedModels.GetUsernamesRequest, 0)
+	err := ipc.ReadRequests(req, &identifiers)
 	if err != nil {
-		log.Fatal(err)
 		return nil, err
 	}
-	return col.Objects, nil
+	return identifiers, nil
 }
+
+// ErrWrongPassword error if the old password of a password change is wrong
+var ErrWrongPassword = apierror.New(apierror.PermissionDenied, "Old password is wrong")
+
+// ErrEmailAlreadyVerified error if a user who verified their email address asks for another verification mail
+var ErrEmailAlreadyVerified = apierror.New(apierror.Conflict, "Email address is already verified")
@@ -15,14 +15,20 @@ import (
 
 	"github.com/bstaijen/mariadb-for-microservices/profile-service/app/models"
 	"github.com/bstaijen/mariadb-for-microservices/profile-service/config"
+	"github.com/bstaijen/mariadb-for-microservices/shared/ipc"
+	"github.com/bstaijen/mariadb-for-microservices/shared/mail"
 	sharedModels "github.com/bstaijen/mariadb-for-microservices/shared/models"
-	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/bstaijen/mariadb-for-microservices/shared/util/middleware"
 	"github.com/gorilla/mux"
 	"github.com/urfave/negroni"
+	"golang.org/x/crypto/bcrypt"
 
 	sqlmock "gopkg.in/DATA-DOG/go-sqlmock.v1"
 )
 
+// testMailer keeps the mails the handlers send.
+var testMailer = &mail.FakeMailer{}
+
 type TestHash struct{}
 
 func (a TestHash) Match(v driver.Value) bool {
@@ -33,7 +39,6 @@ func (a TestHash) Match(v driver.Value) bool {
 // Test creating an user.
 func TestCreateUser(t *testing.T) {
 	cnf := config.Config{}
-	cnf.SecretKey = "ABCDEF"
 
 	user := &models.UserCreate{}
 	user.ID = 1
@@ -73,7 +78,11 @@ func TestCreateUser(t *testing.T) {
 	selectByIDRows := sqlmock.NewRows([]string{"id", "username", "createdAt", "email"}).AddRow(user.ID, user.Username, timeNow, user.Email)
 	mock.ExpectQuery("SELECT (.+) FROM users WHERE").WithArgs(user.ID).WillReturnRows(selectByIDRows)
 
-	handler := CreateUserHandler(db, cnf)
+	// Expectation: store the verification token
+	mock.ExpectExec("INSERT INTO email_verifications").WithArgs(user.ID, user.Email, sqlmock.AnyArg(), sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(1, 1))
+
+	sent := len(testMailer.Messages())
+	handler := CreateUserHandler(db, cnf, testMailer)
 	handler(res, req, nil)
 
 	// Make sure expectations are met
@@ -81,27 +90,26 @@ func TestCreateUser(t *testing.T) {
 		t.Errorf("there were unfulfilled expectations: %s", err)
 	}
 
-	// Make sure response is alright
-	type Token struct {
-		Token     string              `json:"token"`
-		ExpiresOn string              `json:"expires_on"`
-		User      models.UserResponse `json:"user"`
+	// Make sure the verification mail is sent
+	if messages := testMailer.Messages(); len(messages) != sent+1 || messages[sent].To != user.Email {
+		t.Errorf("Expected a verification mail to %v but got %v", user.Email, messages[sent:])
 	}
 
-	response := &Token{}
+	// Make sure response is alright
+	response := &models.UserResponse{}
 	err = decodeJSON(res.Body, response)
 	if err != nil {
 		t.Fatal(errors.New("Bad json"))
 	}
-	if response.User.ID < 1 {
-		t.Errorf("Expected user ID greater than 0 but got %v", response.User.ID)
+	if response.ID < 1 {
+		t.Errorf("Expected user ID greater than 0 but got %v", response.ID)
 	}
 
-	if response.User.Username != user.Username {
-		t.Errorf("Expected username to be %v but got %v", user.Username, response.User.Username)
+	if response.Username != user.Username {
+		t.Errorf("Expected username to be %v but got %v", user.Username, response.Username)
 	}
-	if response.User.Email != user.Email {
-		t.Errorf("Expected username to be %v but got %v", user.Email, response.User.Email)
+	if response.Email != user.Email {
+		t.Errorf("Expected username to be %v but got %v", user.Email, response.Email)
 	}
 
 	if res.Result().StatusCode != 200 {
@@ -112,7 +120,6 @@ func TestCreateUser(t *testing.T) {
 // Test creating an user when a bad json string is provided. We expect an error message.
 func TestBadJson(t *testing.T) {
 	cnf := config.Config{}
-	cnf.SecretKey = "ABCDEF"
 
 	db, _, err := sqlmock.New()
 	if err != nil {
@@ -126,11 +133,11 @@ func TestBadJson(t *testing.T) {
 	}
 
 	res := httptest.NewRecorder()
-	handler := CreateUserHandler(db, cnf)
+	handler := CreateUserHandler(db, cnf, testMailer)
 	handler(res, req, nil)
 
 	actual := res.Body.String()
-	expected := "{\"message\":\"Bad json\"}"
+	expected := "{\"type\":\"about:blank\",\"title\":\"Bad Request\",\"status\":400,\"detail\":\"Bad json\",\"code\":\"invalid_argument\"}"
 	if expected != actual {
 		t.Fatalf("Expected %s got %s", expected, actual)
 	}
@@ -139,7 +146,6 @@ func TestBadJson(t *testing.T) {
 // Test creating a user without providing a username. We expect an error message.
 func TestCreateUserWithoutUsername(t *testing.T) {
 	cnf := config.Config{}
-	cnf.SecretKey = "ABCDEF"
 
 	user := &models.UserCreate{}
 
@@ -158,11 +164,11 @@ func TestCreateUserWithoutUsername(t *testing.T) {
 	}
 	defer db.Close()
 
-	handler := CreateUserHandler(db, cnf)
+	handler := CreateUserHandler(db, cnf, testMailer)
 	handler(res, req, nil)
 
 	actual := res.Body.String()
-	expected := "{\"message\":\"Username is too short\"}"
+	expected := "{\"type\":\"about:blank\",\"title\":\"Unprocessable Entity\",\"status\":422,\"detail\":\"Username is too short\",\"code\":\"validation_failed\"}"
 	if expected != actual {
 		t.Fatalf("Expected %s got %s", expected, actual)
 	}
@@ -171,7 +177,6 @@ func TestCreateUserWithoutUsername(t *testing.T) {
 // Test creating an user without providing a password. We expect an error message.
 func TestCreateUserWithoutPassword(t *testing.T) {
 	cnf := config.Config{}
-	cnf.SecretKey = "ABCDEF"
 
 	user := &models.UserCreate{}
 	user.Email = "test@example.com"
@@ -192,11 +197,11 @@ func TestCreateUserWithoutPassword(t *testing.T) {
 	}
 	defer db.Close()
 
-	handler := CreateUserHandler(db, cnf)
+	handler := CreateUserHandler(db, cnf, testMailer)
 	handler(res, req, nil)
 
 	actual := res.Body.String()
-	expected := "{\"message\":\"Password is to short\"}"
+	expected := "{\"type\":\"about:blank\",\"title\":\"Unprocessable Entity\",\"status\":422,\"detail\":\"Password is to short\",\"code\":\"validation_failed\"}"
 	if expected != actual {
 		t.Fatalf("Expected %s got %s", expected, actual)
 	}
@@ -205,7 +210,6 @@ func TestCreateUserWithoutPassword(t *testing.T) {
 // Test creating an user without providing an email address. We expect an error message.
 func TestCreateUserWithoutEmail(t *testing.T) {
 	cnf := config.Config{}
-	cnf.SecretKey = "ABCDEF"
 
 	user := &models.UserCreate{}
 	user.Username = "username"
@@ -225,11 +229,11 @@ func TestCreateUserWithoutEmail(t *testing.T) {
 	}
 	defer db.Close()
 
-	handler := CreateUserHandler(db, cnf)
+	handler := CreateUserHandler(db, cnf, testMailer)
 	handler(res, req, nil)
 
 	actual := res.Body.String()
-	expected := "{\"message\":\"Email address is to short\"}"
+	expected := "{\"type\":\"about:blank\",\"title\":\"Unprocessable Entity\",\"status\":422,\"detail\":\"Email address is to short\",\"code\":\"validation_failed\"}"
 	if expected != actual {
 		t.Fatalf("Expected %s got %s", expected, actual)
 	}
@@ -248,7 +252,6 @@ func decodeJSON(r io.Reader, target interface{}) error {
 // Test deleting an user.
 func TestDeleteUser(t *testing.T) {
 	cnf := config.Config{}
-	cnf.SecretKey = "ABCDEF"
 
 	user := &models.UserCreate{}
 	user.ID = 1
@@ -256,23 +259,8 @@ func TestDeleteUser(t *testing.T) {
 	user.Password = "password"
 	user.Username = "username"
 
-	// Create JWT object with claims
-	expiration := time.Now().Add(time.Hour * 24 * 31).Unix()
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-		"sub": user.ID,
-		"iat": time.Now().Unix(),
-		"exp": expiration,
-	})
-
-	// Generate a signed token
-	secretKey := cnf.SecretKey
-	tokenString, err := token.SignedString([]byte(secretKey))
-	if err != nil {
-		t.Error(err)
-		return
-	}
 	json, _ := json.Marshal(user)
-	req, err := http.NewRequest("DELETE", "http://localhost/users?token="+tokenString, bytes.NewBuffer(json))
+	req, err := http.NewRequest("DELETE", "http://localhost/users", bytes.NewBuffer(json))
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -287,7 +275,9 @@ func TestDeleteUser(t *testing.T) {
 
 	mock.ExpectExec("DELETE from users WHERE").WithArgs(user.ID).WillReturnResult(sqlmock.NewResult(0, 1))
 
-	handler := DeleteUserHandler(db, cnf)
+	authentication := &ipc.FakeAuthenticationClient{}
+	req = req.WithContext(middleware.WithUser(req.Context(), &middleware.Principal{ID: user.ID}))
+	handler := DeleteUserHandler(db, cnf, &ipc.Clients{Authentication: authentication})
 	handler(res, req, nil)
 
 	// Make sure expectations are met
@@ -297,18 +287,49 @@ func TestDeleteUser(t *testing.T) {
 	if res.Result().StatusCode != 200 {
 		t.Errorf("Expected statuscode to be 200 but got %v", res.Result().StatusCode)
 	}
+
+	// Make sure the deleted user is logged out everywhere
+	if len(authentication.RevokedUsers) != 1 || authentication.RevokedUsers[0] != user.ID {
+		t.Errorf("Expected %v but got %v", []int{user.ID}, authentication.RevokedUsers)
+	}
+}
+
+// Test if the user isn't deleted when the sessions can't be revoked.
+func TestDeleteUserRevokeFails(t *testing.T) {
+	user := getTestUser()
+	json, _ := json.Marshal(user)
+	req, err := http.NewRequest(http.MethodDelete, "http://localhost/users", bytes.NewBuffer(json))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := httptest.NewRecorder()
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	authentication := &ipc.FakeAuthenticationClient{Err: errors.New("authentication service is down")}
+	req = req.WithContext(middleware.WithUser(req.Context(), &middleware.Principal{ID: user.ID}))
+	handler := DeleteUserHandler(db, config.Config{}, &ipc.Clients{Authentication: authentication})
+	handler(res, req, nil)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+	if res.Result().StatusCode == http.StatusOK {
+		t.Errorf("Expected an error but got %v", res.Result().StatusCode)
+	}
 }
 
 // Test updating an user.
 func TestUpdateUser(t *testing.T) {
 	cnf := config.Config{}
-	cnf.SecretKey = "ABCDEF"
 
 	user := getTestUser()
-	tokenString := getTokenString(cnf, user, t)
-
 	json, _ := json.Marshal(user)
-	req, err := http.NewRequest("PUT", "http://localhost/users?token="+tokenString, bytes.NewBuffer(json))
+	req, err := http.NewRequest("PUT", "http://localhost/users", bytes.NewBuffer(json))
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -321,9 +342,11 @@ func TestUpdateUser(t *testing.T) {
 	}
 	defer db.Close()
 
-	mock.ExpectExec("UPDATE users SET").WithArgs(user.Username, user.Email, user.ID).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery("SELECT email, verified FROM users").WithArgs(user.ID).WillReturnRows(sqlmock.NewRows([]string{"email", "verified"}).AddRow(user.Email, true))
+	mock.ExpectExec("UPDATE users SET").WithArgs(user.Email, user.Username, user.Email, user.ID).WillReturnResult(sqlmock.NewResult(0, 1))
 
-	handler := UpdateUserHandler(db, cnf)
+	req = req.WithContext(middleware.WithUser(req.Context(), &middleware.Principal{ID: user.ID}))
+	handler := UpdateUserHandler(db, cnf, testMailer)
 	handler(res, req, nil)
 
 	// Make sure expectations are met
@@ -335,6 +358,206 @@ func TestUpdateUser(t *testing.T) {
 	}
 }
 
+// Test if a password change logs the user out everywhere.
+func TestChangePassword(t *testing.T) {
+	user := getTestUser()
+	req, err := http.NewRequest("PUT", "http://localhost/users/password", bytes.NewBufferString(`{"old_password":"password","new_password":"new password"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := httptest.NewRecorder()
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	oldHash, _ := bcrypt.GenerateFromPassword([]byte("password"), bcrypt.MinCost)
+	mock.ExpectQuery("SELECT password FROM users").WithArgs(user.ID).WillReturnRows(sqlmock.NewRows([]string{"password"}).AddRow(string(oldHash)))
+	mock.ExpectBegin()
+	mock.ExpectExec("UPDATE users SET password").WithArgs(TestHash{}, user.ID).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("UPDATE password_resets SET usedAt").WithArgs(user.ID).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectCommit()
+
+	authentication := &ipc.FakeAuthenticationClient{}
+	req = req.WithContext(middleware.WithUser(req.Context(), &middleware.Principal{ID: user.ID}))
+	handler := ChangePasswordHandler(db, &ipc.Clients{Authentication: authentication})
+	handler(res, req, nil)
+
+	if res.Result().StatusCode != http.StatusOK {
+		t.Fatalf("Expected %v but got %v: %v", http.StatusOK, res.Result().StatusCode, res.Body.String())
+	}
+	if len(authentication.RevokedUsers) != 1 || authentication.RevokedUsers[0] != user.ID {
+		t.Errorf("Expected %v but got %v", []int{user.ID}, authentication.RevokedUsers)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+// Test if the password stays the same when the user can't be logged out everywhere.
+func TestChangePasswordRevokeFails(t *testing.T) {
+	user := getTestUser()
+	req, err := http.NewRequest("PUT", "http://localhost/users/password", bytes.NewBufferString(`{"old_password":"password","new_password":"new password"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := httptest.NewRecorder()
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	oldHash, _ := bcrypt.GenerateFromPassword([]byte("password"), bcrypt.MinCost)
+	mock.ExpectQuery("SELECT password FROM users").WithArgs(user.ID).WillReturnRows(sqlmock.NewRows([]string{"password"}).AddRow(string(oldHash)))
+
+	authentication := &ipc.FakeAuthenticationClient{Err: errors.New("authentication service is down")}
+	req = req.WithContext(middleware.WithUser(req.Context(), &middleware.Principal{ID: user.ID}))
+	handler := ChangePasswordHandler(db, &ipc.Clients{Authentication: authentication})
+	handler(res, req, nil)
+
+	if res.Result().StatusCode == http.StatusOK {
+		t.Errorf("Expected an error but got %v", res.Result().StatusCode)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+// Test if the reset token isn't used up when the user can't be logged out everywhere.
+func TestResetPasswordRevokeFails(t *testing.T) {
+	user := getTestUser()
+	req, err := http.NewRequest("POST", "http://localhost/users/password/reset", bytes.NewBufferString(`{"token":"token","password":"new password"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := httptest.NewRecorder()
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT user_id FROM password_resets").WithArgs(hashToken("token"), sqlmock.AnyArg()).WillReturnRows(sqlmock.NewRows([]string{"user_id"}).AddRow(user.ID))
+	mock.ExpectExec("UPDATE users SET password").WithArgs(sqlmock.AnyArg(), user.ID).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("UPDATE password_resets SET usedAt").WithArgs(sqlmock.AnyArg(), user.ID).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectRollback()
+
+	authentication := &ipc.FakeAuthenticationClient{Err: errors.New("authentication service is down")}
+	handler := ResetPasswordHandler(db, &ipc.Clients{Authentication: authentication})
+	handler(res, req, nil)
+
+	if res.Result().StatusCode == http.StatusOK {
+		t.Errorf("Expected an error but got %v", res.Result().StatusCode)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+// Test if a used or expired reset token is refused and nobody is logged out.
+func TestResetPasswordInvalidToken(t *testing.T) {
+	req, err := http.NewRequest("POST", "http://localhost/users/password/reset", bytes.NewBufferString(`{"token":"used","password":"new password"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := httptest.NewRecorder()
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT user_id FROM password_resets").WithArgs(hashToken("used"), sqlmock.AnyArg()).WillReturnRows(sqlmock.NewRows([]string{"user_id"}))
+	mock.ExpectRollback()
+
+	authentication := &ipc.FakeAuthenticationClient{}
+	handler := ResetPasswordHandler(db, &ipc.Clients{Authentication: authentication})
+	handler(res, req, nil)
+
+	if res.Result().StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected %v but got %v", http.StatusBadRequest, res.Result().StatusCode)
+	}
+	if len(authentication.RevokedUsers) != 0 {
+		t.Errorf("Expected nobody to be logged out but got %v", authentication.RevokedUsers)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+// Test if a new email address has to be verified.
+func TestUpdateUserNewEmail(t *testing.T) {
+	user := getTestUser()
+	user.Email = "new@example.com"
+	json, _ := json.Marshal(user)
+	req, err := http.NewRequest("PUT", "http://localhost/users", bytes.NewBuffer(json))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := httptest.NewRecorder()
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	mock.ExpectQuery("SELECT email, verified FROM users").WithArgs(user.ID).WillReturnRows(sqlmock.NewRows([]string{"email", "verified"}).AddRow("old@example.com", true))
+	mock.ExpectExec("UPDATE users SET").WithArgs(user.Email, user.Username, user.Email, user.ID).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO email_verifications").WithArgs(user.ID, user.Email, sqlmock.AnyArg(), sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(1, 1))
+
+	sent := len(testMailer.Messages())
+	req = req.WithContext(middleware.WithUser(req.Context(), &middleware.Principal{ID: user.ID}))
+	handler := UpdateUserHandler(db, config.Config{}, testMailer)
+	handler(res, req, nil)
+
+	if res.Result().StatusCode != http.StatusOK {
+		t.Fatalf("Expected %v but got %v: %v", http.StatusOK, res.Result().StatusCode, res.Body.String())
+	}
+	if messages := testMailer.Messages(); len(messages) != sent+1 || messages[sent].To != user.Email {
+		t.Errorf("Expected a verification mail to %v but got %v", user.Email, messages[sent:])
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+// Test if a verified user can't ask for another verification mail.
+func TestResendVerificationAlreadyVerified(t *testing.T) {
+	req, err := http.NewRequest("POST", "http://localhost/users/verify/resend", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := httptest.NewRecorder()
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	mock.ExpectQuery("SELECT email, verified FROM users").WithArgs(1).WillReturnRows(sqlmock.NewRows([]string{"email", "verified"}).AddRow("username@example.com", true))
+
+	req = req.WithContext(middleware.WithUser(req.Context(), &middleware.Principal{ID: 1}))
+	handler := ResendVerificationHandler(db, config.Config{}, testMailer)
+	handler(res, req, nil)
+
+	if res.Result().StatusCode != http.StatusConflict {
+		t.Errorf("Expected %v but got %v", http.StatusConflict, res.Result().StatusCode)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
 // Test converting a json string to a list with ID's
 func TestBodyToArrayWithIDs(t *testing.T) {
 	mock := []byte(`{ "requests":[{"id":1} ,{"id":2},{"id":3}, {"id":4} ]}`)
@@ -448,7 +671,7 @@ func TestGetUsernamesHandler(t *testing.T) {
 	}
 
 	// Make sure response expectations are met
-	expected := `{"usernames":[{"id":1,"username":"username1"},{"id":2,"username":"username2"}]}`
+	expected := `{"results":[{"id":1,"username":"username1"},{"id":2,"username":"username2"}]}`
 	if res.Body.String() != expected {
 		t.Errorf("handler returned unexpected body: got %v want %v",
 			res.Body.String(), expected)
@@ -463,7 +686,6 @@ func TestGetUsernamesHandler(t *testing.T) {
 // In this test we'll login as user1 and we try to change user2. This is not allowed therefore we expect an error.
 func TestTryUpdateOtherUser(t *testing.T) {
 	cnf := config.Config{}
-	cnf.SecretKey = "ABCDEF"
 
 	user1 := getTestUser()
 	user1.ID = 1
@@ -473,33 +695,31 @@ func TestTryUpdateOtherUser(t *testing.T) {
 	user2.ID = 2
 	user2.Username = "user2"
 
-	tokenString := getTokenString(cnf, user1, t)
-
 	json, _ := json.Marshal(user2)
-	req, err := http.NewRequest(http.MethodPut, "http://localhost/users?token="+tokenString, bytes.NewBuffer(json))
+	req, err := http.NewRequest(http.MethodPut, "http://localhost/users", bytes.NewBuffer(json))
 	if err != nil {
 		t.Fatal(err)
 	}
 
 	res := httptest.NewRecorder()
-	handler := UpdateUserHandler(nil, cnf)
+	req = req.WithContext(middleware.WithUser(req.Context(), &middleware.Principal{ID: user1.ID}))
+	handler := UpdateUserHandler(nil, cnf, testMailer)
 	handler(res, req, nil)
 
 	// Make sure expectations are met
-	expected := `{"message":"you can only change your own user object"}`
+	expected := `{"type":"about:blank","title":"Forbidden","status":403,"detail":"you can only change your own user object","code":"permission_denied"}`
 	if res.Body.String() != expected {
 		t.Errorf("handler returned unexpected body: got %v want %v",
 			res.Body.String(), expected)
 	}
-	if res.Result().StatusCode != 400 {
-		t.Errorf("Expected statuscode to be 400 but got %v", res.Result().StatusCode)
+	if res.Result().StatusCode != 403 {
+		t.Errorf("Expected statuscode to be 403 but got %v", res.Result().StatusCode)
 	}
 }
 
 // In this test we'll login as user1 and we try to delete user2. This is not allowed therefore we expect an error.
 func TestTryDeleteOtherUser(t *testing.T) {
 	cnf := config.Config{}
-	cnf.SecretKey = "ABCDEF"
 
 	user1 := getTestUser()
 	user1.ID = 1
@@ -509,26 +729,25 @@ func TestTryDeleteOtherUser(t *testing.T) {
 	user2.ID = 2
 	user2.Username = "user2"
 
-	tokenString := getTokenString(cnf, user1, t)
-
 	json, _ := json.Marshal(user2)
-	req, err := http.NewRequest(http.MethodDelete, "http://localhost/users?token="+tokenString, bytes.NewBuffer(json))
+	req, err := http.NewRequest(http.MethodDelete, "http://localhost/users", bytes.NewBuffer(json))
 	if err != nil {
 		t.Fatal(err)
 	}
 
 	res := httptest.NewRecorder()
-	handler := UpdateUserHandler(nil, cnf)
+	req = req.WithContext(middleware.WithUser(req.Context(), &middleware.Principal{ID: user1.ID}))
+	handler := UpdateUserHandler(nil, cnf, testMailer)
 	handler(res, req, nil)
 
 	// Make sure expectations are met
-	expected := `{"message":"you can only change your own user object"}`
+	expected := `{"type":"about:blank","title":"Forbidden","status":403,"detail":"you can only change your own user object","code":"permission_denied"}`
 	if res.Body.String() != expected {
 		t.Errorf("handler returned unexpected body: got %v want %v",
 			res.Body.String(), expected)
 	}
-	if res.Result().StatusCode != 400 {
-		t.Errorf("Expected statuscode to be 400 but got %v", res.Result().StatusCode)
+	if res.Result().StatusCode != 403 {
+		t.Errorf("Expected statuscode to be 403 but got %v", res.Result().StatusCode)
 	}
 }
 
@@ -542,21 +761,3 @@ func getTestUser() *models.UserCreate {
 	user.Hash = "TempFakeHash"
 	return user
 }
-
-func getTokenString(cnf config.Config, user *models.UserCreate, t *testing.T) string {
-	expiration := time.Now().Add(time.Hour * 24 * 31).Unix()
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-		"sub": user.ID,
-		"iat": time.Now().Unix(),
-		"exp": expiration,
-	})
-
-	// Generate a signed token
-	secretKey := cnf.SecretKey
-	tokenString, err := token.SignedString([]byte(secretKey))
-	if err != nil {
-		t.Error(err)
-		return ""
-	}
-	return tokenString
-}
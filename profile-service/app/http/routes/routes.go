@@ -2,58 +2,109 @@ package routes
 
 import (
 	"database/sql"
+	"time"
 
 	"github.com/bstaijen/mariadb-for-microservices/profile-service/app/http/controllers"
 	"github.com/bstaijen/mariadb-for-microservices/profile-service/config"
+	"github.com/bstaijen/mariadb-for-microservices/shared/health"
+	"github.com/bstaijen/mariadb-for-microservices/shared/ipc"
+	"github.com/bstaijen/mariadb-for-microservices/shared/jwks"
+	"github.com/bstaijen/mariadb-for-microservices/shared/mail"
+	"github.com/bstaijen/mariadb-for-microservices/shared/ratelimit"
 	"github.com/bstaijen/mariadb-for-microservices/shared/util/middleware"
 
 	"github.com/gorilla/mux"
 	"github.com/urfave/negroni"
 )
 
-// InitRoutes initializes the REST and IPC routes for this service.
-func InitRoutes(db *sql.DB, cnf config.Config) *mux.Router {
+// passwordPolicy limits the password changes and resets of a client, so old passwords and reset tokens can't be
+// guessed.
+var passwordPolicy = ratelimit.Policy{Name: "password", Limit: 10, Period: time.Minute}
+
+// forgotPasswordPolicy limits the reset links a client can have mailed, which is keyed by its IP address.
+var forgotPasswordPolicy = ratelimit.Policy{Name: "forgot-password", Limit: 5, Period: time.Hour}
+
+// verifyPolicy limits the email verifications of a client.
+var verifyPolicy = ratelimit.Policy{Name: "verify", Limit: 10, Period: time.Minute}
+
+// verificationMailPolicy limits the verification mails a user can ask for.
+var verificationMailPolicy = ratelimit.Policy{Name: "verification-mail", Limit: 5, Period: time.Hour}
+
+// InitRoutes initializes the REST and IPC routes for this service. IPCKeys sign and verify the IPC calls and mailer
+// sends the password reset and email verification links.
+func InitRoutes(db *sql.DB, cnf config.Config, ipcKeys *ipc.Keys, mailer mail.Mailer) *mux.Router {
+	revocations := ipc.NewRevocations(cnf.AuthenticationServiceBaseurl, ipcKeys.Identity, middleware.DefaultRevocationTTL)
+	keys := jwks.NewRemote(cnf.AuthenticationServiceBaseurl, 0)
+	clients := &ipc.Clients{
+		Authentication: ipc.NewAuthenticationClient(cnf.AuthenticationServiceBaseurl, ipcKeys.Identity),
+	}
+
 	router := mux.NewRouter()
-	router = setRESTRoutes(db, cnf, router)
-	router = setIPCRoutes(db, cnf, router)
+	router = setHealthRoutes(db, cnf, router)
+	router = setRESTRoutes(db, cnf, keys, revocations, clients, mailer, router)
+	router = setIPCRoutes(db, cnf, ipcKeys.Callers, router)
 	return router
 }
 
-func setRESTRoutes(db *sql.DB, cnf config.Config, router *mux.Router) *mux.Router {
+func setRESTRoutes(db *sql.DB, cnf config.Config, keys jwks.KeySet, revocations middleware.Revocations, clients *ipc.Clients, mailer mail.Mailer, router *mux.Router) *mux.Router {
 
 	// Subrouter /users
 	users := router.PathPrefix("/users").Subrouter()
 
-	// TODO :  https://github.com/gorilla/handlers/blob/master/cors.go#L140
-	users.Methods("OPTIONS").Handler(negroni.New(
-		negroni.HandlerFunc(middleware.AcceptOPTIONS),
+	// Change the password PUT /users/password. It, the other password routes and the verification routes are
+	// registered before the user routes, which match every path below /users
+	users.Path("/password").Methods("PUT").Handler(negroni.New(
+		middleware.RequireTokenAuthenticationHandler(keys, revocations),
+		ratelimit.Middleware(ratelimit.NewMemoryStore(), passwordPolicy),
+		controllers.ChangePasswordHandler(db, clients),
+	))
+
+	// Mail a reset link POST /users/password/forgot
+	users.Path("/password/forgot").Methods("POST").Handler(negroni.New(
+		ratelimit.Middleware(ratelimit.NewMemoryStore(), forgotPasswordPolicy),
+		controllers.ForgotPasswordHandler(db, cnf, mailer),
+	))
+
+	// Set a new password with the token of a reset link POST /users/password/reset
+	users.Path("/password/reset").Methods("POST").Handler(negroni.New(
+		ratelimit.Middleware(ratelimit.NewMemoryStore(), passwordPolicy),
+		controllers.ResetPasswordHandler(db, clients),
+	))
+
+	// Verify the email address with the token of a verification link POST /users/verify
+	users.Path("/verify").Methods("POST").Handler(negroni.New(
+		ratelimit.Middleware(ratelimit.NewMemoryStore(), verifyPolicy),
+		controllers.VerifyEmailHandler(db),
+	))
+
+	// Send another verification link POST /users/verify/resend
+	users.Path("/verify/resend").Methods("POST").Handler(negroni.New(
+		middleware.RequireTokenAuthenticationHandler(keys, revocations),
+		ratelimit.Middleware(ratelimit.NewMemoryStore(), verificationMailPolicy),
+		controllers.ResendVerificationHandler(db, cnf, mailer),
 	))
 
 	// Update user /users
 	users.Methods("PUT").Handler(negroni.New(
-		negroni.HandlerFunc(middleware.AccessControlHandler),
-		middleware.RequireTokenAuthenticationHandler(cnf.SecretKey),
-		controllers.UpdateUserHandler(db, cnf),
+		middleware.RequireTokenAuthenticationHandler(keys, revocations),
+		controllers.UpdateUserHandler(db, cnf, mailer),
 	))
 
 	// Delete User /users
 	users.Methods("DELETE").Handler(negroni.New(
-		negroni.HandlerFunc(middleware.AccessControlHandler),
-		middleware.RequireTokenAuthenticationHandler(cnf.SecretKey),
-		controllers.DeleteUserHandler(db, cnf),
+		middleware.RequireTokenAuthenticationHandler(keys, revocations),
+		controllers.DeleteUserHandler(db, cnf, clients),
 	))
 
 	// Create user /sers
 	users.Methods("POST").Handler(negroni.New(
-		negroni.HandlerFunc(middleware.AccessControlHandler),
-		controllers.CreateUserHandler(db, cnf),
+		controllers.CreateUserHandler(db, cnf, mailer),
 	))
 
 	// Get one user /user/{id}
 	oneUser := router.PathPrefix("/user/{id}").Subrouter()
 	oneUser.Methods("GET").Handler(negroni.New(
-		negroni.HandlerFunc(middleware.AccessControlHandler),
-		middleware.RequireTokenAuthenticationHandler(cnf.SecretKey),
+		middleware.RequireTokenAuthenticationHandler(keys, revocations),
 		controllers.UserByIndexHandler(db),
 	))
 
@@ -61,15 +112,38 @@ func setRESTRoutes(db *sql.DB, cnf config.Config, router *mux.Router) *mux.Route
 }
 
 // Inter-Process Communication routes
-func setIPCRoutes(db *sql.DB, cnf config.Config, router *mux.Router) *mux.Router {
+func setIPCRoutes(db *sql.DB, cnf config.Config, callers middleware.ServiceKeys, router *mux.Router) *mux.Router {
+
 	// IPC subrouter /ipc
-	ipc := router.PathPrefix("/ipc").Subrouter()
+	ipcRouter := router.PathPrefix("/ipc").Subrouter()
 
 	// get usernames /ipc/usernames
-	ipc.Handle("/usernames", negroni.New(
-		negroni.HandlerFunc(middleware.AccessControlHandler),
+	ipcRouter.Handle("/usernames", negroni.New(
+		middleware.RequireServiceAuthenticationHandler(callers, ipc.ProfileService, ipc.PhotoService, ipc.CommentService),
 		controllers.GetUsernamesHandler(db),
 	)).Methods("GET")
 
+	// create the users of external identity providers /ipc/createUser
+	ipcRouter.Handle("/createUser", negroni.New(
+		middleware.RequireServiceAuthenticationHandler(callers, ipc.ProfileService, ipc.AuthenticationService),
+		controllers.CreateExternalUserHandler(db),
+	)).Methods("POST")
+
+	return router
+}
+
+// setHealthRoutes specifies the liveness and readiness routes
+func setHealthRoutes(db *sql.DB, cnf config.Config, router *mux.Router) *mux.Router {
+	router.Handle("/healthz", negroni.New(
+		negroni.HandlerFunc(health.Liveness),
+	)).Methods("GET")
+
+	router.Handle("/readyz", negroni.New(
+		health.Readiness(health.DefaultTimeout,
+			health.Database(db),
+			health.Service(ipc.AuthenticationService, cnf.AuthenticationServiceBaseurl),
+		),
+	)).Methods("GET")
+
 	return router
 }
@@ -5,17 +5,27 @@ import (
 	"database/sql"
 	"database/sql/driver"
 	"encoding/json"
+	"errors"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 
 	"strconv"
 
+	"github.com/bstaijen/mariadb-for-microservices/profile-service/app/http/controllers"
 	"github.com/bstaijen/mariadb-for-microservices/profile-service/app/models"
 	"github.com/bstaijen/mariadb-for-microservices/profile-service/config"
+	"github.com/bstaijen/mariadb-for-microservices/shared/ipc"
+	"github.com/bstaijen/mariadb-for-microservices/shared/jwks"
+	"github.com/bstaijen/mariadb-for-microservices/shared/mail"
 	sharedModels "github.com/bstaijen/mariadb-for-microservices/shared/models"
+	"github.com/bstaijen/mariadb-for-microservices/shared/util"
+	"github.com/bstaijen/mariadb-for-microservices/shared/util/middleware"
 	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/urfave/negroni"
+	"golang.org/x/crypto/bcrypt"
 	sqlmock "gopkg.in/DATA-DOG/go-sqlmock.v1"
 )
 
@@ -27,22 +37,30 @@ func (a TestHash) Match(v driver.Value) bool {
 }
 
 func TestOPTIONSUsers(t *testing.T) {
-	// Router
-	r := InitRoutes(nil, config.Config{})
+	// Router behind the CORS middleware, like in main
+	n := negroni.New(middleware.CORS(middleware.CORSOptions{}))
+	n.UseHandler(InitRoutes(nil, config.Config{}, ipc.FakeKeys(ipc.ProfileService), testMailer))
 	res := httptest.NewRecorder()
 
-	// Do Request
+	// Do preflight request
 	req, err := http.NewRequest(http.MethodOptions, "/users", nil)
 	if err != nil {
 		t.Fatal(err)
 	}
-	r.ServeHTTP(res, req)
+	req.Header.Set("Origin", "http://localhost:4000")
+	req.Header.Set("Access-Control-Request-Method", http.MethodPut)
+	req.Header.Set("Access-Control-Request-Headers", "token")
+	n.ServeHTTP(res, req)
 
 	// Make sure response statuscode expectation is met
-	if res.Result().StatusCode != 200 {
-		t.Errorf("Expected statuscode to be 200 but got %v", res.Result().StatusCode)
-	} else {
-		t.Logf("Result statuscode %v. (As expected)", res.Result().StatusCode)
+	if res.Result().StatusCode != http.StatusNoContent {
+		t.Errorf("Expected statuscode to be 204 but got %v", res.Result().StatusCode)
+	}
+	if !strings.Contains(res.Header().Get("Access-Control-Allow-Methods"), http.MethodPut) {
+		t.Errorf("Expected %v to be allowed but got %v", http.MethodPut, res.Header().Get("Access-Control-Allow-Methods"))
+	}
+	if !strings.Contains(res.Header().Get("Access-Control-Allow-Headers"), "token") {
+		t.Errorf("Expected the token header to be allowed but got %v", res.Header().Get("Access-Control-Allow-Headers"))
 	}
 }
 
@@ -57,14 +75,17 @@ func TestPUTUsers(t *testing.T) {
 	}
 	defer db.Close()
 
-	mock.ExpectExec("UPDATE users SET").WithArgs(user.Username, user.Email, user.ID).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery("SELECT email, verified FROM users").WithArgs(user.ID).WillReturnRows(sqlmock.NewRows([]string{"email", "verified"}).AddRow(user.Email, true))
+	mock.ExpectExec("UPDATE users SET").WithArgs(user.Email, user.Username, user.Email, user.ID).WillReturnResult(sqlmock.NewResult(0, 1))
 
 	// Mock config
 	cnf := config.Config{}
-	cnf.SecretKey = "ABC"
+	auth := authServer()
+	defer auth.Close()
+	cnf.AuthenticationServiceBaseurl = auth.URL
 
 	// Get token string
-	tokenString := getTokenString(cnf, user, t)
+	tokenString := getTokenString(user, t)
 
 	json, _ := json.Marshal(user)
 	res := doRequest(db, cnf, http.MethodPut, "/users?token="+tokenString, bytes.NewBuffer(json), t)
@@ -96,10 +117,12 @@ func TestDELETEUsers(t *testing.T) {
 
 	// Mock config
 	cnf := config.Config{}
-	cnf.SecretKey = "ABC"
+	auth := authServer()
+	defer auth.Close()
+	cnf.AuthenticationServiceBaseurl = auth.URL
 
 	// Get token string
-	tokenString := getTokenString(cnf, user, t)
+	tokenString := getTokenString(user, t)
 
 	json, _ := json.Marshal(user)
 	res := doRequest(db, cnf, http.MethodDelete, "/users?token="+tokenString, bytes.NewBuffer(json), t)
@@ -142,13 +165,16 @@ func TestPOSTUsers(t *testing.T) {
 	timeNow := time.Now().UTC()
 	selectByIDRows := sqlmock.NewRows([]string{"id", "username", "createdAt", "email"}).AddRow(user.ID, user.Username, timeNow, user.Email)
 	mock.ExpectQuery("SELECT (.+) FROM users WHERE").WithArgs(user.ID).WillReturnRows(selectByIDRows)
+	mock.ExpectExec("INSERT INTO email_verifications").WithArgs(user.ID, user.Email, sqlmock.AnyArg(), sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(1, 1))
 
 	// Mock config
 	cnf := config.Config{}
-	cnf.SecretKey = "ABC"
+	auth := authServer()
+	defer auth.Close()
+	cnf.AuthenticationServiceBaseurl = auth.URL
 
 	// Get token string
-	tokenString := getTokenString(cnf, user, t)
+	tokenString := getTokenString(user, t)
 
 	json, _ := json.Marshal(user)
 	res := doRequest(db, cnf, http.MethodPost, "/users?token="+tokenString, bytes.NewBuffer(json), t)
@@ -184,10 +210,12 @@ func TestGETUserByID(t *testing.T) {
 
 	// Mock config
 	cnf := config.Config{}
-	cnf.SecretKey = "ABC"
+	auth := authServer()
+	defer auth.Close()
+	cnf.AuthenticationServiceBaseurl = auth.URL
 
 	// Get token string
-	tokenString := getTokenString(cnf, user, t)
+	tokenString := getTokenString(user, t)
 
 	json, _ := json.Marshal(user)
 	url := "/user/" + strconv.Itoa(user.ID) + "?token=" + tokenString
@@ -242,7 +270,7 @@ func TestIPCGetUsernames(t *testing.T) {
 
 	json, _ := json.Marshal(jsonObject)
 	url := "/ipc/usernames"
-	res := doRequest(db, cnf, http.MethodGet, url, bytes.NewBuffer(json), t)
+	res := doIPCRequest(db, cnf, ipc.PhotoService, http.MethodGet, url, bytes.NewBuffer(json), t)
 
 	// Make sure expectations are met
 	if err := mock.ExpectationsWereMet(); err != nil {
@@ -257,8 +285,239 @@ func TestIPCGetUsernames(t *testing.T) {
 	}
 }
 
+// Test if a user of an external identity provider is created verified and without a password, and if a taken email
+// address is left out.
+func TestIPCCreateUser(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	cnf := config.Config{}
+
+	mock.ExpectQuery("SELECT (.+) FROM users WHERE email").WithArgs("jane@example.com").WillReturnRows(sqlmock.NewRows([]string{"id"}))
+	mock.ExpectQuery("SELECT (.+) FROM users WHERE username").WithArgs("jane").WillReturnRows(sqlmock.NewRows([]string{"id"}))
+	mock.ExpectExec("INSERT INTO users (.+) VALUES\\(\\?, \\?, '', TRUE\\)").WithArgs("jane", "jane@example.com").WillReturnResult(sqlmock.NewResult(5, 1))
+	mock.ExpectQuery("SELECT (.+) FROM users WHERE email").WithArgs("taken@example.com").WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+
+	requests := []*sharedModels.CreateUserRequest{{Username: "jane", Email: "jane@example.com"}, {Username: "john", Email: "taken@example.com"}}
+	json, _ := json.Marshal(map[string]interface{}{"requests": requests})
+	res := doIPCRequest(db, cnf, ipc.AuthenticationService, http.MethodPost, "/ipc/createUser", bytes.NewBuffer(json), t)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+	if res.Code != http.StatusOK {
+		t.Fatalf("Expected %v but got %v", http.StatusOK, res.Code)
+	}
+	expected := `{"results":[{"id":5,"username":"jane","email":"jane@example.com"}]}`
+	if actual := strings.TrimSpace(res.Body.String()); actual != expected {
+		t.Errorf("Expected %v but got %v", expected, actual)
+	}
+}
+
+// Test if a user can change their password with the old one.
+func TestPUTUsersPassword(t *testing.T) {
+	user := getTestUser()
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	oldHash, _ := bcrypt.GenerateFromPassword([]byte("password"), bcrypt.MinCost)
+	mock.ExpectQuery("SELECT password FROM users").WithArgs(user.ID).WillReturnRows(sqlmock.NewRows([]string{"password"}).AddRow(string(oldHash)))
+	mock.ExpectBegin()
+	mock.ExpectExec("UPDATE users SET password").WithArgs(TestHash{}, user.ID).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("UPDATE password_resets SET usedAt").WithArgs(user.ID).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectCommit()
+
+	cnf := config.Config{}
+	auth := authServer()
+	defer auth.Close()
+	cnf.AuthenticationServiceBaseurl = auth.URL
+
+	body := `{"old_password":"password","new_password":"new password"}`
+	res := doRequest(db, cnf, http.MethodPut, "/users/password?token="+getTokenString(user, t), bytes.NewBufferString(body), t)
+	if res.Result().StatusCode != http.StatusOK {
+		t.Fatalf("Expected %v but got %v: %v", http.StatusOK, res.Result().StatusCode, res.Body.String())
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+// Test if the password isn't changed without the right old password.
+func TestPUTUsersPasswordWrong(t *testing.T) {
+	user := getTestUser()
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	oldHash, _ := bcrypt.GenerateFromPassword([]byte("password"), bcrypt.MinCost)
+	mock.ExpectQuery("SELECT password FROM users").WithArgs(user.ID).WillReturnRows(sqlmock.NewRows([]string{"password"}).AddRow(string(oldHash)))
+
+	cnf := config.Config{}
+	auth := authServer()
+	defer auth.Close()
+	cnf.AuthenticationServiceBaseurl = auth.URL
+
+	body := `{"old_password":"guess","new_password":"new password"}`
+	res := doRequest(db, cnf, http.MethodPut, "/users/password?token="+getTokenString(user, t), bytes.NewBufferString(body), t)
+	if res.Result().StatusCode != http.StatusForbidden {
+		t.Errorf("Expected %v but got %v", http.StatusForbidden, res.Result().StatusCode)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+// Test if a reset link is mailed and its token sets a new password.
+func TestPOSTUsersPasswordForgotAndReset(t *testing.T) {
+	user := getTestUser()
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	cnf := config.Config{}
+	cnf.PasswordResetURL = "http://localhost:4999/#/reset-password"
+	cnf.PasswordResetLifetime = time.Hour
+	auth := authServer()
+	defer auth.Close()
+	cnf.AuthenticationServiceBaseurl = auth.URL
+
+	mock.ExpectQuery("SELECT (.+) FROM users WHERE email").WithArgs(user.Email).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "username", "createdAt", "email"}).AddRow(user.ID, user.Username, user.CreatedAt, user.Email))
+	mock.ExpectExec("INSERT INTO password_resets").WithArgs(user.ID, sqlmock.AnyArg(), sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(1, 1))
+
+	sent := len(testMailer.Messages())
+	res := doRequest(db, cnf, http.MethodPost, "/users/password/forgot", bytes.NewBufferString(`{"email":"`+user.Email+`"}`), t)
+	if res.Result().StatusCode != http.StatusOK {
+		t.Fatalf("Expected %v but got %v: %v", http.StatusOK, res.Result().StatusCode, res.Body.String())
+	}
+	controllers.WaitForMail()
+
+	messages := testMailer.Messages()
+	if len(messages) != sent+1 || messages[sent].To != user.Email {
+		t.Fatalf("Expected a mail to %v but got %v", user.Email, messages[sent:])
+	}
+	prefix := cnf.PasswordResetURL + "?token="
+	start := strings.Index(messages[sent].Body, prefix)
+	if start < 0 {
+		t.Fatalf("Expected a reset link in %v", messages[sent].Body)
+	}
+	token := strings.Fields(messages[sent].Body[start+len(prefix):])[0]
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT user_id FROM password_resets").WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"user_id"}).AddRow(user.ID))
+	mock.ExpectExec("UPDATE users SET password").WithArgs(TestHash{}, user.ID).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("UPDATE password_resets SET usedAt").WithArgs(sqlmock.AnyArg(), user.ID).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	body := `{"token":"` + token + `","password":"new password"}`
+	res = doRequest(db, cnf, http.MethodPost, "/users/password/reset", bytes.NewBufferString(body), t)
+	if res.Result().StatusCode != http.StatusOK {
+		t.Fatalf("Expected %v but got %v: %v", http.StatusOK, res.Result().StatusCode, res.Body.String())
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+// Test if an unknown email address gets the same answer and no mail.
+func TestPOSTUsersPasswordForgotUnknown(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	mock.ExpectQuery("SELECT (.+) FROM users WHERE email").WithArgs("unknown@example.com").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "username", "createdAt", "email"}))
+
+	sent := len(testMailer.Messages())
+	res := doRequest(db, config.Config{}, http.MethodPost, "/users/password/forgot", bytes.NewBufferString(`{"email":"unknown@example.com"}`), t)
+	if res.Result().StatusCode != http.StatusOK {
+		t.Errorf("Expected %v but got %v", http.StatusOK, res.Result().StatusCode)
+	}
+	controllers.WaitForMail()
+	if len(testMailer.Messages()) != sent {
+		t.Errorf("Expected no mail but got %v", testMailer.Messages()[sent:])
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+// Test if a failing mailer gets the same answer as an unknown email address.
+func TestPOSTUsersPasswordForgotMailerFails(t *testing.T) {
+	user := getTestUser()
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	mock.ExpectQuery("SELECT (.+) FROM users WHERE email").WithArgs(user.Email).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "username", "createdAt", "email"}).AddRow(user.ID, user.Username, user.CreatedAt, user.Email))
+	mock.ExpectExec("INSERT INTO password_resets").WithArgs(user.ID, sqlmock.AnyArg(), sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(1, 1))
+
+	mailer := &mail.FakeMailer{Err: errors.New("mail server is down")}
+	r := InitRoutes(db, config.Config{}, ipc.FakeKeys(ipc.ProfileService), mailer)
+	res := httptest.NewRecorder()
+	req, err := http.NewRequest(http.MethodPost, "/users/password/forgot", bytes.NewBufferString(`{"email":"`+user.Email+`"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.ServeHTTP(res, req)
+	controllers.WaitForMail()
+
+	if res.Result().StatusCode != http.StatusOK {
+		t.Errorf("Expected %v but got %v", http.StatusOK, res.Result().StatusCode)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+// Test if the token of a verification link verifies the email address.
+func TestPOSTUsersVerify(t *testing.T) {
+	user := getTestUser()
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT v.user_id FROM email_verifications").WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"user_id"}).AddRow(user.ID))
+	mock.ExpectExec("UPDATE users SET verified = TRUE").WithArgs(user.ID).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("UPDATE email_verifications SET usedAt").WithArgs(sqlmock.AnyArg(), user.ID).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	res := doRequest(db, config.Config{}, http.MethodPost, "/users/verify", bytes.NewBufferString(`{"token":"abc"}`), t)
+	if res.Result().StatusCode != http.StatusOK {
+		t.Fatalf("Expected %v but got %v: %v", http.StatusOK, res.Result().StatusCode, res.Body.String())
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
 func doRequest(db *sql.DB, cnf config.Config, method string, url string, body *bytes.Buffer, t *testing.T) *httptest.ResponseRecorder {
-	r := InitRoutes(db, cnf)
+	r := InitRoutes(db, cnf, ipc.FakeKeys(ipc.ProfileService), testMailer)
 	res := httptest.NewRecorder()
 	req, err := http.NewRequest(method, url, body)
 	if err != nil {
@@ -279,20 +538,88 @@ func getTestUser() *models.UserCreate {
 	return user
 }
 
-func getTokenString(cnf config.Config, user *models.UserCreate, t *testing.T) string {
+var testKeys = newTestKeys()
+
+// testMailer keeps the mails the routes send.
+var testMailer = &mail.FakeMailer{}
+
+func newTestKeys() *jwks.Set {
+	key, err := jwks.GenerateKey()
+	if err != nil {
+		panic(err)
+	}
+	keys, err := jwks.NewSet(key)
+	if err != nil {
+		panic(err)
+	}
+	return keys
+}
+
+// authServer stands in for the authentication service. It publishes testKeys and answers that no token was
+// revoked.
+func authServer() *httptest.Server {
+	mux := http.NewServeMux()
+	mux.Handle(jwks.Path, jwks.Handler(testKeys))
+	mux.HandleFunc("/ipc/tokenStatus", func(w http.ResponseWriter, r *http.Request) {
+		requests := make([]*sharedModels.TokenStatusRequest, 0)
+		if err := ipc.ReadRequests(r, &requests); err != nil {
+			util.SendBadRequest(w, err)
+			return
+		}
+		statuses := make([]*sharedModels.TokenStatusResponse, 0, len(requests))
+		for _, request := range requests {
+			statuses = append(statuses, &sharedModels.TokenStatusResponse{UserID: request.UserID, TokenID: request.TokenID})
+		}
+		ipc.SendResults(w, statuses)
+	})
+	mux.HandleFunc("/ipc/revokeSessions", func(w http.ResponseWriter, r *http.Request) {
+		requests := make([]*sharedModels.RevokeSessionsRequest, 0)
+		if err := ipc.ReadRequests(r, &requests); err != nil {
+			util.SendBadRequest(w, err)
+			return
+		}
+		revoked := make([]*sharedModels.RevokeSessionsResponse, 0, len(requests))
+		for _, request := range requests {
+			revoked = append(revoked, &sharedModels.RevokeSessionsResponse{UserID: request.UserID})
+		}
+		ipc.SendResults(w, revoked)
+	})
+	return httptest.NewServer(mux)
+}
+
+func getTokenString(user *models.UserCreate, t *testing.T) string {
 	expiration := time.Now().Add(time.Hour * 24 * 31).Unix()
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
 		"sub": user.ID,
+		"jti": "test-token",
+		"iss": middleware.TokenIssuer,
 		"iat": time.Now().Unix(),
 		"exp": expiration,
 	})
+	token.Header["kid"] = testKeys.SigningKey().ID
 
 	// Generate a signed token
-	secretKey := cnf.SecretKey
-	tokenString, err := token.SignedString([]byte(secretKey))
+	tokenString, err := token.SignedString(testKeys.SigningKey().Key)
 	if err != nil {
 		t.Error(err)
 		return ""
 	}
 	return tokenString
 }
+
+// doIPCRequest works like doRequest and authenticates the request with a service token of caller.
+func doIPCRequest(db *sql.DB, cnf config.Config, caller string, method string, url string, body *bytes.Buffer, t *testing.T) *httptest.ResponseRecorder {
+	r := InitRoutes(db, cnf, ipc.FakeKeys(ipc.ProfileService), testMailer)
+	res := httptest.NewRecorder()
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := middleware.NewServiceToken(ipc.FakeKeys(caller).Identity.Key, caller, ipc.ProfileService)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	r.ServeHTTP(res, req)
+	return res
+}
@@ -0,0 +1,38 @@
+package models
+
+// PasswordChange is the body of a password change. The old password proves that the user, and not only their
+// access token, asks for it.
+type PasswordChange struct {
+	OldPassword string `json:"old_password"`
+	NewPassword string `json:"new_password"`
+}
+
+// Validate returns an error if the new password is too short.
+func (p *PasswordChange) Validate() error {
+	if len(p.NewPassword) < 1 {
+		return ErrPasswordTooShort
+	}
+	return nil
+}
+
+// PasswordForgot is the body of a request for a reset link.
+type PasswordForgot struct {
+	Email string `json:"email"`
+}
+
+// PasswordReset is the body of a password reset. Token comes from the reset link.
+type PasswordReset struct {
+	Token    string `json:"token"`
+	Password string `json:"password"`
+}
+
+// Validate returns an error if the token is missing or the password is too short.
+func (p *PasswordReset) Validate() error {
+	if len(p.Token) < 1 {
+		return ErrResetTokenMissing
+	}
+	if len(p.Password) < 1 {
+		return ErrPasswordTooShort
+	}
+	return nil
+}
@@ -1,9 +1,11 @@
 package models
 
 import (
-	"errors"
 	"fmt"
+	"net/mail"
 	"time"
+
+	"github.com/bstaijen/mariadb-for-microservices/shared/apierror"
 )
 
 // lower_case private, upper_case public
@@ -37,29 +39,34 @@ func (u *UserCreate) Print() string {
 	return fmt.Sprintf("%v (%v) - %v", u.Username, u.ID, u.CreatedAt)
 }
 
-// Validate returns an error when the username or email is to short.
+// Validate returns an error when the username or email is to short or the email is not an email address.
 func (u *UserCreate) Validate() error {
 	if len(u.Username) < 1 {
 		return ErrUsernameTooShort
 	}
 
-	if len(u.Email) < 1 {
-		return ErrEmailTooShort
-	}
-
-	return nil
+	return ValidateEmail(u.Email)
 }
 
-// Validate returns an error when the username or email is to short.
+// Validate returns an error when the username or email is to short or the email is not an email address.
 func (u *UserResponse) Validate() error {
 	if len(u.Username) < 1 {
 		return ErrUsernameTooShort
 	}
 
-	if len(u.Email) < 1 {
+	return ValidateEmail(u.Email)
+}
+
+// ValidateEmail returns an error when email is empty or not a bare email address like username@example.com.
+func ValidateEmail(email string) error {
+	if len(email) < 1 {
 		return ErrEmailTooShort
 	}
 
+	address, err := mail.ParseAddress(email)
+	if err != nil || address.Address != email {
+		return ErrEmailInvalid
+	}
 	return nil
 }
 
@@ -73,10 +80,19 @@ func (u *UserCreate) ValidatePassword() error {
 }
 
 // ErrUsernameTooShort is a error and is used when username is too short.
-var ErrUsernameTooShort = errors.New("Username is too short")
+var ErrUsernameTooShort = apierror.New(apierror.ValidationFailed, "Username is too short")
 
 // ErrEmailTooShort is an error and is used when email address is too short.
-var ErrEmailTooShort = errors.New("Email address is to short")
+var ErrEmailTooShort = apierror.New(apierror.ValidationFailed, "Email address is to short")
+
+// ErrEmailInvalid is an error and is used when an email address has no valid syntax.
+var ErrEmailInvalid = apierror.New(apierror.ValidationFailed, "Email address is invalid")
 
 // ErrPasswordTooShort is an error and is used when a password is too short.
-var ErrPasswordTooShort = errors.New("Password is to short")
+var ErrPasswordTooShort = apierror.New(apierror.ValidationFailed, "Password is to short")
+
+// ErrResetTokenMissing is an error and is used when a password reset has no token.
+var ErrResetTokenMissing = apierror.New(apierror.ValidationFailed, "Reset token is missing")
+
+// ErrVerificationTokenMissing is an error and is used when an email verification has no token.
+var ErrVerificationTokenMissing = apierror.New(apierror.ValidationFailed, "Verification token is missing")
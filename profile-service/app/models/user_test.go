@@ -101,3 +101,13 @@ func TestTooShortPassword(t *testing.T) {
 		}
 	}
 }
+
+func TestInvalidEmail(t *testing.T) {
+	for _, email := range []string{"user", "user@", "@example.com", "User <user@example.com>", "user@example.com\r\nBcc: other@example.com"} {
+		user := getSimpleUser()
+		user.Email = email
+		if err := user.Validate(); err != models.ErrEmailInvalid {
+			t.Errorf("Expected %v for %q but got %v", models.ErrEmailInvalid, email, err)
+		}
+	}
+}
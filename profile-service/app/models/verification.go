@@ -0,0 +1,14 @@
+package models
+
+// EmailVerification is the body of an email verification. Token comes from the verification link.
+type EmailVerification struct {
+	Token string `json:"token"`
+}
+
+// Validate returns an error if the token is missing.
+func (v *EmailVerification) Validate() error {
+	if len(v.Token) < 1 {
+		return ErrVerificationTokenMissing
+	}
+	return nil
+}
@@ -1,8 +1,8 @@
 package db
 
 import (
+	"context"
 	"database/sql"
-	"errors"
 	"fmt"
 	"time"
 
@@ -13,10 +13,15 @@ import (
 	"github.com/bstaijen/mariadb-for-microservices/profile-service/app/models"
 	"github.com/bstaijen/mariadb-for-microservices/profile-service/config"
 
+	"github.com/bstaijen/mariadb-for-microservices/shared/apierror"
+	"github.com/bstaijen/mariadb-for-microservices/shared/bootstrap"
 	sharedModels "github.com/bstaijen/mariadb-for-microservices/shared/models"
+	"github.com/bstaijen/mariadb-for-microservices/shared/tracing"
+	"github.com/bstaijen/mariadb-for-microservices/shared/util"
 )
 
 // OpenConnection method. This method is being used by the main function. For testing the database is being mocked.
+// It waits for the database to come online for at most cnf.DBConnectTimeout.
 func OpenConnection(cnf config.Config) (*sql.DB, error) {
 	username := cnf.DBUsername
 	password := cnf.DBPassword
@@ -27,14 +32,14 @@ func OpenConnection(cnf config.Config) (*sql.DB, error) {
 	dsn := fmt.Sprintf("%v:%v@tcp(%v:%v)/%v?parseTime=true", username, password, host, port, database)
 
 	log.Debugf("Connect to : %v", dsn)
-	db, err := sql.Open("mysql", dsn)
-	if err != nil {
-		return nil, ErrCanNotConnectWithDatabase
-	}
-
-	// Open doesn't open a connection. Validate DSN data:
-	err = db.Ping()
+	db, err := bootstrap.OpenDB(context.Background(), "mysql", dsn, bootstrap.DBOptions{
+		ConnectTimeout:  cnf.DBConnectTimeout,
+		MaxOpenConns:    cnf.DBMaxOpenConns,
+		MaxIdleConns:    cnf.DBMaxIdleConns,
+		ConnMaxLifetime: cnf.DBConnMaxLifetime,
+	})
 	if err != nil {
+		log.Error(err)
 		return nil, ErrCanNotConnectWithDatabase
 	}
 	return db, nil
@@ -46,8 +51,8 @@ func CloseConnection(db *sql.DB) {
 }
 
 // GetUserByID returns an models.User identified by it's ID or a ErrUserNotFound error when the user cannot be found.
-func GetUserByID(db *sql.DB, ID int) (models.UserResponse, error) {
-	rows, err := db.Query("SELECT id, username, createdAt, email FROM users WHERE id = ?", ID)
+func GetUserByID(ctx context.Context, db *sql.DB, ID int) (models.UserResponse, error) {
+	rows, err := tracing.QueryContext(ctx, db, "SELECT id, username, createdAt, email FROM users WHERE id = ?", ID)
 	if err != nil {
 		return models.UserResponse{}, err
 	}
@@ -68,13 +73,13 @@ func GetUserByID(db *sql.DB, ID int) (models.UserResponse, error) {
 }
 
 // CreateUser create an user in the database and returns the ID of the user being inserted. This method returns a ErrUsernameIsNotUnique or ErrEmailIsNotUnique when the username or email of an user is not unique.
-func CreateUser(db *sql.DB, user *models.UserCreate) (int, error) {
+func CreateUser(ctx context.Context, db *sql.DB, user *models.UserCreate) (int, error) {
 	// check unique username
 	query := "SELECT * FROM users WHERE username = ?"
-	rows, err := db.Query(query, user.Username)
+	rows, err := tracing.QueryContext(ctx, db, query, user.Username)
 	if err != nil {
-		log.Errorf("Error executing query %v ", query)
-		log.Error(err)
+		util.Log(ctx).Errorf("Error executing query %v ", query)
+		util.Log(ctx).Error(err)
 		return 0, err
 	}
 	if rows.Next() {
@@ -83,10 +88,10 @@ func CreateUser(db *sql.DB, user *models.UserCreate) (int, error) {
 
 	// check unique email
 	query = "SELECT * FROM users WHERE email = ?"
-	rows, err = db.Query(query, user.Email)
+	rows, err = tracing.QueryContext(ctx, db, query, user.Email)
 	if err != nil {
-		log.Errorf("Error executing query %v ", query)
-		log.Error(err)
+		util.Log(ctx).Errorf("Error executing query %v ", query)
+		util.Log(ctx).Error(err)
 		return 0, err
 	}
 	if rows.Next() {
@@ -94,59 +99,262 @@ func CreateUser(db *sql.DB, user *models.UserCreate) (int, error) {
 	}
 
 	// Insert
-	res, err := db.Exec("INSERT INTO users (username, email, password) VALUES(?, ?, ?)", user.Username, user.Email, user.Hash)
+	res, err := tracing.ExecContext(ctx, db, "INSERT INTO users (username, email, password) VALUES(?, ?, ?)", user.Username, user.Email, user.Hash)
 	if err != nil {
-		log.Errorf("Error inserting")
-		log.Error(err)
+		util.Log(ctx).Errorf("Error inserting")
+		util.Log(ctx).Error(err)
 		return 0, err
 	}
 
 	id, err := res.LastInsertId()
 	if err != nil {
-		log.Error(err)
+		util.Log(ctx).Error(err)
 		return 0, err
 	}
 
 	return int(id), nil
 }
 
-// UpdateUser updates the username and email of an user. (note: this method does not check if user is authorized to update this row)
-func UpdateUser(db *sql.DB, user *models.UserResponse) (int, error) {
-	_, err := db.Exec("UPDATE users SET username = ?, email = ? WHERE id = ?", user.Username, user.Email, user.ID)
+// maxUsernameSuffix is the highest number CreateExternalUser appends to a taken username.
+const maxUsernameSuffix = 100
+
+// CreateExternalUser creates a user who signs in with an external identity provider and returns the ID and the
+// username of the user. The user has no password and a verified email address, the provider verified it. When
+// username is taken a number is appended to it. It returns ErrEmailIsNotUnique when email is taken.
+func CreateExternalUser(ctx context.Context, db *sql.DB, username string, email string) (int, string, error) {
+	taken, err := exists(ctx, db, "SELECT id FROM users WHERE email = ?", email)
 	if err != nil {
-		log.Errorf("Error inserting")
-		log.Error(err)
+		return 0, "", err
+	}
+	if taken {
+		return 0, "", ErrEmailIsNotUnique
+	}
+
+	candidate := username
+	for suffix := 2; ; suffix++ {
+		taken, err := exists(ctx, db, "SELECT id FROM users WHERE username = ?", candidate)
+		if err != nil {
+			return 0, "", err
+		}
+		if !taken {
+			break
+		}
+		if suffix > maxUsernameSuffix {
+			return 0, "", ErrUsernameIsNotUnique
+		}
+		candidate = username + strconv.Itoa(suffix)
+	}
+
+	// The password is empty, no hash matches it
+	res, err := tracing.ExecContext(ctx, db, "INSERT INTO users (username, email, password, verified) VALUES(?, ?, '', TRUE)", candidate, email)
+	if err != nil {
+		return 0, "", err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return 0, "", err
+	}
+	return int(id), candidate, nil
+}
+
+// exists reports whether query with args returns a row.
+func exists(ctx context.Context, db *sql.DB, query string, args ...interface{}) (bool, error) {
+	rows, err := tracing.QueryContext(ctx, db, query, args...)
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+	return rows.Next(), rows.Err()
+}
+
+// UpdateUser updates the username and email of an user. A new email address has to be verified again. (note: this method does not check if user is authorized to update this row)
+func UpdateUser(ctx context.Context, db *sql.DB, user *models.UserResponse) (int, error) {
+	// The assignments are made from left to right, so verified is compared with the old email address
+	_, err := tracing.ExecContext(ctx, db, "UPDATE users SET verified = verified AND email = ?, username = ?, email = ? WHERE id = ?", user.Email, user.Username, user.Email, user.ID)
+	if err != nil {
+		util.Log(ctx).Errorf("Error inserting")
+		util.Log(ctx).Error(err)
 		return 0, err
 	}
 	return user.ID, nil
 }
 
 // DeleteUser deletes an user from the database. Method does not check if the caller is authorized to perform this action. Method returns the number of rows affected by query. (should be 1)
-func DeleteUser(db *sql.DB, user *models.UserResponse) (int, error) {
+func DeleteUser(ctx context.Context, db *sql.DB, user *models.UserResponse) (int, error) {
 	if user.ID > 0 {
-		res, err := db.Exec("DELETE from users WHERE id = ?", user.ID)
+		res, err := tracing.ExecContext(ctx, db, "DELETE from users WHERE id = ?", user.ID)
 		if err != nil {
-			log.Errorf("Error inserting")
-			log.Error(err)
+			util.Log(ctx).Errorf("Error inserting")
+			util.Log(ctx).Error(err)
 			return 0, err
 		}
 
 		rowsAffected, err := res.RowsAffected()
 		if err != nil {
-			log.Errorf("Error inserting")
-			log.Error(err)
+			util.Log(ctx).Errorf("Error inserting")
+			util.Log(ctx).Error(err)
 			return 0, err
 		}
 		return int(rowsAffected), nil
 	}
-	return 0, errors.New("User ID is empty")
+	return 0, apierror.New(apierror.InvalidArgument, "User ID is empty")
+
+}
+
+// GetUserByEmail returns the user with email or a ErrUserNotFound error when there is none.
+func GetUserByEmail(ctx context.Context, db *sql.DB, email string) (models.UserResponse, error) {
+	rows, err := tracing.QueryContext(ctx, db, "SELECT id, username, createdAt, email FROM users WHERE email = ?", email)
+	if err != nil {
+		return models.UserResponse{}, err
+	}
+	defer rows.Close()
+
+	if rows.Next() {
+		user := models.UserResponse{}
+		if err := rows.Scan(&user.ID, &user.Username, &user.CreatedAt, &user.Email); err != nil {
+			return models.UserResponse{}, err
+		}
+		return user, nil
+	}
+	return models.UserResponse{}, ErrUserNotFound
+}
 
+// GetPasswordHash returns the password hash of the user with userID or a ErrUserNotFound error when the user cannot
+// be found.
+func GetPasswordHash(ctx context.Context, db *sql.DB, userID int) (string, error) {
+	rows, err := tracing.QueryContext(ctx, db, "SELECT password FROM users WHERE id = ?", userID)
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+
+	if rows.Next() {
+		var hash string
+		if err := rows.Scan(&hash); err != nil {
+			return "", err
+		}
+		return hash, nil
+	}
+	return "", ErrUserNotFound
+}
+
+// UpdatePassword replaces the password hash of the user with userID. The reset tokens the user didn't use can't be
+// used anymore.
+func UpdatePassword(ctx context.Context, db *sql.DB, userID int, hash string) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.ExecContext(ctx, "UPDATE users SET password = ? WHERE id = ?", hash, userID)
+	if err != nil {
+		return err
+	}
+	if affected, err := res.RowsAffected(); err != nil || affected == 0 {
+		return ErrUserNotFound
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE password_resets SET usedAt = NOW() WHERE user_id = ? AND usedAt IS NULL", userID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// CreatePasswordReset stores the hash of a reset token of the user with userID which expires at expiresAt.
+func CreatePasswordReset(ctx context.Context, db *sql.DB, userID int, tokenHash string, expiresAt time.Time) error {
+	_, err := tracing.ExecContext(ctx, db, "INSERT INTO password_resets (user_id, token_hash, expiresAt) VALUES (?, ?, ?)", userID, tokenHash, expiresAt)
+	return err
+}
+
+// ResetPassword replaces the password hash of the user of the reset token with tokenHash and returns the ID of the
+// user. The token, and every other token of the user, can't be used again. It returns ErrInvalidResetToken when the
+// token is unknown, used or expired at now. revoke is called with the ID of the user before the new password is
+// committed, nothing changes when it returns an error.
+func ResetPassword(ctx context.Context, db *sql.DB, tokenHash string, hash string, now time.Time, revoke func(userID int) error) (int, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var userID int
+	err = tx.QueryRowContext(ctx, "SELECT user_id FROM password_resets WHERE token_hash = ? AND usedAt IS NULL AND expiresAt > ? FOR UPDATE", tokenHash, now).Scan(&userID)
+	if err == sql.ErrNoRows {
+		return 0, ErrInvalidResetToken
+	}
+	if err != nil {
+		return 0, err
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE users SET password = ? WHERE id = ?", hash, userID); err != nil {
+		return 0, err
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE password_resets SET usedAt = ? WHERE user_id = ? AND usedAt IS NULL", now, userID); err != nil {
+		return 0, err
+	}
+	if err := revoke(userID); err != nil {
+		return 0, err
+	}
+	return userID, tx.Commit()
+}
+
+// GetEmailVerification returns the email address of the user with userID and whether it is verified, or a
+// ErrUserNotFound error when the user cannot be found.
+func GetEmailVerification(ctx context.Context, db *sql.DB, userID int) (string, bool, error) {
+	rows, err := tracing.QueryContext(ctx, db, "SELECT email, verified FROM users WHERE id = ?", userID)
+	if err != nil {
+		return "", false, err
+	}
+	defer rows.Close()
+
+	if rows.Next() {
+		var email string
+		var verified bool
+		if err := rows.Scan(&email, &verified); err != nil {
+			return "", false, err
+		}
+		return email, verified, nil
+	}
+	return "", false, ErrUserNotFound
+}
+
+// CreateEmailVerification stores the hash of a verification token for email, the address of the user with userID,
+// which expires at expiresAt.
+func CreateEmailVerification(ctx context.Context, db *sql.DB, userID int, email string, tokenHash string, expiresAt time.Time) error {
+	_, err := tracing.ExecContext(ctx, db, "INSERT INTO email_verifications (user_id, email, token_hash, expiresAt) VALUES (?, ?, ?, ?)", userID, email, tokenHash, expiresAt)
+	return err
+}
+
+// VerifyEmail marks the email address of the verification token with tokenHash as verified and returns the ID of its
+// user. The token, and every other token of the user, can't be used again. It returns ErrInvalidVerificationToken
+// when the token is unknown, used or expired at now, or the user changed their address since it was sent.
+func VerifyEmail(ctx context.Context, db *sql.DB, tokenHash string, now time.Time) (int, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var userID int
+	err = tx.QueryRowContext(ctx, "SELECT v.user_id FROM email_verifications v JOIN users u ON u.id = v.user_id AND u.email = v.email WHERE v.token_hash = ? AND v.usedAt IS NULL AND v.expiresAt > ? FOR UPDATE", tokenHash, now).Scan(&userID)
+	if err == sql.ErrNoRows {
+		return 0, ErrInvalidVerificationToken
+	}
+	if err != nil {
+		return 0, err
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE users SET verified = TRUE WHERE id = ?", userID); err != nil {
+		return 0, err
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE email_verifications SET usedAt = ? WHERE user_id = ? AND usedAt IS NULL", now, userID); err != nil {
+		return 0, err
+	}
+	return userID, tx.Commit()
 }
 
 // GetUsers returns a list of all database-users. Note: Consider implementing a paging function because this method returns EVERY users at once.
-func GetUsers(db *sql.DB) ([]models.UserResponse, error) {
+func GetUsers(ctx context.Context, db *sql.DB) ([]models.UserResponse, error) {
 
-	rows, err := db.Query("SELECT id, username, email, createdAt FROM users")
+	rows, err := tracing.QueryContext(ctx, db, "SELECT id, username, email, createdAt FROM users")
 	if err != nil {
 		return nil, err
 	}
@@ -167,14 +375,14 @@ func GetUsers(db *sql.DB) ([]models.UserResponse, error) {
 }
 
 // GetUsernames is a method used by the IPC handler. It will return all usernames based on a list of ID's.
-func GetUsernames(db *sql.DB, identifiers []*sharedModels.GetUsernamesRequest) ([]*sharedModels.GetUsernamesResponse, error) {
+func GetUsernames(ctx context.Context, db *sql.DB, identifiers []*sharedModels.GetUsernamesRequest) ([]*sharedModels.GetUsernamesResponse, error) {
 
 	if len(identifiers) < 1 {
 		return make([]*sharedModels.GetUsernamesResponse, 0), nil
 	}
 
 	query := inQueryBuilder(identifiers)
-	rows, err := db.Query(query)
+	rows, err := tracing.QueryContext(ctx, db, query)
 	if err != nil {
 		return nil, err
 	}
@@ -217,13 +425,19 @@ func inQueryBuilder(identifiers []*sharedModels.GetUsernamesRequest) string {
 }
 
 // ErrEmailIsNotUnique error is the email is not unique
-var ErrEmailIsNotUnique = errors.New("Email must be unique")
+var ErrEmailIsNotUnique = apierror.New(apierror.Conflict, "Email must be unique")
 
 // ErrUsernameIsNotUnique error if the username is not unique
-var ErrUsernameIsNotUnique = errors.New("Username must be unique")
+var ErrUsernameIsNotUnique = apierror.New(apierror.Conflict, "Username must be unique")
 
 // ErrUserNotFound error if user does not exist in database
-var ErrUserNotFound = errors.New("User does not exist")
+var ErrUserNotFound = apierror.New(apierror.NotFound, "User does not exist")
+
+// ErrInvalidResetToken error if a password reset token is unknown, used or expired
+var ErrInvalidResetToken = apierror.New(apierror.InvalidArgument, "Reset token is invalid or expired")
+
+// ErrInvalidVerificationToken error if an email verification token is unknown, used, expired or for an old address
+var ErrInvalidVerificationToken = apierror.New(apierror.InvalidArgument, "Verification token is invalid or expired")
 
 // ErrCanNotConnectWithDatabase error if database is unreachable
-var ErrCanNotConnectWithDatabase = errors.New("Can not connect with database")
+var ErrCanNotConnectWithDatabase = apierror.New(apierror.Unavailable, "Can not connect with database")
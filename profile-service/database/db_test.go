@@ -1,6 +1,8 @@
 package db
 
 import (
+	"context"
+	"fmt"
 	"testing"
 	"time"
 
@@ -26,7 +28,7 @@ func TestGetUserByID(t *testing.T) {
 	mock.ExpectQuery("SELECT (.+) FROM users WHERE").WithArgs(user.ID).WillReturnRows(selectByIDRows)
 
 	// Execute the method
-	if _, err := GetUserByID(db, user.ID); err != nil {
+	if _, err := GetUserByID(context.Background(), db, user.ID); err != nil {
 		t.Errorf("there was an unexpected error: %s", err)
 	}
 
@@ -60,7 +62,7 @@ func TestCreateUser(t *testing.T) {
 	mock.ExpectExec("INSERT INTO users").WithArgs(user.Username, user.Email, user.Hash).WillReturnResult(sqlmock.NewResult(1, 1))
 
 	// Execute the method
-	if _, err := CreateUser(db, user); err != nil {
+	if _, err := CreateUser(context.Background(), db, user); err != nil {
 		t.Errorf("there was an unexpected error: %s", err)
 	}
 
@@ -70,6 +72,33 @@ func TestCreateUser(t *testing.T) {
 	}
 }
 
+// Test if a number is appended to a taken username of a user of an external identity provider.
+func TestCreateExternalUser(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	mock.ExpectQuery("SELECT (.+) FROM users WHERE email").WithArgs("jane@example.com").WillReturnRows(sqlmock.NewRows([]string{"id"}))
+	mock.ExpectQuery("SELECT (.+) FROM users WHERE username").WithArgs("jane").WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	mock.ExpectQuery("SELECT (.+) FROM users WHERE username").WithArgs("jane2").WillReturnRows(sqlmock.NewRows([]string{"id"}))
+	mock.ExpectExec("INSERT INTO users").WithArgs("jane2", "jane@example.com").WillReturnResult(sqlmock.NewResult(5, 1))
+
+	id, username, err := CreateExternalUser(context.Background(), db, "jane", "jane@example.com")
+	if err != nil {
+		t.Fatalf("Expected no error, instead got %v", err.Error())
+	}
+	if id != 5 || username != "jane2" {
+		t.Errorf("Expected %v but got %v", "5 jane2", fmt.Sprintf("%v %v", id, username))
+	}
+
+	// Make sure expectations are met
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
 // TestUpdateUser
 func TestUpdateUser(t *testing.T) {
 	db, mock, err := sqlmock.New()
@@ -82,10 +111,10 @@ func TestUpdateUser(t *testing.T) {
 	user := getTestUser()
 
 	// Expectation: insert into database
-	mock.ExpectExec("UPDATE users SET").WithArgs(user.Username, user.Email, user.ID).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("UPDATE users SET").WithArgs(user.Email, user.Username, user.Email, user.ID).WillReturnResult(sqlmock.NewResult(0, 1))
 
 	// Execute the method
-	if _, err := UpdateUser(db, user); err != nil {
+	if _, err := UpdateUser(context.Background(), db, user); err != nil {
 		t.Errorf("there was an unexpected error: %s", err)
 	}
 
@@ -110,7 +139,7 @@ func TestDeleteUser(t *testing.T) {
 	mock.ExpectExec("DELETE from users WHERE").WithArgs(user.ID).WillReturnResult(sqlmock.NewResult(0, 1))
 
 	// Execute the method
-	if _, err := DeleteUser(db, user); err != nil {
+	if _, err := DeleteUser(context.Background(), db, user); err != nil {
 		t.Errorf("there was an unexpected error: %s", err)
 	}
 
@@ -138,7 +167,7 @@ func TestGetUsers(t *testing.T) {
 	mock.ExpectQuery("SELECT (.+) FROM users").WillReturnRows(selectByIDRows)
 
 	// Execute the method
-	if _, err := GetUsers(db); err != nil {
+	if _, err := GetUsers(context.Background(), db); err != nil {
 		t.Errorf("there was an unexpected error: %s", err)
 	}
 
@@ -179,7 +208,7 @@ func TestGetUsernames(t *testing.T) {
 	})
 
 	// Execute the method
-	if _, err := GetUsernames(db, ids); err != nil {
+	if _, err := GetUsernames(context.Background(), db, ids); err != nil {
 		t.Errorf("there was an unexpected error: %s", err)
 	}
 
@@ -246,7 +275,7 @@ func TestUniqueEmail(t *testing.T) {
 	mock.ExpectQuery("SELECT (.+) FROM users WHERE").WithArgs(user1.Email).WillReturnRows(rowsWithData)
 
 	// Execute the method
-	if _, err := CreateUser(db, user1); err != nil {
+	if _, err := CreateUser(context.Background(), db, user1); err != nil {
 		expected := ErrEmailIsNotUnique.Error()
 		actual := err.Error()
 		if expected != actual {
@@ -282,7 +311,7 @@ func TestUniqueUsername(t *testing.T) {
 	mock.ExpectQuery("SELECT (.+) FROM users WHERE").WithArgs(user1.Username).WillReturnRows(rowsWithData)
 
 	// Execute the method
-	if _, err := CreateUser(db, user1); err != nil {
+	if _, err := CreateUser(context.Background(), db, user1); err != nil {
 		expected := ErrUsernameIsNotUnique.Error()
 		actual := err.Error()
 		if expected != actual {
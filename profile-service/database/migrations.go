@@ -0,0 +1,61 @@
+package db
+
+import (
+	"database/sql"
+
+	"github.com/bstaijen/mariadb-for-microservices/shared/migrate"
+)
+
+// Migrations are the versions of the users, password_resets and email_verifications tables in the ProfileService
+// schema.
+var Migrations = []migrate.Migration{
+	{
+		Version: 1,
+		Name:    "create users",
+		Up: []string{
+			"CREATE TABLE IF NOT EXISTS users (id INT NOT NULL AUTO_INCREMENT PRIMARY KEY, username varchar(255) NOT NULL UNIQUE, email varchar(255) NOT NULL UNIQUE, password varchar(255) NOT NULL, createdAt timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP, updatedAt timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP)",
+		},
+		Down: []string{
+			"DROP TABLE users",
+		},
+	},
+	{
+		Version: 2,
+		Name:    "seed demo user",
+		Up: []string{
+			"INSERT IGNORE INTO users (username, email, password) VALUES ('bstaijen', 'bjorge.staijen@mariadb.com', '$2a$10$1CSYrh6MYJdBoAnJMcQ22.sZ2QBfWL7VlfpQayOt8otdOa1Myjt7O')",
+		},
+		Down: []string{
+			"DELETE FROM users WHERE username = 'bstaijen'",
+		},
+	},
+	{
+		Version: 3,
+		Name:    "create password_resets",
+		Up: []string{
+			"CREATE TABLE IF NOT EXISTS password_resets (id INT NOT NULL AUTO_INCREMENT PRIMARY KEY, user_id INT NOT NULL, token_hash char(64) NOT NULL UNIQUE, expiresAt timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP, usedAt timestamp NULL DEFAULT NULL, createdAt timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP, FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE)",
+		},
+		Down: []string{
+			"DROP TABLE password_resets",
+		},
+	},
+	{
+		// The accounts which exist already are verified, they were created before it was possible.
+		Version: 4,
+		Name:    "add users.verified and create email_verifications",
+		Up: []string{
+			"ALTER TABLE users ADD COLUMN verified BOOLEAN NOT NULL DEFAULT FALSE",
+			"UPDATE users SET verified = TRUE",
+			"CREATE TABLE IF NOT EXISTS email_verifications (id INT NOT NULL AUTO_INCREMENT PRIMARY KEY, user_id INT NOT NULL, email varchar(255) NOT NULL, token_hash char(64) NOT NULL UNIQUE, expiresAt timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP, usedAt timestamp NULL DEFAULT NULL, createdAt timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP, FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE)",
+		},
+		Down: []string{
+			"DROP TABLE email_verifications",
+			"ALTER TABLE users DROP COLUMN verified",
+		},
+	},
+}
+
+// Migrator returns the migrator of the schema of the service.
+func Migrator(db *sql.DB) *migrate.Migrator {
+	return migrate.New(db, migrate.DefaultTable, Migrations)
+}
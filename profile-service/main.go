@@ -1,14 +1,24 @@
 package main
 
 import (
+	"context"
 	"net/http"
+	"os"
 	"strconv"
 
 	log "github.com/Sirupsen/logrus"
 
+	"github.com/bstaijen/mariadb-for-microservices/profile-service/app/http/controllers"
 	"github.com/bstaijen/mariadb-for-microservices/profile-service/app/http/routes"
 	"github.com/bstaijen/mariadb-for-microservices/profile-service/config"
 	"github.com/bstaijen/mariadb-for-microservices/profile-service/database"
+	"github.com/bstaijen/mariadb-for-microservices/shared/bootstrap"
+	"github.com/bstaijen/mariadb-for-microservices/shared/ipc"
+	"github.com/bstaijen/mariadb-for-microservices/shared/mail"
+	"github.com/bstaijen/mariadb-for-microservices/shared/metrics"
+	"github.com/bstaijen/mariadb-for-microservices/shared/migrate"
+	"github.com/bstaijen/mariadb-for-microservices/shared/tracing"
+	"github.com/bstaijen/mariadb-for-microservices/shared/util/middleware"
 	negronilogrus "github.com/meatballhat/negroni-logrus"
 
 	"github.com/urfave/negroni"
@@ -24,7 +34,18 @@ func main() {
 	log.SetLevel(log.DebugLevel)
 
 	// Get config
-	cnf := config.LoadConfig()
+	command, args := migrate.ParseCommand(os.Args[1:])
+	cnf, err := config.LoadConfig(args)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Export traces
+	shutdownTracing, err := tracing.Init("profile-service", cnf.OTLPEndpoint)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer shutdownTracing(context.Background())
 
 	// Get database
 	connection, err := db.OpenConnection(cnf)
@@ -33,13 +54,64 @@ func main() {
 	}
 	defer db.CloseConnection(connection)
 
+	// Run the migrate subcommand, or refuse to start while migrations are pending
+	migrator := db.Migrator(connection)
+	if command != nil {
+		if err := migrator.Run(context.Background(), command, os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if err := migrator.Check(context.Background()); err != nil {
+		log.Fatal(err)
+	}
+	if err := metrics.RegisterDB("profile", connection); err != nil {
+		log.Fatal(err)
+	}
+
+	// Load the keys which sign and verify the IPC calls
+	ipcKeys, err := ipc.LoadKeys(ipc.ProfileService, cnf.IPCKeyFile, cnf.IPCPublicKeys)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Mail the password reset links
+	mailer, err := mail.New(mail.Options{
+		Kind:         cnf.Mailer,
+		From:         cnf.MailFrom,
+		Dir:          cnf.MailDir,
+		SMTPAddr:     cnf.SMTPAddr,
+		SMTPUsername: cnf.SMTPUsername,
+		SMTPPassword: cnf.SMTPPassword,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	// Set the REST API routes
-	routes := routes.InitRoutes(connection, cnf)
+	routes := routes.InitRoutes(connection, cnf, ipcKeys, mailer)
+	routes.Handle("/metrics", metrics.Handler()).Methods("GET")
 	n := negroni.Classic()
+	n.Use(negroni.HandlerFunc(middleware.RequestID))
+	n.Use(negroni.HandlerFunc(tracing.Middleware))
+	n.Use(metrics.Middleware(routes))
 	n.Use(negronilogrus.NewMiddleware())
+	n.Use(middleware.Deadline(cnf.RequestTimeout))
+	n.Use(middleware.CORS(middleware.CORSOptions{
+		AllowedOrigins:   cnf.CORSAllowedOrigins,
+		AllowedMethods:   cnf.CORSAllowedMethods,
+		AllowedHeaders:   cnf.CORSAllowedHeaders,
+		AllowCredentials: cnf.CORSAllowCredentials,
+		MaxAge:           cnf.CORSMaxAge,
+	}))
 	n.UseHandler(routes)
 
-	// Start and listen on port in cbf.Port
+	// Start and listen on port in cnf.Port until the process is stopped. The deferred calls close the database
+	// after the requests in flight are finished and the reset links they started to mail are sent.
+	server := &http.Server{Addr: ":" + strconv.Itoa(cnf.Port), Handler: n}
 	log.Info("Starting server on port " + strconv.Itoa(cnf.Port))
-	log.Fatal(http.ListenAndServe(":"+strconv.Itoa(cnf.Port), n))
+	if err := bootstrap.Serve(server, cnf.ShutdownTimeout); err != nil {
+		log.Fatal(err)
+	}
+	controllers.WaitForMail()
 }
@@ -0,0 +1,18 @@
+#!/bin/bash
+set -e
+
+# Generates the IPC keys of the services into ipc-keys/: the private key of every service in ipc-keys/<service>.pem
+# and its public key in ipc-keys/public/<service>.pem. The docker-compose files mount the private key of a service
+# and the public keys of all services. Existing keys are kept.
+
+dir="$(dirname "$0")/../ipc-keys"
+mkdir -p "${dir}/public"
+
+for service in authentication-service profile-service photo-service vote-service comment-service; do
+    if [ ! -f "${dir}/${service}.pem" ]; then
+        echo "---Generate the key of ${service}"
+        openssl genrsa -out "${dir}/${service}.pem" 2048
+        chmod 600 "${dir}/${service}.pem"
+    fi
+    openssl rsa -in "${dir}/${service}.pem" -pubout -out "${dir}/public/${service}.pem"
+done
@@ -0,0 +1,102 @@
+// Package apierror defines the errors which the services return to their clients. Every error has a
+// machine-readable Code which determines the HTTP status of the response. Errors without a Code are classified by
+// From, anything unknown is treated as an internal error and its message is not shown to the client.
+package apierror
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"net"
+	"net/http"
+)
+
+// Code is the machine-readable kind of an error. It is sent to the client in the code member of the problem.
+type Code string
+
+// The codes and their HTTP status.
+const (
+	InvalidArgument  Code = "invalid_argument"  // 400, the request is malformed.
+	Unauthenticated  Code = "unauthenticated"   // 401, no or an invalid token was sent.
+	PermissionDenied Code = "permission_denied" // 403, the user may not perform the action.
+	NotFound         Code = "not_found"         // 404, the resource does not exist.
+	Conflict         Code = "conflict"          // 409, the resource conflicts with an existing one.
+	ValidationFailed Code = "validation_failed" // 422, the request is well-formed but its values are invalid.
+	TooManyRequests  Code = "too_many_requests" // 429, the client exceeded a rate limit.
+	Internal         Code = "internal"          // 500, a bug or an unexpected failure.
+	Unavailable      Code = "unavailable"       // 503, a dependency such as the database is down.
+)
+
+var statuses = map[Code]int{
+	InvalidArgument:  http.StatusBadRequest,
+	Unauthenticated:  http.StatusUnauthorized,
+	PermissionDenied: http.StatusForbidden,
+	NotFound:         http.StatusNotFound,
+	Conflict:         http.StatusConflict,
+	ValidationFailed: http.StatusUnprocessableEntity,
+	TooManyRequests:  http.StatusTooManyRequests,
+	Internal:         http.StatusInternalServerError,
+	Unavailable:      http.StatusServiceUnavailable,
+}
+
+// Status returns the HTTP status code which belongs to c. Unknown codes map to 500.
+func (c Code) Status() int {
+	if status, ok := statuses[c]; ok {
+		return status
+	}
+	return http.StatusInternalServerError
+}
+
+// Error is an error with a Code. Message is shown to the client, Err is the (optional) underlying cause which is
+// only logged.
+type Error struct {
+	Code    Code
+	Message string
+	Err     error
+}
+
+// New returns an Error with code and message.
+func New(code Code, message string) *Error {
+	return &Error{Code: code, Message: message}
+}
+
+// Wrap returns an Error with code and message which has err as its cause.
+func Wrap(code Code, message string, err error) *Error {
+	return &Error{Code: code, Message: message, Err: err}
+}
+
+func (e *Error) Error() string {
+	if e.Err != nil {
+		return e.Message + ": " + e.Err.Error()
+	}
+	return e.Message
+}
+
+// Unwrap returns the cause of e.
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Status returns the HTTP status code of e.
+func (e *Error) Status() int {
+	return e.Code.Status()
+}
+
+// From returns err as an *Error. Errors which already carry a Code (also when wrapped) are returned as is.
+// Connection failures and timeouts become Unavailable, everything else becomes Internal with a generic message so
+// no internals leak to the client.
+func From(err error) *Error {
+	var e *Error
+	if errors.As(err, &e) {
+		return e
+	}
+
+	var netErr net.Error
+	switch {
+	case errors.Is(err, driver.ErrBadConn), errors.Is(err, sql.ErrConnDone), errors.Is(err, context.DeadlineExceeded),
+		errors.As(err, &netErr):
+		return Wrap(Unavailable, "Service is temporarily unavailable", err)
+	}
+	return Wrap(Internal, "Internal server error", err)
+}
@@ -0,0 +1,56 @@
+package apierror
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestCodeStatus(t *testing.T) {
+	tests := map[Code]int{
+		InvalidArgument:  http.StatusBadRequest,
+		Unauthenticated:  http.StatusUnauthorized,
+		PermissionDenied: http.StatusForbidden,
+		NotFound:         http.StatusNotFound,
+		Conflict:         http.StatusConflict,
+		ValidationFailed: http.StatusUnprocessableEntity,
+		TooManyRequests:  http.StatusTooManyRequests,
+		Internal:         http.StatusInternalServerError,
+		Unavailable:      http.StatusServiceUnavailable,
+		Code("unknown"):  http.StatusInternalServerError,
+	}
+	for code, expected := range tests {
+		if actual := code.Status(); actual != expected {
+			t.Errorf("Expected %v but got %v", expected, actual)
+		}
+	}
+}
+
+// Test if From finds a typed error which was wrapped.
+func TestFromWrapped(t *testing.T) {
+	notFound := New(NotFound, "User does not exist")
+	err := fmt.Errorf("loading user: %w", notFound)
+
+	if actual := From(err); actual != notFound {
+		t.Errorf("Expected %v but got %v", notFound, actual)
+	}
+}
+
+// Test if From classifies untyped errors.
+func TestFromUntyped(t *testing.T) {
+	tests := map[error]Code{
+		context.DeadlineExceeded: Unavailable,
+		errors.New("boom"):       Internal,
+	}
+	for err, expected := range tests {
+		actual := From(err)
+		if actual.Code != expected {
+			t.Errorf("Expected %v but got %v", expected, actual.Code)
+		}
+		if !errors.Is(actual, err) {
+			t.Errorf("Expected %v to wrap %v", actual, err)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+// Package bootstrap starts and stops the services. OpenDB waits for the database to come online, so a service
+// doesn't crash when it starts before the database. Serve runs the HTTP server until the process is told to stop
+// and lets the requests in flight finish before it returns, after which the caller closes the database.
+package bootstrap
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net"
+	"net/http"
+	"os/signal"
+	"syscall"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// DBOptions configures OpenDB. Zero values fall back to DefaultDBOptions.
+type DBOptions struct {
+	// ConnectTimeout is how long OpenDB waits for the database to come online.
+	ConnectTimeout time.Duration
+
+	// Backoff is the delay after the first failed attempt. It doubles every attempt up to MaxBackoff.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+
+	// The limits of the connection pool.
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+}
+
+// DefaultDBOptions wait a minute for the database and keep the pool well below the default max_connections of
+// MariaDB, which is shared by all services.
+var DefaultDBOptions = DBOptions{
+	ConnectTimeout:  time.Minute,
+	Backoff:         500 * time.Millisecond,
+	MaxBackoff:      5 * time.Second,
+	MaxOpenConns:    20,
+	MaxIdleConns:    10,
+	ConnMaxLifetime: 5 * time.Minute,
+}
+
+// DefaultShutdownTimeout is how long Serve waits for the requests in flight by default. It stays below the 10
+// seconds docker waits before it kills a stopped container.
+const DefaultShutdownTimeout = 8 * time.Second
+
+// OpenDB opens the database and pings it until it answers or ConnectTimeout has passed.
+func OpenDB(ctx context.Context, driverName string, dsn string, options DBOptions) (*sql.DB, error) {
+	options = options.withDefaults()
+
+	db, err := sql.Open(driverName, dsn)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(options.MaxOpenConns)
+	db.SetMaxIdleConns(options.MaxIdleConns)
+	db.SetConnMaxLifetime(options.ConnMaxLifetime)
+
+	if err := waitForDB(ctx, db, options); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+func waitForDB(ctx context.Context, db *sql.DB, options DBOptions) error {
+	ctx, cancel := context.WithTimeout(ctx, options.ConnectTimeout)
+	defer cancel()
+
+	delay := options.Backoff
+	for attempt := 1; ; attempt++ {
+		err := db.PingContext(ctx)
+		if err == nil {
+			return nil
+		}
+		log.Warnf("Database is not reachable (attempt %v), retrying in %v: %v", attempt, delay, err)
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("database is not reachable after %v: %v", options.ConnectTimeout, err)
+		case <-time.After(delay):
+		}
+
+		delay *= 2
+		if delay > options.MaxBackoff {
+			delay = options.MaxBackoff
+		}
+	}
+}
+
+func (o DBOptions) withDefaults() DBOptions {
+	if o.ConnectTimeout <= 0 {
+		o.ConnectTimeout = DefaultDBOptions.ConnectTimeout
+	}
+	if o.Backoff <= 0 {
+		o.Backoff = DefaultDBOptions.Backoff
+	}
+	if o.MaxBackoff <= 0 {
+		o.MaxBackoff = DefaultDBOptions.MaxBackoff
+	}
+	if o.MaxOpenConns <= 0 {
+		o.MaxOpenConns = DefaultDBOptions.MaxOpenConns
+	}
+	if o.MaxIdleConns <= 0 {
+		o.MaxIdleConns = DefaultDBOptions.MaxIdleConns
+	}
+	if o.ConnMaxLifetime <= 0 {
+		o.ConnMaxLifetime = DefaultDBOptions.ConnMaxLifetime
+	}
+	return o
+}
+
+// Serve runs server until the process receives SIGINT or SIGTERM. Then it stops accepting connections and waits up
+// to timeout for the requests in flight. It returns an error when the server can't start or doesn't drain in time.
+func Serve(server *http.Server, timeout time.Duration) error {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	listener, err := net.Listen("tcp", server.Addr)
+	if err != nil {
+		return err
+	}
+	return serve(ctx, server, listener, timeout)
+}
+
+// serve runs server on listener until ctx is done.
+func serve(ctx context.Context, server *http.Server, listener net.Listener, timeout time.Duration) error {
+	if timeout <= 0 {
+		timeout = DefaultShutdownTimeout
+	}
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- server.Serve(listener)
+	}()
+
+	select {
+	case err := <-errs:
+		return err
+	case <-ctx.Done():
+	}
+
+	log.Infof("Shutting down, waiting up to %v for the requests in flight", timeout)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		return fmt.Errorf("shutdown: %v", err)
+	}
+	log.Info("Server stopped")
+	return nil
+}
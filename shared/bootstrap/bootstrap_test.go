@@ -0,0 +1,121 @@
+package bootstrap
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+// flakyDriver refuses connections until it was asked failures times.
+type flakyDriver struct {
+	mu       sync.Mutex
+	failures int
+	attempts int
+}
+
+func (d *flakyDriver) Open(name string) (driver.Conn, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.attempts++
+	if d.attempts <= d.failures {
+		return nil, errors.New("connection refused")
+	}
+	return conn{}, nil
+}
+
+type conn struct{}
+
+func (conn) Prepare(query string) (driver.Stmt, error) { return nil, errors.New("not implemented") }
+func (conn) Close() error                              { return nil }
+func (conn) Begin() (driver.Tx, error)                 { return nil, errors.New("not implemented") }
+
+var fastRetries = DBOptions{ConnectTimeout: time.Second, Backoff: time.Millisecond, MaxBackoff: time.Millisecond}
+
+// Test if OpenDB retries until the database is online.
+func TestOpenDBRetries(t *testing.T) {
+	d := &flakyDriver{failures: 3}
+	sql.Register("flaky-retries", d)
+
+	db, err := OpenDB(context.Background(), "flaky-retries", "", fastRetries)
+	if err != nil {
+		t.Fatalf("Expected no error, instead got %v", err.Error())
+	}
+	defer db.Close()
+
+	expected := 4
+	if d.attempts != expected {
+		t.Errorf("Expected %v but got %v", expected, d.attempts)
+	}
+	if actual := db.Stats().MaxOpenConnections; actual != DefaultDBOptions.MaxOpenConns {
+		t.Errorf("Expected %v but got %v", DefaultDBOptions.MaxOpenConns, actual)
+	}
+}
+
+// Test if OpenDB gives up after the connect timeout.
+func TestOpenDBTimeout(t *testing.T) {
+	sql.Register("flaky-timeout", &flakyDriver{failures: 1 << 30})
+
+	options := fastRetries
+	options.ConnectTimeout = 20 * time.Millisecond
+	start := time.Now()
+	if _, err := OpenDB(context.Background(), "flaky-timeout", "", options); err == nil {
+		t.Fatal("Expected an error but got nil")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected OpenDB to give up after the timeout but it took %v", elapsed)
+	}
+}
+
+// Test if serve lets a request in flight finish before it returns.
+func TestServeDrains(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		w.WriteHeader(http.StatusOK)
+	})}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, stop := context.WithCancel(context.Background())
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- serve(ctx, server, listener, time.Second)
+	}()
+
+	responses := make(chan int, 1)
+	go func() {
+		res, err := http.Get("http://" + listener.Addr().String())
+		if err != nil {
+			responses <- 0
+			return
+		}
+		res.Body.Close()
+		responses <- res.StatusCode
+	}()
+
+	<-started
+	stop()
+	select {
+	case <-stopped:
+		t.Fatal("Expected serve to wait for the request in flight")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	if status := <-responses; status != http.StatusOK {
+		t.Errorf("Expected %v but got %v", http.StatusOK, status)
+	}
+	if err := <-stopped; err != nil {
+		t.Errorf("Expected no error, instead got %v", err.Error())
+	}
+}
@@ -0,0 +1,141 @@
+// Package health contains the liveness and readiness handlers of the services. Liveness (/healthz) only tells that
+// the process serves requests. Readiness (/readyz) also checks the dependencies of the service, the database and
+// the services it calls, so a load balancer only sends traffic to an instance which can handle it.
+package health
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bstaijen/mariadb-for-microservices/shared/util"
+	"github.com/urfave/negroni"
+)
+
+// DefaultTimeout is the timeout of a single check.
+const DefaultTimeout = 2 * time.Second
+
+// The statuses of the service and of its checks.
+const (
+	StatusOK          = "ok"
+	StatusUnavailable = "unavailable"
+)
+
+// Check is a single dependency of a service. Run returns an error when the dependency can't be used.
+type Check struct {
+	Name string
+	Run  func(ctx context.Context) error
+}
+
+// Report is the body of the /healthz and /readyz responses.
+type Report struct {
+	Status string                  `json:"status"`
+	Checks map[string]*CheckResult `json:"checks,omitempty"`
+}
+
+// CheckResult is the outcome of one check.
+type CheckResult struct {
+	Status     string `json:"status"`
+	DurationMS int64  `json:"duration_ms"`
+	Error      string `json:"error,omitempty"`
+}
+
+// Liveness is a middleware handler for /healthz. It doesn't touch any dependency, a failing database should not
+// get the instance restarted.
+func Liveness(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	send(w, http.StatusOK, &Report{Status: StatusOK})
+}
+
+// Readiness returns a middleware handler for /readyz which runs checks in parallel, each with timeout. It answers
+// 200 when all checks pass and 503 otherwise, in both cases with the result of every check.
+func Readiness(timeout time.Duration, checks ...Check) negroni.HandlerFunc {
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	return negroni.HandlerFunc(func(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+		report := &Report{Status: StatusOK, Checks: make(map[string]*CheckResult, len(checks))}
+
+		var mu sync.Mutex
+		var wg sync.WaitGroup
+		for _, check := range checks {
+			wg.Add(1)
+			go func(check Check) {
+				defer wg.Done()
+				result := run(r.Context(), check, timeout)
+
+				mu.Lock()
+				defer mu.Unlock()
+				report.Checks[check.Name] = result
+				if result.Status != StatusOK {
+					report.Status = StatusUnavailable
+					util.Log(r.Context()).Warnf("Readiness check %v failed: %v", check.Name, result.Error)
+				}
+			}(check)
+		}
+		wg.Wait()
+
+		status := http.StatusOK
+		if report.Status != StatusOK {
+			status = http.StatusServiceUnavailable
+		}
+		send(w, status, report)
+	})
+}
+
+func run(ctx context.Context, check Check, timeout time.Duration) *CheckResult {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	start := time.Now()
+	err := check.Run(ctx)
+	result := &CheckResult{Status: StatusOK, DurationMS: time.Since(start).Nanoseconds() / int64(time.Millisecond)}
+	if err != nil {
+		result.Status = StatusUnavailable
+		result.Error = err.Error()
+	}
+	return result
+}
+
+// Database returns a check which pings db.
+func Database(db *sql.DB) Check {
+	return Check{Name: "database", Run: func(ctx context.Context) error {
+		if db == nil {
+			return errors.New("no database connection")
+		}
+		return db.PingContext(ctx)
+	}}
+}
+
+// Service returns a check which calls the /healthz route of the service name on baseURL. It uses liveness instead
+// of readiness, otherwise a single failing database would make every service which depends on it unready.
+func Service(name string, baseURL string) Check {
+	return Check{Name: name, Run: func(ctx context.Context) error {
+		url := strings.TrimSuffix(baseURL, "/") + "/healthz"
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			return err
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return err
+		}
+		defer res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			return fmt.Errorf("%v answered with statuscode %v", url, res.StatusCode)
+		}
+		return nil
+	}}
+}
+
+func send(w http.ResponseWriter, status int, report *Report) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(report)
+}
@@ -0,0 +1,104 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	sqlmock "gopkg.in/DATA-DOG/go-sqlmock.v1"
+)
+
+func serve(t *testing.T, handler func(http.ResponseWriter, *http.Request, http.HandlerFunc)) (*httptest.ResponseRecorder, *Report) {
+	req, err := http.NewRequest("GET", "http://localhost/readyz", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := httptest.NewRecorder()
+	handler(res, req, nil)
+
+	report := &Report{}
+	if err := json.Unmarshal(res.Body.Bytes(), report); err != nil {
+		t.Fatal(err)
+	}
+	return res, report
+}
+
+func TestLiveness(t *testing.T) {
+	res, report := serve(t, Liveness)
+
+	if res.Result().StatusCode != http.StatusOK {
+		t.Errorf("Expected %v but got %v", http.StatusOK, res.Result().StatusCode)
+	}
+	if report.Status != StatusOK {
+		t.Errorf("Expected %v but got %v", StatusOK, report.Status)
+	}
+}
+
+// Test if the database and the downstream services are checked.
+func TestReadiness(t *testing.T) {
+	db, _, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/healthz" {
+			t.Errorf("Expected %v but got %v", "/healthz", r.URL.Path)
+		}
+		Liveness(w, r, nil)
+	}))
+	defer ts.Close()
+
+	res, report := serve(t, Readiness(time.Second, Database(db), Service("vote-service", ts.URL+"/")))
+
+	if res.Result().StatusCode != http.StatusOK {
+		t.Errorf("Expected %v but got %v", http.StatusOK, res.Result().StatusCode)
+	}
+	for _, name := range []string{"database", "vote-service"} {
+		if check, ok := report.Checks[name]; !ok || check.Status != StatusOK {
+			t.Errorf("Expected %v to be %v but got %v", name, StatusOK, check)
+		}
+	}
+}
+
+// Test if a single failing dependency makes the service unready and is reported with its error.
+func TestReadinessFailure(t *testing.T) {
+	failing := Check{Name: "failing", Run: func(ctx context.Context) error {
+		return errors.New("connection refused")
+	}}
+
+	res, report := serve(t, Readiness(time.Second, Database(nil), failing))
+
+	if res.Result().StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("Expected %v but got %v", http.StatusServiceUnavailable, res.Result().StatusCode)
+	}
+	if report.Status != StatusUnavailable {
+		t.Errorf("Expected %v but got %v", StatusUnavailable, report.Status)
+	}
+	if check := report.Checks["failing"]; check == nil || check.Error != "connection refused" {
+		t.Errorf("Expected the error of the check but got %v", check)
+	}
+}
+
+// Test if a slow check is cancelled after the timeout.
+func TestReadinessTimeout(t *testing.T) {
+	slow := Check{Name: "slow", Run: func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}}
+
+	start := time.Now()
+	res, _ := serve(t, Readiness(10*time.Millisecond, slow))
+
+	if res.Result().StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("Expected %v but got %v", http.StatusServiceUnavailable, res.Result().StatusCode)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected the check to be cancelled but it took %v", elapsed)
+	}
+}
@@ -0,0 +1,117 @@
+package ipc
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/bstaijen/mariadb-for-microservices/shared/models"
+	"github.com/bstaijen/mariadb-for-microservices/shared/util/middleware"
+)
+
+// AuthenticationClient is the client for the IPC routes of the authentication service.
+type AuthenticationClient interface {
+	// TokenStatus returns whether the access token tokenID of the user identified by userID was revoked.
+	TokenStatus(ctx context.Context, userID int, tokenID string) (*models.TokenStatusResponse, error)
+
+	// RevokeSessions logs the user identified by userID out everywhere: every access token and every refresh token
+	// issued before is revoked.
+	RevokeSessions(ctx context.Context, userID int) error
+
+	// AccessToken returns the personal access token with tokenHash, or nil when it doesn't exist.
+	AccessToken(ctx context.Context, tokenHash string) (*models.AccessTokenResponse, error)
+}
+
+// NewAuthenticationClient returns an AuthenticationClient which talks to the authentication service on baseURL. The
+// calls are authenticated with identity.
+func NewAuthenticationClient(baseURL string, identity Identity) AuthenticationClient {
+	return &authenticationClient{client{baseURL: baseURL, audience: AuthenticationService, identity: identity}}
+}
+
+type authenticationClient struct {
+	client
+}
+
+func (c *authenticationClient) TokenStatus(ctx context.Context, userID int, tokenID string) (*models.TokenStatusResponse, error) {
+	requests := []*models.TokenStatusRequest{{UserID: userID, TokenID: tokenID}}
+
+	statuses := make([]*models.TokenStatusResponse, 0)
+	if err := c.get(ctx, "/ipc/tokenStatus", requests, &statuses); err != nil {
+		return nil, err
+	}
+	if len(statuses) != 1 {
+		return nil, fmt.Errorf("ipc: expected the status of 1 token but got %v", len(statuses))
+	}
+	return statuses[0], nil
+}
+
+func (c *authenticationClient) RevokeSessions(ctx context.Context, userID int) error {
+	requests := []*models.RevokeSessionsRequest{{UserID: userID}}
+
+	revoked := make([]*models.RevokeSessionsResponse, 0)
+	if err := c.post(ctx, "/ipc/revokeSessions", requests, &revoked); err != nil {
+		return err
+	}
+	if len(revoked) != 1 {
+		return fmt.Errorf("ipc: expected the sessions of 1 user to be revoked but got %v", len(revoked))
+	}
+	return nil
+}
+
+func (c *authenticationClient) AccessToken(ctx context.Context, tokenHash string) (*models.AccessTokenResponse, error) {
+	requests := []*models.AccessTokenRequest{{TokenHash: tokenHash}}
+
+	tokens := make([]*models.AccessTokenResponse, 0)
+	if err := c.get(ctx, "/ipc/accessTokens", requests, &tokens); err != nil {
+		return nil, err
+	}
+	for _, token := range tokens {
+		if token.TokenHash == tokenHash {
+			return token, nil
+		}
+	}
+	return nil, nil
+}
+
+// NewRevocations returns the Revocations with which the token middleware of a service checks the access tokens at
+// the authentication service on baseURL. The answers are cached for ttl. It returns nil, which disables the check,
+// when baseURL is empty.
+func NewRevocations(baseURL string, identity Identity, ttl time.Duration) middleware.Revocations {
+	if baseURL == "" {
+		return nil
+	}
+	return RevocationsOf(NewAuthenticationClient(baseURL, identity), ttl)
+}
+
+// RevocationsOf returns Revocations which look up the tokens with client.
+func RevocationsOf(client AuthenticationClient, ttl time.Duration) middleware.Revocations {
+	return middleware.NewRevocationCache(func(ctx context.Context, userID int, tokenID string) (middleware.TokenStatus, error) {
+		status, err := client.TokenStatus(ctx, userID, tokenID)
+		if err != nil {
+			return middleware.TokenStatus{}, err
+		}
+		return middleware.TokenStatus{Revoked: status.Revoked, Version: status.Version}, nil
+	}, ttl)
+}
+
+// NewAccessTokens returns the AccessTokens with which the token middleware of a service looks up personal access
+// tokens at the authentication service on baseURL. The answers are cached for ttl. It returns nil, which refuses
+// every personal access token, when baseURL is empty.
+func NewAccessTokens(baseURL string, identity Identity, ttl time.Duration) middleware.AccessTokens {
+	if baseURL == "" {
+		return nil
+	}
+	return AccessTokensOf(NewAuthenticationClient(baseURL, identity), ttl)
+}
+
+// AccessTokensOf returns AccessTokens which look up the personal access tokens with client.
+func AccessTokensOf(client AuthenticationClient, ttl time.Duration) middleware.AccessTokens {
+	return middleware.NewAccessTokenCache(func(ctx context.Context, tokenHash string) (*middleware.Principal, error) {
+		token, err := client.AccessToken(ctx, tokenHash)
+		if err != nil || token == nil {
+			return nil, err
+		}
+		scopes := append([]string{}, token.Scopes...)
+		return &middleware.Principal{ID: token.UserID, EmailVerified: token.EmailVerified, Scopes: scopes}, nil
+	}, ttl)
+}
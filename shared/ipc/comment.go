@@ -0,0 +1,52 @@
+package ipc
+
+import (
+	"context"
+
+	"github.com/bstaijen/mariadb-for-microservices/shared/models"
+)
+
+// CommentClient is the client for the IPC routes of the comment service.
+type CommentClient interface {
+	// LastTen returns the last 10 comments of each photo identified by photoIDs.
+	LastTen(ctx context.Context, photoIDs []int) ([]*models.CommentResponse, error)
+
+	// Counts returns the number of comments of each photo identified by photoIDs.
+	Counts(ctx context.Context, photoIDs []int) ([]*models.CommentCountResponse, error)
+}
+
+// NewCommentClient returns a CommentClient which talks to the comment service on baseURL. The calls are authenticated
+// with identity.
+func NewCommentClient(baseURL string, identity Identity) CommentClient {
+	return &commentClient{client{baseURL: baseURL, audience: CommentService, identity: identity}}
+}
+
+type commentClient struct {
+	client
+}
+
+func (c *commentClient) LastTen(ctx context.Context, photoIDs []int) ([]*models.CommentResponse, error) {
+	requests := make([]*models.CommentRequest, 0, len(photoIDs))
+	for _, id := range photoIDs {
+		requests = append(requests, &models.CommentRequest{PhotoID: id})
+	}
+
+	comments := make([]*models.CommentResponse, 0)
+	if err := c.get(ctx, "/ipc/getLast10", requests, &comments); err != nil {
+		return nil, err
+	}
+	return comments, nil
+}
+
+func (c *commentClient) Counts(ctx context.Context, photoIDs []int) ([]*models.CommentCountResponse, error) {
+	requests := make([]*models.CommentCountRequest, 0, len(photoIDs))
+	for _, id := range photoIDs {
+		requests = append(requests, &models.CommentCountRequest{PhotoID: id})
+	}
+
+	counts := make([]*models.CommentCountResponse, 0)
+	if err := c.get(ctx, "/ipc/getCount", requests, &counts); err != nil {
+		return nil, err
+	}
+	return counts, nil
+}
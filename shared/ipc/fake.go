@@ -0,0 +1,294 @@
+package ipc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"sort"
+	"sync"
+
+	"github.com/bstaijen/mariadb-for-microservices/shared/models"
+	"github.com/bstaijen/mariadb-for-microservices/shared/util/middleware"
+)
+
+// The fakes in this file keep their data in memory and can be used in handler tests instead of a
+// httptest server. Every fake returns Err (when set) instead of a result.
+
+var fakeKeys struct {
+	once    sync.Once
+	private map[string]*rsa.PrivateKey
+	public  middleware.ServiceKeys
+}
+
+// FakeKeys returns the Keys of service for tests. The keys of all Services are generated once per process and every
+// service knows the public keys of all of them.
+func FakeKeys(service string) *Keys {
+	fakeKeys.once.Do(func() {
+		fakeKeys.private = make(map[string]*rsa.PrivateKey, len(Services))
+		fakeKeys.public = make(middleware.ServiceKeys, len(Services))
+		for _, name := range Services {
+			key, err := rsa.GenerateKey(rand.Reader, 2048)
+			if err != nil {
+				panic(err)
+			}
+			fakeKeys.private[name] = key
+			fakeKeys.public[name] = &key.PublicKey
+		}
+	})
+	return &Keys{Identity: Identity{Service: service, Key: fakeKeys.private[service]}, Callers: fakeKeys.public}
+}
+
+// FakeProfileClient is an in-memory ProfileClient. Users maps user IDs to usernames and Emails maps user IDs to
+// email addresses.
+type FakeProfileClient struct {
+	Users  map[int]string
+	Emails map[int]string
+	Err    error
+}
+
+// Usernames returns the known usernames of userIDs.
+func (f *FakeProfileClient) Usernames(ctx context.Context, userIDs []int) ([]*models.GetUsernamesResponse, error) {
+	if f.Err != nil {
+		return nil, f.Err
+	}
+	usernames := make([]*models.GetUsernamesResponse, 0)
+	for _, id := range userIDs {
+		if username, ok := f.Users[id]; ok {
+			usernames = append(usernames, &models.GetUsernamesResponse{ID: id, Username: username})
+		}
+	}
+	return usernames, nil
+}
+
+// CreateUser adds a user with the next free ID, or returns nil when email is taken.
+func (f *FakeProfileClient) CreateUser(ctx context.Context, username string, email string) (*models.CreateUserResponse, error) {
+	if f.Err != nil {
+		return nil, f.Err
+	}
+	if f.Users == nil {
+		f.Users = make(map[int]string)
+	}
+	if f.Emails == nil {
+		f.Emails = make(map[int]string)
+	}
+
+	id := 1
+	for existingID := range f.Users {
+		if f.Emails[existingID] == email {
+			return nil, nil
+		}
+		if existingID >= id {
+			id = existingID + 1
+		}
+	}
+	f.Users[id] = username
+	f.Emails[id] = email
+	return &models.CreateUserResponse{ID: id, Username: username, Email: email}, nil
+}
+
+// FakePhotoClient is an in-memory PhotoClient.
+type FakePhotoClient struct {
+	Images []*models.PhotoResponse
+	Err    error
+}
+
+// Photos returns the known photos of photoIDs.
+func (f *FakePhotoClient) Photos(ctx context.Context, photoIDs []int) ([]*models.PhotoResponse, error) {
+	if f.Err != nil {
+		return nil, f.Err
+	}
+	photos := make([]*models.PhotoResponse, 0)
+	for _, photo := range f.Images {
+		if containsID(photoIDs, photo.ID) {
+			// Hand out a copy so the caller can decorate it without changing the fake.
+			p := *photo
+			photos = append(photos, &p)
+		}
+	}
+	return photos, nil
+}
+
+// FakeVoteClient is an in-memory VoteClient. The counts and timelines are derived from Votes.
+type FakeVoteClient struct {
+	Votes []*models.VoteCreateRequest
+	Err   error
+}
+
+// Counts returns the up- and downvotes of photoIDs.
+func (f *FakeVoteClient) Counts(ctx context.Context, photoIDs []int) ([]*models.VoteCountResponse, error) {
+	if f.Err != nil {
+		return nil, f.Err
+	}
+	counts := make([]*models.VoteCountResponse, 0)
+	for _, count := range f.count() {
+		if containsID(photoIDs, count.PhotoID) {
+			counts = append(counts, count)
+		}
+	}
+	return counts, nil
+}
+
+// Voted returns the votes userID placed on photoIDs.
+func (f *FakeVoteClient) Voted(ctx context.Context, userID int, photoIDs []int) ([]*models.HasVotedResponse, error) {
+	if f.Err != nil {
+		return nil, f.Err
+	}
+	voted := make([]*models.HasVotedResponse, 0)
+	for _, vote := range f.Votes {
+		if vote.UserID == userID && containsID(photoIDs, vote.PhotoID) {
+			voted = append(voted, &models.HasVotedResponse{
+				UserID:   vote.UserID,
+				PhotoID:  vote.PhotoID,
+				Upvote:   vote.Upvote,
+				Downvote: vote.Downvote,
+			})
+		}
+	}
+	return voted, nil
+}
+
+// TopRated returns a page of photos ordered by upvotes minus downvotes.
+func (f *FakeVoteClient) TopRated(ctx context.Context, offset, rows int) ([]*models.TopRatedPhotoResponse, error) {
+	if f.Err != nil {
+		return nil, f.Err
+	}
+	return f.timeline(offset, rows), nil
+}
+
+// Hot returns the same page as TopRated. The fake does not keep track of when a vote was placed.
+func (f *FakeVoteClient) Hot(ctx context.Context, offset, rows int) ([]*models.TopRatedPhotoResponse, error) {
+	if f.Err != nil {
+		return nil, f.Err
+	}
+	return f.timeline(offset, rows), nil
+}
+
+func (f *FakeVoteClient) count() []*models.VoteCountResponse {
+	counts := make([]*models.VoteCountResponse, 0)
+	index := make(map[int]*models.VoteCountResponse)
+	for _, vote := range f.Votes {
+		count, ok := index[vote.PhotoID]
+		if !ok {
+			count = &models.VoteCountResponse{PhotoID: vote.PhotoID}
+			index[vote.PhotoID] = count
+			counts = append(counts, count)
+		}
+		if vote.Upvote {
+			count.UpVoteCount++
+		}
+		if vote.Downvote {
+			count.DownVoteCount++
+		}
+	}
+	return counts
+}
+
+func (f *FakeVoteClient) timeline(offset, rows int) []*models.TopRatedPhotoResponse {
+	counts := f.count()
+	sort.Stable(byScore(counts))
+
+	photos := make([]*models.TopRatedPhotoResponse, 0)
+	for i := offset; i < len(counts) && i < offset+rows; i++ {
+		photos = append(photos, &models.TopRatedPhotoResponse{PhotoID: counts[i].PhotoID})
+	}
+	return photos
+}
+
+// byScore orders vote counts by upvotes minus downvotes, highest first.
+type byScore []*models.VoteCountResponse
+
+func (s byScore) Len() int      { return len(s) }
+func (s byScore) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s byScore) Less(i, j int) bool {
+	return s[i].UpVoteCount-s[i].DownVoteCount > s[j].UpVoteCount-s[j].DownVoteCount
+}
+
+// FakeCommentClient is an in-memory CommentClient. Comments are expected to be ordered newest first.
+type FakeCommentClient struct {
+	Comments []*models.CommentResponse
+	Err      error
+}
+
+// LastTen returns at most 10 comments of each photo in photoIDs.
+func (f *FakeCommentClient) LastTen(ctx context.Context, photoIDs []int) ([]*models.CommentResponse, error) {
+	if f.Err != nil {
+		return nil, f.Err
+	}
+	comments := make([]*models.CommentResponse, 0)
+	perPhoto := make(map[int]int)
+	for _, comment := range f.Comments {
+		if containsID(photoIDs, comment.PhotoID) && perPhoto[comment.PhotoID] < 10 {
+			perPhoto[comment.PhotoID]++
+			c := *comment
+			comments = append(comments, &c)
+		}
+	}
+	return comments, nil
+}
+
+// Counts returns the number of comments of each photo in photoIDs.
+func (f *FakeCommentClient) Counts(ctx context.Context, photoIDs []int) ([]*models.CommentCountResponse, error) {
+	if f.Err != nil {
+		return nil, f.Err
+	}
+	counts := make([]*models.CommentCountResponse, 0)
+	for _, id := range photoIDs {
+		count := &models.CommentCountResponse{PhotoID: id}
+		for _, comment := range f.Comments {
+			if comment.PhotoID == id {
+				count.Count++
+			}
+		}
+		counts = append(counts, count)
+	}
+	return counts, nil
+}
+
+// FakeAuthenticationClient is an in-memory AuthenticationClient. Revoked contains the revoked token IDs and
+// Versions maps user IDs to their token version. RevokedUsers records the users whose sessions were revoked.
+// AccessTokens maps the hashes of personal access tokens to the tokens.
+type FakeAuthenticationClient struct {
+	Revoked      map[string]bool
+	Versions     map[int]int
+	RevokedUsers []int
+	AccessTokens map[string]*models.AccessTokenResponse
+	Err          error
+}
+
+// TokenStatus returns whether tokenID is revoked together with the token version of userID.
+func (f *FakeAuthenticationClient) TokenStatus(ctx context.Context, userID int, tokenID string) (*models.TokenStatusResponse, error) {
+	if f.Err != nil {
+		return nil, f.Err
+	}
+	return &models.TokenStatusResponse{UserID: userID, TokenID: tokenID, Revoked: f.Revoked[tokenID], Version: f.Versions[userID]}, nil
+}
+
+// RevokeSessions records userID in RevokedUsers and increments its token version.
+func (f *FakeAuthenticationClient) RevokeSessions(ctx context.Context, userID int) error {
+	if f.Err != nil {
+		return f.Err
+	}
+	if f.Versions == nil {
+		f.Versions = make(map[int]int)
+	}
+	f.Versions[userID]++
+	f.RevokedUsers = append(f.RevokedUsers, userID)
+	return nil
+}
+
+// AccessToken returns the personal access token with tokenHash, or nil when it isn't in AccessTokens.
+func (f *FakeAuthenticationClient) AccessToken(ctx context.Context, tokenHash string) (*models.AccessTokenResponse, error) {
+	if f.Err != nil {
+		return nil, f.Err
+	}
+	return f.AccessTokens[tokenHash], nil
+}
+
+func containsID(ids []int, id int) bool {
+	for _, v := range ids {
+		if v == id {
+			return true
+		}
+	}
+	return false
+}
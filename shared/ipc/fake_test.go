@@ -0,0 +1,60 @@
+package ipc
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/bstaijen/mariadb-for-microservices/shared/models"
+)
+
+func TestFakeVoteClient(t *testing.T) {
+	fake := &FakeVoteClient{Votes: []*models.VoteCreateRequest{
+		&models.VoteCreateRequest{UserID: 1, PhotoID: 1, Downvote: true},
+		&models.VoteCreateRequest{UserID: 1, PhotoID: 2, Upvote: true},
+		&models.VoteCreateRequest{UserID: 2, PhotoID: 2, Upvote: true},
+	}}
+
+	counts, _ := fake.Counts(context.Background(), []int{2})
+	if len(counts) != 1 || counts[0].UpVoteCount != 2 {
+		t.Errorf("Expected 2 upvotes on photo 2 but got %v", counts)
+	}
+
+	voted, _ := fake.Voted(context.Background(), 1, []int{1, 2})
+	if len(voted) != 2 || !voted[0].Downvote || !voted[1].Upvote {
+		t.Errorf("Expected a downvote on photo 1 and an upvote on photo 2 but got %v", voted)
+	}
+
+	photos, _ := fake.TopRated(context.Background(), 0, 1)
+	if len(photos) != 1 || photos[0].PhotoID != 2 {
+		t.Errorf("Expected photo 2 on top but got %v", photos)
+	}
+}
+
+func TestFakeCommentClientLastTen(t *testing.T) {
+	fake := &FakeCommentClient{}
+	for i := 0; i < 12; i++ {
+		fake.Comments = append(fake.Comments, &models.CommentResponse{ID: i, PhotoID: 1})
+	}
+
+	comments, _ := fake.LastTen(context.Background(), []int{1})
+	expected := 10
+	if len(comments) != expected {
+		t.Errorf("Expected %v but got %v", expected, len(comments))
+	}
+
+	counts, _ := fake.Counts(context.Background(), []int{1, 2})
+	if len(counts) != 2 || counts[0].Count != 12 || counts[1].Count != 0 {
+		t.Errorf("Expected counts 12 and 0 but got %v", counts)
+	}
+}
+
+func TestFakeErr(t *testing.T) {
+	expected := errors.New("service unavailable")
+	fake := &FakeProfileClient{Users: map[int]string{1: "mockuser"}, Err: expected}
+
+	_, err := fake.Usernames(context.Background(), []int{1})
+	if err != expected {
+		t.Errorf("Expected %v but got %v", expected, err)
+	}
+}
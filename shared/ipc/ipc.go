@@ -0,0 +1,145 @@
+// Package ipc contains the typed clients the services use to talk to each other
+// over the /ipc routes, together with the helpers the IPC handlers use to read
+// and write the shared envelope.
+//
+// Every IPC call uses the same envelope. A request body looks like
+// {"requests":[...]} and a response body looks like {"results":[...]}.
+//
+// The calls are authenticated with a short-lived service token in the
+// Authorization header. It names the calling service and the service it is
+// meant for and is signed with the private key of the calling service, see
+// middleware.NewServiceToken. Every route names the services which may call it.
+package ipc
+
+import (
+	"context"
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/bstaijen/mariadb-for-microservices/shared/util"
+	"github.com/bstaijen/mariadb-for-microservices/shared/util/middleware"
+)
+
+// The names with which the services identify themselves on the IPC routes.
+const (
+	AuthenticationService = "authentication-service"
+	ProfileService        = "profile-service"
+	PhotoService          = "photo-service"
+	VoteService           = "vote-service"
+	CommentService        = "comment-service"
+)
+
+// Services are the names of all services.
+var Services = []string{AuthenticationService, ProfileService, PhotoService, VoteService, CommentService}
+
+// Identity is the identity with which a service calls the IPC routes of the other services. Key is the private key
+// of the service, which only it holds. The calls are made without a token when it is nil.
+type Identity struct {
+	Service string
+	Key     *rsa.PrivateKey
+}
+
+// Clients bundles the IPC clients a service can talk to. Services only fill in the clients they need.
+type Clients struct {
+	Authentication AuthenticationClient
+	Profile        ProfileClient
+	Photo          PhotoClient
+	Vote           VoteClient
+	Comment        CommentClient
+}
+
+// requestEnvelope is the body of every IPC request.
+type requestEnvelope struct {
+	Requests interface{} `json:"requests"`
+}
+
+// responseEnvelope is the body of every IPC response.
+type responseEnvelope struct {
+	Results interface{} `json:"results"`
+}
+
+// ReadRequests decodes the requests of an IPC envelope into target. Target must be a pointer to a slice.
+func ReadRequests(r *http.Request, target interface{}) error {
+	return util.RequestToJSON(r, &requestEnvelope{Requests: target})
+}
+
+// SendResults writes results to the client wrapped in an IPC envelope.
+func SendResults(w http.ResponseWriter, results interface{}) {
+	util.SendOK(w, &responseEnvelope{Results: results})
+}
+
+// StatusError is returned by the clients when the other service answers with a non 2xx status code.
+type StatusError struct {
+	URL        string
+	StatusCode int
+	Body       string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("ipc: %v answered with statuscode %v: %v", e.URL, e.StatusCode, e.Body)
+}
+
+// ErrInvalidBaseURL is returned when a client is configured with a base URL which does not start with http.
+var ErrInvalidBaseURL = errors.New("ipc: base URL must start with http")
+
+// client contains the transport shared by all typed clients. Audience is the name of the service on baseURL.
+type client struct {
+	baseURL  string
+	audience string
+	identity Identity
+}
+
+// get sends requests (if any) wrapped in an envelope to path and decodes the results of the answer into results.
+func (c *client) get(ctx context.Context, path string, requests interface{}, results interface{}) error {
+	return c.call(ctx, http.MethodGet, path, requests, results)
+}
+
+// post works like get for the IPC routes which change state. They aren't retried.
+func (c *client) post(ctx context.Context, path string, requests interface{}, results interface{}) error {
+	return c.call(ctx, http.MethodPost, path, requests, results)
+}
+
+func (c *client) call(ctx context.Context, method string, path string, requests interface{}, results interface{}) error {
+	url := strings.TrimSuffix(c.baseURL, "/") + path
+	if !strings.HasPrefix(url, "http") {
+		return ErrInvalidBaseURL
+	}
+
+	var body []byte
+	if requests != nil {
+		var err error
+		body, err = json.Marshal(&requestEnvelope{Requests: requests})
+		if err != nil {
+			return err
+		}
+	}
+
+	var header http.Header
+	if c.identity.Key != nil {
+		token, err := middleware.NewServiceToken(c.identity.Key, c.identity.Service, c.audience)
+		if err != nil {
+			return err
+		}
+		header = http.Header{"Authorization": []string{"Bearer " + token}}
+	}
+
+	var callErr error
+	err := util.RequestWithHeader(ctx, method, url, header, body, func(res *http.Response) {
+		defer res.Body.Close()
+		if res.StatusCode < 200 || res.StatusCode > 299 {
+			data, _ := ioutil.ReadAll(res.Body)
+			callErr = &StatusError{URL: url, StatusCode: res.StatusCode, Body: string(data)}
+			return
+		}
+		callErr = util.ResponseJSONToObject(res, &responseEnvelope{Results: results})
+	})
+	if err != nil {
+		return err
+	}
+	return callErr
+}
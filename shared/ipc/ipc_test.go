@@ -0,0 +1,234 @@
+package ipc
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/bstaijen/mariadb-for-microservices/shared/models"
+	"github.com/bstaijen/mariadb-for-microservices/shared/util"
+	"github.com/bstaijen/mariadb-for-microservices/shared/util/middleware"
+)
+
+func TestProfileClientUsernames(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		expectedURL := "/ipc/usernames"
+		if r.URL.String() != expectedURL {
+			t.Errorf("Expected %v but got %v", expectedURL, r.URL.String())
+		}
+
+		requests := make([]*models.GetUsernamesRequest, 0)
+		if err := ReadRequests(r, &requests); err != nil {
+			t.Fatal(err)
+		}
+
+		usernames := make([]*models.GetUsernamesResponse, 0)
+		for _, v := range requests {
+			usernames = append(usernames, &models.GetUsernamesResponse{ID: v.ID, Username: "mockuser"})
+		}
+		SendResults(w, usernames)
+	}))
+	defer ts.Close()
+
+	// The trailing slash is how the base URLs are configured in the services.
+	usernames, err := NewProfileClient(ts.URL+"/", Identity{}).Usernames(context.Background(), []int{19, 54})
+	if err != nil {
+		t.Fatalf("Expected no error, instead got %v", err.Error())
+	}
+
+	expected := 2
+	if len(usernames) != expected {
+		t.Fatalf("Expected %v but got %v", expected, len(usernames))
+	}
+	if usernames[1].ID != 54 {
+		t.Errorf("Expected %v but got %v", 54, usernames[1].ID)
+	}
+}
+
+func TestProfileClientCreateUser(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			t.Errorf("Expected %v but got %v", http.MethodPost, r.Method)
+		}
+		requests := make([]*models.CreateUserRequest, 0)
+		if err := ReadRequests(r, &requests); err != nil {
+			t.Fatal(err)
+		}
+		users := make([]*models.CreateUserResponse, 0)
+		for _, v := range requests {
+			if v.Email != "taken@example.com" {
+				users = append(users, &models.CreateUserResponse{ID: 7, Username: v.Username + "2", Email: v.Email})
+			}
+		}
+		SendResults(w, users)
+	}))
+	defer ts.Close()
+
+	client := NewProfileClient(ts.URL, Identity{})
+	user, err := client.CreateUser(context.Background(), "jane", "jane@example.com")
+	if err != nil {
+		t.Fatalf("Expected no error, instead got %v", err.Error())
+	}
+	if user == nil || user.ID != 7 || user.Username != "jane2" {
+		t.Errorf("Expected user 7 jane2 but got %+v", user)
+	}
+
+	if user, _ := client.CreateUser(context.Background(), "jane", "taken@example.com"); user != nil {
+		t.Errorf("Expected no user but got %+v", user)
+	}
+}
+
+func TestVoteClientTopRated(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		expectedURL := "/ipc/toprated?offset=10&rows=5"
+		if r.URL.String() != expectedURL {
+			t.Errorf("Expected %v but got %v", expectedURL, r.URL.String())
+		}
+		SendResults(w, []*models.TopRatedPhotoResponse{&models.TopRatedPhotoResponse{PhotoID: 3}})
+	}))
+	defer ts.Close()
+
+	photos, err := NewVoteClient(ts.URL, Identity{}).TopRated(context.Background(), 10, 5)
+	if err != nil {
+		t.Fatalf("Expected no error, instead got %v", err.Error())
+	}
+	if len(photos) != 1 || photos[0].PhotoID != 3 {
+		t.Errorf("Expected photo 3 but got %v", photos)
+	}
+}
+
+func TestAuthenticationClientTokenStatus(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests := make([]*models.TokenStatusRequest, 0)
+		if err := ReadRequests(r, &requests); err != nil {
+			t.Fatal(err)
+		}
+		if len(requests) != 1 || requests[0].TokenID != "abc" {
+			t.Fatalf("Expected a request for token abc but got %v", requests)
+		}
+		SendResults(w, []*models.TokenStatusResponse{&models.TokenStatusResponse{UserID: requests[0].UserID, TokenID: "abc", Revoked: true}})
+	}))
+	defer ts.Close()
+
+	revocations := NewRevocations(ts.URL, Identity{}, 0)
+	revoked, err := revocations.Revoked(context.Background(), &middleware.Principal{ID: 1, TokenID: "abc"})
+	if err != nil {
+		t.Fatalf("Expected no error, instead got %v", err.Error())
+	}
+	if !revoked {
+		t.Errorf("Expected %v but got %v", true, revoked)
+	}
+
+	if NewRevocations("", Identity{}, 0) != nil {
+		t.Error("Expected no revocations without a base URL")
+	}
+}
+
+func TestAuthenticationClientAccessToken(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests := make([]*models.AccessTokenRequest, 0)
+		if err := ReadRequests(r, &requests); err != nil {
+			t.Fatal(err)
+		}
+		tokens := make([]*models.AccessTokenResponse, 0)
+		if len(requests) == 1 && requests[0].TokenHash == "abc" {
+			tokens = append(tokens, &models.AccessTokenResponse{TokenHash: "abc", UserID: 3, Scopes: []string{middleware.ScopeVotesRead}})
+		}
+		SendResults(w, tokens)
+	}))
+	defer ts.Close()
+
+	accessTokens := NewAccessTokens(ts.URL, Identity{}, 0)
+	principal, err := accessTokens.AccessToken(context.Background(), "abc")
+	if err != nil {
+		t.Fatalf("Expected no error, instead got %v", err.Error())
+	}
+	if principal == nil || principal.ID != 3 || !principal.HasScope(middleware.ScopeVotesRead) || principal.HasScope(middleware.ScopeVotesWrite) {
+		t.Errorf("Expected user 3 with scope %v but got %+v", middleware.ScopeVotesRead, principal)
+	}
+
+	if principal, _ := accessTokens.AccessToken(context.Background(), "def"); principal != nil {
+		t.Errorf("Expected no user but got %+v", principal)
+	}
+}
+
+func TestClientStatusError(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		util.SendErrorMessage(w, "database is down")
+	}))
+	defer ts.Close()
+
+	_, err := NewCommentClient(ts.URL, Identity{}).Counts(context.Background(), []int{1})
+	statusErr, ok := err.(*StatusError)
+	if !ok {
+		t.Fatalf("Expected a *StatusError but got %v", err)
+	}
+
+	expected := http.StatusBadRequest
+	if statusErr.StatusCode != expected {
+		t.Errorf("Expected %v but got %v", expected, statusErr.StatusCode)
+	}
+}
+
+// Test if the calls carry a service token which the receiving service accepts.
+func TestClientServiceToken(t *testing.T) {
+	var caller string
+	keys := FakeKeys(CommentService)
+	auth := middleware.RequireServiceAuthenticationHandler(keys.Callers, CommentService, PhotoService)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth(w, r, func(w http.ResponseWriter, r *http.Request) {
+			caller = util.CallingServiceFromContext(r.Context())
+			SendResults(w, []*models.CommentCountResponse{})
+		})
+	}))
+	defer ts.Close()
+
+	_, err := NewCommentClient(ts.URL, FakeKeys(PhotoService).Identity).Counts(context.Background(), []int{1})
+	if err != nil {
+		t.Fatalf("Expected no error, instead got %v", err.Error())
+	}
+	if caller != PhotoService {
+		t.Errorf("Expected %v but got %v", PhotoService, caller)
+	}
+}
+
+func TestClientInvalidBaseURL(t *testing.T) {
+	_, err := NewPhotoClient("", Identity{}).Photos(context.Background(), []int{1})
+	if err != ErrInvalidBaseURL {
+		t.Errorf("Expected %v but got %v", ErrInvalidBaseURL, err)
+	}
+}
+
+func TestReadRequests(t *testing.T) {
+	body := []byte(`{"requests":[{"photo_id":1},{"photo_id":2}]}`)
+	req, err := http.NewRequest("GET", "/ipc/getPhotos", bytes.NewBuffer(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	requests := make([]*models.PhotoRequest, 0)
+	if err := ReadRequests(req, &requests); err != nil {
+		t.Fatalf("Expected no error, instead got %v", err.Error())
+	}
+
+	expected := 2
+	if len(requests) != expected {
+		t.Fatalf("Expected %v but got %v", expected, len(requests))
+	}
+	if requests[1].PhotoID != 2 {
+		t.Errorf("Expected %v but got %v", 2, requests[1].PhotoID)
+	}
+}
+
+func TestSendResults(t *testing.T) {
+	res := httptest.NewRecorder()
+	SendResults(res, []*models.CommentCountResponse{&models.CommentCountResponse{PhotoID: 5, Count: 10}})
+
+	expected := `{"results":[{"photo_id":5,"count":10}]}`
+	actual := res.Body.String()
+	if expected != actual {
+		t.Errorf("Expected %v but got %v", expected, actual)
+	}
+}
@@ -0,0 +1,57 @@
+package ipc
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/bstaijen/mariadb-for-microservices/shared/util/middleware"
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+// Keys are the IPC keys of a service. Identity signs the calls the service makes, Callers are the public keys of the
+// services which call it.
+type Keys struct {
+	Identity Identity
+	Callers  middleware.ServiceKeys
+}
+
+// LoadKeys loads the PEM encoded RSA private key of service from the file at keyFile and the public keys of its
+// callers from publicKeys, a comma separated list of service=file pairs, e.g.
+// "photo-service=/run/secrets/photo-service.pub,vote-service=/run/secrets/vote-service.pub".
+func LoadKeys(service string, keyFile string, publicKeys string) (*Keys, error) {
+	data, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	key, err := jwt.ParseRSAPrivateKeyFromPEM(data)
+	if err != nil {
+		return nil, fmt.Errorf("ipc: %v: %v", keyFile, err)
+	}
+
+	callers := middleware.ServiceKeys{}
+	for _, pair := range strings.Split(publicKeys, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("ipc: %q is not a service=file pair", pair)
+		}
+		if _, ok := callers[parts[0]]; ok {
+			return nil, fmt.Errorf("ipc: the key of %v is listed twice", parts[0])
+		}
+		data, err := ioutil.ReadFile(parts[1])
+		if err != nil {
+			return nil, err
+		}
+		publicKey, err := jwt.ParseRSAPublicKeyFromPEM(data)
+		if err != nil {
+			return nil, fmt.Errorf("ipc: %v: %v", parts[1], err)
+		}
+		callers[parts[0]] = publicKey
+	}
+
+	return &Keys{Identity: Identity{Service: service, Key: key}, Callers: callers}, nil
+}
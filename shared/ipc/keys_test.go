@@ -0,0 +1,70 @@
+package ipc
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+// writeKeys writes the private key and the public key of the fake key of service to dir.
+func writeKeys(t *testing.T, dir string, service string) (string, string) {
+	key := FakeKeys(service).Identity.Key
+	public, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyFile := filepath.Join(dir, service+".pem")
+	publicFile := filepath.Join(dir, service+".pub")
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(publicFile, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: public}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return keyFile, publicFile
+}
+
+func TestLoadKeys(t *testing.T) {
+	dir := t.TempDir()
+	keyFile, _ := writeKeys(t, dir, ProfileService)
+	_, photo := writeKeys(t, dir, PhotoService)
+	_, comment := writeKeys(t, dir, CommentService)
+
+	keys, err := LoadKeys(ProfileService, keyFile, " photo-service="+photo+", comment-service="+comment)
+	if err != nil {
+		t.Fatalf("Expected no error, instead got %v", err.Error())
+	}
+	if keys.Identity.Service != ProfileService || keys.Identity.Key.N.Cmp(FakeKeys(ProfileService).Identity.Key.N) != 0 {
+		t.Errorf("Expected the key of %v", ProfileService)
+	}
+
+	expected := 2
+	if len(keys.Callers) != expected {
+		t.Fatalf("Expected %v but got %v", expected, len(keys.Callers))
+	}
+	if keys.Callers[PhotoService].N.Cmp(FakeKeys(PhotoService).Identity.Key.N) != 0 {
+		t.Errorf("Expected the public key of %v", PhotoService)
+	}
+}
+
+func TestLoadKeysInvalid(t *testing.T) {
+	dir := t.TempDir()
+	keyFile, photo := writeKeys(t, dir, PhotoService)
+
+	tests := map[string][2]string{
+		"missing key":      {filepath.Join(dir, "missing.pem"), ""},
+		"public key":       {photo, ""},
+		"pair":             {keyFile, photo},
+		"duplicate":        {keyFile, "photo-service=" + photo + ",photo-service=" + photo},
+		"missing public":   {keyFile, "photo-service=" + filepath.Join(dir, "missing.pub")},
+		"not a public key": {keyFile, "photo-service=" + filepath.Join(dir, "..")},
+	}
+	for name, test := range tests {
+		if _, err := LoadKeys(PhotoService, test[0], test[1]); err == nil {
+			t.Errorf("Expected an error for the %v but got nil", name)
+		}
+	}
+}
@@ -0,0 +1,36 @@
+package ipc
+
+import (
+	"context"
+
+	"github.com/bstaijen/mariadb-for-microservices/shared/models"
+)
+
+// PhotoClient is the client for the IPC routes of the photo service.
+type PhotoClient interface {
+	// Photos returns the photos identified by photoIDs. Unknown photos are left out.
+	Photos(ctx context.Context, photoIDs []int) ([]*models.PhotoResponse, error)
+}
+
+// NewPhotoClient returns a PhotoClient which talks to the photo service on baseURL. The calls are authenticated
+// with identity.
+func NewPhotoClient(baseURL string, identity Identity) PhotoClient {
+	return &photoClient{client{baseURL: baseURL, audience: PhotoService, identity: identity}}
+}
+
+type photoClient struct {
+	client
+}
+
+func (c *photoClient) Photos(ctx context.Context, photoIDs []int) ([]*models.PhotoResponse, error) {
+	requests := make([]*models.PhotoRequest, 0, len(photoIDs))
+	for _, id := range photoIDs {
+		requests = append(requests, &models.PhotoRequest{PhotoID: id})
+	}
+
+	photos := make([]*models.PhotoResponse, 0)
+	if err := c.get(ctx, "/ipc/getPhotos", requests, &photos); err != nil {
+		return nil, err
+	}
+	return photos, nil
+}
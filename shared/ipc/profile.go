@@ -0,0 +1,55 @@
+package ipc
+
+import (
+	"context"
+
+	"github.com/bstaijen/mariadb-for-microservices/shared/models"
+)
+
+// ProfileClient is the client for the IPC routes of the profile service.
+type ProfileClient interface {
+	// Usernames returns the usernames of the users identified by userIDs. Unknown users are left out.
+	Usernames(ctx context.Context, userIDs []int) ([]*models.GetUsernamesResponse, error)
+
+	// CreateUser creates a user without a password for a login with an external identity provider, which verified
+	// email. It returns nil when email is taken.
+	CreateUser(ctx context.Context, username string, email string) (*models.CreateUserResponse, error)
+}
+
+// NewProfileClient returns a ProfileClient which talks to the profile service on baseURL. The calls are authenticated
+// with identity.
+func NewProfileClient(baseURL string, identity Identity) ProfileClient {
+	return &profileClient{client{baseURL: baseURL, audience: ProfileService, identity: identity}}
+}
+
+type profileClient struct {
+	client
+}
+
+func (c *profileClient) Usernames(ctx context.Context, userIDs []int) ([]*models.GetUsernamesResponse, error) {
+	requests := make([]*models.GetUsernamesRequest, 0, len(userIDs))
+	for _, id := range userIDs {
+		requests = append(requests, &models.GetUsernamesRequest{ID: id})
+	}
+
+	usernames := make([]*models.GetUsernamesResponse, 0)
+	if err := c.get(ctx, "/ipc/usernames", requests, &usernames); err != nil {
+		return nil, err
+	}
+	return usernames, nil
+}
+
+func (c *profileClient) CreateUser(ctx context.Context, username string, email string) (*models.CreateUserResponse, error) {
+	requests := []*models.CreateUserRequest{{Username: username, Email: email}}
+
+	users := make([]*models.CreateUserResponse, 0)
+	if err := c.post(ctx, "/ipc/createUser", requests, &users); err != nil {
+		return nil, err
+	}
+	for _, user := range users {
+		if user.Email == email {
+			return user, nil
+		}
+	}
+	return nil, nil
+}
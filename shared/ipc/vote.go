@@ -0,0 +1,76 @@
+package ipc
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/bstaijen/mariadb-for-microservices/shared/models"
+)
+
+// VoteClient is the client for the IPC routes of the vote service.
+type VoteClient interface {
+	// Counts returns the number of up- and downvotes of the photos identified by photoIDs.
+	Counts(ctx context.Context, photoIDs []int) ([]*models.VoteCountResponse, error)
+
+	// Voted returns how the user identified by userID voted on the photos identified by photoIDs.
+	// Photos the user did not vote on are left out.
+	Voted(ctx context.Context, userID int, photoIDs []int) ([]*models.HasVotedResponse, error)
+
+	// TopRated returns a page of the top rated timeline.
+	TopRated(ctx context.Context, offset, rows int) ([]*models.TopRatedPhotoResponse, error)
+
+	// Hot returns a page of the hot timeline.
+	Hot(ctx context.Context, offset, rows int) ([]*models.TopRatedPhotoResponse, error)
+}
+
+// NewVoteClient returns a VoteClient which talks to the vote service on baseURL. The calls are authenticated
+// with identity.
+func NewVoteClient(baseURL string, identity Identity) VoteClient {
+	return &voteClient{client{baseURL: baseURL, audience: VoteService, identity: identity}}
+}
+
+type voteClient struct {
+	client
+}
+
+func (c *voteClient) Counts(ctx context.Context, photoIDs []int) ([]*models.VoteCountResponse, error) {
+	requests := make([]*models.VoteCountRequest, 0, len(photoIDs))
+	for _, id := range photoIDs {
+		requests = append(requests, &models.VoteCountRequest{PhotoID: id})
+	}
+
+	counts := make([]*models.VoteCountResponse, 0)
+	if err := c.get(ctx, "/ipc/count", requests, &counts); err != nil {
+		return nil, err
+	}
+	return counts, nil
+}
+
+func (c *voteClient) Voted(ctx context.Context, userID int, photoIDs []int) ([]*models.HasVotedResponse, error) {
+	requests := make([]*models.HasVotedRequest, 0, len(photoIDs))
+	for _, id := range photoIDs {
+		requests = append(requests, &models.HasVotedRequest{UserID: userID, PhotoID: id})
+	}
+
+	voted := make([]*models.HasVotedResponse, 0)
+	if err := c.get(ctx, "/ipc/voted", requests, &voted); err != nil {
+		return nil, err
+	}
+	return voted, nil
+}
+
+func (c *voteClient) TopRated(ctx context.Context, offset, rows int) ([]*models.TopRatedPhotoResponse, error) {
+	return c.timeline(ctx, "/ipc/toprated", offset, rows)
+}
+
+func (c *voteClient) Hot(ctx context.Context, offset, rows int) ([]*models.TopRatedPhotoResponse, error) {
+	return c.timeline(ctx, "/ipc/hot", offset, rows)
+}
+
+func (c *voteClient) timeline(ctx context.Context, path string, offset, rows int) ([]*models.TopRatedPhotoResponse, error) {
+	photos := make([]*models.TopRatedPhotoResponse, 0)
+	if err := c.get(ctx, fmt.Sprintf("%v?offset=%v&rows=%v", path, offset, rows), nil, &photos); err != nil {
+		return nil, err
+	}
+	return photos, nil
+}
@@ -0,0 +1,368 @@
+// Package jwks contains the keys which sign and verify the access tokens. The authentication service signs the
+// tokens with RS256 and publishes the public keys as a JSON Web Key Set on Path. The other services only know the
+// public keys, which they fetch from there and cache, so they can verify tokens but never issue them.
+//
+// Every token names its key in the kid header. A key is rotated by adding the new key in front of the old one: the
+// new key signs from then on, while the old one is still published until it is removed, which is safe once the
+// access token lifetime has passed.
+package jwks
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/bstaijen/mariadb-for-microservices/shared/util"
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+// Path is the route on which the authentication service publishes its key set.
+const Path = "/.well-known/jwks.json"
+
+// Algorithm is the signing algorithm of the keys.
+const Algorithm = "RS256"
+
+// KeyBits is the size of the generated keys.
+const KeyBits = 2048
+
+// ErrUnknownKey is returned when no key with the requested ID is known.
+var ErrUnknownKey = errors.New("jwks: unknown key")
+
+// KeySet looks up the public keys which verify the access tokens by their key ID.
+type KeySet interface {
+	PublicKey(ctx context.Context, kid string) (*rsa.PublicKey, error)
+}
+
+// PrivateKey is a signing key. ID is the RFC 7638 thumbprint of its public key, so every instance which loads the
+// key derives the same ID.
+type PrivateKey struct {
+	ID  string
+	Key *rsa.PrivateKey
+}
+
+// NewPrivateKey returns key with its ID.
+func NewPrivateKey(key *rsa.PrivateKey) *PrivateKey {
+	return &PrivateKey{ID: thumbprint(&key.PublicKey), Key: key}
+}
+
+// GenerateKey returns a new random key of KeyBits.
+func GenerateKey() (*PrivateKey, error) {
+	key, err := rsa.GenerateKey(rand.Reader, KeyBits)
+	if err != nil {
+		return nil, err
+	}
+	return NewPrivateKey(key), nil
+}
+
+// LoadPrivateKey reads a PEM encoded RSA private key from the file at path.
+func LoadPrivateKey(path string) (*PrivateKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := jwt.ParseRSAPrivateKeyFromPEM(data)
+	if err != nil {
+		return nil, fmt.Errorf("jwks: %v: %v", path, err)
+	}
+	return NewPrivateKey(key), nil
+}
+
+// JWK is a public key in the JSON Web Key format.
+type JWK struct {
+	KeyType   string `json:"kty"`
+	Use       string `json:"use"`
+	Algorithm string `json:"alg"`
+	KeyID     string `json:"kid"`
+	N         string `json:"n"`
+	E         string `json:"e"`
+}
+
+// Document is a JSON Web Key Set.
+type Document struct {
+	Keys []JWK `json:"keys"`
+}
+
+func newJWK(kid string, key *rsa.PublicKey) JWK {
+	return JWK{
+		KeyType:   "RSA",
+		Use:       "sig",
+		Algorithm: Algorithm,
+		KeyID:     kid,
+		N:         base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+		E:         base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+	}
+}
+
+// PublicKey decodes the RSA key of k.
+func (k JWK) PublicKey() (*rsa.PublicKey, error) {
+	if k.KeyType != "RSA" {
+		return nil, fmt.Errorf("jwks: key %v has type %v", k.KeyID, k.KeyType)
+	}
+	n, err := base64.RawURLEncoding.DecodeString(k.N)
+	if err != nil {
+		return nil, fmt.Errorf("jwks: modulus of key %v: %v", k.KeyID, err)
+	}
+	e, err := base64.RawURLEncoding.DecodeString(k.E)
+	if err != nil {
+		return nil, fmt.Errorf("jwks: exponent of key %v: %v", k.KeyID, err)
+	}
+	return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+}
+
+// thumbprint returns the RFC 7638 thumbprint of key.
+func thumbprint(key *rsa.PublicKey) string {
+	jwk := newJWK("", key)
+	sum := sha256.Sum256([]byte(fmt.Sprintf(`{"e":"%v","kty":"RSA","n":"%v"}`, jwk.E, jwk.N)))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// Set is the key set of the authentication service. The first key signs, the others only verify.
+type Set struct {
+	keys []*PrivateKey
+}
+
+// NewSet returns the set of keys. It needs at least one key.
+func NewSet(keys ...*PrivateKey) (*Set, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("jwks: a key set needs a signing key")
+	}
+	return &Set{keys: keys}, nil
+}
+
+// LoadSet loads the set of the PEM encoded keys in the files at paths, the signing key first.
+func LoadSet(paths []string) (*Set, error) {
+	keys := make([]*PrivateKey, 0, len(paths))
+	for _, path := range paths {
+		key, err := LoadPrivateKey(path)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return NewSet(keys...)
+}
+
+// SigningKey returns the key which signs new tokens.
+func (s *Set) SigningKey() *PrivateKey {
+	return s.keys[0]
+}
+
+// PublicKey returns the public key of the key with kid.
+func (s *Set) PublicKey(ctx context.Context, kid string) (*rsa.PublicKey, error) {
+	for _, key := range s.keys {
+		if key.ID == kid {
+			return &key.Key.PublicKey, nil
+		}
+	}
+	return nil, ErrUnknownKey
+}
+
+// Document returns the public keys of the set.
+func (s *Set) Document() *Document {
+	doc := &Document{Keys: make([]JWK, 0, len(s.keys))}
+	for _, key := range s.keys {
+		doc.Keys = append(doc.Keys, newJWK(key.ID, &key.Key.PublicKey))
+	}
+	return doc
+}
+
+// Handler serves the public keys of set.
+func Handler(set *Set) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%v", int(DefaultCacheTTL.Seconds())))
+		util.SendOK(w, set.Document())
+	})
+}
+
+// DefaultCacheTTL is how long a Remote trusts the keys it fetched.
+const DefaultCacheTTL = 10 * time.Minute
+
+// MinRefreshInterval is the minimum time between two fetches of a Remote. A token with an unknown key triggers a
+// fetch, so a newly rotated key is picked up at once, but a flood of forged tokens doesn't flood the authentication
+// service.
+const MinRefreshInterval = 10 * time.Second
+
+// FetchTimeout is how long a fetch of a Remote may take. The fetch is shared by every lookup which waits for it, so
+// it doesn't stop when the lookup which started it gives up.
+const FetchTimeout = 10 * time.Second
+
+// Remote is the KeySet of the authentication service, fetched from its Path and cached.
+type Remote struct {
+	url    string
+	ttl    time.Duration
+	client *http.Client
+	now    func() time.Time
+
+	mu        sync.RWMutex
+	keys      map[string]*rsa.PublicKey
+	fetchedAt time.Time
+	triedAt   time.Time
+	fetching  *fetchCall
+}
+
+// fetchCall is a fetch in progress, which concurrent lookups wait for instead of fetching themselves.
+type fetchCall struct {
+	done chan struct{}
+	err  error
+}
+
+// NewRemote returns the key set of the authentication service on baseURL, which is cached for ttl. A ttl of zero
+// means DefaultCacheTTL.
+func NewRemote(baseURL string, ttl time.Duration) *Remote {
+	if ttl <= 0 {
+		ttl = DefaultCacheTTL
+	}
+	return &Remote{url: strings.TrimSuffix(baseURL, "/") + Path, ttl: ttl, now: time.Now}
+}
+
+// NewRemoteURL returns the key set published on url by a third party, e.g. the jwks_uri of an OpenID Connect provider,
+// which is cached for ttl. A ttl of zero means DefaultCacheTTL. The keys are fetched with client instead of the IPC
+// client, which would send the request ID and the trace context of the service to the third party.
+func NewRemoteURL(url string, ttl time.Duration, client *http.Client) *Remote {
+	if ttl <= 0 {
+		ttl = DefaultCacheTTL
+	}
+	return &Remote{url: url, ttl: ttl, client: client, now: time.Now}
+}
+
+// PublicKey returns the public key with kid. The keys are fetched again when they are older than the TTL or when kid
+// is unknown. When the fetch fails the keys fetched before are used.
+func (r *Remote) PublicKey(ctx context.Context, kid string) (*rsa.PublicKey, error) {
+	key, ok, fresh := r.cached(kid)
+	if ok && fresh {
+		return key, nil
+	}
+
+	// A known key is used while another lookup fetches the keys, only unknown keys wait for the fetch
+	if err := r.refresh(ctx, !ok); err != nil {
+		if ok {
+			util.Log(ctx).Warnf("Can not refresh the keys, using the cached keys: %v", err)
+			return key, nil
+		}
+		return nil, err
+	}
+
+	if key, ok, _ = r.cached(kid); !ok {
+		return nil, ErrUnknownKey
+	}
+	return key, nil
+}
+
+// cached returns the cached key with kid, whether it is known and whether the keys are younger than the TTL.
+func (r *Remote) cached(kid string) (*rsa.PublicKey, bool, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	key, ok := r.keys[kid]
+	return key, ok, r.now().Sub(r.fetchedAt) < r.ttl
+}
+
+// refresh fetches the keys, unless they were tried within MinRefreshInterval. The lock isn't held during the fetch,
+// so lookups of cached keys go on. A lookup which finds a fetch in progress doesn't fetch again, but waits for it when
+// wait is set. The fetch runs on its own context with FetchTimeout, every lookup only stops waiting when its ctx is
+// done.
+func (r *Remote) refresh(ctx context.Context, wait bool) error {
+	r.mu.Lock()
+	call := r.fetching
+	if call == nil {
+		now := r.now()
+		if now.Sub(r.triedAt) < MinRefreshInterval {
+			r.mu.Unlock()
+			return nil
+		}
+		r.triedAt = now
+		call = &fetchCall{done: make(chan struct{})}
+		r.fetching = call
+		go r.fetchShared(context.WithoutCancel(ctx), call, now)
+	} else if !wait {
+		r.mu.Unlock()
+		return nil
+	}
+	r.mu.Unlock()
+
+	select {
+	case <-call.done:
+		return call.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// fetchShared fetches the keys for call, which was started at now, and stores them.
+func (r *Remote) fetchShared(ctx context.Context, call *fetchCall, now time.Time) {
+	ctx, cancel := context.WithTimeout(ctx, FetchTimeout)
+	defer cancel()
+
+	keys, err := r.fetch(ctx)
+
+	r.mu.Lock()
+	if err == nil {
+		r.keys = keys
+		r.fetchedAt = now
+	}
+	r.fetching = nil
+	r.mu.Unlock()
+
+	call.err = err
+	close(call.done)
+}
+
+func (r *Remote) fetch(ctx context.Context) (map[string]*rsa.PublicKey, error) {
+	if !strings.HasPrefix(r.url, "http") {
+		return nil, fmt.Errorf("jwks: %q is not a URL", r.url)
+	}
+
+	doc := &Document{}
+	var fetchErr error
+	read := func(res *http.Response) {
+		defer res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			fetchErr = fmt.Errorf("jwks: %v answered with statuscode %v", r.url, res.StatusCode)
+			return
+		}
+		fetchErr = json.NewDecoder(res.Body).Decode(doc)
+	}
+	if r.client != nil {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, r.url, nil)
+		if err != nil {
+			return nil, err
+		}
+		res, err := r.client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		read(res)
+	} else if err := util.RequestWithContext(ctx, http.MethodGet, r.url, nil, read); err != nil {
+		return nil, err
+	}
+	if fetchErr != nil {
+		return nil, fetchErr
+	}
+
+	keys := make(map[string]*rsa.PublicKey, len(doc.Keys))
+	for _, jwk := range doc.Keys {
+		// Other sets may hold keys for other algorithms or for encryption, and may leave alg out
+		if jwk.KeyType != "RSA" || (jwk.Algorithm != "" && jwk.Algorithm != Algorithm) || (jwk.Use != "" && jwk.Use != "sig") {
+			continue
+		}
+		key, err := jwk.PublicKey()
+		if err != nil {
+			log.Warn(err)
+			continue
+		}
+		keys[jwk.KeyID] = key
+	}
+	return keys, nil
+}
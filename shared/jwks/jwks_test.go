@@ -0,0 +1,204 @@
+package jwks
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Test if a Remote verifies with the keys published by the Handler of a set.
+func TestRemote(t *testing.T) {
+	current, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	set, err := NewSet(current, previous)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fetches := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches++
+		if r.URL.Path != Path {
+			t.Errorf("Expected %v but got %v", Path, r.URL.Path)
+		}
+		Handler(set).ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+
+	// The trailing slash is how the base URLs are configured in the services.
+	remote := NewRemote(ts.URL+"/", time.Minute)
+	for _, key := range []*PrivateKey{current, previous} {
+		publicKey, err := remote.PublicKey(context.Background(), key.ID)
+		if err != nil {
+			t.Fatalf("Expected no error, instead got %v", err.Error())
+		}
+		if publicKey.N.Cmp(key.Key.N) != 0 || publicKey.E != key.Key.E {
+			t.Errorf("Expected the public key of %v", key.ID)
+		}
+	}
+
+	// An unknown key is fetched again, but not within MinRefreshInterval.
+	if _, err := remote.PublicKey(context.Background(), "unknown"); err != ErrUnknownKey {
+		t.Errorf("Expected %v but got %v", ErrUnknownKey, err)
+	}
+	expected := 1
+	if fetches != expected {
+		t.Errorf("Expected %v but got %v", expected, fetches)
+	}
+}
+
+// Test if the cached keys are used when the authentication service is unreachable.
+func TestRemoteStale(t *testing.T) {
+	key, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	set, _ := NewSet(key)
+	ts := httptest.NewServer(Handler(set))
+
+	now := time.Now()
+	remote := NewRemote(ts.URL, time.Minute)
+	remote.now = func() time.Time { return now }
+	if _, err := remote.PublicKey(context.Background(), key.ID); err != nil {
+		t.Fatalf("Expected no error, instead got %v", err.Error())
+	}
+
+	ts.Close()
+	now = now.Add(time.Hour)
+	if _, err := remote.PublicKey(context.Background(), key.ID); err != nil {
+		t.Errorf("Expected no error, instead got %v", err.Error())
+	}
+}
+
+// Test if concurrent lookups share one fetch, and if known keys are returned while it is in progress.
+func TestRemoteConcurrent(t *testing.T) {
+	key, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	set, _ := NewSet(key)
+
+	var fetches int32
+	var block int32
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		if atomic.LoadInt32(&block) == 1 {
+			started <- struct{}{}
+			<-release
+		}
+		Handler(set).ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+
+	now := time.Now()
+	remote := NewRemote(ts.URL, time.Minute)
+	remote.now = func() time.Time { return now }
+	if _, err := remote.PublicKey(context.Background(), key.ID); err != nil {
+		t.Fatalf("Expected no error, instead got %v", err.Error())
+	}
+
+	// The keys are stale and the next fetch hangs.
+	now = now.Add(time.Hour)
+	atomic.StoreInt32(&block, 1)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for i := 0; i < cap(errs); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := remote.PublicKey(context.Background(), "unknown")
+			errs <- err
+		}()
+	}
+	<-started
+
+	if _, err := remote.PublicKey(context.Background(), key.ID); err != nil {
+		t.Errorf("Expected no error, instead got %v", err.Error())
+	}
+
+	close(release)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != ErrUnknownKey {
+			t.Errorf("Expected %v but got %v", ErrUnknownKey, err)
+		}
+	}
+	expected := int32(2)
+	if fetches != expected {
+		t.Errorf("Expected %v but got %v", expected, fetches)
+	}
+}
+
+// Test if a fetch goes on for the other lookups when the lookup which started it gives up.
+func TestRemoteFetchOutlivesCaller(t *testing.T) {
+	key, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	set, _ := NewSet(key)
+
+	var fetches int32
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		started <- struct{}{}
+		<-release
+		Handler(set).ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+
+	remote := NewRemote(ts.URL, time.Minute)
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error, 1)
+	go func() {
+		_, err := remote.PublicKey(ctx, key.ID)
+		errs <- err
+	}()
+	<-started
+	cancel()
+	if err := <-errs; err != context.Canceled {
+		t.Errorf("Expected %v but got %v", context.Canceled, err)
+	}
+
+	go func() {
+		_, err := remote.PublicKey(context.Background(), key.ID)
+		errs <- err
+	}()
+	close(release)
+	if err := <-errs; err != nil {
+		t.Errorf("Expected no error, instead got %v", err.Error())
+	}
+	expected := int32(1)
+	if fetches != expected {
+		t.Errorf("Expected %v but got %v", expected, fetches)
+	}
+}
+
+// Test if the ID of a key only depends on the key, so every instance derives the same ID.
+func TestKeyID(t *testing.T) {
+	key, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again := NewPrivateKey(key.Key); again.ID != key.ID {
+		t.Errorf("Expected %v but got %v", key.ID, again.ID)
+	}
+	if _, err := NewSet(); err == nil {
+		t.Error("Expected an error but got nil")
+	}
+}
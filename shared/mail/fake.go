@@ -0,0 +1,36 @@
+package mail
+
+import (
+	"context"
+	"sync"
+)
+
+// FakeMailer keeps the mails in memory, so handler tests can read them. It returns Err (when set) instead of
+// sending.
+type FakeMailer struct {
+	Err error
+
+	mu       sync.Mutex
+	messages []Message
+}
+
+// Send remembers message.
+func (f *FakeMailer) Send(ctx context.Context, message Message) error {
+	if f.Err != nil {
+		return f.Err
+	}
+	if err := message.validate(); err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.messages = append(f.messages, message)
+	return nil
+}
+
+// Messages returns the mails sent so far.
+func (f *FakeMailer) Messages() []Message {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]Message(nil), f.messages...)
+}
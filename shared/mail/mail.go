@@ -0,0 +1,166 @@
+// Package mail sends the emails of the services, such as the links which reset a password. The services only know
+// the Mailer interface. The LogMailer and the FileMailer are meant for local development and tests, they don't
+// deliver anything. The SMTPMailer hands the mails to a mail server.
+package mail
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/bstaijen/mariadb-for-microservices/shared/util"
+)
+
+// The kinds of mailers New returns.
+const (
+	Log  = "log"
+	File = "file"
+	SMTP = "smtp"
+)
+
+// Message is a plain text mail.
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer sends mails. Implementations must be safe for concurrent use.
+type Mailer interface {
+	Send(ctx context.Context, message Message) error
+}
+
+// Options describe the mailer New returns. Dir is only used by the file mailer and the SMTP fields only by the
+// SMTP mailer.
+type Options struct {
+	Kind         string
+	From         string
+	Dir          string
+	SMTPAddr     string
+	SMTPUsername string
+	SMTPPassword string
+}
+
+// New returns the mailer of options.Kind. The kind has to be chosen explicitly, so a service can't end up writing
+// reset links to its log because the configuration was forgotten.
+func New(options Options) (Mailer, error) {
+	switch options.Kind {
+	case Log:
+		return NewLogMailer(options.From), nil
+	case File:
+		return NewFileMailer(options.Dir, options.From), nil
+	case SMTP:
+		if options.SMTPAddr == "" {
+			return nil, fmt.Errorf("mail: the %v mailer needs an address", SMTP)
+		}
+		return NewSMTPMailer(options.SMTPAddr, options.SMTPUsername, options.SMTPPassword, options.From), nil
+	}
+	return nil, fmt.Errorf("mail: unknown mailer %q, expected %v, %v or %v", options.Kind, Log, File, SMTP)
+}
+
+// LogMailer writes the mails to the log. The log contains everything in the mails, e.g. reset links, so it must
+// not be used in production.
+type LogMailer struct {
+	from string
+}
+
+// NewLogMailer returns a LogMailer which sends as from.
+func NewLogMailer(from string) *LogMailer {
+	return &LogMailer{from: from}
+}
+
+// Send logs message.
+func (m *LogMailer) Send(ctx context.Context, message Message) error {
+	if err := message.validate(); err != nil {
+		return err
+	}
+	util.Log(ctx).WithField("from", m.from).WithField("to", message.To).WithField("subject", message.Subject).Info(message.Body)
+	return nil
+}
+
+// FileMailer writes every mail to its own .eml file in a directory, which mail clients can open.
+type FileMailer struct {
+	dir  string
+	from string
+}
+
+// NewFileMailer returns a FileMailer which writes to dir and sends as from. The directory is created when needed.
+func NewFileMailer(dir string, from string) *FileMailer {
+	return &FileMailer{dir: dir, from: from}
+}
+
+// Send writes message to a new file.
+func (m *FileMailer) Send(ctx context.Context, message Message) error {
+	if err := message.validate(); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(m.dir, 0700); err != nil {
+		return err
+	}
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%v-%v.eml", time.Now().UTC().Format("20060102T150405.000000000"), hex.EncodeToString(suffix))
+	return ioutil.WriteFile(filepath.Join(m.dir, name), message.bytes(m.from, time.Now()), 0600)
+}
+
+// SMTPMailer delivers the mails to a mail server.
+type SMTPMailer struct {
+	addr string
+	auth smtp.Auth
+	from string
+}
+
+// NewSMTPMailer returns a SMTPMailer which delivers to the server on addr, host:port, and sends as from. It logs in
+// with username and password, unless username is empty.
+func NewSMTPMailer(addr string, username string, password string, from string) *SMTPMailer {
+	var auth smtp.Auth
+	if username != "" {
+		host, _, _ := net.SplitHostPort(addr)
+		auth = smtp.PlainAuth("", username, password, host)
+	}
+	return &SMTPMailer{addr: addr, auth: auth, from: from}
+}
+
+// Send delivers message.
+func (m *SMTPMailer) Send(ctx context.Context, message Message) error {
+	if err := message.validate(); err != nil {
+		return err
+	}
+	return smtp.SendMail(m.addr, m.auth, m.from, []string{message.To}, message.bytes(m.from, time.Now()))
+}
+
+// validate returns an error when a header of message contains a line break, which would add headers to the mail.
+func (message Message) validate() error {
+	if strings.ContainsAny(message.To, "\r\n") || strings.ContainsAny(message.Subject, "\r\n") {
+		return fmt.Errorf("mail: the recipient and the subject can't contain line breaks")
+	}
+	if message.To == "" {
+		return fmt.Errorf("mail: the message has no recipient")
+	}
+	return nil
+}
+
+// bytes returns message from from, sent at date, as RFC 5322 mail.
+func (message Message) bytes(from string, date time.Time) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %v\r\n", from)
+	fmt.Fprintf(&b, "To: %v\r\n", message.To)
+	fmt.Fprintf(&b, "Subject: %v\r\n", message.Subject)
+	fmt.Fprintf(&b, "Date: %v\r\n", date.Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	b.WriteString("\r\n")
+	b.WriteString(strings.Replace(message.Body, "\n", "\r\n", -1))
+	return b.Bytes()
+}
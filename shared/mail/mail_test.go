@@ -0,0 +1,60 @@
+package mail
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFileMailer(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "mail")
+	mailer, err := New(Options{Kind: File, Dir: dir, From: "no-reply@example.com"})
+	if err != nil {
+		t.Fatalf("Expected no error, instead got %v", err.Error())
+	}
+
+	message := Message{To: "username@example.com", Subject: "Reset your password", Body: "line 1\nline 2"}
+	if err := mailer.Send(context.Background(), message); err != nil {
+		t.Fatalf("Expected no error, instead got %v", err.Error())
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil || len(files) != 1 {
+		t.Fatalf("Expected %v but got %v (%v)", 1, len(files), err)
+	}
+	b, err := ioutil.ReadFile(filepath.Join(dir, files[0].Name()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{"From: no-reply@example.com\r\n", "To: username@example.com\r\n", "Subject: Reset your password\r\n", "\r\n\r\nline 1\r\nline 2"} {
+		if !strings.Contains(string(b), expected) {
+			t.Errorf("Expected %q in %q", expected, string(b))
+		}
+	}
+}
+
+// Test if a header can't be smuggled into a mail.
+func TestHeaderInjection(t *testing.T) {
+	mailer := &FakeMailer{}
+	err := mailer.Send(context.Background(), Message{To: "username@example.com\r\nBcc: other@example.com", Subject: "Hello"})
+	if err == nil {
+		t.Errorf("Expected an error")
+	}
+	if len(mailer.Messages()) != 0 {
+		t.Errorf("Expected %v but got %v", 0, len(mailer.Messages()))
+	}
+}
+
+func TestNewUnknown(t *testing.T) {
+	if _, err := New(Options{Kind: "carrier-pigeon"}); err == nil {
+		t.Errorf("Expected an error")
+	}
+	if _, err := New(Options{}); err == nil {
+		t.Errorf("Expected an error for a mailer which isn't chosen")
+	}
+	if _, err := New(Options{Kind: SMTP}); err == nil {
+		t.Errorf("Expected an error for a SMTP mailer without an address")
+	}
+}
@@ -0,0 +1,90 @@
+// Package metrics collects Prometheus metrics for the services: the rate, errors and duration (RED) of every
+// inbound request per mux route template, the duration of outbound IPC calls per destination and the connection
+// pool statistics of the database. Everything is served by Handler, which the services mount on /metrics.
+package metrics
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/urfave/negroni"
+)
+
+// unmatchedRoute is the route label of requests which don't match any route, so unknown paths can't blow up the
+// number of series.
+const unmatchedRoute = "unmatched"
+
+var (
+	requests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "http_requests_total",
+		Help: "Number of HTTP requests handled, by method, route template and status code.",
+	}, []string{"method", "route", "code"})
+
+	requestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "http_request_duration_seconds",
+		Help:    "Duration of HTTP requests, by method, route template and status code.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method", "route", "code"})
+
+	ipcDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "ipc_request_duration_seconds",
+		Help:    "Duration of outbound IPC calls, by destination host, method and status code. Calls which got no response have code \"error\".",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"host", "method", "code"})
+)
+
+func init() {
+	prometheus.MustRegister(requests, requestDuration, ipcDuration)
+}
+
+// Middleware returns a negroni middleware which counts and times every request. The requests are labeled with the
+// path template of the route in router which matches them (e.g. /image/{id}), not with the actual path.
+func Middleware(router *mux.Router) negroni.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+		route := unmatchedRoute
+		var match mux.RouteMatch
+		if router.Match(r, &match) && match.Route != nil {
+			if template, err := match.Route.GetPathTemplate(); err == nil {
+				route = template
+			}
+		}
+
+		start := time.Now()
+		if next != nil {
+			next(w, r)
+		}
+
+		code := "200"
+		if res, ok := w.(negroni.ResponseWriter); ok && res.Status() != 0 {
+			code = strconv.Itoa(res.Status())
+		}
+		requests.WithLabelValues(r.Method, route, code).Inc()
+		requestDuration.WithLabelValues(r.Method, route, code).Observe(time.Since(start).Seconds())
+	}
+}
+
+// ObserveIPC records the duration of an outbound call to host. Status is the status code of the response, or 0
+// when the call failed before a response was received.
+func ObserveIPC(host string, method string, status int, duration time.Duration) {
+	code := "error"
+	if status != 0 {
+		code = strconv.Itoa(status)
+	}
+	ipcDuration.WithLabelValues(host, method, code).Observe(duration.Seconds())
+}
+
+// RegisterDB exports the connection pool statistics (sql.DB.Stats) of db as gauges labeled with name.
+func RegisterDB(name string, db *sql.DB) error {
+	return prometheus.Register(collectors.NewDBStatsCollector(db, name))
+}
+
+// Handler serves the collected metrics in the Prometheus exposition format.
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
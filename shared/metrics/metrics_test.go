@@ -0,0 +1,110 @@
+package metrics
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/urfave/negroni"
+	sqlmock "gopkg.in/DATA-DOG/go-sqlmock.v1"
+)
+
+func serve(router *mux.Router, method string, url string) *httptest.ResponseRecorder {
+	n := negroni.New(Middleware(router))
+	n.UseHandler(router)
+	res := httptest.NewRecorder()
+	req, _ := http.NewRequest(method, url, nil)
+	n.ServeHTTP(res, req)
+	return res
+}
+
+// Test if requests are labeled with the route template instead of the path.
+func TestMiddlewareRouteTemplate(t *testing.T) {
+	router := mux.NewRouter()
+	router.HandleFunc("/metricstest/{id}", func(w http.ResponseWriter, r *http.Request) {}).Methods("GET")
+
+	serve(router, "GET", "http://localhost/metricstest/1")
+	serve(router, "GET", "http://localhost/metricstest/2")
+
+	expected := 2.0
+	actual := testutil.ToFloat64(requests.WithLabelValues("GET", "/metricstest/{id}", "200"))
+	if actual != expected {
+		t.Errorf("Expected %v but got %v", expected, actual)
+	}
+}
+
+// Test if the status code of failed requests is recorded.
+func TestMiddlewareErrors(t *testing.T) {
+	router := mux.NewRouter()
+	router.HandleFunc("/metricserror", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}).Methods("GET")
+
+	serve(router, "GET", "http://localhost/metricserror")
+
+	expected := 1.0
+	actual := testutil.ToFloat64(requests.WithLabelValues("GET", "/metricserror", "500"))
+	if actual != expected {
+		t.Errorf("Expected %v but got %v", expected, actual)
+	}
+}
+
+// Test if requests without a route share a single label value.
+func TestMiddlewareUnmatched(t *testing.T) {
+	router := mux.NewRouter()
+
+	serve(router, "GET", "http://localhost/does/not/exist")
+
+	expected := 1.0
+	actual := testutil.ToFloat64(requests.WithLabelValues("GET", unmatchedRoute, "404"))
+	if actual != expected {
+		t.Errorf("Expected %v but got %v", expected, actual)
+	}
+}
+
+// Test if ObserveIPC records calls without a response as errors.
+func TestObserveIPC(t *testing.T) {
+	ObserveIPC("vote:5003", "GET", 200, time.Millisecond)
+	ObserveIPC("vote:5003", "GET", 0, time.Millisecond)
+
+	output := scrape(t)
+	for _, series := range []string{
+		`ipc_request_duration_seconds_count{code="200",host="vote:5003",method="GET"}`,
+		`ipc_request_duration_seconds_count{code="error",host="vote:5003",method="GET"}`,
+	} {
+		if !strings.Contains(output, series+" 1") {
+			t.Errorf("Expected %v in the output but got %v", series, output)
+		}
+	}
+}
+
+// Test if the pool statistics of a registered database are served by Handler.
+func TestRegisterDB(t *testing.T) {
+	db, _, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	if err := RegisterDB("test", db); err != nil {
+		t.Fatal(err)
+	}
+
+	if output := scrape(t); !strings.Contains(output, `go_sql_open_connections{db_name="test"}`) {
+		t.Errorf("Expected the pool statistics in the output but got %v", output)
+	}
+}
+
+func scrape(t *testing.T) string {
+	res := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", "http://localhost/metrics", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	Handler().ServeHTTP(res, req)
+	return res.Body.String()
+}
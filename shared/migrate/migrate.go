@@ -0,0 +1,448 @@
+// Package migrate versions the schemas of the services. Every service owns a list of numbered migrations and a
+// tracking table in its schema which records the applied versions. The binaries of the services expose it as
+// subcommands:
+//
+//	main migrate up        applies every pending migration
+//	main migrate down [n]  reverts the last n migrations, 1 by default
+//	main migrate status    lists the migrations and when they were applied
+//
+// The services refuse to start while migrations are pending, see Check.
+//
+// Only one process migrates a schema at a time. GET_LOCK isn't replicated by Galera, so the lock is a row in a
+// lock table instead: inserting it is certified by the whole cluster and fails on every node but one. DDL
+// statements aren't transactional in MariaDB, a migration which fails halfway has to be cleaned up by hand.
+package migrate
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/go-sql-driver/mysql"
+)
+
+// DefaultTable is the name of the tracking table. The lock table has the same name with a _lock suffix.
+const DefaultTable = "schema_migrations"
+
+// Defaults of Migrator.
+const (
+	DefaultLockTimeout = time.Minute
+	DefaultStaleLock   = 10 * time.Minute
+)
+
+// The MySQL error numbers of a lock which is held by another process. Galera reports a lost certification as a
+// deadlock.
+const (
+	errDuplicateEntry = 1062
+	errDeadlock       = 1213
+)
+
+// ErrLocked is returned when the lock can't be taken within the lock timeout.
+var ErrLocked = errors.New("migrate: the schema is locked by another process")
+
+// Migration is one version of a schema. Up and Down are executed statement by statement, so a statement must not
+// end with a semicolon followed by another statement.
+type Migration struct {
+	Version int
+	Name    string
+	Up      []string
+	Down    []string
+}
+
+func (m Migration) String() string {
+	return fmt.Sprintf("%v %v", m.Version, m.Name)
+}
+
+// Status is a migration with the moment it was applied.
+type Status struct {
+	Migration
+	Applied   bool
+	AppliedAt time.Time
+}
+
+// PendingError is returned by Check when migrations are pending.
+type PendingError struct {
+	Pending []Migration
+}
+
+func (e *PendingError) Error() string {
+	names := make([]string, len(e.Pending))
+	for i, m := range e.Pending {
+		names[i] = m.String()
+	}
+	return fmt.Sprintf("%v migration(s) pending (%v), run: migrate up", len(e.Pending), strings.Join(names, ", "))
+}
+
+// Migrator applies and reverts the migrations of a schema.
+type Migrator struct {
+	db         *sql.DB
+	table      string
+	migrations []Migration
+
+	// LockTimeout is how long Up and Down wait for the lock.
+	LockTimeout time.Duration
+
+	// StaleLock is the age after which a lock is considered left behind by a process which crashed. The holder
+	// of the lock refreshes it three times within this age, so a long migration doesn't lose it.
+	StaleLock time.Duration
+
+	owner string
+}
+
+// New returns a migrator for the migrations tracked in table.
+func New(db *sql.DB, table string, migrations []Migration) *Migrator {
+	sorted := append([]Migration(nil), migrations...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Version < sorted[j].Version })
+
+	hostname, _ := os.Hostname()
+	return &Migrator{
+		db:          db,
+		table:       table,
+		migrations:  sorted,
+		LockTimeout: DefaultLockTimeout,
+		StaleLock:   DefaultStaleLock,
+		owner:       fmt.Sprintf("%v:%v", hostname, os.Getpid()),
+	}
+}
+
+func (m *Migrator) validate() error {
+	for i, migration := range m.migrations {
+		if migration.Version <= 0 {
+			return fmt.Errorf("migrate: version of %q must be positive", migration.Name)
+		}
+		if i > 0 && m.migrations[i-1].Version == migration.Version {
+			return fmt.Errorf("migrate: version %v is used twice", migration.Version)
+		}
+	}
+	return nil
+}
+
+func (m *Migrator) createTables(ctx context.Context) error {
+	statements := []string{
+		"CREATE TABLE IF NOT EXISTS " + m.table + " (version INT NOT NULL PRIMARY KEY, name varchar(255) NOT NULL, appliedAt timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP)",
+		"CREATE TABLE IF NOT EXISTS " + m.table + "_lock (id INT NOT NULL PRIMARY KEY, owner varchar(255) NOT NULL, lockedAt timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP)",
+	}
+	for _, statement := range statements {
+		if _, err := m.db.ExecContext(ctx, statement); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// applied returns the applied versions with the moment they were applied.
+func (m *Migrator) applied(ctx context.Context) (map[int]time.Time, error) {
+	rows, err := m.db.QueryContext(ctx, "SELECT version, appliedAt FROM "+m.table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := make(map[int]time.Time)
+	for rows.Next() {
+		var version int
+		var appliedAt timestamp
+		if err := rows.Scan(&version, &appliedAt); err != nil {
+			return nil, err
+		}
+		applied[version] = appliedAt.Time
+	}
+	return applied, rows.Err()
+}
+
+// timestamp scans a TIMESTAMP column whether or not the connection parses times, the driver returns the text
+// of the column without parseTime=true in the DSN.
+type timestamp struct {
+	time.Time
+}
+
+// timestampLayout is the format MariaDB returns a TIMESTAMP column in, the fraction is only present when the
+// column has one.
+const timestampLayout = "2006-01-02 15:04:05.999999"
+
+func (t *timestamp) Scan(value interface{}) error {
+	var err error
+	switch v := value.(type) {
+	case time.Time:
+		t.Time = v
+	case []byte:
+		t.Time, err = time.ParseInLocation(timestampLayout, string(v), time.UTC)
+	case string:
+		t.Time, err = time.ParseInLocation(timestampLayout, v, time.UTC)
+	default:
+		err = fmt.Errorf("migrate: can not scan %T into a timestamp", value)
+	}
+	return err
+}
+
+// lock takes the lock of the schema and returns the function which releases it. The lock is refreshed until it
+// is released, otherwise another process would take it over as stale in the middle of a long migration.
+func (m *Migrator) lock(ctx context.Context) (func(), error) {
+	ctx, cancel := context.WithTimeout(ctx, m.LockTimeout)
+	defer cancel()
+
+	for {
+		_, err := m.db.ExecContext(ctx, "DELETE FROM "+m.table+"_lock WHERE lockedAt < NOW() - INTERVAL ? SECOND", int(m.StaleLock.Seconds()))
+		if err != nil {
+			return nil, err
+		}
+
+		_, err = m.db.ExecContext(ctx, "INSERT INTO "+m.table+"_lock (id, owner) VALUES (1, ?)", m.owner)
+		if err == nil {
+			stop := make(chan struct{})
+			stopped := make(chan struct{})
+			go m.refresh(stop, stopped)
+			return func() {
+				close(stop)
+				<-stopped
+				if _, err := m.db.Exec("DELETE FROM "+m.table+"_lock WHERE id = 1 AND owner = ?", m.owner); err != nil {
+					log.Errorf("Can not release the migration lock: %v", err)
+				}
+			}, nil
+		}
+		if mysqlErr, ok := err.(*mysql.MySQLError); !ok || (mysqlErr.Number != errDuplicateEntry && mysqlErr.Number != errDeadlock) {
+			return nil, err
+		}
+
+		log.Info("Waiting for the migration lock")
+		select {
+		case <-ctx.Done():
+			return nil, ErrLocked
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// refresh renews lockedAt of the held lock until stop is closed and closes stopped when it returns.
+func (m *Migrator) refresh(stop <-chan struct{}, stopped chan<- struct{}) {
+	defer close(stopped)
+
+	ticker := time.NewTicker(m.StaleLock / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		res, err := m.db.Exec("UPDATE "+m.table+"_lock SET lockedAt = NOW() WHERE id = 1 AND owner = ?", m.owner)
+		if err != nil {
+			log.Errorf("Can not refresh the migration lock: %v", err)
+			continue
+		}
+		if affected, err := res.RowsAffected(); err == nil && affected == 0 {
+			log.Errorf("The migration lock of %v was taken over by another process", m.table)
+		}
+	}
+}
+
+// Status returns every known migration and whether it was applied.
+func (m *Migrator) Status(ctx context.Context) ([]Status, error) {
+	if err := m.validate(); err != nil {
+		return nil, err
+	}
+	if err := m.createTables(ctx); err != nil {
+		return nil, err
+	}
+	applied, err := m.applied(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := make([]Status, len(m.migrations))
+	for i, migration := range m.migrations {
+		appliedAt, ok := applied[migration.Version]
+		statuses[i] = Status{Migration: migration, Applied: ok, AppliedAt: appliedAt}
+	}
+	return statuses, nil
+}
+
+// Check returns a *PendingError when not every migration was applied.
+func (m *Migrator) Check(ctx context.Context) error {
+	statuses, err := m.Status(ctx)
+	if err != nil {
+		return err
+	}
+	pending := make([]Migration, 0)
+	for _, status := range statuses {
+		if !status.Applied {
+			pending = append(pending, status.Migration)
+		}
+	}
+	if len(pending) > 0 {
+		return &PendingError{Pending: pending}
+	}
+	return nil
+}
+
+// Up applies every pending migration in order and returns them.
+func (m *Migrator) Up(ctx context.Context) ([]Migration, error) {
+	if err := m.validate(); err != nil {
+		return nil, err
+	}
+	if err := m.createTables(ctx); err != nil {
+		return nil, err
+	}
+	unlock, err := m.lock(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	applied, err := m.applied(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	done := make([]Migration, 0)
+	for _, migration := range m.migrations {
+		if _, ok := applied[migration.Version]; ok {
+			continue
+		}
+		if err := m.exec(ctx, migration.Up); err != nil {
+			return done, fmt.Errorf("migrate: up %v: %v", migration, err)
+		}
+		if _, err := m.db.ExecContext(ctx, "INSERT INTO "+m.table+" (version, name) VALUES (?, ?)", migration.Version, migration.Name); err != nil {
+			return done, fmt.Errorf("migrate: up %v: %v", migration, err)
+		}
+		log.Infof("Applied migration %v", migration)
+		done = append(done, migration)
+	}
+	return done, nil
+}
+
+// Down reverts the last steps applied migrations, the latest first, and returns them.
+func (m *Migrator) Down(ctx context.Context, steps int) ([]Migration, error) {
+	if err := m.validate(); err != nil {
+		return nil, err
+	}
+	if err := m.createTables(ctx); err != nil {
+		return nil, err
+	}
+	unlock, err := m.lock(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	applied, err := m.applied(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	known := make(map[int]Migration, len(m.migrations))
+	for _, migration := range m.migrations {
+		known[migration.Version] = migration
+	}
+	versions := make([]int, 0, len(applied))
+	for version := range applied {
+		versions = append(versions, version)
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(versions)))
+
+	done := make([]Migration, 0)
+	for _, version := range versions {
+		if len(done) == steps {
+			break
+		}
+		migration, ok := known[version]
+		if !ok {
+			return done, fmt.Errorf("migrate: version %v was applied but is unknown to this binary", version)
+		}
+		if err := m.exec(ctx, migration.Down); err != nil {
+			return done, fmt.Errorf("migrate: down %v: %v", migration, err)
+		}
+		if _, err := m.db.ExecContext(ctx, "DELETE FROM "+m.table+" WHERE version = ?", version); err != nil {
+			return done, fmt.Errorf("migrate: down %v: %v", migration, err)
+		}
+		log.Infof("Reverted migration %v", migration)
+		done = append(done, migration)
+	}
+	return done, nil
+}
+
+func (m *Migrator) exec(ctx context.Context, statements []string) error {
+	for _, statement := range statements {
+		if _, err := m.db.ExecContext(ctx, statement); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Run executes the migrate subcommand in command, e.g. ["down", "2"], and writes its result to w.
+func (m *Migrator) Run(ctx context.Context, command []string, w io.Writer) error {
+	if len(command) == 0 {
+		return errors.New("usage: migrate up|down [n]|status")
+	}
+
+	switch command[0] {
+	case "up":
+		done, err := m.Up(ctx)
+		for _, migration := range done {
+			fmt.Fprintf(w, "applied %v\n", migration)
+		}
+		if err == nil && len(done) == 0 {
+			fmt.Fprintln(w, "no pending migrations")
+		}
+		return err
+	case "down":
+		steps := 1
+		if len(command) > 1 {
+			n, err := strconv.Atoi(command[1])
+			if err != nil || n < 1 {
+				return fmt.Errorf("migrate down: %q is not a positive number", command[1])
+			}
+			steps = n
+		}
+		done, err := m.Down(ctx, steps)
+		for _, migration := range done {
+			fmt.Fprintf(w, "reverted %v\n", migration)
+		}
+		return err
+	case "status":
+		statuses, err := m.Status(ctx)
+		if err != nil {
+			return err
+		}
+		tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "VERSION\tNAME\tAPPLIED")
+		for _, status := range statuses {
+			applied := "pending"
+			if status.Applied {
+				applied = status.AppliedAt.Format(time.RFC3339)
+			}
+			fmt.Fprintf(tw, "%v\t%v\t%v\n", status.Version, status.Name, applied)
+		}
+		return tw.Flush()
+	default:
+		return fmt.Errorf("migrate: unknown subcommand %q, use up, down or status", command[0])
+	}
+}
+
+// ParseCommand splits the command-line arguments without the program name into the migrate subcommand and the
+// remaining flags, e.g. "migrate down 2 --db-host db" into ["down", "2"] and ["--db-host", "db"]. The command is
+// nil when args don't start with migrate.
+func ParseCommand(args []string) (command []string, flags []string) {
+	if len(args) == 0 || args[0] != "migrate" {
+		return nil, args
+	}
+	command = make([]string, 0)
+	for i, arg := range args[1:] {
+		if strings.HasPrefix(arg, "-") {
+			return command, args[i+1:]
+		}
+		command = append(command, arg)
+	}
+	return command, nil
+}
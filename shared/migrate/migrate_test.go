@@ -0,0 +1,208 @@
+package migrate
+
+import (
+	"bytes"
+	"context"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	sqlmock "gopkg.in/DATA-DOG/go-sqlmock.v1"
+)
+
+var testMigrations = []Migration{
+	{Version: 2, Name: "add email", Up: []string{"ALTER TABLE users ADD email varchar(255)"}, Down: []string{"ALTER TABLE users DROP email"}},
+	{Version: 1, Name: "create users", Up: []string{"CREATE TABLE users (id INT NOT NULL PRIMARY KEY)"}, Down: []string{"DROP TABLE users"}},
+}
+
+func expectTables(mock sqlmock.Sqlmock) {
+	mock.ExpectExec(regexp.QuoteMeta("CREATE TABLE IF NOT EXISTS schema_migrations ")).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta("CREATE TABLE IF NOT EXISTS schema_migrations_lock ")).WillReturnResult(sqlmock.NewResult(0, 0))
+}
+
+func expectLock(mock sqlmock.Sqlmock) {
+	mock.ExpectExec(regexp.QuoteMeta("DELETE FROM schema_migrations_lock WHERE lockedAt <")).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO schema_migrations_lock (id, owner) VALUES (1, ?)")).WillReturnResult(sqlmock.NewResult(1, 1))
+}
+
+func expectApplied(mock sqlmock.Sqlmock, versions ...int) {
+	rows := sqlmock.NewRows([]string{"version", "appliedAt"})
+	for _, version := range versions {
+		rows.AddRow(version, time.Now())
+	}
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT version, appliedAt FROM schema_migrations")).WillReturnRows(rows)
+}
+
+func expectUnlock(mock sqlmock.Sqlmock) {
+	mock.ExpectExec(regexp.QuoteMeta("DELETE FROM schema_migrations_lock WHERE id = 1 AND owner = ?")).WillReturnResult(sqlmock.NewResult(0, 1))
+}
+
+// Test if only the pending migrations are applied and recorded.
+func TestUp(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	expectTables(mock)
+	expectLock(mock)
+	expectApplied(mock, 1)
+	mock.ExpectExec(regexp.QuoteMeta("ALTER TABLE users ADD email varchar(255)")).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO schema_migrations (version, name) VALUES (?, ?)")).WithArgs(2, "add email").WillReturnResult(sqlmock.NewResult(0, 1))
+	expectUnlock(mock)
+
+	done, err := New(db, DefaultTable, testMigrations).Up(context.Background())
+	if err != nil {
+		t.Fatalf("Expected no error, instead got %v", err.Error())
+	}
+	if len(done) != 1 || done[0].Version != 2 {
+		t.Errorf("Expected %v but got %v", "[2 add email]", done)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expections: %s", err)
+	}
+}
+
+// Test if the latest migration is reverted first.
+func TestDown(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	expectTables(mock)
+	expectLock(mock)
+	expectApplied(mock, 1, 2)
+	mock.ExpectExec(regexp.QuoteMeta("ALTER TABLE users DROP email")).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta("DELETE FROM schema_migrations WHERE version = ?")).WithArgs(2).WillReturnResult(sqlmock.NewResult(0, 1))
+	expectUnlock(mock)
+
+	var out bytes.Buffer
+	if err := New(db, DefaultTable, testMigrations).Run(context.Background(), []string{"down"}, &out); err != nil {
+		t.Fatalf("Expected no error, instead got %v", err.Error())
+	}
+	expected := "reverted 2 add email\n"
+	if out.String() != expected {
+		t.Errorf("Expected %q but got %q", expected, out.String())
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expections: %s", err)
+	}
+}
+
+// Test if Check reports the pending migrations.
+func TestCheck(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	expectTables(mock)
+	expectApplied(mock, 1)
+
+	err = New(db, DefaultTable, testMigrations).Check(context.Background())
+	pendingErr, ok := err.(*PendingError)
+	if !ok {
+		t.Fatalf("Expected a *PendingError but got %v", err)
+	}
+	if len(pendingErr.Pending) != 1 || pendingErr.Pending[0].Version != 2 {
+		t.Errorf("Expected %v but got %v", "[2 add email]", pendingErr.Pending)
+	}
+}
+
+// Test if Up gives up when another process holds the lock.
+func TestUpLocked(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	expectTables(mock)
+	mock.ExpectExec(regexp.QuoteMeta("DELETE FROM schema_migrations_lock WHERE lockedAt <")).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO schema_migrations_lock (id, owner) VALUES (1, ?)")).WillReturnError(&mysql.MySQLError{Number: errDuplicateEntry, Message: "Duplicate entry '1'"})
+
+	migrator := New(db, DefaultTable, testMigrations)
+	migrator.LockTimeout = 10 * time.Millisecond
+	if _, err := migrator.Up(context.Background()); err != ErrLocked {
+		t.Errorf("Expected %v but got %v", ErrLocked, err)
+	}
+}
+
+// Test if the applied migrations are read when the connection doesn't parse times.
+func TestCheckWithoutParseTime(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	expectTables(mock)
+	rows := sqlmock.NewRows([]string{"version", "appliedAt"}).
+		AddRow(1, []byte("2026-10-19 12:00:00")).
+		AddRow(2, []byte("2026-10-19 12:00:01.5"))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT version, appliedAt FROM schema_migrations")).WillReturnRows(rows)
+
+	if err := New(db, DefaultTable, testMigrations).Check(context.Background()); err != nil {
+		t.Fatalf("Expected no error, instead got %v", err.Error())
+	}
+}
+
+// Test if the lock is refreshed while it is held, so another process doesn't take it over as stale.
+func TestLockRefreshed(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	expectLock(mock)
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE schema_migrations_lock SET lockedAt = NOW() WHERE id = 1 AND owner = ?")).WillReturnResult(sqlmock.NewResult(0, 1))
+	expectUnlock(mock)
+
+	migrator := New(db, DefaultTable, testMigrations)
+	migrator.StaleLock = 150 * time.Millisecond
+	unlock, err := migrator.lock(context.Background())
+	if err != nil {
+		t.Fatalf("Expected no error, instead got %v", err.Error())
+	}
+	time.Sleep(75 * time.Millisecond)
+	unlock()
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expections: %s", err)
+	}
+}
+
+func TestDuplicateVersion(t *testing.T) {
+	db, _, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	migrations := append([]Migration{{Version: 1, Name: "again"}}, testMigrations...)
+	if _, err := New(db, DefaultTable, migrations).Status(context.Background()); err == nil {
+		t.Fatal("Expected an error but got nil")
+	}
+}
+
+func TestParseCommand(t *testing.T) {
+	command, flags := ParseCommand([]string{"migrate", "down", "2", "--db-host", "db"})
+	if strings.Join(command, " ") != "down 2" {
+		t.Errorf("Expected %v but got %v", "down 2", command)
+	}
+	if strings.Join(flags, " ") != "--db-host db" {
+		t.Errorf("Expected %v but got %v", "--db-host db", flags)
+	}
+
+	command, flags = ParseCommand([]string{"--port", "5000"})
+	if command != nil || len(flags) != 2 {
+		t.Errorf("Expected no command but got %v", command)
+	}
+}
@@ -0,0 +1,14 @@
+package models
+
+// Problem is an RFC 7807 problem details object. It is the body of every error response of the services and is
+// sent with the application/problem+json content type. Code is the machine-readable kind of the error (see
+// package apierror) and RequestID the ID of the request which caused it.
+type Problem struct {
+	Type      string `json:"type"`
+	Title     string `json:"title"`
+	Status    int    `json:"status"`
+	Detail    string `json:"detail,omitempty"`
+	Instance  string `json:"instance,omitempty"`
+	Code      string `json:"code"`
+	RequestID string `json:"request_id,omitempty"`
+}
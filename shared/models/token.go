@@ -0,0 +1,41 @@
+package models
+
+// TokenStatusRequest is a struct and contains the fields the TokenStatus IPC needs
+type TokenStatusRequest struct {
+	UserID  int    `json:"user_id"`
+	TokenID string `json:"jti"`
+}
+
+// TokenStatusResponse is a struct and contains the fields the TokenStatus IPC returns. Version is the current token
+// version of the user, tokens with a lower version are revoked.
+type TokenStatusResponse struct {
+	UserID  int    `json:"user_id"`
+	TokenID string `json:"jti"`
+	Revoked bool   `json:"revoked"`
+	Version int    `json:"version"`
+}
+
+// RevokeSessionsRequest is a struct and contains the fields the RevokeSessions IPC needs
+type RevokeSessionsRequest struct {
+	UserID int `json:"user_id"`
+}
+
+// RevokeSessionsResponse is a struct and contains the user whose sessions the RevokeSessions IPC revoked
+type RevokeSessionsResponse struct {
+	UserID int `json:"user_id"`
+}
+
+// AccessTokenRequest is a struct and contains the fields the AccessTokens IPC needs. TokenHash is the hash of a
+// personal access token, see middleware.HashAccessToken.
+type AccessTokenRequest struct {
+	TokenHash string `json:"token_hash"`
+}
+
+// AccessTokenResponse is a struct and contains the fields the AccessTokens IPC returns for every personal access
+// token which exists
+type AccessTokenResponse struct {
+	TokenHash     string   `json:"token_hash"`
+	UserID        int      `json:"user_id"`
+	Scopes        []string `json:"scopes"`
+	EmailVerified bool     `json:"email_verified"`
+}
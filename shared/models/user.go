@@ -10,3 +10,18 @@ type GetUsernamesResponse struct {
 	ID       int    `json:"id"`
 	Username string `json:"username"`
 }
+
+// CreateUserRequest is a struct and contains the fields the CreateUser IPC needs. The user signs in with an
+// external identity provider, which verified Email.
+type CreateUserRequest struct {
+	Username string `json:"username"`
+	Email    string `json:"email"`
+}
+
+// CreateUserResponse is a struct and contains the fields the CreateUser IPC returns. Username differs from the
+// requested one when that was taken.
+type CreateUserResponse struct {
+	ID       int    `json:"id"`
+	Username string `json:"username"`
+	Email    string `json:"email"`
+}
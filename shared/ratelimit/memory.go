@@ -0,0 +1,80 @@
+package ratelimit
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+)
+
+// sweepInterval is how often MemoryStore removes the buckets which are full again.
+const sweepInterval = time.Minute
+
+// MemoryStore keeps the buckets in the memory of the process. Every instance of a service has its own buckets, so
+// the effective limit grows with the number of instances.
+type MemoryStore struct {
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+
+	// now returns the current time, tests replace it.
+	now func() time.Time
+}
+
+type bucket struct {
+	policy Policy
+	tokens float64
+	last   time.Time
+}
+
+// NewMemoryStore returns an empty MemoryStore.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{buckets: make(map[string]*bucket), now: time.Now}
+}
+
+// Take removes a token from the bucket of key in policy.
+func (s *MemoryStore) Take(ctx context.Context, policy Policy, key string) (Result, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	s.sweep(now)
+
+	id := policy.Name + "|" + key
+	b, ok := s.buckets[id]
+	if !ok {
+		b = &bucket{policy: policy, tokens: policy.burst(), last: now}
+		s.buckets[id] = b
+	}
+	b.refill(now)
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return Result{Allowed: true}, nil
+	}
+	wait := (1 - b.tokens) / policy.rate()
+	return Result{RetryAfter: time.Duration(wait * float64(time.Second))}, nil
+}
+
+// sweep removes the buckets which are full again, they are no different from a new bucket.
+func (s *MemoryStore) sweep(now time.Time) {
+	if now.Sub(s.lastSweep) < sweepInterval {
+		return
+	}
+	s.lastSweep = now
+	for id, b := range s.buckets {
+		b.refill(now)
+		if b.tokens >= b.policy.burst() {
+			delete(s.buckets, id)
+		}
+	}
+}
+
+func (b *bucket) refill(now time.Time) {
+	elapsed := now.Sub(b.last).Seconds()
+	if elapsed <= 0 {
+		return
+	}
+	b.tokens = math.Min(b.policy.burst(), b.tokens+elapsed*b.policy.rate())
+	b.last = now
+}
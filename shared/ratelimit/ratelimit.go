@@ -0,0 +1,95 @@
+// Package ratelimit throttles clients with token buckets. Every Policy has its own buckets, which are keyed by the
+// authenticated user or, for anonymous requests, by the IP address of the client. The buckets live in a Store, so
+// the services can share them by plugging in a store backed by a shared database instead of MemoryStore.
+package ratelimit
+
+import (
+	"context"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/bstaijen/mariadb-for-microservices/shared/apierror"
+	"github.com/bstaijen/mariadb-for-microservices/shared/util"
+	"github.com/bstaijen/mariadb-for-microservices/shared/util/middleware"
+	"github.com/urfave/negroni"
+)
+
+// ErrTooManyRequests is sent when a client exceeded the limit of a policy.
+var ErrTooManyRequests = apierror.New(apierror.TooManyRequests, "too many requests, try again later")
+
+// Policy is a token bucket. A client may do Limit requests per Period on average and Burst requests at once. Burst
+// defaults to Limit.
+type Policy struct {
+	Name   string
+	Limit  int
+	Period time.Duration
+	Burst  int
+}
+
+// rate returns the number of tokens added to a bucket per second.
+func (p Policy) rate() float64 {
+	return float64(p.Limit) / p.Period.Seconds()
+}
+
+// burst returns the capacity of a bucket.
+func (p Policy) burst() float64 {
+	if p.Burst > 0 {
+		return float64(p.Burst)
+	}
+	return float64(p.Limit)
+}
+
+// Result is the outcome of taking a token from a bucket. RetryAfter is how long the client has to wait for the
+// next token when the request is not allowed.
+type Result struct {
+	Allowed    bool
+	RetryAfter time.Duration
+}
+
+// Store keeps the buckets of the policies. Take removes a token from the bucket of key and reports whether there
+// was one. Implementations must be safe for concurrent use.
+type Store interface {
+	Take(ctx context.Context, policy Policy, key string) (Result, error)
+}
+
+// Middleware is a middleware handler which limits the requests of every client to policy. It must run after the
+// token authentication middleware, otherwise every client is keyed by its IP address. Requests over the limit are
+// answered with 429 and a Retry-After header. When the store fails the request is let through, the limiter should
+// not take the service down.
+func Middleware(store Store, policy Policy) negroni.HandlerFunc {
+	return negroni.HandlerFunc(func(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+		key := clientKey(r)
+		result, err := store.Take(r.Context(), policy, key)
+		if err != nil {
+			util.Log(r.Context()).Errorf("Rate limiter %v: %v", policy.Name, err)
+		} else if !result.Allowed {
+			util.Log(r.Context()).Warnf("Rate limit %v exceeded by %v", policy.Name, key)
+			seconds := int(math.Ceil(result.RetryAfter.Seconds()))
+			if seconds < 1 {
+				seconds = 1
+			}
+			w.Header().Set("Retry-After", strconv.Itoa(seconds))
+			util.SendError(w, ErrTooManyRequests)
+			return
+		}
+
+		if next != nil {
+			next(w, r)
+		}
+	})
+}
+
+// clientKey returns the key of the bucket of the client of r.
+func clientKey(r *http.Request) string {
+	if user, ok := middleware.UserFromContext(r.Context()); ok {
+		return "user:" + strconv.Itoa(user.ID)
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "ip:" + host
+}
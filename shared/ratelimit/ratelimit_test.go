@@ -0,0 +1,119 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/bstaijen/mariadb-for-microservices/shared/util/middleware"
+)
+
+var testPolicy = Policy{Name: "test", Limit: 2, Period: time.Minute}
+
+func serve(t *testing.T, store Store, user int, remoteAddr string) *httptest.ResponseRecorder {
+	req, err := http.NewRequest("POST", "http://localhost/test", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.RemoteAddr = remoteAddr
+	if user > 0 {
+		req = req.WithContext(middleware.WithUser(req.Context(), &middleware.Principal{ID: user}))
+	}
+	res := httptest.NewRecorder()
+
+	Middleware(store, testPolicy)(res, req, func(w http.ResponseWriter, r *http.Request) {})
+	return res
+}
+
+// Test if the requests over the limit are answered with 429 and a Retry-After header.
+func TestMiddlewareLimit(t *testing.T) {
+	store := NewMemoryStore()
+	for i := 0; i < testPolicy.Limit; i++ {
+		if res := serve(t, store, 1, "10.0.0.1:1234"); res.Result().StatusCode != http.StatusOK {
+			t.Fatalf("Expected %v but got %v", http.StatusOK, res.Result().StatusCode)
+		}
+	}
+
+	res := serve(t, store, 1, "10.0.0.1:1234")
+	if res.Result().StatusCode != http.StatusTooManyRequests {
+		t.Errorf("Expected %v but got %v", http.StatusTooManyRequests, res.Result().StatusCode)
+	}
+	expected := "30"
+	if actual := res.Header().Get("Retry-After"); actual != expected {
+		t.Errorf("Expected %v but got %v", expected, actual)
+	}
+}
+
+// Test if users and anonymous clients have their own buckets.
+func TestMiddlewareKeys(t *testing.T) {
+	store := NewMemoryStore()
+	for i := 0; i < testPolicy.Limit; i++ {
+		serve(t, store, 1, "10.0.0.1:1234")
+	}
+
+	// Another user behind the same address.
+	if res := serve(t, store, 2, "10.0.0.1:1234"); res.Result().StatusCode != http.StatusOK {
+		t.Errorf("Expected %v but got %v", http.StatusOK, res.Result().StatusCode)
+	}
+
+	// Anonymous clients are keyed by their address, not by their port.
+	serve(t, store, 0, "10.0.0.2:1000")
+	serve(t, store, 0, "10.0.0.2:2000")
+	if res := serve(t, store, 0, "10.0.0.2:3000"); res.Result().StatusCode != http.StatusTooManyRequests {
+		t.Errorf("Expected %v but got %v", http.StatusTooManyRequests, res.Result().StatusCode)
+	}
+	if res := serve(t, store, 0, "10.0.0.3:1000"); res.Result().StatusCode != http.StatusOK {
+		t.Errorf("Expected %v but got %v", http.StatusOK, res.Result().StatusCode)
+	}
+}
+
+// Test if the bucket is refilled over time.
+func TestMemoryStoreRefill(t *testing.T) {
+	now := time.Now()
+	store := NewMemoryStore()
+	store.now = func() time.Time { return now }
+
+	for i := 0; i < testPolicy.Limit; i++ {
+		store.Take(context.Background(), testPolicy, "key")
+	}
+	if result, _ := store.Take(context.Background(), testPolicy, "key"); result.Allowed {
+		t.Fatal("Expected the bucket to be empty")
+	}
+
+	now = now.Add(30 * time.Second)
+	if result, _ := store.Take(context.Background(), testPolicy, "key"); !result.Allowed {
+		t.Error("Expected a token after half of the period")
+	}
+}
+
+// Test if full buckets are removed, so the store doesn't grow forever.
+func TestMemoryStoreSweep(t *testing.T) {
+	now := time.Now()
+	store := NewMemoryStore()
+	store.now = func() time.Time { return now }
+
+	store.Take(context.Background(), testPolicy, "key")
+	now = now.Add(time.Hour)
+	store.Take(context.Background(), testPolicy, "other")
+
+	expected := 1
+	if actual := len(store.buckets); actual != expected {
+		t.Errorf("Expected %v but got %v", expected, actual)
+	}
+}
+
+type failingStore struct{}
+
+func (failingStore) Take(ctx context.Context, policy Policy, key string) (Result, error) {
+	return Result{}, errors.New("store is down")
+}
+
+// Test if requests are let through when the store fails.
+func TestMiddlewareStoreError(t *testing.T) {
+	if res := serve(t, failingStore{}, 1, "10.0.0.1:1234"); res.Result().StatusCode != http.StatusOK {
+		t.Errorf("Expected %v but got %v", http.StatusOK, res.Result().StatusCode)
+	}
+}
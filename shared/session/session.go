@@ -0,0 +1,169 @@
+// Package session keeps the refresh tokens of the users. A login starts a family of refresh tokens. Every refresh
+// rotates the token: the old one is marked as used and a new one of the same family is returned. A used token which
+// is presented again was stolen, or the client was, so the whole family is revoked and the user has to log in.
+//
+// Only a SHA-256 hash of a refresh token is stored, the token itself is only known to the client.
+package session
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"time"
+
+	"github.com/bstaijen/mariadb-for-microservices/shared/apierror"
+	"github.com/bstaijen/mariadb-for-microservices/shared/tracing"
+)
+
+// DefaultRefreshTokenLifetime is the lifetime of a refresh token when none is configured.
+const DefaultRefreshTokenLifetime = 30 * 24 * time.Hour
+
+// ErrInvalidRefreshToken is sent when a refresh token is unknown, expired or revoked.
+var ErrInvalidRefreshToken = apierror.New(apierror.Unauthenticated, "Invalid refresh token")
+
+// ErrRefreshTokenReused is sent when a refresh token is used twice. The session it belongs to is revoked.
+var ErrRefreshTokenReused = apierror.New(apierror.Unauthenticated, "Refresh token was already used, the session is revoked")
+
+// Migration creates the table of the refresh tokens. It is part of the migrations of the authentication service,
+// which owns the table.
+var Migration = []string{
+	"CREATE TABLE IF NOT EXISTS refresh_tokens (id INT NOT NULL AUTO_INCREMENT PRIMARY KEY, token_hash char(64) NOT NULL UNIQUE, family_id char(32) NOT NULL, user_id INT NOT NULL, expiresAt timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP, rotatedAt timestamp NULL DEFAULT NULL, revokedAt timestamp NULL DEFAULT NULL, createdAt timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP, INDEX refresh_tokens_family (family_id), INDEX refresh_tokens_user (user_id))",
+}
+
+// RefreshToken is a refresh token as it is handed to the client.
+type RefreshToken struct {
+	Token     string
+	UserID    int
+	ExpiresAt time.Time
+}
+
+// Store issues and rotates refresh tokens.
+type Store struct {
+	db       *sql.DB
+	lifetime time.Duration
+}
+
+// NewStore returns a store of refresh tokens which live for lifetime. A lifetime of zero means
+// DefaultRefreshTokenLifetime.
+func NewStore(db *sql.DB, lifetime time.Duration) *Store {
+	if lifetime <= 0 {
+		lifetime = DefaultRefreshTokenLifetime
+	}
+	return &Store{db: db, lifetime: lifetime}
+}
+
+// Issue starts a new family with a refresh token for the user with userID.
+func (s *Store) Issue(ctx context.Context, userID int) (*RefreshToken, error) {
+	family, err := randomBytes(16)
+	if err != nil {
+		return nil, err
+	}
+	token, hash, err := newToken()
+	if err != nil {
+		return nil, err
+	}
+
+	expiresAt := time.Now().Add(s.lifetime)
+	_, err = tracing.ExecContext(ctx, s.db, "INSERT INTO refresh_tokens (token_hash, family_id, user_id, expiresAt) VALUES (?, ?, ?, ?)", hash, hex.EncodeToString(family), userID, expiresAt)
+	if err != nil {
+		return nil, err
+	}
+	return &RefreshToken{Token: token, UserID: userID, ExpiresAt: expiresAt}, nil
+}
+
+// Rotate marks token as used and returns its successor. A token which was rotated before revokes its family and
+// returns ErrRefreshTokenReused.
+func (s *Store) Rotate(ctx context.Context, token string) (*RefreshToken, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// FOR UPDATE serializes the rotations of a token on a single node. On Galera a concurrent rotation on another
+	// node fails the certification of one of both commits.
+	var id, userID int
+	var family string
+	var expiresAt time.Time
+	var rotatedAt, revokedAt *time.Time
+	err = tx.QueryRowContext(ctx, "SELECT id, family_id, user_id, expiresAt, rotatedAt, revokedAt FROM refresh_tokens WHERE token_hash = ? FOR UPDATE", hashToken(token)).
+		Scan(&id, &family, &userID, &expiresAt, &rotatedAt, &revokedAt)
+	if err == sql.ErrNoRows {
+		return nil, ErrInvalidRefreshToken
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if revokedAt != nil {
+		return nil, ErrInvalidRefreshToken
+	}
+	if rotatedAt != nil {
+		if _, err := tx.ExecContext(ctx, "UPDATE refresh_tokens SET revokedAt = NOW() WHERE family_id = ? AND revokedAt IS NULL", family); err != nil {
+			return nil, err
+		}
+		if err := tx.Commit(); err != nil {
+			return nil, err
+		}
+		return nil, ErrRefreshTokenReused
+	}
+	if time.Now().After(expiresAt) {
+		return nil, ErrInvalidRefreshToken
+	}
+
+	next, hash, err := newToken()
+	if err != nil {
+		return nil, err
+	}
+	nextExpiresAt := time.Now().Add(s.lifetime)
+	if _, err := tx.ExecContext(ctx, "UPDATE refresh_tokens SET rotatedAt = NOW() WHERE id = ?", id); err != nil {
+		return nil, err
+	}
+	if _, err := tx.ExecContext(ctx, "INSERT INTO refresh_tokens (token_hash, family_id, user_id, expiresAt) VALUES (?, ?, ?, ?)", hash, family, userID, nextExpiresAt); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return &RefreshToken{Token: next, UserID: userID, ExpiresAt: nextExpiresAt}, nil
+}
+
+// Revoke revokes the family of token when it belongs to the user with userID. An unknown token is ignored, the
+// session it would start is gone anyway.
+func (s *Store) Revoke(ctx context.Context, userID int, token string) error {
+	_, err := tracing.ExecContext(ctx, s.db, "UPDATE refresh_tokens SET revokedAt = NOW() WHERE revokedAt IS NULL AND user_id = ? AND family_id = (SELECT family_id FROM (SELECT family_id FROM refresh_tokens WHERE token_hash = ?) AS token)", userID, hashToken(token))
+	return err
+}
+
+// RevokeUser revokes every refresh token of the user with userID.
+func (s *Store) RevokeUser(ctx context.Context, userID int) error {
+	_, err := tracing.ExecContext(ctx, s.db, "UPDATE refresh_tokens SET revokedAt = NOW() WHERE user_id = ? AND revokedAt IS NULL", userID)
+	return err
+}
+
+// newToken returns a random refresh token and its hash.
+func newToken() (string, string, error) {
+	b, err := randomBytes(32)
+	if err != nil {
+		return "", "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+	return token, hashToken(token), nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// randomBytes returns n bytes from crypto/rand.
+func randomBytes(n int) ([]byte, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
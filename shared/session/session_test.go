@@ -0,0 +1,132 @@
+package session
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	sqlmock "gopkg.in/DATA-DOG/go-sqlmock.v1"
+)
+
+var columns = []string{"id", "family_id", "user_id", "expiresAt", "rotatedAt", "revokedAt"}
+
+func TestIssue(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	mock.ExpectExec("INSERT INTO refresh_tokens").WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), 1, sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(1, 1))
+
+	token, err := NewStore(db, time.Hour).Issue(context.Background(), 1)
+	if err != nil {
+		t.Fatalf("Expected no error, instead got %v", err.Error())
+	}
+	if token.Token == "" || token.UserID != 1 {
+		t.Errorf("Expected a token for user 1 but got %+v", token)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+// Test if a token is replaced by a token of the same family.
+func TestRotate(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT (.+) FROM refresh_tokens WHERE token_hash").WithArgs(hashToken("old")).
+		WillReturnRows(sqlmock.NewRows(columns).AddRow(7, "family", 1, time.Now().Add(time.Hour), nil, nil))
+	mock.ExpectExec("UPDATE refresh_tokens SET rotatedAt").WithArgs(7).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO refresh_tokens").WithArgs(sqlmock.AnyArg(), "family", 1, sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(8, 1))
+	mock.ExpectCommit()
+
+	token, err := NewStore(db, time.Hour).Rotate(context.Background(), "old")
+	if err != nil {
+		t.Fatalf("Expected no error, instead got %v", err.Error())
+	}
+	if token.Token == "old" || token.UserID != 1 {
+		t.Errorf("Expected a new token for user 1 but got %+v", token)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+// Test if a token which was rotated before revokes its family.
+func TestRotateReused(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT (.+) FROM refresh_tokens WHERE token_hash").WithArgs(hashToken("old")).
+		WillReturnRows(sqlmock.NewRows(columns).AddRow(7, "family", 1, time.Now().Add(time.Hour), time.Now(), nil))
+	mock.ExpectExec("UPDATE refresh_tokens SET revokedAt").WithArgs("family").WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectCommit()
+
+	if _, err := NewStore(db, time.Hour).Rotate(context.Background(), "old"); err != ErrRefreshTokenReused {
+		t.Errorf("Expected %v but got %v", ErrRefreshTokenReused, err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestRotateExpired(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT (.+) FROM refresh_tokens WHERE token_hash").WithArgs(hashToken("old")).
+		WillReturnRows(sqlmock.NewRows(columns).AddRow(7, "family", 1, time.Now().Add(-time.Hour), nil, nil))
+	mock.ExpectRollback()
+
+	if _, err := NewStore(db, time.Hour).Rotate(context.Background(), "old"); err != ErrInvalidRefreshToken {
+		t.Errorf("Expected %v but got %v", ErrInvalidRefreshToken, err)
+	}
+}
+
+func TestRotateUnknown(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT (.+) FROM refresh_tokens WHERE token_hash").WillReturnRows(sqlmock.NewRows(columns))
+	mock.ExpectRollback()
+
+	if _, err := NewStore(db, time.Hour).Rotate(context.Background(), "unknown"); err != ErrInvalidRefreshToken {
+		t.Errorf("Expected %v but got %v", ErrInvalidRefreshToken, err)
+	}
+}
+
+// Test if only the family of the token of the user is revoked.
+func TestRevoke(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	mock.ExpectExec("UPDATE refresh_tokens SET revokedAt").WithArgs(1, hashToken("token")).WillReturnResult(sqlmock.NewResult(0, 2))
+
+	if err := NewStore(db, time.Hour).Revoke(context.Background(), 1, "token"); err != nil {
+		t.Fatalf("Expected no error, instead got %v", err.Error())
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
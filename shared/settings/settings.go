@@ -0,0 +1,300 @@
+// Package settings loads the configuration of a service into a struct. The fields are described with tags:
+//
+//	Port int `env:"PORT" required:"true" min:"1" max:"65535"`
+//
+// Every field is loaded from, in increasing order of precedence:
+//
+//   - the default tag
+//   - the configuration file given with --config or CONFIG_FILE, in YAML (.yml, .yaml) or TOML (.toml), with the
+//     name of the environment variable in lower case as key, e.g. db_port
+//   - the environment variable, or the file named by the variable with a _FILE suffix, e.g. SECRET_KEY_FILE for
+//     Docker secrets
+//   - the command-line flag, the name of the environment variable in lower case with dashes, e.g. --db-port
+//
+// Load reports every value which can't be parsed and every field which fails its validation at once, so a service
+// can refuse to start with a complete list of what is wrong.
+package settings
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// FileEnv and FileFlag name the configuration file.
+const (
+	FileEnv  = "CONFIG_FILE"
+	FileFlag = "config"
+)
+
+// FileSuffix is the suffix of the environment variables which name a file with the value, e.g. SECRET_KEY_FILE.
+const FileSuffix = "_FILE"
+
+// Error lists every problem with the configuration.
+type Error struct {
+	Problems []string
+}
+
+func (e *Error) Error() string {
+	return "invalid configuration:\n  - " + strings.Join(e.Problems, "\n  - ")
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// field is a tagged field of the configuration struct.
+type field struct {
+	env   string
+	value reflect.Value
+	tag   reflect.StructTag
+}
+
+// Load fills target, a pointer to a struct, from the defaults, the configuration file, the environment and args,
+// the command-line arguments without the program name. The values which could be parsed are set even when Load
+// returns an *Error.
+func Load(target interface{}, args []string) error {
+	ptr := reflect.ValueOf(target)
+	if ptr.Kind() != reflect.Ptr || ptr.Elem().Kind() != reflect.Struct {
+		return errors.New("settings: target must be a pointer to a struct")
+	}
+
+	fields, err := fieldsOf(ptr.Elem())
+	if err != nil {
+		return err
+	}
+
+	l := &loader{}
+	flags := l.parseFlags(fields, args)
+
+	for _, f := range fields {
+		if def, ok := f.tag.Lookup("default"); ok {
+			l.set(f, def, "default")
+		}
+	}
+
+	path := os.Getenv(FileEnv)
+	if value, ok := flags[FileFlag]; ok {
+		path = value
+	}
+	if path != "" {
+		l.loadFile(fields, path)
+	}
+
+	for _, f := range fields {
+		l.loadEnv(f)
+	}
+
+	for _, f := range fields {
+		if value, ok := flags[flagName(f.env)]; ok {
+			l.set(f, value, "flag --"+flagName(f.env))
+		}
+	}
+
+	for _, f := range fields {
+		l.validate(f)
+	}
+
+	if len(l.problems) > 0 {
+		return &Error{Problems: l.problems}
+	}
+	return nil
+}
+
+func fieldsOf(v reflect.Value) ([]field, error) {
+	fields := make([]field, 0, v.NumField())
+	for i := 0; i < v.NumField(); i++ {
+		sf := v.Type().Field(i)
+		env, ok := sf.Tag.Lookup("env")
+		if !ok {
+			continue
+		}
+		switch {
+		case sf.Type == durationType:
+		case sf.Type.Kind() == reflect.String, sf.Type.Kind() == reflect.Int, sf.Type.Kind() == reflect.Bool:
+		case sf.Type.Kind() == reflect.Slice && sf.Type.Elem().Kind() == reflect.String:
+		default:
+			return nil, fmt.Errorf("settings: field %v has unsupported type %v", sf.Name, sf.Type)
+		}
+		fields = append(fields, field{env: env, value: v.Field(i), tag: sf.Tag})
+	}
+	return fields, nil
+}
+
+type loader struct {
+	problems []string
+}
+
+func (l *loader) problemf(format string, args ...interface{}) {
+	l.problems = append(l.problems, fmt.Sprintf(format, args...))
+}
+
+// parseFlags returns the value of every flag in args.
+func (l *loader) parseFlags(fields []field, args []string) map[string]string {
+	fs := flag.NewFlagSet(filepath.Base(os.Args[0]), flag.ContinueOnError)
+	fs.String(FileFlag, "", "the configuration file, overrides "+FileEnv)
+	for _, f := range fields {
+		fs.String(flagName(f.env), "", "overrides "+f.env)
+	}
+	if err := fs.Parse(args); err != nil {
+		l.problemf("command line: %v", err)
+	}
+
+	values := make(map[string]string)
+	fs.Visit(func(f *flag.Flag) {
+		values[f.Name] = f.Value.String()
+	})
+	return values
+}
+
+func (l *loader) loadFile(fields []field, path string) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		l.problemf("configuration file: %v", err)
+		return
+	}
+
+	values := make(map[string]interface{})
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yml", ".yaml":
+		err = yaml.Unmarshal(data, &values)
+	case ".toml":
+		err = toml.Unmarshal(data, &values)
+	default:
+		err = fmt.Errorf("unknown format %q, use .yml, .yaml or .toml", filepath.Ext(path))
+	}
+	if err != nil {
+		l.problemf("configuration file %v: %v", path, err)
+		return
+	}
+
+	source := "file " + path
+	known := make(map[string]bool, len(fields))
+	for _, f := range fields {
+		key := strings.ToLower(f.env)
+		known[key] = true
+		if value, ok := values[key]; ok {
+			l.set(f, fileValue(value), source)
+		}
+	}
+	for key := range values {
+		if !known[key] {
+			l.problemf("%v: unknown key %q", source, key)
+		}
+	}
+}
+
+// fileValue turns a value of the configuration file into the form of an environment variable.
+func fileValue(value interface{}) string {
+	if list, ok := value.([]interface{}); ok {
+		items := make([]string, len(list))
+		for i, item := range list {
+			items[i] = fmt.Sprint(item)
+		}
+		return strings.Join(items, ",")
+	}
+	return fmt.Sprint(value)
+}
+
+func (l *loader) loadEnv(f field) {
+	value, ok := os.LookupEnv(f.env)
+	path, fromFile := os.LookupEnv(f.env + FileSuffix)
+	switch {
+	case ok && fromFile:
+		l.problemf("%v and %v are both set", f.env, f.env+FileSuffix)
+	case fromFile:
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			l.problemf("%v: %v", f.env+FileSuffix, err)
+			return
+		}
+		l.set(f, strings.TrimRight(string(data), "\r\n"), "environment "+f.env+FileSuffix)
+	case ok:
+		l.set(f, value, "environment")
+	}
+}
+
+// set parses value into the field. A value which can't be parsed is reported with its source and doesn't
+// change the field.
+func (l *loader) set(f field, value string, source string) {
+	v := f.value
+	switch {
+	case v.Type() == durationType:
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			l.problemf("%v (%v): %q is not a duration like 500ms or 10s", f.env, source, value)
+			return
+		}
+		v.SetInt(int64(d))
+	case v.Kind() == reflect.String:
+		v.SetString(value)
+	case v.Kind() == reflect.Int:
+		i, err := strconv.Atoi(strings.TrimSpace(value))
+		if err != nil {
+			l.problemf("%v (%v): %q is not a whole number", f.env, source, value)
+			return
+		}
+		v.SetInt(int64(i))
+	case v.Kind() == reflect.Bool:
+		b, err := strconv.ParseBool(strings.TrimSpace(value))
+		if err != nil {
+			l.problemf("%v (%v): %q is not true or false", f.env, source, value)
+			return
+		}
+		v.SetBool(b)
+	case v.Kind() == reflect.Slice:
+		v.Set(reflect.ValueOf(splitList(value)))
+	}
+}
+
+func (l *loader) validate(f field) {
+	v := f.value
+	if f.tag.Get("required") == "true" && isZero(v) {
+		l.problemf("%v is required", f.env)
+		return
+	}
+	if v.Kind() != reflect.Int || v.Type() == durationType {
+		return
+	}
+	if min, ok := f.tag.Lookup("min"); ok {
+		if bound, err := strconv.Atoi(min); err == nil && int(v.Int()) < bound {
+			l.problemf("%v must be at least %v, got %v", f.env, bound, v.Int())
+		}
+	}
+	if max, ok := f.tag.Lookup("max"); ok {
+		if bound, err := strconv.Atoi(max); err == nil && int(v.Int()) > bound {
+			l.problemf("%v must be at most %v, got %v", f.env, bound, v.Int())
+		}
+	}
+}
+
+func isZero(v reflect.Value) bool {
+	if v.Kind() == reflect.Slice {
+		return v.Len() == 0
+	}
+	return v.IsZero()
+}
+
+// flagName is the name of the command-line flag of the environment variable env, e.g. db-port for DB_PORT.
+func flagName(env string) string {
+	return strings.Replace(strings.ToLower(env), "_", "-", -1)
+}
+
+// splitList splits a comma separated value into its trimmed, non-empty items.
+func splitList(value string) []string {
+	list := make([]string, 0)
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
@@ -0,0 +1,174 @@
+package settings
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testConfig struct {
+	Port    int           `env:"PORT" required:"true" min:"1" max:"65535"`
+	DBPort  int           `env:"DB_PORT" default:"3306"`
+	Secret  string        `env:"SECRET_KEY" required:"true"`
+	Timeout time.Duration `env:"REQUEST_TIMEOUT"`
+	Debug   bool          `env:"DEBUG"`
+	Origins []string      `env:"CORS_ALLOWED_ORIGINS"`
+	Ignored string
+}
+
+func writeFile(t *testing.T, dir string, name string, content string) string {
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "settings")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+// Test if the layers are applied in order: default, file, environment and flag.
+func TestLoadPrecedence(t *testing.T) {
+	os.Clearenv()
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	path := writeFile(t, dir, "config.yml", "port: 4000\nsecret_key: from-file\nrequest_timeout: 5s\ncors_allowed_origins:\n  - http://a\n  - http://b\n")
+	os.Setenv(FileEnv, path)
+	os.Setenv("SECRET_KEY", "from-env")
+
+	cnf := testConfig{}
+	if err := Load(&cnf, []string{"--port", "5000"}); err != nil {
+		t.Fatalf("Expected no error, instead got %v", err.Error())
+	}
+
+	if cnf.DBPort != 3306 {
+		t.Errorf("Expected %v but got %v", 3306, cnf.DBPort)
+	}
+	if cnf.Timeout != 5*time.Second {
+		t.Errorf("Expected %v but got %v", 5*time.Second, cnf.Timeout)
+	}
+	if actual := strings.Join(cnf.Origins, "|"); actual != "http://a|http://b" {
+		t.Errorf("Expected %v but got %v", "http://a|http://b", actual)
+	}
+	if cnf.Secret != "from-env" {
+		t.Errorf("Expected %v but got %v", "from-env", cnf.Secret)
+	}
+	if cnf.Port != 5000 {
+		t.Errorf("Expected %v but got %v", 5000, cnf.Port)
+	}
+	os.Clearenv()
+}
+
+func TestLoadTOML(t *testing.T) {
+	os.Clearenv()
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	path := writeFile(t, dir, "config.toml", "port = 4000\nsecret_key = \"abc\"\ndebug = true\n")
+
+	cnf := testConfig{}
+	if err := Load(&cnf, []string{"--config", path}); err != nil {
+		t.Fatalf("Expected no error, instead got %v", err.Error())
+	}
+	if cnf.Port != 4000 || cnf.Secret != "abc" || !cnf.Debug {
+		t.Errorf("Expected the values of the file but got %+v", cnf)
+	}
+}
+
+// Test if a _FILE variable is read like a Docker secret.
+func TestLoadEnvFile(t *testing.T) {
+	os.Clearenv()
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	os.Setenv("PORT", "4000")
+	os.Setenv("SECRET_KEY_FILE", writeFile(t, dir, "secret", "s3cret\n"))
+
+	cnf := testConfig{}
+	if err := Load(&cnf, nil); err != nil {
+		t.Fatalf("Expected no error, instead got %v", err.Error())
+	}
+	if cnf.Secret != "s3cret" {
+		t.Errorf("Expected %v but got %v", "s3cret", cnf.Secret)
+	}
+	os.Clearenv()
+}
+
+// Test if every problem is reported at once.
+func TestLoadProblems(t *testing.T) {
+	os.Clearenv()
+	os.Setenv("DB_PORT", "abc")
+	os.Setenv("REQUEST_TIMEOUT", "10")
+	os.Setenv("DEBUG", "maybe")
+
+	cnf := testConfig{}
+	err := Load(&cnf, []string{"--unknown"})
+	validationErr, ok := err.(*Error)
+	if !ok {
+		t.Fatalf("Expected an *Error but got %v", err)
+	}
+
+	// --unknown, DB_PORT, REQUEST_TIMEOUT, DEBUG, PORT and SECRET_KEY.
+	expected := 6
+	if actual := len(validationErr.Problems); actual != expected {
+		t.Fatalf("Expected %v but got %v: %v", expected, actual, err)
+	}
+	if cnf.DBPort != 3306 {
+		t.Errorf("Expected the default to be kept but got %v", cnf.DBPort)
+	}
+	os.Clearenv()
+}
+
+func TestLoadRange(t *testing.T) {
+	os.Clearenv()
+	os.Setenv("PORT", "0")
+	os.Setenv("SECRET_KEY", "abc")
+
+	cnf := testConfig{}
+	if err := Load(&cnf, []string{"--port", "70000"}); err == nil {
+		t.Fatal("Expected an error but got nil")
+	}
+	os.Clearenv()
+}
+
+func TestLoadUnknownKey(t *testing.T) {
+	os.Clearenv()
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	path := writeFile(t, dir, "config.yml", "port: 4000\nsecret_key: abc\nsecretkey: typo\n")
+
+	cnf := testConfig{}
+	err := Load(&cnf, []string{"--config", path})
+	if err == nil || !strings.Contains(err.Error(), "secretkey") {
+		t.Fatalf("Expected the unknown key to be reported but got %v", err)
+	}
+}
+
+func TestLoadBothEnvAndFile(t *testing.T) {
+	os.Clearenv()
+	os.Setenv("PORT", "4000")
+	os.Setenv("SECRET_KEY", "abc")
+	os.Setenv("SECRET_KEY_FILE", "/run/secrets/secret_key")
+
+	cnf := testConfig{}
+	if err := Load(&cnf, nil); err == nil {
+		t.Fatal("Expected an error but got nil")
+	}
+	os.Clearenv()
+}
+
+func TestLoadTarget(t *testing.T) {
+	if err := Load(testConfig{}, nil); err == nil {
+		t.Fatal("Expected an error but got nil")
+	}
+}
@@ -0,0 +1,153 @@
+// Package tracing sets up OpenTelemetry for the services. It exports spans for every inbound request (Middleware),
+// every outbound IPC call (see util.Client) and every SQL query (QueryContext and ExecContext). The trace context
+// is propagated between the services with the W3C traceparent header.
+package tracing
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/bstaijen/mariadb-for-microservices/shared/util"
+	"github.com/urfave/negroni"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// instrumentationName is the name of the tracer used by the shared packages.
+const instrumentationName = "github.com/bstaijen/mariadb-for-microservices/shared/tracing"
+
+// Init installs a global tracer provider for service and the W3C trace context propagator. Spans are sent over
+// OTLP/HTTP to endpoint (for example http://collector:4318). When endpoint is empty tracing is off: the default
+// no-op provider stays installed and only the trace context of the callers is passed on. The returned func
+// flushes and stops the exporter.
+func Init(service string, endpoint string) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	if endpoint == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	exporter, err := newExporter(endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(
+		semconv.SchemaURL,
+		semconv.ServiceName(service),
+	))
+	if err != nil {
+		return nil, err
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}
+
+func newExporter(endpoint string) (sdktrace.SpanExporter, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	options := []otlptracehttp.Option{otlptracehttp.WithEndpoint(u.Host)}
+	if u.Scheme == "http" {
+		options = append(options, otlptracehttp.WithInsecure())
+	}
+	if u.Path != "" && u.Path != "/" {
+		options = append(options, otlptracehttp.WithURLPath(u.Path))
+	}
+	return otlptracehttp.New(context.Background(), options...)
+}
+
+// Tracer returns the tracer of the shared packages from the global tracer provider.
+func Tracer() trace.Tracer {
+	return otel.Tracer(instrumentationName)
+}
+
+// Middleware is a negroni middleware which continues the trace of the caller (if any) and wraps the request in a
+// server span. Only the path of the request is recorded, the query may carry a token.
+func Middleware(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	ctx, span := Tracer().Start(ctx, r.Method+" "+r.URL.Path,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			semconv.HTTPMethod(r.Method),
+			semconv.HTTPTarget(r.URL.EscapedPath()),
+		),
+	)
+	defer span.End()
+
+	if id := util.RequestIDFromContext(ctx); id != "" {
+		span.SetAttributes(attribute.String("request_id", id))
+	}
+
+	if next != nil {
+		next(w, r.WithContext(ctx))
+	}
+
+	if res, ok := w.(negroni.ResponseWriter); ok {
+		span.SetAttributes(semconv.HTTPStatusCode(res.Status()))
+		if res.Status() >= 500 {
+			span.SetStatus(codes.Error, http.StatusText(res.Status()))
+		}
+	}
+}
+
+// QueryContext executes query on db inside a span.
+func QueryContext(ctx context.Context, db *sql.DB, query string, args ...interface{}) (*sql.Rows, error) {
+	ctx, span := startQuery(ctx, query)
+	defer span.End()
+
+	rows, err := db.QueryContext(ctx, query, args...)
+	recordError(span, err)
+	return rows, err
+}
+
+// ExecContext executes query on db inside a span.
+func ExecContext(ctx context.Context, db *sql.DB, query string, args ...interface{}) (sql.Result, error) {
+	ctx, span := startQuery(ctx, query)
+	defer span.End()
+
+	res, err := db.ExecContext(ctx, query, args...)
+	recordError(span, err)
+	return res, err
+}
+
+func startQuery(ctx context.Context, query string) (context.Context, trace.Span) {
+	return Tracer().Start(ctx, "SQL "+operation(query),
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			semconv.DBSystemMySQL,
+			semconv.DBStatement(query),
+		),
+	)
+}
+
+// operation returns the first keyword of query, e.g. SELECT.
+func operation(query string) string {
+	fields := strings.Fields(strings.TrimLeft(query, "( "))
+	if len(fields) == 0 {
+		return ""
+	}
+	return strings.ToUpper(fields[0])
+}
+
+func recordError(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+}
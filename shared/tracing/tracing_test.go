@@ -0,0 +1,198 @@
+package tracing
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/bstaijen/mariadb-for-microservices/shared/util"
+	"github.com/urfave/negroni"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace/noop"
+	sqlmock "gopkg.in/DATA-DOG/go-sqlmock.v1"
+)
+
+func installRecorder() *tracetest.SpanRecorder {
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	return recorder
+}
+
+func byName(spans []sdktrace.ReadOnlySpan) map[string]sdktrace.ReadOnlySpan {
+	m := make(map[string]sdktrace.ReadOnlySpan)
+	for _, span := range spans {
+		m[span.Name()] = span
+	}
+	return m
+}
+
+// Test if a request which calls another service, which in turn queries the database, ends up in a single trace:
+// server span -> IPC client span -> downstream server span -> SQL span.
+func TestSpanTree(t *testing.T) {
+	recorder := installRecorder()
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	mock.ExpectQuery("SELECT (.+) FROM votes").WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+
+	downstream := negroni.New(negroni.HandlerFunc(Middleware))
+	downstream.UseHandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rows, err := QueryContext(r.Context(), db, "SELECT COUNT(*) FROM votes")
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		rows.Close()
+	})
+	ts := httptest.NewServer(downstream)
+	defer ts.Close()
+
+	upstream := negroni.New(negroni.HandlerFunc(Middleware))
+	upstream.UseHandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := util.DefaultClient.Do(r.Context(), http.MethodGet, ts.URL+"/ipc/count", nil, func(*http.Response) {}); err != nil {
+			t.Error(err)
+		}
+	})
+	req, err := http.NewRequest(http.MethodGet, "http://localhost/image/toprated", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstream.ServeHTTP(httptest.NewRecorder(), req)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	spans := byName(recorder.Ended())
+	root, ok := spans["GET /image/toprated"]
+	if !ok {
+		t.Fatalf("Expected a server span but got %v", spans)
+	}
+	client := spans["GET "+strings.TrimPrefix(ts.URL, "http://")]
+	server := spans["GET /ipc/count"]
+	query := spans["SQL SELECT"]
+
+	if client == nil || server == nil || query == nil {
+		t.Fatalf("Expected 4 spans but got %v", spans)
+	}
+	if root.Parent().IsValid() {
+		t.Errorf("Expected the server span to be a root span but got parent %v", root.Parent().SpanID())
+	}
+	if client.Parent().SpanID() != root.SpanContext().SpanID() {
+		t.Errorf("Expected %v but got %v", root.SpanContext().SpanID(), client.Parent().SpanID())
+	}
+	if server.Parent().SpanID() != client.SpanContext().SpanID() {
+		t.Errorf("Expected %v but got %v", client.SpanContext().SpanID(), server.Parent().SpanID())
+	}
+	if query.Parent().SpanID() != server.SpanContext().SpanID() {
+		t.Errorf("Expected %v but got %v", server.SpanContext().SpanID(), query.Parent().SpanID())
+	}
+	for name, span := range spans {
+		if span.SpanContext().TraceID() != root.SpanContext().TraceID() {
+			t.Errorf("Expected span %v to be part of trace %v but got %v", name, root.SpanContext().TraceID(), span.SpanContext().TraceID())
+		}
+	}
+}
+
+// Test if Middleware marks a server error on the span.
+func TestMiddlewareServerError(t *testing.T) {
+	recorder := installRecorder()
+
+	n := negroni.New(negroni.HandlerFunc(Middleware))
+	n.UseHandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+	req, err := http.NewRequest(http.MethodGet, "http://localhost/test", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.ServeHTTP(httptest.NewRecorder(), req.WithContext(util.WithRequestID(context.Background(), "abc")))
+
+	spans := recorder.Ended()
+	if len(spans) != 1 {
+		t.Fatalf("Expected 1 span but got %v", len(spans))
+	}
+	if code := spans[0].Status().Code.String(); code != "Error" {
+		t.Errorf("Expected Error but got %v", code)
+	}
+	found := false
+	for _, attr := range spans[0].Attributes() {
+		if attr.Key == "request_id" && attr.Value.AsString() == "abc" {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("Expected the span to carry the request ID but got %v", spans[0].Attributes())
+	}
+}
+
+// Test if Middleware leaves the query of the request, which may carry a token, out of the span.
+func TestMiddlewareTarget(t *testing.T) {
+	recorder := installRecorder()
+
+	n := negroni.New(negroni.HandlerFunc(Middleware))
+	n.UseHandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	req, err := http.NewRequest(http.MethodGet, "http://localhost/image/1?token=secret", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.ServeHTTP(httptest.NewRecorder(), req)
+
+	spans := recorder.Ended()
+	if len(spans) != 1 {
+		t.Fatalf("Expected 1 span but got %v", len(spans))
+	}
+	for _, attr := range spans[0].Attributes() {
+		if strings.Contains(attr.Value.Emit(), "secret") {
+			t.Errorf("Expected the token to be left out but got %v=%v", attr.Key, attr.Value.Emit())
+		}
+		if attr.Key == "http.target" && attr.Value.AsString() != "/image/1" {
+			t.Errorf("Expected %v but got %v", "/image/1", attr.Value.AsString())
+		}
+	}
+}
+
+// Test if Init keeps tracing off when no endpoint is configured.
+func TestInitWithoutEndpoint(t *testing.T) {
+	recorder := installRecorder()
+	otel.SetTracerProvider(noop.NewTracerProvider())
+
+	shutdown, err := Init("test-service", "")
+	if err != nil {
+		t.Fatalf("Expected no error, instead got %v", err.Error())
+	}
+	defer shutdown(context.Background())
+
+	_, span := Tracer().Start(context.Background(), "test")
+	span.End()
+	if span.SpanContext().IsValid() || span.IsRecording() {
+		t.Errorf("Expected a no-op span but got %v", span.SpanContext())
+	}
+	if len(recorder.Ended()) != 0 {
+		t.Errorf("Expected 0 spans but got %v", len(recorder.Ended()))
+	}
+}
+
+// Test if operation returns the SQL keyword of a query.
+func TestOperation(t *testing.T) {
+	tests := map[string]string{
+		"SELECT id FROM photos":          "SELECT",
+		"  insert INTO votes VALUES (?)": "INSERT",
+		"(SELECT 1) UNION (SELECT 2)":    "SELECT",
+		"":                               "",
+	}
+	for query, expected := range tests {
+		if actual := operation(query); actual != expected {
+			t.Errorf("Expected %v but got %v", expected, actual)
+		}
+	}
+}
@@ -0,0 +1,349 @@
+package util
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/bstaijen/mariadb-for-microservices/shared/apierror"
+	"github.com/bstaijen/mariadb-for-microservices/shared/metrics"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracerName is the name of the tracer which creates the spans of the outgoing requests.
+const tracerName = "github.com/bstaijen/mariadb-for-microservices/shared/util"
+
+// ErrCircuitOpen is returned when a destination failed too often and the client refuses to call it until the
+// cooldown has passed.
+var ErrCircuitOpen = apierror.New(apierror.Unavailable, "circuit breaker is open")
+
+// ClientOptions configures a Client.
+type ClientOptions struct {
+	// Timeout is the maximum duration of a single attempt, including reading the response in the callback.
+	Timeout time.Duration
+
+	// Retries is the number of extra attempts for idempotent requests which failed with a network error or a
+	// 502, 503 or 504.
+	Retries int
+
+	// Backoff is the base delay between attempts. It doubles every attempt up to MaxBackoff, the actual delay
+	// is a random duration between 0 and that value.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+
+	// BreakerThreshold is the number of consecutive failures after which the breaker of a destination opens.
+	// BreakerCooldown is how long it stays open before a single trial request is let through.
+	BreakerThreshold int
+	BreakerCooldown  time.Duration
+}
+
+// DefaultClientOptions are the options of DefaultClient.
+var DefaultClientOptions = ClientOptions{
+	Timeout:          5 * time.Second,
+	Retries:          2,
+	Backoff:          50 * time.Millisecond,
+	MaxBackoff:       time.Second,
+	BreakerThreshold: 5,
+	BreakerCooldown:  10 * time.Second,
+}
+
+// DefaultClient is the client used by Request and RequestWithContext.
+var DefaultClient = NewClient(DefaultClientOptions)
+
+// Client executes requests over a shared connection pool. Every destination (host:port) has its own circuit
+// breaker. A Client is safe for concurrent use.
+type Client struct {
+	options    ClientOptions
+	httpClient *http.Client
+
+	mu       sync.Mutex
+	breakers map[string]*breaker
+}
+
+// NewClient returns a Client configured with options.
+func NewClient(options ClientOptions) *Client {
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   options.Timeout,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		MaxIdleConns:        100,
+		MaxIdleConnsPerHost: 10,
+		IdleConnTimeout:     90 * time.Second,
+	}
+	return &Client{
+		options:    options,
+		httpClient: &http.Client{Transport: transport},
+		breakers:   make(map[string]*breaker),
+	}
+}
+
+// Do executes the request and calls cb with the response. Idempotent requests are retried with a jittered
+// backoff. The response body is closed after cb returns.
+func (c *Client) Do(ctx context.Context, method, rawurl string, body []byte, cb func(*http.Response)) error {
+	return c.DoWithHeader(ctx, method, rawurl, nil, body, cb)
+}
+
+// DoWithHeader works like Do and sends header with every attempt.
+func (c *Client) DoWithHeader(ctx context.Context, method, rawurl string, header http.Header, body []byte, cb func(*http.Response)) error {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		Log(ctx).Errorf("Error creating request: %v", err)
+		return err
+	}
+	b := c.breaker(u.Host)
+
+	attempts := 1
+	if isIdempotent(method) {
+		attempts += c.options.Retries
+	}
+
+	for attempt := 0; ; attempt++ {
+		if !b.allow(time.Now()) {
+			Log(ctx).Warnf("%v %v: %v", method, rawurl, ErrCircuitOpen)
+			return ErrCircuitOpen
+		}
+
+		retry, err := c.attempt(ctx, method, rawurl, header, body, attempt == attempts-1, b, cb)
+		if !retry {
+			return err
+		}
+
+		if err := sleep(ctx, c.backoff(attempt)); err != nil {
+			return err
+		}
+	}
+}
+
+// attempt executes the request once. It returns whether the request should be tried again. Retryable responses
+// of the last attempt are passed to cb like any other response.
+func (c *Client) attempt(ctx context.Context, method, rawurl string, header http.Header, body []byte, last bool, b *breaker, cb func(*http.Response)) (bool, error) {
+	if c.options.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.options.Timeout)
+		defer cancel()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, rawurl, bytes.NewBuffer(body))
+	if err != nil {
+		Log(ctx).Errorf("Error creating request: %v", err)
+		b.release()
+		return false, err
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	if id := RequestIDFromContext(ctx); id != "" {
+		req.Header.Set(RequestIDHeader, id)
+	}
+
+	// Every attempt gets its own client span, the trace context is passed on in the traceparent header.
+	ctx, span := otel.Tracer(tracerName).Start(ctx, method+" "+req.URL.Host,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			semconv.HTTPMethod(method),
+			semconv.HTTPURL(rawurl),
+		),
+	)
+	defer span.End()
+	req = req.WithContext(ctx)
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+
+	start := time.Now()
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		metrics.ObserveIPC(req.URL.Host, method, 0, time.Since(start))
+		Log(ctx).Errorf("Error executing request: %v", err)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+
+		// Don't retry when the caller gave up, which says nothing about the destination.
+		if ctx.Err() == context.Canceled {
+			b.release()
+			return false, err
+		}
+		b.failure(time.Now(), c.options.BreakerThreshold, c.options.BreakerCooldown)
+		if ctx.Err() != nil && ctx.Err() != context.DeadlineExceeded {
+			return false, err
+		}
+		return !last, err
+	}
+	defer resp.Body.Close()
+
+	metrics.ObserveIPC(req.URL.Host, method, resp.StatusCode, time.Since(start))
+	Log(ctx).Infof("%v %v %v", method, rawurl, resp.StatusCode)
+	span.SetAttributes(semconv.HTTPStatusCode(resp.StatusCode))
+	if resp.StatusCode >= 500 {
+		span.SetStatus(codes.Error, resp.Status)
+		b.failure(time.Now(), c.options.BreakerThreshold, c.options.BreakerCooldown)
+	} else {
+		b.success()
+	}
+
+	if isRetryableStatus(resp.StatusCode) && !last {
+		return true, nil
+	}
+
+	cb(resp)
+	return false, nil
+}
+
+func (c *Client) backoff(attempt int) time.Duration {
+	max := c.options.Backoff << uint(attempt)
+	if max <= 0 || (c.options.MaxBackoff > 0 && max > c.options.MaxBackoff) {
+		max = c.options.MaxBackoff
+	}
+	if max <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(max)))
+}
+
+func (c *Client) breaker(host string) *breaker {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	b, ok := c.breakers[host]
+	if !ok {
+		b = &breaker{}
+		c.breakers[host] = b
+	}
+	return b
+}
+
+// BreakerState describes the circuit breaker of a single destination.
+type BreakerState struct {
+	Host                string    `json:"host"`
+	State               string    `json:"state"`
+	ConsecutiveFailures int       `json:"consecutive_failures"`
+	OpenUntil           time.Time `json:"open_until,omitempty"`
+}
+
+// Breakers returns the state of the circuit breakers of all destinations the client has called, ordered by host.
+func (c *Client) Breakers() []*BreakerState {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	states := make([]*BreakerState, 0, len(c.breakers))
+	for host, b := range c.breakers {
+		states = append(states, b.state(host, now))
+	}
+	sort.Sort(byHost(states))
+	return states
+}
+
+type byHost []*BreakerState
+
+func (s byHost) Len() int           { return len(s) }
+func (s byHost) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byHost) Less(i, j int) bool { return s[i].Host < s[j].Host }
+
+// BreakersHandler sends the breaker states of DefaultClient to the client.
+func BreakersHandler(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	SendOK(w, DefaultClient.Breakers())
+}
+
+// breaker is a consecutive-failures circuit breaker. When it is open no requests are let through until the
+// cooldown has passed. After that a single trial request decides whether it closes again.
+type breaker struct {
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+	trial     bool
+}
+
+func (b *breaker) allow(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.openUntil.IsZero() {
+		return true
+	}
+	if now.Before(b.openUntil) || b.trial {
+		return false
+	}
+	b.trial = true
+	return true
+}
+
+func (b *breaker) success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures = 0
+	b.openUntil = time.Time{}
+	b.trial = false
+}
+
+// release ends a trial request which didn't reach the destination, so the next request can try again.
+func (b *breaker) release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.trial = false
+}
+
+func (b *breaker) failure(now time.Time, threshold int, cooldown time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures++
+	if threshold > 0 && (b.trial || b.failures >= threshold) {
+		b.openUntil = now.Add(cooldown)
+	}
+	b.trial = false
+}
+
+func (b *breaker) state(host string, now time.Time) *BreakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	s := &BreakerState{Host: host, State: "closed", ConsecutiveFailures: b.failures}
+	if !b.openUntil.IsZero() {
+		s.OpenUntil = b.openUntil
+		s.State = "open"
+		if !now.Before(b.openUntil) {
+			s.State = "half-open"
+		}
+	}
+	return s
+}
+
+func isIdempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+func isRetryableStatus(code int) bool {
+	return code == http.StatusBadGateway || code == http.StatusServiceUnavailable || code == http.StatusGatewayTimeout
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return fmt.Errorf("giving up retrying: %v", ctx.Err())
+	case <-t.C:
+		return nil
+	}
+}
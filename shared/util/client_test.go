@@ -0,0 +1,282 @@
+package util
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// testClientOptions keeps the delays short so the tests run fast.
+var testClientOptions = ClientOptions{
+	Timeout:          100 * time.Millisecond,
+	Retries:          2,
+	Backoff:          time.Millisecond,
+	MaxBackoff:       5 * time.Millisecond,
+	BreakerThreshold: 3,
+	BreakerCooldown:  50 * time.Millisecond,
+}
+
+func TestClientRetriesUnavailable(t *testing.T) {
+	var calls int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Fail the first two attempts.
+		if atomic.AddInt32(&calls, 1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+
+	statusCode := 0
+	err := NewClient(testClientOptions).Do(context.Background(), "GET", ts.URL, nil, func(res *http.Response) {
+		statusCode = res.StatusCode
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, instead got %v", err.Error())
+	}
+
+	if statusCode != http.StatusOK {
+		t.Errorf("Expected %v but got %v", http.StatusOK, statusCode)
+	}
+	if calls != 3 {
+		t.Errorf("Expected %v but got %v", 3, calls)
+	}
+}
+
+func TestClientPassesLastFailedResponse(t *testing.T) {
+	var calls int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer ts.Close()
+
+	statusCode := 0
+	err := NewClient(testClientOptions).Do(context.Background(), "GET", ts.URL, nil, func(res *http.Response) {
+		statusCode = res.StatusCode
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, instead got %v", err.Error())
+	}
+
+	if statusCode != http.StatusBadGateway {
+		t.Errorf("Expected %v but got %v", http.StatusBadGateway, statusCode)
+	}
+	if calls != 3 {
+		t.Errorf("Expected %v but got %v", 3, calls)
+	}
+}
+
+func TestClientDoesNotRetryPOST(t *testing.T) {
+	var calls int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer ts.Close()
+
+	NewClient(testClientOptions).Do(context.Background(), "POST", ts.URL, []byte("{}"), func(res *http.Response) {})
+
+	if calls != 1 {
+		t.Errorf("Expected %v but got %v", 1, calls)
+	}
+}
+
+func TestClientTimeout(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(time.Second):
+		}
+	}))
+	defer ts.Close()
+
+	options := testClientOptions
+	options.Retries = 0
+
+	start := time.Now()
+	isCallbackCalled := false
+	err := NewClient(options).Do(context.Background(), "GET", ts.URL, nil, func(res *http.Response) {
+		isCallbackCalled = true
+	})
+
+	if err == nil {
+		t.Error("Expected a timeout error, instead got nothing")
+	}
+	if isCallbackCalled {
+		t.Error("Expected the callback not to be called")
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("Expected the request to be aborted after %v, instead it took %v", options.Timeout, elapsed)
+	}
+}
+
+func TestClientBreaker(t *testing.T) {
+	var calls int32
+	healthy := int32(0)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		if atomic.LoadInt32(&healthy) == 1 {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer ts.Close()
+
+	options := testClientOptions
+	options.Retries = 0
+	client := NewClient(options)
+	noop := func(res *http.Response) {}
+
+	// Three failures open the breaker.
+	for i := 0; i < 3; i++ {
+		if err := client.Do(context.Background(), "GET", ts.URL, nil, noop); err != nil {
+			t.Fatalf("Expected no error, instead got %v", err.Error())
+		}
+	}
+
+	err := client.Do(context.Background(), "GET", ts.URL, nil, noop)
+	if err != ErrCircuitOpen {
+		t.Errorf("Expected %v but got %v", ErrCircuitOpen, err)
+	}
+	if calls != 3 {
+		t.Errorf("Expected the open breaker to stop the call, but the server was called %v times", calls)
+	}
+
+	host := mustHost(t, ts.URL)
+	states := client.Breakers()
+	if len(states) != 1 || states[0].Host != host || states[0].State != "open" {
+		t.Errorf("Expected an open breaker for %v but got %+v", host, states[0])
+	}
+
+	// After the cooldown a trial request is let through and closes the breaker again.
+	atomic.StoreInt32(&healthy, 1)
+	time.Sleep(options.BreakerCooldown)
+
+	if err := client.Do(context.Background(), "GET", ts.URL, nil, noop); err != nil {
+		t.Fatalf("Expected no error, instead got %v", err.Error())
+	}
+
+	states = client.Breakers()
+	if states[0].State != "closed" || states[0].ConsecutiveFailures != 0 {
+		t.Errorf("Expected a closed breaker but got %+v", states[0])
+	}
+}
+
+func TestClientBreakerIgnoresCanceled(t *testing.T) {
+	block := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-block
+	}))
+	defer ts.Close()
+	defer close(block)
+
+	options := testClientOptions
+	options.Retries = 0
+	options.Timeout = time.Second
+	client := NewClient(options)
+	noop := func(res *http.Response) {}
+
+	// Requests the caller gives up on say nothing about the destination.
+	for i := 0; i < 4; i++ {
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(5*time.Millisecond, cancel)
+		if err := client.Do(ctx, "GET", ts.URL, nil, noop); err == nil || err == ErrCircuitOpen {
+			t.Fatalf("Expected the cancelled request to fail, instead got %v", err)
+		}
+	}
+
+	states := client.Breakers()
+	if len(states) != 1 || states[0].State != "closed" || states[0].ConsecutiveFailures != 0 {
+		t.Errorf("Expected a closed breaker but got %+v", states)
+	}
+}
+
+func TestClientBreakerReleasesTrial(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+
+	options := testClientOptions
+	options.Retries = 0
+	client := NewClient(options)
+	noop := func(res *http.Response) {}
+
+	b := client.breaker(mustHost(t, ts.URL))
+	for i := 0; i < options.BreakerThreshold; i++ {
+		b.failure(time.Now(), options.BreakerThreshold, options.BreakerCooldown)
+	}
+	time.Sleep(options.BreakerCooldown)
+
+	// The trial request can't be created, which must not keep the breaker open.
+	if err := client.Do(context.Background(), "BAD METHOD", ts.URL, nil, noop); err == nil || err == ErrCircuitOpen {
+		t.Fatalf("Expected an invalid request, instead got %v", err)
+	}
+	if err := client.Do(context.Background(), "GET", ts.URL, nil, noop); err != nil {
+		t.Errorf("Expected no error, instead got %v", err)
+	}
+}
+
+func TestClientBreakerPerDestination(t *testing.T) {
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer healthy.Close()
+
+	options := testClientOptions
+	options.Retries = 0
+	client := NewClient(options)
+	noop := func(res *http.Response) {}
+
+	for i := 0; i < 4; i++ {
+		client.Do(context.Background(), "GET", failing.URL, nil, noop)
+	}
+
+	if err := client.Do(context.Background(), "GET", healthy.URL, nil, noop); err != nil {
+		t.Errorf("Expected no error, instead got %v", err.Error())
+	}
+}
+
+func mustHost(t *testing.T, rawurl string) string {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u.Host
+}
+
+// Test if the log lines of a request carry its request ID.
+func TestClientLogsRequestID(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer ts.Close()
+
+	var out bytes.Buffer
+	logrus.SetOutput(&out)
+	defer logrus.SetOutput(os.Stderr)
+
+	client := NewClient(testClientOptions)
+	ctx := WithRequestID(context.Background(), "abc")
+	if err := client.Do(ctx, http.MethodGet, ts.URL, nil, func(*http.Response) {}); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "request_id=abc") {
+		t.Errorf("Expected the request ID in %q", out.String())
+	}
+}
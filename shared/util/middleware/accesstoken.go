@@ -0,0 +1,150 @@
+package middleware
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bstaijen/mariadb-for-microservices/shared/apierror"
+)
+
+// AccessTokenPrefix starts every personal access token, which tells them apart from the access tokens of a login.
+const AccessTokenPrefix = "mfm_pat_"
+
+// The scopes of the personal access tokens. A route which accepts personal access tokens names the scope a token
+// needs for it.
+const (
+	ScopePhotosRead    = "photos:read"
+	ScopePhotosWrite   = "photos:write"
+	ScopeVotesRead     = "votes:read"
+	ScopeVotesWrite    = "votes:write"
+	ScopeCommentsRead  = "comments:read"
+	ScopeCommentsWrite = "comments:write"
+)
+
+// Scopes are all scopes a personal access token can have.
+var Scopes = []string{ScopePhotosRead, ScopePhotosWrite, ScopeVotesRead, ScopeVotesWrite, ScopeCommentsRead, ScopeCommentsWrite}
+
+// ErrInsufficientScope is sent when a personal access token is used on a route it has no scope for.
+var ErrInsufficientScope = apierror.New(apierror.PermissionDenied, "Token does not have the scope for this request")
+
+// NewAccessToken returns a new personal access token: AccessTokenPrefix followed by 32 random bytes.
+func NewAccessToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return AccessTokenPrefix + base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// IsAccessToken reports whether token is a personal access token.
+func IsAccessToken(token string) bool {
+	return strings.HasPrefix(token, AccessTokenPrefix)
+}
+
+// HashAccessToken returns the hex encoded SHA-256 hash of token. The personal access tokens are stored and looked up
+// by their hash, so the tokens themselves never leave the client and the authentication service.
+func HashAccessToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// HasScope reports whether principal may make a request which needs scope. The access tokens of a login have every
+// scope, a personal access token only the scopes it was created with.
+func (principal *Principal) HasScope(scope string) bool {
+	if principal.Scopes == nil {
+		return true
+	}
+	for _, s := range principal.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// AccessTokens looks up personal access tokens.
+type AccessTokens interface {
+	// AccessToken returns the user of the personal access token with tokenHash, or nil when the token doesn't exist
+	// or was revoked.
+	AccessToken(ctx context.Context, tokenHash string) (*Principal, error)
+}
+
+// AccessTokenLookup returns the user of the personal access token with tokenHash, or nil when there is none.
+type AccessTokenLookup func(ctx context.Context, tokenHash string) (*Principal, error)
+
+// AccessToken does the lookup for every token, without a cache.
+func (lookup AccessTokenLookup) AccessToken(ctx context.Context, tokenHash string) (*Principal, error) {
+	return lookup(ctx, tokenHash)
+}
+
+// AccessTokenCache is AccessTokens on top of a lookup, which is done at most once per token per TTL. Unknown tokens
+// are cached as well, so guessing doesn't reach the authentication service more often than real tokens.
+type AccessTokenCache struct {
+	lookup AccessTokenLookup
+	ttl    time.Duration
+	now    func() time.Time
+
+	mu        sync.Mutex
+	entries   map[string]accessTokenEntry
+	lastSweep time.Time
+}
+
+type accessTokenEntry struct {
+	principal *Principal
+	expires   time.Time
+}
+
+// NewAccessTokenCache returns an AccessTokenCache which caches the answers of lookup for ttl. A ttl of zero means
+// DefaultRevocationTTL, so a revoked personal access token stops working as fast as a logged out access token.
+func NewAccessTokenCache(lookup AccessTokenLookup, ttl time.Duration) *AccessTokenCache {
+	if ttl <= 0 {
+		ttl = DefaultRevocationTTL
+	}
+	return &AccessTokenCache{lookup: lookup, ttl: ttl, now: time.Now, entries: make(map[string]accessTokenEntry)}
+}
+
+// AccessToken returns a copy of the user of the personal access token with tokenHash, or nil when there is none.
+func (c *AccessTokenCache) AccessToken(ctx context.Context, tokenHash string) (*Principal, error) {
+	now := c.now()
+
+	c.mu.Lock()
+	entry, ok := c.entries[tokenHash]
+	c.mu.Unlock()
+
+	if !ok || now.After(entry.expires) {
+		principal, err := c.lookup(ctx, tokenHash)
+		if err != nil {
+			return nil, err
+		}
+		entry = accessTokenEntry{principal: principal, expires: now.Add(c.ttl)}
+
+		c.mu.Lock()
+		c.sweep(now)
+		c.entries[tokenHash] = entry
+		c.mu.Unlock()
+	}
+	if entry.principal == nil {
+		return nil, nil
+	}
+	principal := *entry.principal
+	return &principal, nil
+}
+
+// sweep removes the expired entries, at most once per TTL. The caller holds mu.
+func (c *AccessTokenCache) sweep(now time.Time) {
+	if now.Sub(c.lastSweep) < c.ttl {
+		return
+	}
+	c.lastSweep = now
+	for hash, entry := range c.entries {
+		if now.After(entry.expires) {
+			delete(c.entries, hash)
+		}
+	}
+}
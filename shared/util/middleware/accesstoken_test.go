@@ -0,0 +1,87 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// Test if the lookup is cached, unknown tokens included, and if the cache hands out copies.
+func TestAccessTokenCache(t *testing.T) {
+	lookups := 0
+	cache := NewAccessTokenCache(func(ctx context.Context, tokenHash string) (*Principal, error) {
+		lookups++
+		if tokenHash != HashAccessToken("known") {
+			return nil, nil
+		}
+		return &Principal{ID: 1, Scopes: []string{ScopeVotesRead}}, nil
+	}, time.Minute)
+
+	for _, token := range []string{"known", "known", "unknown", "unknown"} {
+		if _, err := cache.AccessToken(context.Background(), HashAccessToken(token)); err != nil {
+			t.Fatalf("Expected no error, instead got %v", err.Error())
+		}
+	}
+	expected := 2
+	if lookups != expected {
+		t.Errorf("Expected %v but got %v", expected, lookups)
+	}
+
+	principal, _ := cache.AccessToken(context.Background(), HashAccessToken("known"))
+	principal.ID = 2
+	if principal, _ := cache.AccessToken(context.Background(), HashAccessToken("known")); principal.ID != 1 {
+		t.Errorf("Expected %v but got %v", 1, principal.ID)
+	}
+}
+
+// Test if a personal access token is only accepted on the routes of its scopes.
+func TestRequireScopedToken(t *testing.T) {
+	token := AccessTokenPrefix + "abc"
+	accessTokens := AccessTokenLookup(func(ctx context.Context, tokenHash string) (*Principal, error) {
+		if tokenHash != HashAccessToken(token) {
+			return nil, nil
+		}
+		return &Principal{ID: 7, Scopes: []string{ScopeVotesRead}}, nil
+	})
+
+	cases := []struct {
+		handler  func(http.ResponseWriter, *http.Request, http.HandlerFunc)
+		token    string
+		expected int
+	}{
+		{RequireScopedTokenAuthenticationHandler(testKeys, nil, accessTokens, ScopeVotesRead), token, http.StatusOK},
+		{RequireScopedTokenAuthenticationHandler(testKeys, nil, accessTokens, ScopeVotesWrite), token, http.StatusForbidden},
+		{RequireScopedTokenAuthenticationHandler(testKeys, nil, accessTokens, ScopeVotesRead), AccessTokenPrefix + "unknown", http.StatusUnauthorized},
+		{RequireTokenAuthenticationHandler(testKeys, nil), token, http.StatusUnauthorized},
+	}
+	for _, c := range cases {
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.Header.Set("token", c.token)
+		res := httptest.NewRecorder()
+		c.handler(res, req, func(w http.ResponseWriter, r *http.Request) {
+			user, _ := UserFromContext(r.Context())
+			if user.ID != 7 {
+				t.Errorf("Expected %v but got %v", 7, user.ID)
+			}
+		})
+
+		if res.Code != c.expected {
+			t.Errorf("Expected %v but got %v", c.expected, res.Code)
+		}
+	}
+
+	// The access tokens of a login have every scope
+	tokenString, _, err := NewToken(testKey, 1, 0, false, time.Minute)
+	if err != nil {
+		t.Fatalf("Expected no error, instead got %v", err.Error())
+	}
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.Header.Set("token", tokenString)
+	res := httptest.NewRecorder()
+	RequireScopedTokenAuthenticationHandler(testKeys, nil, accessTokens, ScopeVotesWrite)(res, req, nil)
+	if res.Code != http.StatusOK {
+		t.Errorf("Expected %v but got %v", http.StatusOK, res.Code)
+	}
+}
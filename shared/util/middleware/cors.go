@@ -0,0 +1,116 @@
+package middleware
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bstaijen/mariadb-for-microservices/shared/util"
+	"github.com/urfave/negroni"
+)
+
+// CORSOptions configures the CORS middleware. Empty fields fall back to DefaultCORSOptions.
+type CORSOptions struct {
+	// AllowedOrigins are the origins which may call the service. "*" allows every origin.
+	AllowedOrigins []string
+
+	// AllowedMethods and AllowedHeaders are sent in the answer to a preflight request.
+	AllowedMethods []string
+	AllowedHeaders []string
+
+	// AllowCredentials allows browsers to send cookies and authorization headers from the origins which are listed
+	// by name. The origin of the request is then echoed instead of "*". Origins which are only allowed by "*"
+	// never get credentials, otherwise every site could make authenticated calls.
+	AllowCredentials bool
+
+	// MaxAge is how long a browser may cache the answer to a preflight request.
+	MaxAge time.Duration
+}
+
+// DefaultCORSOptions allow every origin to call the REST API with the methods and headers the services use.
+var DefaultCORSOptions = CORSOptions{
+	AllowedOrigins: []string{"*"},
+	AllowedMethods: []string{http.MethodGet, http.MethodPost, http.MethodPut, http.MethodDelete},
+	AllowedHeaders: []string{"Content-Type", "token", util.RequestIDHeader},
+	MaxAge:         10 * time.Minute,
+}
+
+// CORS is a middleware handler which implements the CORS policy in options. Preflight requests are answered by the
+// middleware itself and never reach the router, other requests of an allowed origin get the
+// Access-Control-Allow-Origin header. Requests of other origins are passed on without CORS headers, so the browser
+// blocks them.
+func CORS(options CORSOptions) negroni.HandlerFunc {
+	if len(options.AllowedOrigins) == 0 {
+		options.AllowedOrigins = DefaultCORSOptions.AllowedOrigins
+	}
+	if len(options.AllowedMethods) == 0 {
+		options.AllowedMethods = DefaultCORSOptions.AllowedMethods
+	}
+	if len(options.AllowedHeaders) == 0 {
+		options.AllowedHeaders = DefaultCORSOptions.AllowedHeaders
+	}
+	if options.MaxAge == 0 {
+		options.MaxAge = DefaultCORSOptions.MaxAge
+	}
+	methods := strings.Join(options.AllowedMethods, ", ")
+	headers := strings.Join(options.AllowedHeaders, ", ")
+	maxAge := strconv.Itoa(int(options.MaxAge.Seconds()))
+
+	return negroni.HandlerFunc(func(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+		origin := r.Header.Get("Origin")
+		preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+		w.Header().Add("Vary", "Origin")
+
+		if origin != "" && options.allowsOrigin(origin) {
+			credentials := options.AllowCredentials && options.listsOrigin(origin)
+			if credentials || !options.allowsAnyOrigin() {
+				w.Header().Set("Access-Control-Allow-Origin", origin)
+			} else {
+				w.Header().Set("Access-Control-Allow-Origin", "*")
+			}
+			if credentials {
+				w.Header().Set("Access-Control-Allow-Credentials", "true")
+			}
+
+			if preflight {
+				w.Header().Set("Access-Control-Allow-Methods", methods)
+				w.Header().Set("Access-Control-Allow-Headers", headers)
+				w.Header().Set("Access-Control-Max-Age", maxAge)
+			} else {
+				w.Header().Set("Access-Control-Expose-Headers", util.RequestIDHeader)
+			}
+		}
+
+		if preflight {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		if next != nil {
+			next(w, r)
+		}
+	})
+}
+
+func (o CORSOptions) allowsAnyOrigin() bool {
+	for _, allowed := range o.AllowedOrigins {
+		if allowed == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+func (o CORSOptions) allowsOrigin(origin string) bool {
+	return o.allowsAnyOrigin() || o.listsOrigin(origin)
+}
+
+// listsOrigin reports whether origin is allowed by name rather than by "*".
+func (o CORSOptions) listsOrigin(origin string) bool {
+	for _, allowed := range o.AllowedOrigins {
+		if strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,119 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func corsRequest(t *testing.T, options CORSOptions, method string, origin string, requestMethod string) (*httptest.ResponseRecorder, bool) {
+	req, err := http.NewRequest(method, "http://localhost/test", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if origin != "" {
+		req.Header.Set("Origin", origin)
+	}
+	if requestMethod != "" {
+		req.Header.Set("Access-Control-Request-Method", requestMethod)
+	}
+	res := httptest.NewRecorder()
+
+	called := false
+	CORS(options)(res, req, func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	})
+	return res, called
+}
+
+// Test if a preflight request is answered with the configured methods, headers and max age.
+func TestCORSPreflight(t *testing.T) {
+	res, called := corsRequest(t, CORSOptions{}, http.MethodOptions, "http://localhost:4000", http.MethodDelete)
+
+	if called {
+		t.Error("Expected the preflight request not to reach the next handler")
+	}
+	if res.Result().StatusCode != http.StatusNoContent {
+		t.Errorf("Expected %v but got %v", http.StatusNoContent, res.Result().StatusCode)
+	}
+
+	expected := map[string]string{
+		"Access-Control-Allow-Origin":  "*",
+		"Access-Control-Allow-Methods": "GET, POST, PUT, DELETE",
+		"Access-Control-Allow-Headers": "Content-Type, token, X-Request-ID",
+		"Access-Control-Max-Age":       "600",
+	}
+	for header, value := range expected {
+		if actual := res.Header().Get(header); actual != value {
+			t.Errorf("Expected %v to be %v but got %v", header, value, actual)
+		}
+	}
+}
+
+// Test if a request of an allowed origin is passed on with the CORS headers.
+func TestCORSAllowedOrigin(t *testing.T) {
+	options := CORSOptions{AllowedOrigins: []string{"https://example.com"}, AllowCredentials: true}
+	res, called := corsRequest(t, options, http.MethodGet, "https://example.com", "")
+
+	if !called {
+		t.Error("Expected the next handler to be called")
+	}
+	expected := map[string]string{
+		"Access-Control-Allow-Origin":      "https://example.com",
+		"Access-Control-Allow-Credentials": "true",
+		"Access-Control-Expose-Headers":    "X-Request-ID",
+	}
+	for header, value := range expected {
+		if actual := res.Header().Get(header); actual != value {
+			t.Errorf("Expected %v to be %v but got %v", header, value, actual)
+		}
+	}
+}
+
+// Test if an origin which is only allowed by "*" gets no credentials, also not when they are allowed.
+func TestCORSCredentialsWildcard(t *testing.T) {
+	options := CORSOptions{AllowedOrigins: []string{"*", "https://example.com"}, AllowCredentials: true}
+	for _, method := range []string{http.MethodGet, http.MethodOptions} {
+		res, _ := corsRequest(t, options, method, "https://evil.example.com", http.MethodGet)
+
+		if actual := res.Header().Get("Access-Control-Allow-Origin"); actual != "*" {
+			t.Errorf("Expected %v but got %v", "*", actual)
+		}
+		if actual := res.Header().Get("Access-Control-Allow-Credentials"); actual != "" {
+			t.Errorf("Expected no Access-Control-Allow-Credentials but got %v", actual)
+		}
+	}
+
+	res, _ := corsRequest(t, options, http.MethodGet, "https://example.com", "")
+	if actual := res.Header().Get("Access-Control-Allow-Credentials"); actual != "true" {
+		t.Errorf("Expected %v but got %v", "true", actual)
+	}
+}
+
+// Test if other origins get no CORS headers, also not on a preflight request.
+func TestCORSOtherOrigin(t *testing.T) {
+	options := CORSOptions{AllowedOrigins: []string{"https://example.com"}}
+	for _, method := range []string{http.MethodGet, http.MethodOptions} {
+		res, _ := corsRequest(t, options, method, "https://evil.example.com", http.MethodGet)
+
+		if actual := res.Header().Get("Access-Control-Allow-Origin"); actual != "" {
+			t.Errorf("Expected no Access-Control-Allow-Origin but got %v", actual)
+		}
+		if actual := res.Header().Get("Access-Control-Allow-Methods"); actual != "" {
+			t.Errorf("Expected no Access-Control-Allow-Methods but got %v", actual)
+		}
+	}
+}
+
+// Test if requests without an origin are passed on untouched.
+func TestCORSWithoutOrigin(t *testing.T) {
+	res, called := corsRequest(t, CORSOptions{MaxAge: time.Hour}, http.MethodGet, "", "")
+
+	if !called {
+		t.Error("Expected the next handler to be called")
+	}
+	if actual := res.Header().Get("Access-Control-Allow-Origin"); actual != "" {
+		t.Errorf("Expected no Access-Control-Allow-Origin but got %v", actual)
+	}
+}
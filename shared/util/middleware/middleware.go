@@ -1,31 +1,169 @@
 package middleware
 
 import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/hex"
 	"errors"
+	"fmt"
+	"math"
 	"net/http"
+	"strings"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
+	"github.com/bstaijen/mariadb-for-microservices/shared/apierror"
+	"github.com/bstaijen/mariadb-for-microservices/shared/jwks"
 	"github.com/bstaijen/mariadb-for-microservices/shared/util"
 	jwt "github.com/dgrijalva/jwt-go"
 	"github.com/urfave/negroni"
 )
 
-// AccessControlHandler set the Access-Control-Allow-Origin and calls next HandlerFunc
-func AccessControlHandler(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-	if next != nil {
-		next(w, r)
+// TokenIssuer is the iss claim of the tokens issued by the authentication service. Tokens with another issuer are
+// rejected.
+const TokenIssuer = "mariadb-for-microservices"
+
+// ErrTokenMandatory is sent when a request which needs a user carries no token.
+var ErrTokenMandatory = apierror.New(apierror.Unauthenticated, "token is mandatory")
+
+// ErrInvalidToken is sent when the token of a request can't be verified.
+var ErrInvalidToken = apierror.New(apierror.Unauthenticated, "Invalid token")
+
+// ErrTokenRevoked is sent when the token of a request was revoked by a logout.
+var ErrTokenRevoked = apierror.New(apierror.Unauthenticated, "Token is revoked")
+
+// errRevocationUnavailable is sent when it can't be checked whether a token was revoked.
+var errRevocationUnavailable = apierror.New(apierror.Unavailable, "Can not verify token")
+
+// ErrEmailNotVerified is sent when a request which needs a verified email address comes from a user who didn't
+// verify theirs.
+var ErrEmailNotVerified = apierror.New(apierror.PermissionDenied, "Email address is not verified")
+
+// Principal is the authenticated user of a request. TokenID is the jti claim of its token and Version the token
+// version of the user when the token was issued. EmailVerified tells whether the user had verified their email
+// address when the token was issued. Scopes are the scopes of a personal access token, they are nil for the access
+// tokens of a login, which have every scope; TokenID, Version and ExpiresAt are unset for personal access tokens.
+type Principal struct {
+	ID            int
+	TokenID       string
+	Version       int
+	EmailVerified bool
+	ExpiresAt     time.Time
+	Scopes        []string
+}
+
+type principalKey struct{}
+
+// WithUser returns a copy of ctx which carries user.
+func WithUser(ctx context.Context, user *Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, user)
+}
+
+// UserFromContext returns the user which the authentication middleware stored in ctx. The second return value is
+// false for anonymous requests.
+func UserFromContext(ctx context.Context) (*Principal, bool) {
+	user, ok := ctx.Value(principalKey{}).(*Principal)
+	return user, ok && user != nil
+}
+
+// DefaultTokenLifetime is the lifetime of an access token when none is configured. Clients renew their access
+// token with a refresh token, so it can be short.
+const DefaultTokenLifetime = 15 * time.Minute
+
+// NewToken returns an access token for the user with userID, signed with RS256 and key, and the moment it expires.
+// Version is the current token version of the user, see Revocations, and emailVerified whether the user verified
+// their email address. A lifetime of zero means DefaultTokenLifetime.
+func NewToken(key *jwks.PrivateKey, userID int, version int, emailVerified bool, lifetime time.Duration) (string, time.Time, error) {
+	if lifetime <= 0 {
+		lifetime = DefaultTokenLifetime
+	}
+	now := time.Now()
+	expiresAt := now.Add(lifetime)
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+		"sub":            userID,
+		"jti":            randomID(),
+		"ver":            version,
+		"email_verified": emailVerified,
+		"iss":            TokenIssuer,
+		"iat":            now.Unix(),
+		"exp":            expiresAt.Unix(),
+	})
+	token.Header["kid"] = key.ID
+	tokenString, err := token.SignedString(key.Key)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	return tokenString, expiresAt, nil
+}
+
+// ParseToken verifies tokenString and returns the user it was issued to. The token must be signed with RS256 and the
+// key of keys named by its kid header, must not be expired, must be issued by TokenIssuer, its subject must be a user
+// ID and it must have a jti, so it can be revoked.
+func ParseToken(ctx context.Context, keys jwks.KeySet, tokenString string) (*Principal, error) {
+	tok, err := jwt.Parse(tokenString, func(t *jwt.Token) (interface{}, error) {
+		if t.Method != jwt.SigningMethodRS256 {
+			return nil, fmt.Errorf("unexpected signing method %v", t.Header["alg"])
+		}
+		kid, _ := t.Header["kid"].(string)
+		if kid == "" {
+			return nil, errors.New("token has no kid")
+		}
+		return keys.PublicKey(ctx, kid)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	claims, ok := tok.Claims.(jwt.MapClaims)
+	if !ok || !tok.Valid {
+		return nil, errors.New("token is invalid")
+	}
+	if !claims.VerifyExpiresAt(time.Now().Unix(), true) {
+		return nil, errors.New("token is expired or has no expiry")
+	}
+	if !claims.VerifyIssuer(TokenIssuer, true) {
+		return nil, fmt.Errorf("unexpected issuer %v", claims["iss"])
+	}
+	sub, ok := claims["sub"].(float64)
+	if !ok || sub < 1 || sub != math.Trunc(sub) {
+		return nil, fmt.Errorf("subject %v is not a user ID", claims["sub"])
 	}
+	jti, _ := claims["jti"].(string)
+	if jti == "" {
+		return nil, errors.New("token has no jti")
+	}
+	ver, _ := claims["ver"].(float64)
+	emailVerified, _ := claims["email_verified"].(bool)
+	exp, _ := claims["exp"].(float64)
+
+	return &Principal{ID: int(sub), TokenID: jti, Version: int(ver), EmailVerified: emailVerified, ExpiresAt: time.Unix(int64(exp), 0)}, nil
+}
+
+// RequireTokenAuthenticationHandler is a middleware handler which extracts the token from the header or from the query parameter, checks if the token is valid against keys and not revoked and stores the user in the request context. Revocations may be nil, then tokens are only verified.
+func RequireTokenAuthenticationHandler(keys jwks.KeySet, revocations Revocations) negroni.HandlerFunc {
+	return tokenAuthenticationHandler(keys, revocations, nil, "", true)
 }
 
-// AcceptOPTIONS sets the Access-Control-Allow-Origin and Access-Control-Allow-Headers headers
-func AcceptOPTIONS(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Add("Access-Control-Allow-Headers", "Content-Type")
+// OptionalTokenAuthenticationHandler works like RequireTokenAuthenticationHandler but lets requests without a token
+// through as anonymous requests. A token which is present must be valid.
+func OptionalTokenAuthenticationHandler(keys jwks.KeySet, revocations Revocations) negroni.HandlerFunc {
+	return tokenAuthenticationHandler(keys, revocations, nil, "", false)
 }
 
-// RequireTokenAuthenticationHandler is a middleware handler which extracts the token from the header of from the query parameter and checks if the token is valid.
-func RequireTokenAuthenticationHandler(secretKey string) negroni.HandlerFunc {
+// RequireScopedTokenAuthenticationHandler works like RequireTokenAuthenticationHandler but accepts the personal
+// access tokens of accessTokens with scope as well. The routes without a scope refuse personal access tokens.
+func RequireScopedTokenAuthenticationHandler(keys jwks.KeySet, revocations Revocations, accessTokens AccessTokens, scope string) negroni.HandlerFunc {
+	return tokenAuthenticationHandler(keys, revocations, accessTokens, scope, true)
+}
+
+// OptionalScopedTokenAuthenticationHandler works like OptionalTokenAuthenticationHandler but accepts the personal
+// access tokens of accessTokens with scope as well.
+func OptionalScopedTokenAuthenticationHandler(keys jwks.KeySet, revocations Revocations, accessTokens AccessTokens, scope string) negroni.HandlerFunc {
+	return tokenAuthenticationHandler(keys, revocations, accessTokens, scope, false)
+}
+
+func tokenAuthenticationHandler(keys jwks.KeySet, revocations Revocations, accessTokens AccessTokens, scope string, required bool) negroni.HandlerFunc {
 	return negroni.HandlerFunc(func(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
 		var queryToken = r.URL.Query().Get("token")
 
@@ -34,27 +172,268 @@ func RequireTokenAuthenticationHandler(secretKey string) negroni.HandlerFunc {
 		}
 
 		if len(queryToken) < 1 {
-			util.SendBadRequest(w, errors.New("token is mandatory"))
+			if required {
+				util.SendError(w, ErrTokenMandatory)
+				return
+			}
+			if next != nil {
+				next(w, r)
+			}
+			return
+		}
+
+		var user *Principal
+		var err error
+		if accessTokens != nil && IsAccessToken(queryToken) {
+			user, err = verifyAccessToken(r.Context(), accessTokens, queryToken, scope)
+		} else {
+			user, err = verifyToken(r.Context(), keys, revocations, queryToken)
+		}
+		if err != nil {
+			util.SendError(w, err)
+			return
+		}
+
+		if next != nil {
+			next(w, r.WithContext(WithUser(r.Context(), user)))
+		}
+	})
+}
+
+// verifyToken returns the user of the access token tokenString, or the error to send when it is invalid or revoked.
+func verifyToken(ctx context.Context, keys jwks.KeySet, revocations Revocations, tokenString string) (*Principal, error) {
+	user, err := ParseToken(ctx, keys, tokenString)
+	if err != nil {
+		util.Log(ctx).Infof("Rejected token: %v", err)
+		return nil, ErrInvalidToken
+	}
+
+	if revocations != nil {
+		revoked, err := revocations.Revoked(ctx, user)
+		if err != nil {
+			util.Log(ctx).Errorf("Can not check the revocation of a token: %v", err)
+			return nil, errRevocationUnavailable
+		}
+		if revoked {
+			return nil, ErrTokenRevoked
+		}
+	}
+	return user, nil
+}
+
+// verifyAccessToken returns the user of the personal access token tokenString, or the error to send when it is
+// unknown or lacks scope.
+func verifyAccessToken(ctx context.Context, accessTokens AccessTokens, tokenString string, scope string) (*Principal, error) {
+	user, err := accessTokens.AccessToken(ctx, HashAccessToken(tokenString))
+	if err != nil {
+		util.Log(ctx).Errorf("Can not look up a personal access token: %v", err)
+		return nil, errRevocationUnavailable
+	}
+	if user == nil {
+		util.Log(ctx).Info("Rejected an unknown personal access token")
+		return nil, ErrInvalidToken
+	}
+	if !user.HasScope(scope) {
+		return nil, ErrInsufficientScope
+	}
+	return user, nil
+}
+
+// RequireVerifiedEmail is a middleware handler which refuses the requests of users who didn't verify their email
+// address when required is true. It must run after the token authentication middleware. The claim is read from the
+// access token, so a user who just verified their address has to refresh the token first.
+func RequireVerifiedEmail(required bool) negroni.HandlerFunc {
+	return negroni.HandlerFunc(func(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+		if user, ok := UserFromContext(r.Context()); required && ok && !user.EmailVerified {
+			util.SendError(w, ErrEmailNotVerified)
 			return
 		}
+		if next != nil {
+			next(w, r)
+		}
+	})
+}
+
+// ServiceTokenIssuer is the iss claim of the tokens with which the services authenticate themselves on the /ipc
+// routes of each other. Every service signs its tokens with a key of its own, so user tokens are never accepted on
+// the /ipc routes, service tokens are never accepted as user tokens and no service can pose as another one.
+const ServiceTokenIssuer = "mariadb-for-microservices/ipc"
+
+// ServiceTokenLifetime is the maximum lifetime of a service token. A token is created for every IPC call, so it
+// only has to outlive the retries of that call.
+const ServiceTokenLifetime = time.Minute
+
+// ServiceKeys are the public keys of the services by their name. A service token is only accepted when the key of
+// the service it names verifies it.
+type ServiceKeys map[string]*rsa.PublicKey
+
+// ErrServiceTokenMandatory is sent when an IPC request carries no service token.
+var ErrServiceTokenMandatory = apierror.New(apierror.Unauthenticated, "service token is mandatory")
+
+// ErrInvalidServiceToken is sent when the service token of an IPC request can't be verified.
+var ErrInvalidServiceToken = apierror.New(apierror.Unauthenticated, "Invalid service token")
+
+// ErrServiceNotAllowed is sent when a service calls an IPC route which isn't meant for it.
+var ErrServiceNotAllowed = apierror.New(apierror.PermissionDenied, "Service is not allowed to call this route")
+
+// errNoServiceKey is returned when a service has no IPC key, or knows no keys of other services. Without them no
+// service can be trusted.
+var errNoServiceKey = errors.New("no IPC key configured")
+
+// NewServiceToken returns a token with which service authenticates itself on the /ipc routes of audience. The token
+// is signed with RS256 and key, the private key of service, and expires after ServiceTokenLifetime.
+func NewServiceToken(key *rsa.PrivateKey, service string, audience string) (string, error) {
+	if key == nil {
+		return "", errNoServiceKey
+	}
+	now := time.Now()
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+		"sub": service,
+		"aud": audience,
+		"iss": ServiceTokenIssuer,
+		"iat": now.Unix(),
+		"exp": now.Add(ServiceTokenLifetime).Unix(),
+	})
+	return token.SignedString(key)
+}
+
+// ParseServiceToken verifies tokenString and returns the name of the service which signed it. The token must be
+// signed with RS256 and the key in keys of the service in its subject, must be issued by ServiceTokenIssuer for
+// audience and may not be valid for longer than ServiceTokenLifetime.
+func ParseServiceToken(keys ServiceKeys, audience string, tokenString string) (string, error) {
+	if len(keys) == 0 {
+		return "", errNoServiceKey
+	}
+	var service string
+	tok, err := jwt.Parse(tokenString, func(t *jwt.Token) (interface{}, error) {
+		if t.Method != jwt.SigningMethodRS256 {
+			return nil, fmt.Errorf("unexpected signing method %v", t.Header["alg"])
+		}
+		claims, _ := t.Claims.(jwt.MapClaims)
+		service, _ = claims["sub"].(string)
+		key, ok := keys[service]
+		if !ok {
+			return nil, fmt.Errorf("subject %v is not a known service", claims["sub"])
+		}
+		return key, nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	claims, ok := tok.Claims.(jwt.MapClaims)
+	if !ok || !tok.Valid {
+		return "", errors.New("token is invalid")
+	}
+	if !claims.VerifyExpiresAt(time.Now().Unix(), true) {
+		return "", errors.New("token is expired or has no expiry")
+	}
+	if !claims.VerifyIssuer(ServiceTokenIssuer, true) {
+		return "", fmt.Errorf("unexpected issuer %v", claims["iss"])
+	}
+	if !claims.VerifyAudience(audience, true) {
+		return "", fmt.Errorf("unexpected audience %v", claims["aud"])
+	}
+	iat, _ := claims["iat"].(float64)
+	exp, _ := claims["exp"].(float64)
+	if iat == 0 || time.Duration(exp-iat)*time.Second > ServiceTokenLifetime {
+		return "", errors.New("token lives too long")
+	}
+	return service, nil
+}
 
-		tok, err := jwt.Parse(queryToken, func(t *jwt.Token) (interface{}, error) {
-			return []byte(secretKey), nil
-		})
+// RequireServiceAuthenticationHandler is a middleware handler for an /ipc route of audience which only the services
+// in allowed may call. It takes the service token from the Authorization header, rejects the request when the token
+// is missing or can't be verified with keys, refuses the other services and stores the name of the calling service
+// in the request context, from where util.Log adds it to every log entry.
+func RequireServiceAuthenticationHandler(keys ServiceKeys, audience string, allowed ...string) negroni.HandlerFunc {
+	return negroni.HandlerFunc(func(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+		header := r.Header.Get("Authorization")
+		if !strings.HasPrefix(header, "Bearer ") {
+			util.SendError(w, ErrServiceTokenMandatory)
+			return
+		}
 
+		service, err := ParseServiceToken(keys, audience, strings.TrimPrefix(header, "Bearer "))
 		if err != nil {
-			log.Errorf("Error. Token: %v. Message: %v.\n", queryToken, err.Error())
-			util.SendBadRequest(w, errors.New("Invalid token"))
+			util.Log(r.Context()).Warnf("Rejected service token: %v", err)
+			util.SendError(w, ErrInvalidServiceToken)
 			return
 		}
 
-		if tok != nil && tok.Valid {
-			if next != nil {
-				next(w, r)
-			}
-		} else {
-			w.WriteHeader(http.StatusUnauthorized)
-			w.Write([]byte(""))
+		ctx := util.WithCallingService(r.Context(), service)
+		if !isAllowed(allowed, service) {
+			util.Log(ctx).Warnf("Refused IPC %v %v", r.Method, r.URL.Path)
+			util.SendError(w, ErrServiceNotAllowed)
+			return
+		}
+
+		util.Log(ctx).Infof("IPC %v %v", r.Method, r.URL.Path)
+		if next != nil {
+			next(w, r.WithContext(ctx))
+		}
+	})
+}
+
+// isAllowed returns whether service is one of allowed.
+func isAllowed(allowed []string, service string) bool {
+	for _, name := range allowed {
+		if name == service {
+			return true
+		}
+	}
+	return false
+}
+
+// Deadline is a middleware handler which cancels the context of the request after timeout. Database queries and IPC
+// calls made with the request context are aborted when the deadline passes or the client disconnects. A timeout
+// of 0 or less only propagates the cancellation of the client.
+func Deadline(timeout time.Duration) negroni.HandlerFunc {
+	return negroni.HandlerFunc(func(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+		if timeout > 0 {
+			ctx, cancel := context.WithTimeout(r.Context(), timeout)
+			defer cancel()
+			r = r.WithContext(ctx)
+		}
+		if next != nil {
+			next(w, r)
 		}
 	})
 }
+
+// RequestID is a middleware handler which takes the correlation ID from the X-Request-ID header, or generates one
+// when the header is missing or invalid. The ID is stored in the request context, from where it is added to log
+// entries (util.Log) and forwarded on IPC calls, and it is echoed in the X-Request-ID header of the response.
+func RequestID(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	id := r.Header.Get(util.RequestIDHeader)
+	if !validRequestID(id) {
+		id = randomID()
+	}
+
+	w.Header().Set(util.RequestIDHeader, id)
+	if next != nil {
+		next(w, r.WithContext(util.WithRequestID(r.Context(), id)))
+	}
+}
+
+// validRequestID accepts IDs of up to 128 printable ASCII characters, so a client can't inject anything into the
+// logs or the headers of the other services.
+func validRequestID(id string) bool {
+	if len(id) == 0 || len(id) > 128 {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] < 0x21 || id[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+func randomID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		log.Error(err)
+	}
+	return hex.EncodeToString(b)
+}
@@ -1,98 +1,31 @@
 package middleware
 
 import (
+	"context"
+	"crypto/rsa"
 	"net/http"
 	"net/http/httptest"
 	"testing"
 	"time"
 
+	"github.com/bstaijen/mariadb-for-microservices/shared/jwks"
+	"github.com/bstaijen/mariadb-for-microservices/shared/util"
 	jwt "github.com/dgrijalva/jwt-go"
 )
 
-// Test if AccessControlHandler sets the Access-Control-Allow-Origin header.
-func TestAccessControlHandler(t *testing.T) {
-	req, err := http.NewRequest("GET", "http://localhost/test", nil)
-	if err != nil {
-		t.Fatal(err)
-	}
-	res := httptest.NewRecorder()
-
-	AccessControlHandler(res, req, nil)
-
-	exp := "*"
-	act := res.Header().Get("Access-Control-Allow-Origin")
-	if exp != act {
-		t.Fatalf("Expected %s got %s", exp, act)
-	}
-}
-
-// Test if the next function is being executed.
-func TestAccessControlHandlerWithNext(t *testing.T) {
-	req, err := http.NewRequest("GET", "http://localhost/test", nil)
-	if err != nil {
-		t.Fatal(err)
-	}
-	res := httptest.NewRecorder()
-
-	// Test if the code gets executed when there's a next arguments passed
-	AccessControlHandler(res, req, func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("test", "value")
-	})
-
-	exp := "*"
-	act := res.Header().Get("Access-Control-Allow-Origin")
-	if exp != act {
-		t.Fatalf("Expected %s got %s", exp, act)
-	}
-
-	exp = "value"
-	act = res.Header().Get("test")
-	if exp != act {
-		t.Fatalf("Expected %s got %s", exp, act)
-	}
-}
-
-// Test if the Access-Control-Allow-Origin and Access-Control-Allow-Headers are being set by the AcceptOPTIONSHandler middleware
-func TestAcceptOPTIONS(t *testing.T) {
-	req, err := http.NewRequest("GET", "http://localhost/test", nil)
-	if err != nil {
-		t.Fatal(err)
-	}
-	res := httptest.NewRecorder()
-
-	AcceptOPTIONS(res, req, nil)
-
-	exp := "*"
-	act := res.Header().Get("Access-Control-Allow-Origin")
-	if exp != act {
-		t.Fatalf("Expected %s got %s", exp, act)
-	}
-
-	exp = "Content-Type"
-	act = res.Header().Get("Access-Control-Allow-Headers")
-	if exp != act {
-		t.Fatalf("Expected %s got %s", exp, act)
-	}
-}
-
 // Test getting and validating token in the query parameter.
 func TestRequireTokenInURLParam(t *testing.T) {
 
 	// Create JWT object with claims
 	expiration := time.Now().Add(time.Hour * 24 * 31).Unix()
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+	tokenString := userToken(t, jwt.MapClaims{
 		"sub": 1,
+		"jti": "test-token",
+		"iss": TokenIssuer,
 		"iat": time.Now().Unix(),
 		"exp": expiration,
 	})
 
-	// Generate a signed token
-	tokenString, err := token.SignedString([]byte("ABCDEF"))
-	if err != nil {
-		t.Error(err)
-		return
-	}
-
 	// Make rquest
 	req, err := http.NewRequest("GET", "http://localhost/test?token="+tokenString, nil)
 	if err != nil {
@@ -101,14 +34,14 @@ func TestRequireTokenInURLParam(t *testing.T) {
 	res := httptest.NewRecorder()
 
 	// Invoke middleware
-	handler := RequireTokenAuthenticationHandler("ABCDEF")
+	handler := RequireTokenAuthenticationHandler(testKeys, nil)
 	handler(res, req, nil)
 
 	// Test results:
 
 	// In case of no token
-	if res.Result().StatusCode == 400 {
-		t.Errorf("Expected statuscode to be empty but got %v. Bad Request.", res.Result().StatusCode)
+	if res.Result().StatusCode == 401 {
+		t.Errorf("Expected statuscode to be empty but got %v. Unauthorized.", res.Result().StatusCode)
 	}
 
 	// In case of bad token
@@ -123,19 +56,14 @@ func TestRequireTokenInURLParam(t *testing.T) {
 func TestRequireTokenInHeader(t *testing.T) {
 	// Create JWT object with claims
 	expiration := time.Now().Add(time.Hour * 24 * 31).Unix()
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+	tokenString := userToken(t, jwt.MapClaims{
 		"sub": 1,
+		"jti": "test-token",
+		"iss": TokenIssuer,
 		"iat": time.Now().Unix(),
 		"exp": expiration,
 	})
 
-	// Generate a signed token
-	tokenString, err := token.SignedString([]byte("ABCDEF"))
-	if err != nil {
-		t.Error(err)
-		return
-	}
-
 	// Make rquest
 	req, err := http.NewRequest("GET", "http://localhost/test", nil)
 	if err != nil {
@@ -145,14 +73,14 @@ func TestRequireTokenInHeader(t *testing.T) {
 	res := httptest.NewRecorder()
 
 	// Invoke middleware
-	handler := RequireTokenAuthenticationHandler("ABCDEF")
+	handler := RequireTokenAuthenticationHandler(testKeys, nil)
 	handler(res, req, nil)
 
 	// Test results:
 
 	// In case of no token
-	if res.Result().StatusCode == 400 {
-		t.Errorf("Expected statuscode to be empty but got %v. Bad Request.", res.Result().StatusCode)
+	if res.Result().StatusCode == 401 {
+		t.Errorf("Expected statuscode to be empty but got %v. Unauthorized.", res.Result().StatusCode)
 	}
 
 	// In case of bad token
@@ -172,11 +100,11 @@ func TestNoTokenProvided(t *testing.T) {
 	res := httptest.NewRecorder()
 
 	// Invoke middleware
-	handler := RequireTokenAuthenticationHandler("")
+	handler := RequireTokenAuthenticationHandler(testKeys, nil)
 	handler(res, req, nil)
 
-	if res.Result().StatusCode != 400 {
-		t.Errorf("Expected statuscode to be 400 but got %v.", res.Result().StatusCode)
+	if res.Result().StatusCode != 401 {
+		t.Errorf("Expected statuscode to be 401 but got %v.", res.Result().StatusCode)
 	}
 }
 
@@ -189,30 +117,25 @@ func TestBadToken(t *testing.T) {
 	res := httptest.NewRecorder()
 
 	// Invoke middleware
-	handler := RequireTokenAuthenticationHandler("ThisIsNotAGoodSecretKey")
+	handler := RequireTokenAuthenticationHandler(testKeys, nil)
 	handler(res, req, nil)
 
-	if res.Result().StatusCode != 400 {
-		t.Errorf("Expected statuscode to be 400 but got %v.", res.Result().StatusCode)
+	if res.Result().StatusCode != 401 {
+		t.Errorf("Expected statuscode to be 401 but got %v.", res.Result().StatusCode)
 	}
 }
 
 func TestTokenOK(t *testing.T) {
 	// Create JWT object with claims
 	expiration := time.Now().Add(time.Hour * 24 * 31).Unix()
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+	tokenString := userToken(t, jwt.MapClaims{
 		"sub": 1,
+		"jti": "test-token",
+		"iss": TokenIssuer,
 		"iat": time.Now().Unix(),
 		"exp": expiration,
 	})
 
-	// Generate a signed token
-	tokenString, err := token.SignedString([]byte("ABCDEF"))
-	if err != nil {
-		t.Error(err)
-		return
-	}
-
 	// Make rquest
 	req, err := http.NewRequest("GET", "http://localhost/test?token="+tokenString, nil)
 	if err != nil {
@@ -221,7 +144,7 @@ func TestTokenOK(t *testing.T) {
 	res := httptest.NewRecorder()
 
 	// Invoke middleware
-	handler := RequireTokenAuthenticationHandler("ABCDEF")
+	handler := RequireTokenAuthenticationHandler(testKeys, nil)
 	handler(res, req, func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("test", "value")
 	})
@@ -234,31 +157,436 @@ func TestTokenOK(t *testing.T) {
 func TestExpiredToken(t *testing.T) {
 	// Create JWT object with claims
 	expiration := (time.Now().Unix() - 1)
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+	tokenString := userToken(t, jwt.MapClaims{
 		"sub": 1,
+		"jti": "test-token",
+		"iss": TokenIssuer,
 		"iat": time.Now().Unix(),
 		"exp": expiration,
 	})
 
-	// Generate a signed token
-	tokenString, err := token.SignedString([]byte("ABCDEF"))
+	// Make rquest
+	req, err := http.NewRequest("GET", "http://localhost/test?token="+tokenString, nil)
 	if err != nil {
-		t.Error(err)
-		return
+		t.Fatal(err)
+	}
+	res := httptest.NewRecorder()
+
+	// Invoke middleware
+	handler := RequireTokenAuthenticationHandler(testKeys, nil)
+	handler(res, req, nil)
+
+	if res.Result().StatusCode != 401 {
+		t.Errorf("Expected statuscode to be 401 but got %v.", res.Result().StatusCode)
 	}
+}
 
-	// Make rquest
+// Test if a token of NewToken is accepted and expires after its lifetime.
+func TestNewToken(t *testing.T) {
+	tokenString, expiresAt, err := NewToken(testKey, 1, 0, false, time.Minute)
+	if err != nil {
+		t.Fatalf("Expected no error, instead got %v", err.Error())
+	}
+	if expiresAt.Sub(time.Now()) > time.Minute {
+		t.Errorf("Expected the token to expire within %v but it expires at %v", time.Minute, expiresAt)
+	}
+
+	user, err := ParseToken(context.Background(), testKeys, tokenString)
+	if err != nil {
+		t.Fatalf("Expected no error, instead got %v", err.Error())
+	}
+	if user.ID != 1 {
+		t.Errorf("Expected %v but got %v", 1, user.ID)
+	}
+}
+
+// Test if the users who didn't verify their email address are refused, and only when it is required.
+func TestRequireVerifiedEmail(t *testing.T) {
+	tests := []struct {
+		required bool
+		verified bool
+		expected int
+	}{
+		{true, false, http.StatusForbidden},
+		{true, true, http.StatusOK},
+		{false, false, http.StatusOK},
+	}
+	for _, test := range tests {
+		tokenString, _, err := NewToken(testKey, 1, 0, test.verified, time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		user, err := ParseToken(context.Background(), testKeys, tokenString)
+		if err != nil || user.EmailVerified != test.verified {
+			t.Fatalf("Expected %v but got %v (%v)", test.verified, user, err)
+		}
+
+		req, err := http.NewRequest("POST", "http://localhost/test", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req = req.WithContext(WithUser(req.Context(), user))
+		res := httptest.NewRecorder()
+
+		handler := RequireVerifiedEmail(test.required)
+		handler(res, req, func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		})
+		if res.Code != test.expected {
+			t.Errorf("Expected %v but got %v", test.expected, res.Code)
+		}
+	}
+}
+
+// Test if Deadline sets a deadline on the context of the request.
+func TestDeadline(t *testing.T) {
+	req, err := http.NewRequest("GET", "http://localhost/test", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := httptest.NewRecorder()
+
+	handler := Deadline(time.Second)
+	handler(res, req, func(w http.ResponseWriter, r *http.Request) {
+		deadline, ok := r.Context().Deadline()
+		if !ok {
+			t.Fatal("Expected the context to have a deadline")
+		}
+		if remaining := time.Until(deadline); remaining > time.Second {
+			t.Errorf("Expected the deadline to be at most 1s away but got %v", remaining)
+		}
+	})
+}
+
+// Test if Deadline leaves the context alone when no timeout is configured.
+func TestDeadlineDisabled(t *testing.T) {
+	req, err := http.NewRequest("GET", "http://localhost/test", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := httptest.NewRecorder()
+
+	handler := Deadline(0)
+	handler(res, req, func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := r.Context().Deadline(); ok {
+			t.Error("Expected the context to have no deadline")
+		}
+	})
+}
+
+// Test if RequestID generates an ID when the client did not send one.
+func TestRequestIDGenerated(t *testing.T) {
+	req, err := http.NewRequest("GET", "http://localhost/test", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := httptest.NewRecorder()
+
+	var fromContext string
+	RequestID(res, req, func(w http.ResponseWriter, r *http.Request) {
+		fromContext = util.RequestIDFromContext(r.Context())
+	})
+
+	if len(fromContext) != 32 {
+		t.Errorf("Expected a generated ID of 32 characters but got %v", fromContext)
+	}
+	if actual := res.Header().Get(util.RequestIDHeader); actual != fromContext {
+		t.Errorf("Expected %v but got %v", fromContext, actual)
+	}
+}
+
+// Test if RequestID keeps the ID sent by the client.
+func TestRequestIDAccepted(t *testing.T) {
+	req, err := http.NewRequest("GET", "http://localhost/test", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set(util.RequestIDHeader, "abc-123")
+	res := httptest.NewRecorder()
+
+	var fromContext string
+	RequestID(res, req, func(w http.ResponseWriter, r *http.Request) {
+		fromContext = util.RequestIDFromContext(r.Context())
+	})
+
+	expected := "abc-123"
+	if fromContext != expected {
+		t.Errorf("Expected %v but got %v", expected, fromContext)
+	}
+	if actual := res.Header().Get(util.RequestIDHeader); actual != expected {
+		t.Errorf("Expected %v but got %v", expected, actual)
+	}
+}
+
+// Test if RequestID replaces an ID which could be used to inject data into the logs.
+func TestRequestIDRejected(t *testing.T) {
+	req, err := http.NewRequest("GET", "http://localhost/test", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set(util.RequestIDHeader, "abc 123\tlevel=error")
+	res := httptest.NewRecorder()
+
+	var fromContext string
+	RequestID(res, req, func(w http.ResponseWriter, r *http.Request) {
+		fromContext = util.RequestIDFromContext(r.Context())
+	})
+
+	if fromContext == "abc 123\tlevel=error" || len(fromContext) != 32 {
+		t.Errorf("Expected a generated ID but got %v", fromContext)
+	}
+}
+
+// testKey signs the user tokens of the tests, testKeys verifies them.
+var testKey, testKeys = newTestKeys()
+
+func newTestKeys() (*jwks.PrivateKey, *jwks.Set) {
+	key, err := jwks.GenerateKey()
+	if err != nil {
+		panic(err)
+	}
+	keys, err := jwks.NewSet(key)
+	if err != nil {
+		panic(err)
+	}
+	return key, keys
+}
+
+// userToken returns a user token with claims, signed with testKey.
+func userToken(t *testing.T, claims jwt.MapClaims) string {
+	return signedUserToken(t, jwt.SigningMethodRS256, testKey.Key, testKey.ID, claims)
+}
+
+func signedUserToken(t *testing.T, method jwt.SigningMethod, key interface{}, kid string, claims jwt.MapClaims) string {
+	token := jwt.NewWithClaims(method, claims)
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
+	tokenString, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tokenString
+}
+
+func signedToken(t *testing.T, method jwt.SigningMethod, claims jwt.MapClaims) string {
+	tokenString, err := jwt.NewWithClaims(method, claims).SignedString([]byte("ABCDEF"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tokenString
+}
+
+// Test if the user of a valid token is stored in the request context.
+func TestTokenPrincipal(t *testing.T) {
+	tokenString := userToken(t, jwt.MapClaims{
+		"sub": 7,
+		"jti": "test-token",
+		"iss": TokenIssuer,
+		"exp": time.Now().Add(time.Hour).Unix(),
+	})
 	req, err := http.NewRequest("GET", "http://localhost/test?token="+tokenString, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
 	res := httptest.NewRecorder()
 
-	// Invoke middleware
-	handler := RequireTokenAuthenticationHandler("ABCDEF")
+	var user *Principal
+	handler := RequireTokenAuthenticationHandler(testKeys, nil)
+	handler(res, req, func(w http.ResponseWriter, r *http.Request) {
+		user, _ = UserFromContext(r.Context())
+	})
+
+	if user == nil || user.ID != 7 {
+		t.Errorf("Expected user 7 but got %v", user)
+	}
+}
+
+// Test if tokens are rejected when the algorithm, key, issuer, expiry or subject is wrong.
+func TestTokenRejected(t *testing.T) {
+	exp := time.Now().Add(time.Hour).Unix()
+	otherKey, err := jwks.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims := jwt.MapClaims{"sub": 1, "jti": "test-token", "iss": TokenIssuer, "exp": exp}
+	tests := map[string]string{
+		"algorithm": signedUserToken(t, jwt.SigningMethodHS256, []byte("ABCDEF"), testKey.ID, claims),
+		"key":       signedUserToken(t, jwt.SigningMethodRS256, otherKey.Key, otherKey.ID, claims),
+		"kid":       signedUserToken(t, jwt.SigningMethodRS256, testKey.Key, "", claims),
+		"issuer":    userToken(t, jwt.MapClaims{"sub": 1, "jti": "test-token", "iss": "someone-else", "exp": exp}),
+		"no expiry": userToken(t, jwt.MapClaims{"sub": 1, "jti": "test-token", "iss": TokenIssuer}),
+		"subject":   userToken(t, jwt.MapClaims{"sub": "admin", "jti": "test-token", "iss": TokenIssuer, "exp": exp}),
+		"no jti":    userToken(t, jwt.MapClaims{"sub": 1, "iss": TokenIssuer, "exp": exp}),
+	}
+
+	for name, tokenString := range tests {
+		req, err := http.NewRequest("GET", "http://localhost/test?token="+tokenString, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res := httptest.NewRecorder()
+
+		handler := RequireTokenAuthenticationHandler(testKeys, nil)
+		handler(res, req, func(w http.ResponseWriter, r *http.Request) {
+			t.Errorf("Expected the token with the wrong %v to be rejected", name)
+		})
+
+		if res.Result().StatusCode != 401 {
+			t.Errorf("Expected statuscode to be 401 but got %v.", res.Result().StatusCode)
+		}
+	}
+}
+
+// Test if OptionalTokenAuthenticationHandler lets anonymous requests through.
+func TestOptionalTokenAnonymous(t *testing.T) {
+	req, err := http.NewRequest("GET", "http://localhost/test", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := httptest.NewRecorder()
+
+	called := false
+	handler := OptionalTokenAuthenticationHandler(testKeys, nil)
+	handler(res, req, func(w http.ResponseWriter, r *http.Request) {
+		called = true
+		if _, ok := UserFromContext(r.Context()); ok {
+			t.Error("Expected no user in the context")
+		}
+	})
+
+	if !called {
+		t.Error("Expected the next handler to be called")
+	}
+}
+
+// Test if OptionalTokenAuthenticationHandler still rejects a bad token.
+func TestOptionalTokenBadToken(t *testing.T) {
+	req, err := http.NewRequest("GET", "http://localhost/test?token=token", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := httptest.NewRecorder()
+
+	handler := OptionalTokenAuthenticationHandler(testKeys, nil)
 	handler(res, req, nil)
 
-	if res.Result().StatusCode != 400 {
-		t.Errorf("Expected statuscode to be 400 but got %v.", res.Result().StatusCode)
+	if res.Result().StatusCode != 401 {
+		t.Errorf("Expected statuscode to be 401 but got %v.", res.Result().StatusCode)
+	}
+}
+
+// photoServiceKey and voteServiceKey sign the service tokens of the tests, testServiceKeys knows their public keys.
+var photoServiceKey, voteServiceKey = newServiceKey(), newServiceKey()
+var testServiceKeys = ServiceKeys{"photo-service": &photoServiceKey.PublicKey, "vote-service": &voteServiceKey.PublicKey}
+
+func newServiceKey() *rsa.PrivateKey {
+	key, err := jwks.GenerateKey()
+	if err != nil {
+		panic(err)
+	}
+	return key.Key
+}
+
+// Test if the name of the calling service is stored in the request context.
+func TestServiceToken(t *testing.T) {
+	tokenString, err := NewServiceToken(photoServiceKey, "photo-service", "vote-service")
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := http.NewRequest("GET", "http://localhost/ipc/count", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+tokenString)
+	res := httptest.NewRecorder()
+
+	var service string
+	handler := RequireServiceAuthenticationHandler(testServiceKeys, "vote-service", "photo-service")
+	handler(res, req, func(w http.ResponseWriter, r *http.Request) {
+		service = util.CallingServiceFromContext(r.Context())
+	})
+
+	expected := "photo-service"
+	if service != expected {
+		t.Errorf("Expected %v but got %v", expected, service)
+	}
+}
+
+// Test if IPC requests are rejected without a valid service token for the receiving service.
+func TestServiceTokenRejected(t *testing.T) {
+	now := time.Now()
+	claims := func(sub string, iss string, aud string, lifetime time.Duration) jwt.MapClaims {
+		return jwt.MapClaims{"sub": sub, "aud": aud, "iss": iss, "iat": now.Unix(), "exp": now.Add(lifetime).Unix()}
+	}
+	otherService, err := NewServiceToken(photoServiceKey, "photo-service", "profile-service")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := map[string]string{
+		"missing":    "",
+		"audience":   "Bearer " + otherService,
+		"user token": "Bearer " + userToken(t, jwt.MapClaims{"sub": 1, "jti": "test-token", "iss": TokenIssuer, "exp": now.Add(time.Hour).Unix()}),
+		"issuer":     "Bearer " + signedUserToken(t, jwt.SigningMethodRS256, photoServiceKey, "", claims("photo-service", TokenIssuer, "vote-service", time.Minute)),
+		"lifetime":   "Bearer " + signedUserToken(t, jwt.SigningMethodRS256, photoServiceKey, "", claims("photo-service", ServiceTokenIssuer, "vote-service", time.Hour)),
+		"expired":    "Bearer " + signedUserToken(t, jwt.SigningMethodRS256, photoServiceKey, "", claims("photo-service", ServiceTokenIssuer, "vote-service", -time.Second)),
+		"algorithm":  "Bearer " + signedToken(t, jwt.SigningMethodHS256, claims("photo-service", ServiceTokenIssuer, "vote-service", time.Minute)),
+		"key":        "Bearer " + signedUserToken(t, jwt.SigningMethodRS256, photoServiceKey, "", claims("vote-service", ServiceTokenIssuer, "vote-service", time.Minute)),
+		"service":    "Bearer " + signedUserToken(t, jwt.SigningMethodRS256, photoServiceKey, "", claims("comment-service", ServiceTokenIssuer, "vote-service", time.Minute)),
+	}
+
+	for name, header := range tests {
+		req, err := http.NewRequest("GET", "http://localhost/ipc/count", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", header)
+		res := httptest.NewRecorder()
+
+		handler := RequireServiceAuthenticationHandler(testServiceKeys, "vote-service", "photo-service", "vote-service", "comment-service")
+		handler(res, req, func(w http.ResponseWriter, r *http.Request) {
+			t.Errorf("Expected the request with the wrong %v to be rejected", name)
+		})
+
+		if res.Result().StatusCode != 401 {
+			t.Errorf("Expected statuscode to be 401 but got %v.", res.Result().StatusCode)
+		}
+	}
+}
+
+// Test if a service which isn't allowed on a route is refused.
+func TestServiceTokenNotAllowed(t *testing.T) {
+	tokenString, err := NewServiceToken(voteServiceKey, "vote-service", "vote-service")
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := http.NewRequest("GET", "http://localhost/ipc/count", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+tokenString)
+	res := httptest.NewRecorder()
+
+	handler := RequireServiceAuthenticationHandler(testServiceKeys, "vote-service", "photo-service")
+	handler(res, req, func(w http.ResponseWriter, r *http.Request) {
+		t.Error("Expected the request of the vote service to be refused")
+	})
+
+	if res.Result().StatusCode != 403 {
+		t.Errorf("Expected statuscode to be 403 but got %v.", res.Result().StatusCode)
+	}
+}
+
+// Test if no service is trusted without keys.
+func TestServiceTokenWithoutKeys(t *testing.T) {
+	tokenString, err := NewServiceToken(photoServiceKey, "photo-service", "vote-service")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ParseServiceToken(nil, "vote-service", tokenString); err == nil {
+		t.Error("Expected an error but got nil")
+	}
+	if _, err := NewServiceToken(nil, "photo-service", "vote-service"); err == nil {
+		t.Error("Expected an error but got nil")
 	}
 }
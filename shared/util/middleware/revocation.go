@@ -0,0 +1,98 @@
+package middleware
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// DefaultRevocationTTL is how long a RevocationCache trusts an answer of the authentication service. A logout takes
+// at most this long to reach every service.
+const DefaultRevocationTTL = 30 * time.Second
+
+// Revocations tells whether the token of a principal was revoked.
+type Revocations interface {
+	Revoked(ctx context.Context, principal *Principal) (bool, error)
+}
+
+// TokenStatus is what the authentication service knows about a token. Revoked is true when the token was logged
+// out. Version is the current token version of the user; logging out everywhere increments it, which revokes every
+// token with a lower version.
+type TokenStatus struct {
+	Revoked bool
+	Version int
+}
+
+// RevocationLookup returns the status of the token tokenID of the user with userID.
+type RevocationLookup func(ctx context.Context, userID int, tokenID string) (TokenStatus, error)
+
+// Revoked does the lookup for every token, without a cache. It suits the service which owns the revocations.
+func (lookup RevocationLookup) Revoked(ctx context.Context, principal *Principal) (bool, error) {
+	status, err := lookup(ctx, principal.ID, principal.TokenID)
+	if err != nil {
+		return false, err
+	}
+	return status.Revoked || principal.Version < status.Version, nil
+}
+
+// RevocationCache is Revocations on top of a lookup, which is done at most once per token per TTL.
+type RevocationCache struct {
+	lookup RevocationLookup
+	ttl    time.Duration
+	now    func() time.Time
+
+	mu        sync.Mutex
+	entries   map[string]revocationEntry
+	lastSweep time.Time
+}
+
+type revocationEntry struct {
+	status  TokenStatus
+	expires time.Time
+}
+
+// NewRevocationCache returns a RevocationCache which caches the answers of lookup for ttl. A ttl of zero means
+// DefaultRevocationTTL.
+func NewRevocationCache(lookup RevocationLookup, ttl time.Duration) *RevocationCache {
+	if ttl <= 0 {
+		ttl = DefaultRevocationTTL
+	}
+	return &RevocationCache{lookup: lookup, ttl: ttl, now: time.Now, entries: make(map[string]revocationEntry)}
+}
+
+// Revoked returns true when the token of principal was logged out or was issued before its user logged out
+// everywhere.
+func (c *RevocationCache) Revoked(ctx context.Context, principal *Principal) (bool, error) {
+	now := c.now()
+
+	c.mu.Lock()
+	entry, ok := c.entries[principal.TokenID]
+	c.mu.Unlock()
+
+	if !ok || now.After(entry.expires) {
+		status, err := c.lookup(ctx, principal.ID, principal.TokenID)
+		if err != nil {
+			return false, err
+		}
+		entry = revocationEntry{status: status, expires: now.Add(c.ttl)}
+
+		c.mu.Lock()
+		c.sweep(now)
+		c.entries[principal.TokenID] = entry
+		c.mu.Unlock()
+	}
+	return entry.status.Revoked || principal.Version < entry.status.Version, nil
+}
+
+// sweep removes the expired entries, at most once per TTL. The caller holds mu.
+func (c *RevocationCache) sweep(now time.Time) {
+	if now.Sub(c.lastSweep) < c.ttl {
+		return
+	}
+	c.lastSweep = now
+	for id, entry := range c.entries {
+		if now.After(entry.expires) {
+			delete(c.entries, id)
+		}
+	}
+}
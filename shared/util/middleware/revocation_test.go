@@ -0,0 +1,70 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// Test if the lookup is cached and if tokens of an older version are revoked.
+func TestRevocationCache(t *testing.T) {
+	lookups := 0
+	cache := NewRevocationCache(func(ctx context.Context, userID int, tokenID string) (TokenStatus, error) {
+		lookups++
+		return TokenStatus{Revoked: tokenID == "revoked", Version: 2}, nil
+	}, time.Minute)
+
+	cases := []struct {
+		principal *Principal
+		expected  bool
+	}{
+		{&Principal{ID: 1, TokenID: "current", Version: 2}, false},
+		{&Principal{ID: 1, TokenID: "current", Version: 2}, false},
+		{&Principal{ID: 1, TokenID: "old", Version: 1}, true},
+		{&Principal{ID: 1, TokenID: "revoked", Version: 2}, true},
+	}
+	for _, c := range cases {
+		revoked, err := cache.Revoked(context.Background(), c.principal)
+		if err != nil {
+			t.Fatalf("Expected no error, instead got %v", err.Error())
+		}
+		if revoked != c.expected {
+			t.Errorf("Expected %v but got %v for %+v", c.expected, revoked, c.principal)
+		}
+	}
+
+	expected := 3
+	if lookups != expected {
+		t.Errorf("Expected %v but got %v", expected, lookups)
+	}
+}
+
+// Test if a revoked token is rejected and a failing lookup is reported as unavailable.
+func TestRequireTokenRevoked(t *testing.T) {
+	tokenString, _, err := NewToken(testKey, 1, 0, false, time.Minute)
+	if err != nil {
+		t.Fatalf("Expected no error, instead got %v", err.Error())
+	}
+
+	cases := map[error]int{nil: http.StatusUnauthorized, errors.New("down"): http.StatusServiceUnavailable}
+	for lookupErr, expected := range cases {
+		lookupErr := lookupErr
+		cache := NewRevocationCache(func(ctx context.Context, userID int, tokenID string) (TokenStatus, error) {
+			return TokenStatus{Revoked: true}, lookupErr
+		}, 0)
+
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.Header.Set("token", tokenString)
+		res := httptest.NewRecorder()
+		RequireTokenAuthenticationHandler(testKeys, cache)(res, req, func(w http.ResponseWriter, r *http.Request) {
+			t.Error("Expected the request to be rejected")
+		})
+
+		if res.Code != expected {
+			t.Errorf("Expected %v but got %v", expected, res.Code)
+		}
+	}
+}
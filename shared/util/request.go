@@ -1,30 +1,22 @@
 package util
 
 import (
-	"bytes"
-	"log"
+	"context"
 	"net/http"
 )
 
 // Request is a helper which executes a request over the network and returns an error or a response
 func Request(method, url string, body []byte, cb func(*http.Response)) error {
+	return RequestWithContext(context.Background(), method, url, body, cb)
+}
 
-	req, err := http.NewRequest(method, url, bytes.NewBuffer(body))
-	if err != nil {
-		log.Println("Error creating request: " + err.Error())
-		return err
-	}
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		log.Println("Error executing request: " + err.Error())
-		return err
-	}
-
-	// callback
-	log.Printf("[info] %v %v %v", method, url, resp.StatusCode)
-	cb(resp)
+// RequestWithContext works like Request but aborts the request as soon as ctx is done. It uses DefaultClient, so
+// the request is subject to its timeout, retries and circuit breaker.
+func RequestWithContext(ctx context.Context, method, url string, body []byte, cb func(*http.Response)) error {
+	return DefaultClient.Do(ctx, method, url, body, cb)
+}
 
-	//return
-	return nil
+// RequestWithHeader works like RequestWithContext and adds header to the request.
+func RequestWithHeader(ctx context.Context, method, url string, header http.Header, body []byte, cb func(*http.Response)) error {
+	return DefaultClient.DoWithHeader(ctx, method, url, header, body, cb)
 }
@@ -1,6 +1,7 @@
 package util
 
 import (
+	"context"
 	"net/http"
 	"net/http/httptest"
 	"testing"
@@ -87,3 +88,22 @@ func TestBadURLRequest(t *testing.T) {
 		t.Errorf("Expected %v but got %v", expectedCb, isCallbackCalled)
 	}
 }
+
+func TestRequestForwardsRequestID(t *testing.T) {
+	forwarded := ""
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded = r.Header.Get(RequestIDHeader)
+	}))
+	defer ts.Close()
+
+	ctx := WithRequestID(context.Background(), "abc-123")
+	err := RequestWithContext(ctx, "GET", ts.URL, nil, func(res *http.Response) {})
+	if err != nil {
+		t.Errorf("Expected no error, instead got %v", err.Error())
+	}
+
+	expected := "abc-123"
+	if forwarded != expected {
+		t.Errorf("Expected %v but got %v", expected, forwarded)
+	}
+}
@@ -0,0 +1,51 @@
+package util
+
+import (
+	"context"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// RequestIDHeader is the header which carries the correlation ID of a request between the services and back to
+// the client.
+const RequestIDHeader = "X-Request-ID"
+
+type requestIDKey struct{}
+
+// WithRequestID returns a copy of ctx which carries id.
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// RequestIDFromContext returns the request ID stored in ctx, or an empty string when there is none.
+func RequestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+type callingServiceKey struct{}
+
+// WithCallingService returns a copy of ctx which carries the name of the service which made the (IPC) request.
+func WithCallingService(ctx context.Context, service string) context.Context {
+	return context.WithValue(ctx, callingServiceKey{}, service)
+}
+
+// CallingServiceFromContext returns the name of the service stored in ctx, or an empty string when the request
+// was not made by another service.
+func CallingServiceFromContext(ctx context.Context) string {
+	service, _ := ctx.Value(callingServiceKey{}).(string)
+	return service
+}
+
+// Log returns a logrus entry which is tagged with the request ID and the calling service in ctx. Use it for every
+// log line written while handling a request, so the lines of all services involved can be tied together.
+func Log(ctx context.Context) *logrus.Entry {
+	entry := logrus.NewEntry(logrus.StandardLogger())
+	if id := RequestIDFromContext(ctx); id != "" {
+		entry = entry.WithField("request_id", id)
+	}
+	if service := CallingServiceFromContext(ctx); service != "" {
+		entry = entry.WithField("caller", service)
+	}
+	return entry
+}
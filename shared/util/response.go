@@ -2,11 +2,11 @@ package util
 
 import (
 	"encoding/json"
-	"net/http"
-	"runtime/debug"
-
 	"errors"
+	"net/http"
 
+	"github.com/Sirupsen/logrus"
+	"github.com/bstaijen/mariadb-for-microservices/shared/apierror"
 	"github.com/bstaijen/mariadb-for-microservices/shared/models"
 )
 
@@ -27,25 +27,48 @@ func SendOK(w http.ResponseWriter, data interface{}) {
 	}
 }
 
-// SendErrorMessage send a http response an error message
+// ProblemContentType is the content type of error responses.
+const ProblemContentType = "application/problem+json"
+
+// SendErrorMessage sends a 400 Bad Request problem with message as detail.
 func SendErrorMessage(w http.ResponseWriter, message string) {
-	SendError(w, errors.New(message))
+	SendError(w, apierror.New(apierror.InvalidArgument, message))
 }
 
-// SendError send a http response with status code 400 with the error parameter as error message.
+// SendError sends err as an RFC 7807 problem. The status code follows from the code of the error, see
+// apierror.From. Server errors are logged together with their cause, the client only gets the message. The problem
+// includes the request ID when the RequestID middleware has set it on the response.
 func SendError(w http.ResponseWriter, err error) {
-	debug.PrintStack()
-	SendBadRequest(w, err)
+	e := apierror.From(err)
+	status := e.Status()
+	requestID := w.Header().Get(RequestIDHeader)
+	if status >= http.StatusInternalServerError {
+		logrus.WithField("request_id", requestID).WithError(err).Error("Request failed")
+	}
+
+	problem := &models.Problem{
+		Type:      "about:blank",
+		Title:     http.StatusText(status),
+		Status:    status,
+		Detail:    e.Message,
+		Code:      string(e.Code),
+		RequestID: requestID,
+	}
+	data, _ := json.Marshal(problem)
+
+	w.Header().Set("Content-Type", ProblemContentType)
+	w.WriteHeader(status)
+	w.Write(data)
 }
 
-// SendBadRequest writes a Bad Request to the ResponseWrite
+// SendBadRequest sends err as a 400 Bad Request problem with the message of err as detail. Errors which carry a
+// code of their own are sent with the status of that code.
 func SendBadRequest(w http.ResponseWriter, err error) {
-	e := &models.Error{Message: err.Error()}
-	var errJSON, _ = json.Marshal(e)
-
-	w.WriteHeader(http.StatusBadRequest)
-	w.Header().Set("Content-Type", "application/json")
-	w.Write([]byte(string(errJSON)))
+	var e *apierror.Error
+	if !errors.As(err, &e) {
+		err = apierror.New(apierror.InvalidArgument, err.Error())
+	}
+	SendError(w, err)
 }
 
 // SendImage send a http response with a write a image to the client
@@ -1,11 +1,17 @@
 package util
 
 import (
+	"database/sql/driver"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"testing"
+
+	"github.com/bstaijen/mariadb-for-microservices/shared/apierror"
+	"github.com/bstaijen/mariadb-for-microservices/shared/models"
 )
 
 func TestSendOK(t *testing.T) {
@@ -78,8 +84,8 @@ func TestSendBadRequest(t *testing.T) {
 		}
 		defer res.Body.Close()
 
-		//
-		expected := "{\"message\":\"Nope\"}"
+		// Make sure response is as expected
+		expected := "{\"type\":\"about:blank\",\"title\":\"Bad Request\",\"status\":400,\"detail\":\"Nope\",\"code\":\"invalid_argument\"}"
 		actual := string(data)
 		if expected != actual {
 			t.Errorf("Expected %v but got %v", expected, actual)
@@ -124,7 +130,7 @@ func TestSendErrorMessage(t *testing.T) {
 		defer res.Body.Close()
 
 		// Make sure response is as expected
-		expected := "{\"message\":\"A Error\"}"
+		expected := "{\"type\":\"about:blank\",\"title\":\"Bad Request\",\"status\":400,\"detail\":\"A Error\",\"code\":\"invalid_argument\"}"
 		actual := string(data)
 		if expected != actual {
 			t.Errorf("Expected %v but got %v", expected, actual)
@@ -202,3 +208,48 @@ func TestSendImage(t *testing.T) {
 		t.Errorf("Expected %v but got %v", expectedCb, isCallbackCalled)
 	}
 }
+
+func TestSendBadRequestWithRequestID(t *testing.T) {
+	res := httptest.NewRecorder()
+	res.Header().Set(RequestIDHeader, "abc-123")
+
+	SendBadRequest(res, errors.New("Nope"))
+
+	expected := "{\"type\":\"about:blank\",\"title\":\"Bad Request\",\"status\":400,\"detail\":\"Nope\",\"code\":\"invalid_argument\",\"request_id\":\"abc-123\"}"
+	actual := res.Body.String()
+	if expected != actual {
+		t.Errorf("Expected %v but got %v", expected, actual)
+	}
+}
+
+func TestSendErrorStatus(t *testing.T) {
+	tests := []struct {
+		err    error
+		status int
+		detail string
+	}{
+		{apierror.New(apierror.NotFound, "User does not exist"), 404, "User does not exist"},
+		{apierror.New(apierror.Conflict, "Email must be unique"), 409, "Email must be unique"},
+		{fmt.Errorf("query failed: %w", driver.ErrBadConn), 503, "Service is temporarily unavailable"},
+		{errors.New("secret internals"), 500, "Internal server error"},
+	}
+
+	for _, test := range tests {
+		res := httptest.NewRecorder()
+		SendError(res, test.err)
+
+		if res.Code != test.status {
+			t.Errorf("Expected %v but got %v", test.status, res.Code)
+		}
+		if actual := res.Header().Get("Content-Type"); actual != ProblemContentType {
+			t.Errorf("Expected %v but got %v", ProblemContentType, actual)
+		}
+		problem := &models.Problem{}
+		if err := json.Unmarshal(res.Body.Bytes(), problem); err != nil {
+			t.Fatal(err)
+		}
+		if problem.Status != test.status || problem.Detail != test.detail {
+			t.Errorf("Expected %v %v but got %v %v", test.status, test.detail, problem.Status, problem.Detail)
+		}
+	}
+}
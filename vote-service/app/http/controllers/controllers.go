@@ -1,131 +1,102 @@
 package controllers
 
 import (
+	"context"
 	"database/sql"
-	"encoding/json"
-	"io/ioutil"
-	"log"
 	"net/http"
-	"strings"
 
-	"github.com/Sirupsen/logrus"
 	"github.com/bstaijen/mariadb-for-microservices/vote-service/config"
 	"github.com/bstaijen/mariadb-for-microservices/vote-service/database"
-	jwt "github.com/dgrijalva/jwt-go"
 	"github.com/urfave/negroni"
 
 	"fmt"
 
+	"github.com/bstaijen/mariadb-for-microservices/shared/apierror"
 	"github.com/bstaijen/mariadb-for-microservices/shared/helper"
+	"github.com/bstaijen/mariadb-for-microservices/shared/ipc"
 	sharedModels "github.com/bstaijen/mariadb-for-microservices/shared/models"
 	"github.com/bstaijen/mariadb-for-microservices/shared/util"
+	"github.com/bstaijen/mariadb-for-microservices/shared/util/middleware"
 )
 
 // CreateHandler handler for creating a vote and storing it in the database.
 func CreateHandler(connection *sql.DB, cnf config.Config) negroni.HandlerFunc {
 	return negroni.HandlerFunc(func(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
 
-		// Get the tokenstring from the request
-		var queryToken = r.URL.Query().Get("token")
-		if len(queryToken) < 1 {
-			queryToken = r.Header.Get("token")
-		}
-		if len(queryToken) < 1 {
-			util.SendErrorMessage(w, "token is mandatory")
-			return
-		}
-
-		// Parse the tokenstring to a Token object through the jwt parser
-		secretKey := cnf.SecretKey
-		tok, err := jwt.Parse(queryToken, func(t *jwt.Token) (interface{}, error) {
-			return []byte(secretKey), nil
-		})
-
-		if err != nil {
-			util.SendErrorMessage(w, "You are not authorized")
+		// Get the user from the request context
+		user, ok := middleware.UserFromContext(r.Context())
+		if !ok {
+			util.SendError(w, middleware.ErrTokenMandatory)
 			return
 		}
 
-		// Get the user from the token object
-		claims := tok.Claims.(jwt.MapClaims)
-		var ID = claims["sub"].(float64) // gets the ID
-
 		// STEP 1 : parse body
 		voteCreateObject := &sharedModels.VoteCreateRequest{}
-		err = util.RequestToJSON(r, voteCreateObject)
+		err := util.RequestToJSON(r, voteCreateObject)
 		if err != nil {
 			util.SendErrorMessage(w, "bad json")
 			return
 		}
-		voteCreateObject.UserID = int(ID)
+		voteCreateObject.UserID = user.ID
 		if voteCreateObject.Upvote == voteCreateObject.Downvote {
-			util.SendErrorMessage(w, "can not vote for none or both")
+			util.SendError(w, apierror.New(apierror.ValidationFailed, "can not vote for none or both"))
 			return
 		}
 
 		if voteCreateObject.UserID > 0 && voteCreateObject.PhotoID > 0 && (voteCreateObject.Upvote || voteCreateObject.Downvote) {
 			// 2.save in database
-			err := db.Create(connection, voteCreateObject)
+			err := db.Create(r.Context(), connection, voteCreateObject)
 			if err != nil {
-				util.SendBadRequest(w, err)
+				util.SendError(w, err)
 				return
 			}
 
 			// 3.send result to frontend
 			util.SendOKMessage(w, "You voted")
 		} else {
-			util.SendErrorMessage(w, "UserID or PhotoID are invalid")
+			util.SendError(w, apierror.New(apierror.ValidationFailed, "UserID or PhotoID are invalid"))
 		}
 
 	})
 }
 
-func GetVotesFromAUser(connection *sql.DB, cnf config.Config) negroni.HandlerFunc {
+// GetVotesFromAUser is the handler which lists the photos the user has voted on.
+func GetVotesFromAUser(connection *sql.DB, cnf config.Config, clients *ipc.Clients) negroni.HandlerFunc {
 	return negroni.HandlerFunc(func(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
-		var queryToken = r.URL.Query().Get("token")
-
-		if len(queryToken) < 1 {
-			queryToken = r.Header.Get("token")
-		}
-
-		if len(queryToken) < 1 {
-			util.SendErrorMessage(w, "Token is mandatory")
+		user, ok := middleware.UserFromContext(r.Context())
+		if !ok {
+			util.SendError(w, middleware.ErrTokenMandatory)
 			return
 		}
 
-		secretKey := cnf.SecretKey
-		tok, err := jwt.Parse(queryToken, func(t *jwt.Token) (interface{}, error) {
-			return []byte(secretKey), nil
-		})
+		// get offset and rows
+		offset, rows := helper.PaginationFromRequest(r)
 
+		votes, err := db.GetVotesFromUser(r.Context(), connection, user.ID, offset, rows)
 		if err != nil {
-			util.SendErrorMessage(w, "You are not authorized")
+			util.SendError(w, err)
 			return
 		}
 
-		claims := tok.Claims.(jwt.MapClaims)
-		var ID = claims["sub"].(float64) // gets the UserID
-
-		// get offset and rows
-		offset, rows := helper.PaginationFromRequest(r)
-
-		photoIDs, err := db.GetVotesFromUser(connection, int(ID), offset, rows)
+		photoIDs := make([]int, 0, len(votes))
+		for _, v := range votes {
+			photoIDs = append(photoIDs, v.PhotoID)
+		}
+		photos, err := clients.Photo.Photos(r.Context(), photoIDs)
 		if err != nil {
 			util.SendError(w, err)
 			return
 		}
 
-		photos := getPhotos(cnf, photoIDs)
-
 		t := make([]*sharedModels.HasVotedRequest, 0)
 		g := make([]*sharedModels.VoteCountRequest, 0)
 		for _, v := range photos {
 
-			fmt.Printf("PhotoID %v, UserID %v \n", v.ID, ID)
+			fmt.Printf("PhotoID %v, UserID %v \n", v.ID, user.ID)
 
 			t = append(t, &sharedModels.HasVotedRequest{
 				PhotoID: v.ID,
-				UserID:  int(ID),
+				UserID:  user.ID,
 			})
 			g = append(g, &sharedModels.VoteCountRequest{
 				PhotoID: v.ID,
@@ -133,8 +104,8 @@ func GetVotesFromAUser(connection *sql.DB, cnf config.Config) negroni.HandlerFun
 		}
 
 		// Get youVoted
-		photos = appendUserVoted(connection, cnf, t, photos)
-		photos = appendVotesCount(connection, cnf, g, photos)
+		photos = appendUserVoted(r.Context(), connection, cnf, t, photos)
+		photos = appendVotesCount(r.Context(), connection, cnf, g, photos)
 
 		type Resp struct {
 			Result []*sharedModels.PhotoResponse `json:"result"`
@@ -143,61 +114,13 @@ func GetVotesFromAUser(connection *sql.DB, cnf config.Config) negroni.HandlerFun
 	})
 }
 
-func HealthHandler(connection *sql.DB, cnf config.Config) negroni.HandlerFunc {
-	return negroni.HandlerFunc(func(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
-
-		log.Println("Health Handler called")
-
-		util.SendOKMessage(w, "I am healthy")
-
-	})
-}
-
-func getPhotos(cnf config.Config, input []*sharedModels.TopRatedPhotoResponse) []*sharedModels.PhotoResponse {
-	type Req struct {
-		Requests []*sharedModels.TopRatedPhotoResponse `json:"requests"`
-	}
-	body, _ := json.Marshal(&Req{Requests: input})
-
-	// Make url
-	url := cnf.PhotoServiceBaseurl + "ipc/getPhotos"
-
-	photos := make([]*sharedModels.PhotoResponse, 0)
-	if strings.HasPrefix(url, "http") {
-		err := util.Request("GET", url, body, func(res *http.Response) {
-			// Error handling
-			if res.StatusCode < 200 || res.StatusCode > 299 {
-				printResponseError(res)
-				return
-			}
-
-			// Happy path
-			type Collection struct {
-				Objects []*sharedModels.PhotoResponse `json:"results"`
-			}
-			col := &Collection{}
-			col.Objects = make([]*sharedModels.PhotoResponse, 0)
-			err := util.ResponseJSONToObject(res, &col)
-			if err != nil {
-				log.Fatal(err)
-			}
-			photos = col.Objects
-		})
-		if err != nil {
-			logrus.Fatal(err)
-		}
-	} else {
-		logrus.Errorf("Wrong URL. Expected something which starts with http, instead got %v.", url)
-	}
-	return photos
-}
-
 // appendVotesCount triggers `GET votes request` and appends result to []Photo
-func appendVotesCount(connection *sql.DB, cnf config.Config, photoCountIdentifiers []*sharedModels.VoteCountRequest, photos []*sharedModels.PhotoResponse) []*sharedModels.PhotoResponse {
+func appendVotesCount(ctx context.Context, connection *sql.DB, cnf config.Config, photoCountIdentifiers []*sharedModels.VoteCountRequest, photos []*sharedModels.PhotoResponse) []*sharedModels.PhotoResponse {
 	// Get the vote counts and add them
-	results, err := db.VoteCount(connection, photoCountIdentifiers)
+	results, err := db.VoteCount(ctx, connection, photoCountIdentifiers)
 	if err != nil {
-		logrus.Fatal(err)
+		util.Log(ctx).Warn(err)
+		return photos
 	}
 	for index := 0; index < len(photos); index++ {
 		photoObject := photos[index]
@@ -215,10 +138,11 @@ func appendVotesCount(connection *sql.DB, cnf config.Config, photoCountIdentifie
 
 // appendUserVoted triggers `GET voted request` and appends results to []Photo. This function will
 // lookup whether the user has voted on the Photo
-func appendUserVoted(connection *sql.DB, cnf config.Config, photoVotedIdentifiers []*sharedModels.HasVotedRequest, photos []*sharedModels.PhotoResponse) []*sharedModels.PhotoResponse {
-	youVoted, err := db.HasVoted(connection, photoVotedIdentifiers)
+func appendUserVoted(ctx context.Context, connection *sql.DB, cnf config.Config, photoVotedIdentifiers []*sharedModels.HasVotedRequest, photos []*sharedModels.PhotoResponse) []*sharedModels.PhotoResponse {
+	youVoted, err := db.HasVoted(ctx, connection, photoVotedIdentifiers)
 	if err != nil {
-		logrus.Fatal(err)
+		util.Log(ctx).Warn(err)
+		return photos
 	}
 	for index := 0; index < len(photos); index++ {
 		photoObject := photos[index]
@@ -233,9 +157,3 @@ func appendUserVoted(connection *sql.DB, cnf config.Config, photoVotedIdentifier
 	}
 	return photos
 }
-
-func printResponseError(res *http.Response) {
-	logrus.Errorf("Response error with statuscode %v.", res.Status)
-	data, _ := ioutil.ReadAll(res.Body)
-	logrus.Error(string(data))
-}
@@ -2,13 +2,13 @@ package controllers
 
 import (
 	"database/sql"
-	"log"
 	"net/http"
 
 	"github.com/bstaijen/mariadb-for-microservices/vote-service/database"
 	"github.com/urfave/negroni"
 
 	"github.com/bstaijen/mariadb-for-microservices/shared/helper"
+	"github.com/bstaijen/mariadb-for-microservices/shared/ipc"
 	sharedModels "github.com/bstaijen/mariadb-for-microservices/shared/models"
 	"github.com/bstaijen/mariadb-for-microservices/shared/util"
 )
@@ -20,16 +20,13 @@ func GetTopRatedHandler(connection *sql.DB) negroni.HandlerFunc {
 		// get offset and rows
 		offset, rows := helper.PaginationFromRequest(r)
 
-		topRated, err := db.GetTopRatedTimeline(connection, offset, rows)
+		topRated, err := db.GetTopRatedTimeline(r.Context(), connection, offset, rows)
 		if err != nil {
 			util.SendError(w, err)
 			return
 		}
 
-		type Resp struct {
-			Results []*sharedModels.TopRatedPhotoResponse `json:"results"`
-		}
-		util.SendOK(w, &Resp{Results: topRated})
+		ipc.SendResults(w, topRated)
 	})
 }
 
@@ -40,16 +37,13 @@ func GetHotHandler(connection *sql.DB) negroni.HandlerFunc {
 		// get offset and rows
 		offset, rows := helper.PaginationFromRequest(r)
 
-		hot, err := db.GetHotTimeline(connection, offset, rows)
+		hot, err := db.GetHotTimeline(r.Context(), connection, offset, rows)
 		if err != nil {
 			util.SendError(w, err)
 			return
 		}
 
-		type Resp struct {
-			Results []*sharedModels.TopRatedPhotoResponse `json:"results"`
-		}
-		util.SendOK(w, &Resp{Results: hot})
+		ipc.SendResults(w, hot)
 	})
 }
 
@@ -57,53 +51,39 @@ func GetHotHandler(connection *sql.DB) negroni.HandlerFunc {
 func HasVotedHandler(connection *sql.DB) negroni.HandlerFunc {
 	return negroni.HandlerFunc(func(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
 
-		type Collection struct {
-			Objects []*sharedModels.HasVotedRequest `json:"requests"`
-		}
-		col := &Collection{}
-		col.Objects = make([]*sharedModels.HasVotedRequest, 0)
-
-		err := util.RequestToJSON(r, &col)
+		requests := make([]*sharedModels.HasVotedRequest, 0)
+		err := ipc.ReadRequests(r, &requests)
 		if err != nil {
-			log.Fatal(err)
+			util.SendBadRequest(w, err)
+			return
 		}
 
-		counts, err := db.HasVoted(connection, col.Objects)
+		counts, err := db.HasVoted(r.Context(), connection, requests)
 		if err != nil {
 			util.SendError(w, err)
 			return
 		}
 
-		type Resp struct {
-			Results []*sharedModels.HasVotedResponse `json:"results"`
-		}
-		util.SendOK(w, &Resp{Results: counts})
+		ipc.SendResults(w, counts)
 	})
 }
 
 // GetVoteCountHandler is the handler for calculating the number of votes on a photo
 func GetVoteCountHandler(connection *sql.DB) negroni.HandlerFunc {
 	return negroni.HandlerFunc(func(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
-		type Collection struct {
-			Objects []*sharedModels.VoteCountRequest `json:"requests"`
-		}
-		col := &Collection{}
-		col.Objects = make([]*sharedModels.VoteCountRequest, 0)
-
-		err := util.RequestToJSON(r, &col)
+		requests := make([]*sharedModels.VoteCountRequest, 0)
+		err := ipc.ReadRequests(r, &requests)
 		if err != nil {
-			log.Fatal(err)
+			util.SendBadRequest(w, err)
+			return
 		}
 
-		counts, err := db.VoteCount(connection, col.Objects)
+		counts, err := db.VoteCount(r.Context(), connection, requests)
 		if err != nil {
 			util.SendError(w, err)
 			return
 		}
 
-		type Resp struct {
-			Results []*sharedModels.VoteCountResponse `json:"results"`
-		}
-		util.SendOK(w, &Resp{Results: counts})
+		ipc.SendResults(w, counts)
 	})
 }
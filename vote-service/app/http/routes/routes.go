@@ -2,66 +2,100 @@ package routes
 
 import (
 	"database/sql"
+	"time"
 
 	"github.com/bstaijen/mariadb-for-microservices/vote-service/app/http/controllers"
 	"github.com/bstaijen/mariadb-for-microservices/vote-service/config"
 
+	"github.com/bstaijen/mariadb-for-microservices/shared/health"
+	"github.com/bstaijen/mariadb-for-microservices/shared/ipc"
+	"github.com/bstaijen/mariadb-for-microservices/shared/jwks"
+	"github.com/bstaijen/mariadb-for-microservices/shared/ratelimit"
+	"github.com/bstaijen/mariadb-for-microservices/shared/util"
 	"github.com/bstaijen/mariadb-for-microservices/shared/util/middleware"
 	"github.com/gorilla/mux"
 	"github.com/urfave/negroni"
 )
 
-// InitRoutes initializes the REST and IPC routes for this service.
-func InitRoutes(db *sql.DB, cnf config.Config) *mux.Router {
+// votePolicy limits the votes a user can cast.
+var votePolicy = ratelimit.Policy{Name: "vote", Limit: 60, Period: time.Minute}
+
+// InitRoutes initializes the REST and IPC routes for this service. IPCKeys sign and verify the IPC calls.
+func InitRoutes(db *sql.DB, cnf config.Config, ipcKeys *ipc.Keys) *mux.Router {
+	identity := ipcKeys.Identity
+	clients := &ipc.Clients{
+		Photo: ipc.NewPhotoClient(cnf.PhotoServiceBaseurl, identity),
+	}
+	revocations := ipc.NewRevocations(cnf.AuthenticationServiceBaseurl, identity, middleware.DefaultRevocationTTL)
+	accessTokens := ipc.NewAccessTokens(cnf.AuthenticationServiceBaseurl, identity, middleware.DefaultRevocationTTL)
+	keys := jwks.NewRemote(cnf.AuthenticationServiceBaseurl, 0)
+
 	router := mux.NewRouter()
-	router = setRESTRoutes(db, cnf, router)
-	router = setIPCRoutes(db, cnf, router)
+	router = setHealthRoutes(db, cnf, router)
+	router = setRESTRoutes(db, cnf, clients, keys, revocations, accessTokens, router)
+	router = setIPCRoutes(db, cnf, ipcKeys.Callers, router)
 	return router
 }
 
-func setRESTRoutes(db *sql.DB, cnf config.Config, router *mux.Router) *mux.Router {
-	health := router.PathPrefix("/health").Subrouter()
-	health.Methods("OPTIONS").Handler(negroni.New(
-		negroni.HandlerFunc(middleware.AcceptOPTIONS),
-	))
-	health.Methods("GET").Handler(negroni.New(
-		negroni.HandlerFunc(middleware.AccessControlHandler),
-		controllers.HealthHandler(db, cnf),
-	))
+func setRESTRoutes(db *sql.DB, cnf config.Config, clients *ipc.Clients, keys jwks.KeySet, revocations middleware.Revocations, accessTokens middleware.AccessTokens, router *mux.Router) *mux.Router {
+	limiter := ratelimit.NewMemoryStore()
 
 	votes := router.PathPrefix("/votes").Subrouter()
-	votes.Methods("OPTIONS").Handler(negroni.New(
-		negroni.HandlerFunc(middleware.AcceptOPTIONS),
-	))
 	votes.Methods("POST").Handler(negroni.New(
-		negroni.HandlerFunc(middleware.AccessControlHandler),
+		middleware.RequireScopedTokenAuthenticationHandler(keys, revocations, accessTokens, middleware.ScopeVotesWrite),
+		middleware.RequireVerifiedEmail(cnf.RequireVerifiedEmail),
+		ratelimit.Middleware(limiter, votePolicy),
 		controllers.CreateHandler(db, cnf),
 	))
 	votes.Methods("GET").Handler(negroni.New(
-		negroni.HandlerFunc(middleware.AccessControlHandler),
-		controllers.GetVotesFromAUser(db, cnf),
+		middleware.RequireScopedTokenAuthenticationHandler(keys, revocations, accessTokens, middleware.ScopeVotesRead),
+		controllers.GetVotesFromAUser(db, cnf, clients),
 	))
 	return router
 }
 
 // Inter-Process Communication routes
-func setIPCRoutes(db *sql.DB, cnf config.Config, router *mux.Router) *mux.Router {
-	ipc := router.PathPrefix("/ipc").Subrouter()
-	ipc.Handle("/toprated", negroni.New(
-		negroni.HandlerFunc(middleware.AccessControlHandler),
+func setIPCRoutes(db *sql.DB, cnf config.Config, callers middleware.ServiceKeys, router *mux.Router) *mux.Router {
+	ipcRouter := router.PathPrefix("/ipc").Subrouter()
+	ipcRouter.Handle("/toprated", negroni.New(
+		middleware.RequireServiceAuthenticationHandler(callers, ipc.VoteService, ipc.PhotoService),
 		controllers.GetTopRatedHandler(db),
 	)).Methods("GET")
-	ipc.Handle("/hot", negroni.New(
-		negroni.HandlerFunc(middleware.AccessControlHandler),
+	ipcRouter.Handle("/hot", negroni.New(
+		middleware.RequireServiceAuthenticationHandler(callers, ipc.VoteService, ipc.PhotoService),
 		controllers.GetHotHandler(db),
 	)).Methods("GET")
-	ipc.Handle("/count", negroni.New(
-		negroni.HandlerFunc(middleware.AccessControlHandler),
+	ipcRouter.Handle("/count", negroni.New(
+		middleware.RequireServiceAuthenticationHandler(callers, ipc.VoteService, ipc.PhotoService, ipc.CommentService),
 		controllers.GetVoteCountHandler(db),
 	))
-	ipc.Handle("/voted", negroni.New(
-		negroni.HandlerFunc(middleware.AccessControlHandler),
+	ipcRouter.Handle("/voted", negroni.New(
+		middleware.RequireServiceAuthenticationHandler(callers, ipc.VoteService, ipc.PhotoService, ipc.CommentService),
 		controllers.HasVotedHandler(db),
 	))
+
+	// State of the circuit breakers of the outgoing IPC calls
+	ipcRouter.Handle("/breakers", negroni.New(
+		middleware.RequireServiceAuthenticationHandler(callers, ipc.VoteService, ipc.Services...),
+		negroni.HandlerFunc(util.BreakersHandler),
+	)).Methods("GET")
+
+	return router
+}
+
+// setHealthRoutes specifies the liveness and readiness routes
+func setHealthRoutes(db *sql.DB, cnf config.Config, router *mux.Router) *mux.Router {
+	router.Handle("/healthz", negroni.New(
+		negroni.HandlerFunc(health.Liveness),
+	)).Methods("GET")
+
+	router.Handle("/readyz", negroni.New(
+		health.Readiness(health.DefaultTimeout,
+			health.Database(db),
+			health.Service(ipc.AuthenticationService, cnf.AuthenticationServiceBaseurl),
+			health.Service(ipc.PhotoService, cnf.PhotoServiceBaseurl),
+		),
+	)).Methods("GET")
+
 	return router
 }
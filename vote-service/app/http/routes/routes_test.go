@@ -6,34 +6,78 @@ import (
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 
 	sqlmock "gopkg.in/DATA-DOG/go-sqlmock.v1"
 
+	"github.com/bstaijen/mariadb-for-microservices/shared/jwks"
 	"github.com/bstaijen/mariadb-for-microservices/vote-service/config"
 	jwt "github.com/dgrijalva/jwt-go"
 
+	"github.com/bstaijen/mariadb-for-microservices/shared/ipc"
 	sharedModels "github.com/bstaijen/mariadb-for-microservices/shared/models"
+	"github.com/bstaijen/mariadb-for-microservices/shared/util"
+	"github.com/bstaijen/mariadb-for-microservices/shared/util/middleware"
+	"github.com/urfave/negroni"
 )
 
 func TestOPTIONSVotes(t *testing.T) {
-	// Router
-	r := InitRoutes(nil, config.Config{})
+	// Router behind the CORS middleware, like in main
+	n := negroni.New(middleware.CORS(middleware.CORSOptions{}))
+	n.UseHandler(InitRoutes(nil, config.Config{}, ipc.FakeKeys(ipc.VoteService)))
 	res := httptest.NewRecorder()
 
-	// Do Request
+	// Do preflight request
 	req, err := http.NewRequest(http.MethodOptions, "/votes", nil)
 	if err != nil {
 		t.Fatal(err)
 	}
-	r.ServeHTTP(res, req)
+	req.Header.Set("Origin", "http://localhost:4000")
+	req.Header.Set("Access-Control-Request-Method", http.MethodPost)
+	req.Header.Set("Access-Control-Request-Headers", "token")
+	n.ServeHTTP(res, req)
 
 	// Make sure response statuscode expectation is met
-	if res.Result().StatusCode != 200 {
-		t.Errorf("Expected statuscode to be 200 but got %v", res.Result().StatusCode)
-	} else {
-		t.Logf("Result statuscode %v. (As expected)", res.Result().StatusCode)
+	if res.Result().StatusCode != http.StatusNoContent {
+		t.Errorf("Expected statuscode to be 204 but got %v", res.Result().StatusCode)
+	}
+	if !strings.Contains(res.Header().Get("Access-Control-Allow-Methods"), http.MethodPost) {
+		t.Errorf("Expected %v to be allowed but got %v", http.MethodPost, res.Header().Get("Access-Control-Allow-Methods"))
+	}
+	if !strings.Contains(res.Header().Get("Access-Control-Allow-Headers"), "token") {
+		t.Errorf("Expected the token header to be allowed but got %v", res.Header().Get("Access-Control-Allow-Headers"))
+	}
+}
+
+// Test if the liveness and readiness routes are registered and check the photo service.
+func TestHealthRoutes(t *testing.T) {
+	db, _, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	photoService := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer photoService.Close()
+
+	cnf := config.Config{}
+	cnf.PhotoServiceBaseurl = photoService.URL + "/"
+
+	res := doRequest(db, cnf, http.MethodGet, "/healthz", bytes.NewBuffer([]byte("")), t)
+	if res.Result().StatusCode != http.StatusOK {
+		t.Errorf("Expected %v but got %v", http.StatusOK, res.Result().StatusCode)
+	}
+
+	res = doRequest(db, cnf, http.MethodGet, "/readyz", bytes.NewBuffer([]byte("")), t)
+	if res.Result().StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("Expected %v but got %v", http.StatusServiceUnavailable, res.Result().StatusCode)
+	}
+	if !strings.Contains(res.Body.String(), `"photo-service":{"status":"unavailable"`) {
+		t.Errorf("Expected the photo service to be unavailable but got %v", res.Body.String())
 	}
 }
 
@@ -52,9 +96,12 @@ func TestPOSTVotes(t *testing.T) {
 
 	// Mock config
 	cnf := config.Config{}
+	auth := authServer()
+	defer auth.Close()
+	cnf.AuthenticationServiceBaseurl = auth.URL
 
 	// Get token string
-	tokenString := getTokenString(cnf, vote.UserID, t)
+	tokenString := getTokenString(vote.UserID, t)
 
 	json, _ := json.Marshal(vote)
 	res := doRequest(db, cnf, http.MethodPost, "/votes?token="+tokenString, bytes.NewBuffer(json), t)
@@ -74,6 +121,77 @@ func TestPOSTVotes(t *testing.T) {
 	}
 }
 
+// Test if an unverified user can not vote when verification is required.
+func TestPOSTVotesUnverified(t *testing.T) {
+	vote := getTestVote()
+
+	// Mock database
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	// Mock config
+	cnf := config.Config{}
+	cnf.RequireVerifiedEmail = true
+	auth := authServer()
+	defer auth.Close()
+	cnf.AuthenticationServiceBaseurl = auth.URL
+
+	tokenString := getTokenString(vote.UserID, t)
+	json, _ := json.Marshal(vote)
+	res := doRequest(db, cnf, http.MethodPost, "/votes?token="+tokenString, bytes.NewBuffer(json), t)
+
+	// Nothing may be stored
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+	if res.Result().StatusCode != http.StatusForbidden {
+		t.Errorf("Expected %v but got %v", http.StatusForbidden, res.Result().StatusCode)
+	}
+}
+
+// Test if a personal access token can vote with the scope votes:write only.
+func TestPOSTVotesWithAccessToken(t *testing.T) {
+	vote := getTestVote()
+
+	cases := map[string]int{
+		middleware.AccessTokenPrefix + "write":   http.StatusOK,
+		middleware.AccessTokenPrefix + "read":    http.StatusForbidden,
+		middleware.AccessTokenPrefix + "unknown": http.StatusUnauthorized,
+	}
+	for token, expected := range cases {
+		// Mock database
+		db, mock, err := sqlmock.New()
+		if err != nil {
+			t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+		}
+
+		if expected == http.StatusOK {
+			mock.ExpectExec("DELETE FROM votes WHERE").WithArgs(vote.UserID, vote.PhotoID).WillReturnResult(sqlmock.NewResult(0, 1))
+			mock.ExpectExec("INSERT INTO votes").WithArgs(vote.UserID, vote.PhotoID, vote.Upvote, vote.Downvote).WillReturnResult(sqlmock.NewResult(1, 1))
+		}
+
+		// Mock config
+		cnf := config.Config{}
+		auth := authServer()
+		cnf.AuthenticationServiceBaseurl = auth.URL
+
+		json, _ := json.Marshal(vote)
+		res := doRequest(db, cnf, http.MethodPost, "/votes?token="+token, bytes.NewBuffer(json), t)
+
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("there were unfulfilled expectations: %s", err)
+		}
+		if res.Result().StatusCode != expected {
+			t.Errorf("Expected %v but got %v for %v", expected, res.Result().StatusCode, token)
+		}
+		auth.Close()
+		db.Close()
+	}
+}
+
 func TestIPCGetTopRated(t *testing.T) {
 
 	// Mock database
@@ -90,7 +208,7 @@ func TestIPCGetTopRated(t *testing.T) {
 	// Mock config
 	cnf := config.Config{}
 
-	res := doRequest(db, cnf, http.MethodGet, "/ipc/toprated", bytes.NewBuffer([]byte("")), t)
+	res := doIPCRequest(db, cnf, ipc.PhotoService, http.MethodGet, "/ipc/toprated", bytes.NewBuffer([]byte("")), t)
 
 	// Make sure expectations are met
 	if err := mock.ExpectationsWereMet(); err != nil {
@@ -121,7 +239,7 @@ func TestIPCGetHot(t *testing.T) {
 	// Mock config
 	cnf := config.Config{}
 
-	res := doRequest(db, cnf, http.MethodGet, "/ipc/hot", bytes.NewBuffer([]byte("")), t)
+	res := doIPCRequest(db, cnf, ipc.PhotoService, http.MethodGet, "/ipc/hot", bytes.NewBuffer([]byte("")), t)
 
 	// Make sure expectations are met
 	if err := mock.ExpectationsWereMet(); err != nil {
@@ -153,7 +271,7 @@ func TestIPCGetCount(t *testing.T) {
 
 	body := []byte(`{ "requests":[{"photo_id":1} ,{"photo_id":2},{"photo_id":3}, {"photo_id":4} ]}`)
 
-	res := doRequest(db, cnf, http.MethodGet, "/ipc/count", bytes.NewBuffer(body), t)
+	res := doIPCRequest(db, cnf, ipc.CommentService, http.MethodGet, "/ipc/count", bytes.NewBuffer(body), t)
 
 	t.Log(res.Body.String())
 
@@ -187,7 +305,7 @@ func TestIPCGetVoted(t *testing.T) {
 
 	body := []byte(`{ "requests":[{"photo_id":1} ,{"photo_id":2},{"photo_id":3}, {"photo_id":4} ]}`)
 
-	res := doRequest(db, cnf, http.MethodGet, "/ipc/voted", bytes.NewBuffer(body), t)
+	res := doIPCRequest(db, cnf, ipc.PhotoService, http.MethodGet, "/ipc/voted", bytes.NewBuffer(body), t)
 
 	t.Log(res.Body.String())
 
@@ -204,8 +322,48 @@ func TestIPCGetVoted(t *testing.T) {
 	}
 }
 
+// Test if a service which doesn't call a route is refused, even with a valid service token.
+func TestIPCServiceNotAllowed(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	res := doIPCRequest(db, config.Config{}, ipc.ProfileService, http.MethodGet, "/ipc/toprated", bytes.NewBuffer([]byte("")), t)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+	if res.Result().StatusCode != http.StatusForbidden {
+		t.Errorf("Expected %v but got %v", http.StatusForbidden, res.Result().StatusCode)
+	}
+}
+
+// Test if the IPC routes can't be called without a service token.
+func TestIPCWithoutServiceToken(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	cnf := config.Config{}
+	res := doRequest(db, cnf, http.MethodGet, "/ipc/toprated", bytes.NewBuffer([]byte("")), t)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+	if res.Result().StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected %v but got %v", http.StatusUnauthorized, res.Result().StatusCode)
+	}
+	if origin := res.Header().Get("Access-Control-Allow-Origin"); origin != "" {
+		t.Errorf("Expected no CORS header but got %v", origin)
+	}
+}
+
 func doRequest(db *sql.DB, cnf config.Config, method string, url string, body *bytes.Buffer, t *testing.T) *httptest.ResponseRecorder {
-	r := InitRoutes(db, cnf)
+	r := InitRoutes(db, cnf, ipc.FakeKeys(ipc.VoteService))
 	res := httptest.NewRecorder()
 	req, err := http.NewRequest(method, url, body)
 	if err != nil {
@@ -224,20 +382,95 @@ func getTestVote() *sharedModels.VoteCreateRequest {
 	return vote
 }
 
-func getTokenString(cnf config.Config, userID int, t *testing.T) string {
+var testKeys = newTestKeys()
+
+func newTestKeys() *jwks.Set {
+	key, err := jwks.GenerateKey()
+	if err != nil {
+		panic(err)
+	}
+	keys, err := jwks.NewSet(key)
+	if err != nil {
+		panic(err)
+	}
+	return keys
+}
+
+// authServer stands in for the authentication service. It publishes testKeys and answers that no token was
+// revoked.
+func authServer() *httptest.Server {
+	mux := http.NewServeMux()
+	mux.Handle(jwks.Path, jwks.Handler(testKeys))
+	mux.HandleFunc("/ipc/tokenStatus", func(w http.ResponseWriter, r *http.Request) {
+		requests := make([]*sharedModels.TokenStatusRequest, 0)
+		if err := ipc.ReadRequests(r, &requests); err != nil {
+			util.SendBadRequest(w, err)
+			return
+		}
+		statuses := make([]*sharedModels.TokenStatusResponse, 0, len(requests))
+		for _, request := range requests {
+			statuses = append(statuses, &sharedModels.TokenStatusResponse{UserID: request.UserID, TokenID: request.TokenID})
+		}
+		ipc.SendResults(w, statuses)
+	})
+	mux.HandleFunc("/ipc/accessTokens", func(w http.ResponseWriter, r *http.Request) {
+		requests := make([]*sharedModels.AccessTokenRequest, 0)
+		if err := ipc.ReadRequests(r, &requests); err != nil {
+			util.SendBadRequest(w, err)
+			return
+		}
+		tokens := make([]*sharedModels.AccessTokenResponse, 0, len(requests))
+		for token, scopes := range testAccessTokens {
+			for _, request := range requests {
+				if request.TokenHash == middleware.HashAccessToken(token) {
+					tokens = append(tokens, &sharedModels.AccessTokenResponse{TokenHash: request.TokenHash, UserID: getTestVote().UserID, Scopes: scopes, EmailVerified: true})
+				}
+			}
+		}
+		ipc.SendResults(w, tokens)
+	})
+	return httptest.NewServer(mux)
+}
+
+// testAccessTokens are the personal access tokens of the user of getTestVote which authServer knows, with their scopes.
+var testAccessTokens = map[string][]string{
+	middleware.AccessTokenPrefix + "read":  {middleware.ScopeVotesRead},
+	middleware.AccessTokenPrefix + "write": {middleware.ScopeVotesWrite},
+}
+
+func getTokenString(userID int, t *testing.T) string {
 	expiration := time.Now().Add(time.Hour * 24 * 31).Unix()
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
 		"sub": userID,
+		"jti": "test-token",
+		"iss": middleware.TokenIssuer,
 		"iat": time.Now().Unix(),
 		"exp": expiration,
 	})
+	token.Header["kid"] = testKeys.SigningKey().ID
 
 	// Generate a signed token
-	secretKey := cnf.SecretKey
-	tokenString, err := token.SignedString([]byte(secretKey))
+	tokenString, err := token.SignedString(testKeys.SigningKey().Key)
 	if err != nil {
 		t.Error(err)
 		return ""
 	}
 	return tokenString
 }
+
+// doIPCRequest works like doRequest and authenticates the request with a service token of caller.
+func doIPCRequest(db *sql.DB, cnf config.Config, caller string, method string, url string, body *bytes.Buffer, t *testing.T) *httptest.ResponseRecorder {
+	r := InitRoutes(db, cnf, ipc.FakeKeys(ipc.VoteService))
+	res := httptest.NewRecorder()
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := middleware.NewServiceToken(ipc.FakeKeys(caller).Identity.Key, caller, ipc.VoteService)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	r.ServeHTTP(res, req)
+	return res
+}
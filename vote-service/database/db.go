@@ -1,17 +1,21 @@
 package db
 
 import (
+	"context"
 	"database/sql"
-	"errors"
 	"fmt"
 	"strconv"
 
 	log "github.com/Sirupsen/logrus"
+	"github.com/bstaijen/mariadb-for-microservices/shared/apierror"
+	"github.com/bstaijen/mariadb-for-microservices/shared/bootstrap"
 	sharedModels "github.com/bstaijen/mariadb-for-microservices/shared/models"
+	"github.com/bstaijen/mariadb-for-microservices/shared/tracing"
 	"github.com/bstaijen/mariadb-for-microservices/vote-service/config"
 )
 
-// OpenConnection opens the connection to the database
+// OpenConnection opens the connection to the database. It waits for the database to come online for at most
+// cnf.DBConnectTimeout.
 func OpenConnection(cnf config.Config) (*sql.DB, error) {
 	username := cnf.DBUsername
 	password := cnf.DBPassword
@@ -19,17 +23,17 @@ func OpenConnection(cnf config.Config) (*sql.DB, error) {
 	port := cnf.DBPort
 	database := cnf.Database
 
-	dsn := fmt.Sprintf("%v:%v@tcp(%v:%v)/%v", username, password, host, port, database)
+	dsn := fmt.Sprintf("%v:%v@tcp(%v:%v)/%v?parseTime=true", username, password, host, port, database)
 
 	log.Debugf("Connect to : %v", dsn)
-	db, err := sql.Open("mysql", dsn)
-	if err != nil {
-		return nil, ErrCanNotConnectWithDatabase
-	}
-
-	// Open doesn't open a connection. Validate DSN data:
-	err = db.Ping()
+	db, err := bootstrap.OpenDB(context.Background(), "mysql", dsn, bootstrap.DBOptions{
+		ConnectTimeout:  cnf.DBConnectTimeout,
+		MaxOpenConns:    cnf.DBMaxOpenConns,
+		MaxIdleConns:    cnf.DBMaxIdleConns,
+		ConnMaxLifetime: cnf.DBConnMaxLifetime,
+	})
 	if err != nil {
+		log.Error(err)
 		return nil, ErrCanNotConnectWithDatabase
 	}
 	return db, nil
@@ -41,15 +45,15 @@ func CloseConnection(db *sql.DB) {
 }
 
 // Create a vote in the database
-func Create(db *sql.DB, vote *sharedModels.VoteCreateRequest) error {
+func Create(ctx context.Context, db *sql.DB, vote *sharedModels.VoteCreateRequest) error {
 	// Delete previous vote (if any).
-	_, err := db.Exec("DELETE FROM votes WHERE user_id=? AND photo_id=?", vote.UserID, vote.PhotoID)
+	_, err := tracing.ExecContext(ctx, db, "DELETE FROM votes WHERE user_id=? AND photo_id=?", vote.UserID, vote.PhotoID)
 	if err != nil {
 		return err
 	}
 
 	// Insert new vote
-	_, err = db.Exec("INSERT INTO votes(user_id, photo_id, upvote, downvote) VALUES(?,?,?,?)", vote.UserID, vote.PhotoID, vote.Upvote, vote.Downvote)
+	_, err = tracing.ExecContext(ctx, db, "INSERT INTO votes(user_id, photo_id, upvote, downvote) VALUES(?,?,?,?)", vote.UserID, vote.PhotoID, vote.Upvote, vote.Downvote)
 	if err != nil {
 		return err
 	}
@@ -57,7 +61,7 @@ func Create(db *sql.DB, vote *sharedModels.VoteCreateRequest) error {
 }
 
 // VoteCount calculates how many votes each photos has.
-func VoteCount(db *sql.DB, items []*sharedModels.VoteCountRequest) ([]*sharedModels.VoteCountResponse, error) {
+func VoteCount(ctx context.Context, db *sql.DB, items []*sharedModels.VoteCountRequest) ([]*sharedModels.VoteCountResponse, error) {
 	if len(items) < 1 {
 		return make([]*sharedModels.VoteCountResponse, 0), nil
 	}
@@ -78,7 +82,7 @@ func VoteCount(db *sql.DB, items []*sharedModels.VoteCountRequest) ([]*sharedMod
 
 	query += ") GROUP BY photo_id"
 
-	rows, err := db.Query(query)
+	rows, err := tracing.QueryContext(ctx, db, query)
 	if err != nil {
 		return nil, err
 	}
@@ -97,7 +101,7 @@ func VoteCount(db *sql.DB, items []*sharedModels.VoteCountRequest) ([]*sharedMod
 }
 
 // HasVoted is a method which calculates whether or not a user has voted on a photo. Method accepts a list of photos and returns the result for each photo in the list.
-func HasVoted(db *sql.DB, items []*sharedModels.HasVotedRequest) ([]*sharedModels.HasVotedResponse, error) {
+func HasVoted(ctx context.Context, db *sql.DB, items []*sharedModels.HasVotedRequest) ([]*sharedModels.HasVotedResponse, error) {
 	if len(items) < 1 {
 		return make([]*sharedModels.HasVotedResponse, 0), nil
 	}
@@ -118,7 +122,7 @@ func HasVoted(db *sql.DB, items []*sharedModels.HasVotedRequest) ([]*sharedModel
 
 	fmt.Println(query)
 
-	rows, err := db.Query(query)
+	rows, err := tracing.QueryContext(ctx, db, query)
 	if err != nil {
 		return nil, err
 	}
@@ -140,8 +144,8 @@ func HasVoted(db *sql.DB, items []*sharedModels.HasVotedRequest) ([]*sharedModel
 }
 
 // GetTopRatedTimeline returns an array of top rated photos. The array contains a list of ID's. Offset and nrOfRows can be used for pagination.
-func GetTopRatedTimeline(db *sql.DB, offset int, nrOfRows int) ([]*sharedModels.TopRatedPhotoResponse, error) {
-	rows, err := db.Query("SELECT photo_id as photoID, sum(upvote) AS totalUpvote, sum(downvote) AS totalDownvote, sum(upvote) - sum(downvote) as difference FROM votes GROUP BY photo_id ORDER BY difference DESC LIMIT ?, ?", offset, nrOfRows)
+func GetTopRatedTimeline(ctx context.Context, db *sql.DB, offset int, nrOfRows int) ([]*sharedModels.TopRatedPhotoResponse, error) {
+	rows, err := tracing.QueryContext(ctx, db, "SELECT photo_id as photoID, sum(upvote) AS totalUpvote, sum(downvote) AS totalDownvote, sum(upvote) - sum(downvote) as difference FROM votes GROUP BY photo_id ORDER BY difference DESC LIMIT ?, ?", offset, nrOfRows)
 	if err != nil {
 		return nil, err
 	}
@@ -166,8 +170,8 @@ func GetTopRatedTimeline(db *sql.DB, offset int, nrOfRows int) ([]*sharedModels.
 }
 
 // GetHotTimeline returns an array of photos ordered by on which is most 'hot' meaning which has been voted on the most for the CURRENT_DAY
-func GetHotTimeline(db *sql.DB, offset int, nrOfRows int) ([]*sharedModels.TopRatedPhotoResponse, error) {
-	rows, err := db.Query("SELECT photo_id as photoID, sum(upvote) AS totalUpvote, sum(downvote) AS totalDownvote, sum(upvote) - sum(downvote) AS difference FROM votes WHERE createdAt > DATE_SUB(now(), INTERVAL 1 DAY) GROUP BY photo_id ORDER BY difference DESC LIMIT ?, ?", offset, nrOfRows)
+func GetHotTimeline(ctx context.Context, db *sql.DB, offset int, nrOfRows int) ([]*sharedModels.TopRatedPhotoResponse, error) {
+	rows, err := tracing.QueryContext(ctx, db, "SELECT photo_id as photoID, sum(upvote) AS totalUpvote, sum(downvote) AS totalDownvote, sum(upvote) - sum(downvote) AS difference FROM votes WHERE createdAt > DATE_SUB(now(), INTERVAL 1 DAY) GROUP BY photo_id ORDER BY difference DESC LIMIT ?, ?", offset, nrOfRows)
 	if err != nil {
 		return nil, err
 	}
@@ -193,8 +197,8 @@ func GetHotTimeline(db *sql.DB, offset int, nrOfRows int) ([]*sharedModels.TopRa
 }
 
 // GetVotesFromUser returns the votes the user has placed on photos. Order by last created.
-func GetVotesFromUser(db *sql.DB, userID int, offset int, nrOfRows int) ([]*sharedModels.TopRatedPhotoResponse, error) {
-	rows, err := db.Query("SELECT photo_id FROM votes WHERE user_id = ? ORDER BY createdAt DESC LIMIT ?, ?", userID, offset, nrOfRows)
+func GetVotesFromUser(ctx context.Context, db *sql.DB, userID int, offset int, nrOfRows int) ([]*sharedModels.TopRatedPhotoResponse, error) {
+	rows, err := tracing.QueryContext(ctx, db, "SELECT photo_id FROM votes WHERE user_id = ? ORDER BY createdAt DESC LIMIT ?, ?", userID, offset, nrOfRows)
 	if err != nil {
 		return nil, err
 	}
@@ -213,7 +217,7 @@ func GetVotesFromUser(db *sql.DB, userID int, offset int, nrOfRows int) ([]*shar
 }
 
 // ErrUserNotFound error if user does not exist in database
-var ErrUserNotFound = errors.New("User does not exist")
+var ErrUserNotFound = apierror.New(apierror.NotFound, "User does not exist")
 
 // ErrCanNotConnectWithDatabase error if database is unreachable
-var ErrCanNotConnectWithDatabase = errors.New("Can not connect with database")
+var ErrCanNotConnectWithDatabase = apierror.New(apierror.Unavailable, "Can not connect with database")
@@ -1,6 +1,7 @@
 package db
 
 import (
+	"context"
 	"testing"
 
 	"encoding/json"
@@ -27,7 +28,7 @@ func TestCreate(t *testing.T) {
 	mock.ExpectExec("INSERT INTO votes").WithArgs(toCreate.UserID, toCreate.PhotoID, toCreate.Upvote, toCreate.Downvote).WillReturnResult(sqlmock.NewResult(1, 1))
 
 	// Execute the method
-	if err := Create(db, toCreate); err != nil {
+	if err := Create(context.Background(), db, toCreate); err != nil {
 		t.Errorf("there was an unexpected error: %s", err)
 	}
 
@@ -59,7 +60,7 @@ func TestVoteCount(t *testing.T) {
 	mock.ExpectQuery("SELECT (.+) FROM votes WHERE").WithArgs().WillReturnRows(selectByIDRows)
 
 	// Execute the method
-	if _, err := VoteCount(db, list); err != nil {
+	if _, err := VoteCount(context.Background(), db, list); err != nil {
 		t.Errorf("there was an unexpected error: %s", err)
 	}
 
@@ -92,7 +93,7 @@ func TestHasVoted(t *testing.T) {
 	mock.ExpectQuery("SELECT (.+) FROM votes WHERE").WithArgs().WillReturnRows(selectByIDRows)
 
 	// Execute the method
-	if _, err := HasVoted(db, list); err != nil {
+	if _, err := HasVoted(context.Background(), db, list); err != nil {
 		t.Errorf("there was an unexpected error: %s", err)
 	}
 
@@ -116,7 +117,7 @@ func TestGetTopRatedTimeline(t *testing.T) {
 	mock.ExpectQuery("SELECT (.+) FROM votes").WithArgs(1, 10).WillReturnRows(selectByIDRows)
 
 	// Execute the method
-	if result, err := GetTopRatedTimeline(db, 1, 10); err != nil {
+	if result, err := GetTopRatedTimeline(context.Background(), db, 1, 10); err != nil {
 		t.Errorf("there was an unexpected error: %s", err)
 
 	} else {
@@ -145,7 +146,7 @@ func TestGetHotTimeline(t *testing.T) {
 	mock.ExpectQuery("SELECT (.+) FROM votes").WithArgs(1, 10).WillReturnRows(selectByIDRows)
 
 	// Execute the method
-	if result, err := GetHotTimeline(db, 1, 10); err != nil {
+	if result, err := GetHotTimeline(context.Background(), db, 1, 10); err != nil {
 		t.Errorf("there was an unexpected error: %s", err)
 
 	} else {
@@ -0,0 +1,26 @@
+package db
+
+import (
+	"database/sql"
+
+	"github.com/bstaijen/mariadb-for-microservices/shared/migrate"
+)
+
+// Migrations are the versions of the votes table in the VoteService schema.
+var Migrations = []migrate.Migration{
+	{
+		Version: 1,
+		Name:    "create votes",
+		Up: []string{
+			"CREATE TABLE IF NOT EXISTS votes (user_id INT NOT NULL, photo_id INT NOT NULL, upvote boolean DEFAULT false, downvote boolean DEFAULT false, createdAt timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP, updatedAt timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP, CONSTRAINT constraint_key PRIMARY KEY(user_id, photo_id))",
+		},
+		Down: []string{
+			"DROP TABLE votes",
+		},
+	},
+}
+
+// Migrator returns the migrator of the schema of the service.
+func Migrator(db *sql.DB) *migrate.Migrator {
+	return migrate.New(db, migrate.DefaultTable, Migrations)
+}
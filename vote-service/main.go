@@ -1,11 +1,19 @@
 package main
 
 import (
+	"context"
 	"net/http"
+	"os"
 	"strconv"
 
 	log "github.com/Sirupsen/logrus"
 
+	"github.com/bstaijen/mariadb-for-microservices/shared/bootstrap"
+	"github.com/bstaijen/mariadb-for-microservices/shared/ipc"
+	"github.com/bstaijen/mariadb-for-microservices/shared/metrics"
+	"github.com/bstaijen/mariadb-for-microservices/shared/migrate"
+	"github.com/bstaijen/mariadb-for-microservices/shared/tracing"
+	"github.com/bstaijen/mariadb-for-microservices/shared/util/middleware"
 	"github.com/bstaijen/mariadb-for-microservices/vote-service/app/http/routes"
 	"github.com/bstaijen/mariadb-for-microservices/vote-service/config"
 	"github.com/bstaijen/mariadb-for-microservices/vote-service/database"
@@ -24,7 +32,18 @@ func main() {
 	log.SetLevel(log.DebugLevel)
 
 	// Get config
-	cnf := config.LoadConfig()
+	command, args := migrate.ParseCommand(os.Args[1:])
+	cnf, err := config.LoadConfig(args)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Export traces
+	shutdownTracing, err := tracing.Init("vote-service", cnf.OTLPEndpoint)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer shutdownTracing(context.Background())
 
 	// Get database
 	connection, err := db.OpenConnection(cnf)
@@ -33,13 +52,50 @@ func main() {
 	}
 	defer db.CloseConnection(connection)
 
+	// Run the migrate subcommand, or refuse to start while migrations are pending
+	migrator := db.Migrator(connection)
+	if command != nil {
+		if err := migrator.Run(context.Background(), command, os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if err := migrator.Check(context.Background()); err != nil {
+		log.Fatal(err)
+	}
+	if err := metrics.RegisterDB("vote", connection); err != nil {
+		log.Fatal(err)
+	}
+
+	// Load the keys which sign and verify the IPC calls
+	ipcKeys, err := ipc.LoadKeys(ipc.VoteService, cnf.IPCKeyFile, cnf.IPCPublicKeys)
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	// Set the REST API routes
-	routes := routes.InitRoutes(connection, cnf)
+	routes := routes.InitRoutes(connection, cnf, ipcKeys)
+	routes.Handle("/metrics", metrics.Handler()).Methods("GET")
 	n := negroni.Classic()
+	n.Use(negroni.HandlerFunc(middleware.RequestID))
+	n.Use(negroni.HandlerFunc(tracing.Middleware))
+	n.Use(metrics.Middleware(routes))
 	n.Use(negronilogrus.NewMiddleware())
+	n.Use(middleware.Deadline(cnf.RequestTimeout))
+	n.Use(middleware.CORS(middleware.CORSOptions{
+		AllowedOrigins:   cnf.CORSAllowedOrigins,
+		AllowedMethods:   cnf.CORSAllowedMethods,
+		AllowedHeaders:   cnf.CORSAllowedHeaders,
+		AllowCredentials: cnf.CORSAllowCredentials,
+		MaxAge:           cnf.CORSMaxAge,
+	}))
 	n.UseHandler(routes)
 
-	// Start and listen on port in cbf.Port
+	// Start and listen on port in cnf.Port until the process is stopped. The deferred calls close the database
+	// after the requests in flight are finished.
+	server := &http.Server{Addr: ":" + strconv.Itoa(cnf.Port), Handler: n}
 	log.Info("Starting server on port " + strconv.Itoa(cnf.Port))
-	log.Fatal(http.ListenAndServe(":"+strconv.Itoa(cnf.Port), n))
+	if err := bootstrap.Serve(server, cnf.ShutdownTimeout); err != nil {
+		log.Fatal(err)
+	}
 }
@@ -59,4 +59,32 @@ var app = angular.module("MariaDBApp", ['ngRoute', 'ngFileUpload', 'ui.bootstrap
             .otherwise({
                 redirectTo: "/"
             });
-    });
\ No newline at end of file
+    });
+
+// Renew the access token with the refresh token shortly before it expires.
+app.run(function ($interval, ApiService, LocalStorage) {
+    var refreshing = false;
+
+    $interval(function () {
+        var refreshToken = LocalStorage.getRefreshToken();
+        if (!refreshToken || refreshing || LocalStorage.getExpiresOn() * 1000 - Date.now() > 60 * 1000) {
+            return;
+        }
+
+        refreshing = true;
+        ApiService.refresh(refreshToken).then(
+            function (data) {
+                refreshing = false;
+                LocalStorage.setToken(data.token);
+                LocalStorage.setRefreshToken(data.refresh_token, data.expires_on);
+            },
+            function (response) {
+                refreshing = false;
+                if (response.status == 401) {
+                    LocalStorage.removeToken();
+                    LocalStorage.removeUser();
+                }
+            }
+        );
+    }, 30 * 1000);
+});
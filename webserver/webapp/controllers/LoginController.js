@@ -11,6 +11,7 @@ app.controller("LoginController", function ($scope, $window, ApiService, LocalSt
                     $scope.successMessages.push("Login successful");
 
                     LocalStorage.setToken(data.token);
+                    LocalStorage.setRefreshToken(data.refresh_token, data.expires_on);
 
                     if (data.user) {
                         //console.info(data.user);
@@ -31,8 +32,8 @@ app.controller("LoginController", function ($scope, $window, ApiService, LocalSt
                 if (response.data) {
                     var data = response.data;
 
-                    if (data && data.message) {
-                        $scope.errorMessages.push(data.message);
+                    if (data && data.detail) {
+                        $scope.errorMessages.push(data.detail);
                         return;
                     }
                 }
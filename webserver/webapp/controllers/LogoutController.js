@@ -1,7 +1,16 @@
-app.controller("LogoutController", function ($window, LocalStorage) {
-    LocalStorage.removeToken();
-    LocalStorage.removeUser();
+app.controller("LogoutController", function ($window, ApiService, LocalStorage) {
+    var clear = function () {
+        LocalStorage.removeToken();
+        LocalStorage.removeUser();
 
-    $window.location.href = '#/';
+        $window.location.href = '#/';
+    };
+
+    // Revoke the tokens at the server, the client is logged out even when that fails.
+    if (LocalStorage.hasToken()) {
+        ApiService.logout(LocalStorage.getRefreshToken()).then(clear, clear);
+    } else {
+        clear();
+    }
 
 });
\ No newline at end of file
@@ -5,34 +5,44 @@ app.controller('RegisterController', function ($scope, $window, ApiService, Loca
     $scope.register = function () {
         emptyMessages();
 
-        ApiService.register($scope.username, $scope.email, $scope.password).then(
-            function (data) {
-                console.log(data);
+        var username = $scope.username;
+        var password = $scope.password;
+        ApiService.register(username, $scope.email, password).then(
+            function (user) {
+                console.log(user);
                 $scope.successMessages.push("Registration successful");
                 emptyFields();
 
+                if (!(user.id && user.email && user.username)) {
+                    $scope.errorMessages.push("Something went wrong. Please try again.");
+                    return;
+                }
 
+                // The new user logs in like any other user
+                ApiService.login(username, password).then(
+                    function (data) {
+                        if (data && data.token) {
+                            LocalStorage.setToken(data.token);
+                            LocalStorage.setRefreshToken(data.refresh_token, data.expires_on);
+                            LocalStorage.setUser(data.user || user);
 
-                if (data.user) {
-                    //console.info(data.user);
-                    var user = data.user;
-                    if (user.id && user.email && user.username) {
-                        LocalStorage.setToken(data.token);
-                        LocalStorage.setUser(data.user);
-
-                        $window.location.href = '#/';
-                        return;
+                            $window.location.href = '#/';
+                            return;
+                        }
+                        $window.location.href = '#/login';
+                    }, function (response) {
+                        console.log(response);
+                        $window.location.href = '#/login';
                     }
-                }
-                $scope.errorMessages.push("Something went wrong. Please try again.");
+                );
 
             }, function (response) {
                 console.log(response);
                 if (response && response.data) {
                     var data = response.data;
 
-                    if (data && data.message) {
-                        $scope.errorMessages.push(data.message);
+                    if (data && data.detail) {
+                        $scope.errorMessages.push(data.detail);
                         return;
                     }
                 }
@@ -7,6 +7,8 @@ app.factory('LocalStorage', function () {
     var STORAGE_PREFIX = 'm_';
     var USER_KEY = "user";
     var TOKEN_KEY = "token";
+    var REFRESH_TOKEN_KEY = "refresh_token";
+    var EXPIRES_ON_KEY = "expires_on";
 
     return {
 
@@ -68,10 +70,40 @@ app.factory('LocalStorage', function () {
         },
 
         /**
-         * Remove token from LocalStorage.
+         * Save the refresh token and the moment the access token expires in LocalStorage.
+         * @param refreshToken Refresh token
+         * @param expiresOn Unix time at which the access token expires
+         */
+        setRefreshToken: function (refreshToken, expiresOn) {
+            if (refreshToken && refreshToken.length > 0) {
+                localStorage.setItem(STORAGE_PREFIX + REFRESH_TOKEN_KEY, refreshToken);
+                localStorage.setItem(STORAGE_PREFIX + EXPIRES_ON_KEY, expiresOn);
+            }
+        },
+
+        /**
+         * Get refresh token from LocalStorage.
+         * @returns {string} refresh token.
+         */
+        getRefreshToken: function () {
+            return localStorage.getItem(STORAGE_PREFIX + REFRESH_TOKEN_KEY);
+        },
+
+        /**
+         * Get the moment the access token expires.
+         * @returns {number} Unix time, 0 when unknown.
+         */
+        getExpiresOn: function () {
+            return parseInt(localStorage.getItem(STORAGE_PREFIX + EXPIRES_ON_KEY), 10) || 0;
+        },
+
+        /**
+         * Remove the access token and the refresh token from LocalStorage.
          */
         removeToken: function () {
             localStorage.removeItem(STORAGE_PREFIX + TOKEN_KEY);
+            localStorage.removeItem(STORAGE_PREFIX + REFRESH_TOKEN_KEY);
+            localStorage.removeItem(STORAGE_PREFIX + EXPIRES_ON_KEY);
         }
     }
 });
\ No newline at end of file
@@ -124,6 +124,18 @@ app.factory('ApiService', function ($http, $q, LocalStorage, Upload) {
                 password: password
             });
         },
+        refresh: function (refreshToken) {
+            var url = composeAuthenticationUrl('/token-auth/refresh');
+            return post(url, {
+                refresh_token: refreshToken
+            });
+        },
+        logout: function (refreshToken) {
+            var url = composeAuthenticationUrl('/token-auth/logout?token=' + LocalStorage.getToken());
+            return post(url, {
+                refresh_token: refreshToken
+            });
+        },
         register: function (username, email, password) {
             var url = composeProfileUrl('/users');
             return post(url, {username: username, password: password, email: email});
@@ -181,7 +193,7 @@ app.factory('ApiService', function ($http, $q, LocalStorage, Upload) {
             return post(url, options);
         },
         comment: function (user_id, photo_id, comment) {
-            var url = composeCommentUrl('/comments');
+            var url = composeCommentUrl('/comments?token=' + LocalStorage.getToken());
             var options = {
                 user_id: user_id,
                 photo_id: photo_id,